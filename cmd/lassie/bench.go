@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	cmdinternal "github.com/filecoin-project/lassie/cmd/lassie/internal"
+	"github.com/filecoin-project/lassie/pkg/lassie"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/urfave/cli/v2"
+)
+
+var benchProviderAddrInfos []peer.AddrInfo
+
+var benchCmd = &cli.Command{
+	Name:      "bench",
+	Usage:     "Benchmarks retrievals of a list of CIDs and reports on their performance",
+	ArgsUsage: "[<CID>[/path/to/content] ...]",
+	Before:    before,
+	Action:    Bench,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:      "input",
+			Aliases:   []string{"i"},
+			Usage:     "a file containing a list of CIDs (with optional paths) to retrieve, one per line, or - for stdin",
+			TakesFile: true,
+		},
+		&cli.UintFlag{
+			Name:    "concurrency",
+			Aliases: []string{"c"},
+			Usage:   "number of retrievals to run simultaneously",
+			Value:   1,
+		},
+		&cli.UintFlag{
+			Name:    "repeat",
+			Aliases: []string{"r"},
+			Usage:   "number of times to retrieve each CID",
+			Value:   1,
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Usage:   "report output format, text or json",
+			Value:   "text",
+		},
+		&cli.DurationFlag{
+			Name:    "timeout",
+			Aliases: []string{"t"},
+			Usage:   "consider it an error after not receiving a response from a storage provider for this long",
+			Value:   20 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:        "global-timeout",
+			Usage:       "consider it an error if an individual retrieval takes longer than this",
+			DefaultText: "no timeout",
+		},
+		&cli.BoolFlag{
+			Name:        "shallow",
+			Usage:       "only fetch the content at the end of the path",
+			DefaultText: "false, the entire DAG at the end of the path will be fetched",
+			Value:       false,
+		},
+		&cli.StringFlag{
+			Name:        "providers",
+			Aliases:     []string{"provider"},
+			DefaultText: "Providers will be discovered automatically",
+			Usage:       "Provider addresses including its peer ID, seperated by a comma. Example: /ip4/1.2.3.4/tcp/1234/p2p/12D3KooWBSTEYMLSu5FnQjshEVah9LFGEZoQt26eacCEVYfedWA4",
+			Action: func(cctx *cli.Context, v string) error {
+				vs := strings.Split(v, ",")
+				for _, v := range vs {
+					addrInfo, err := peer.AddrInfoFromString(v)
+					if err != nil {
+						return err
+					}
+					benchProviderAddrInfos = append(benchProviderAddrInfos, *addrInfo)
+				}
+				return nil
+			},
+		},
+		FlagVerbose,
+		FlagVeryVerbose,
+		FlagDisableGraphsync,
+	},
+}
+
+type benchTarget struct {
+	rootCid cid.Cid
+	path    string
+}
+
+func parseBenchTarget(cpath string) (benchTarget, error) {
+	cstr := strings.Split(cpath, "/")[0]
+	rootCid, err := cid.Parse(cstr)
+	if err != nil {
+		return benchTarget{}, fmt.Errorf("invalid CID %s: %w", cstr, err)
+	}
+	return benchTarget{rootCid: rootCid, path: strings.TrimPrefix(cpath, cstr)}, nil
+}
+
+func readBenchTargets(c *cli.Context) ([]benchTarget, error) {
+	var targets []benchTarget
+	for _, arg := range c.Args().Slice() {
+		target, err := parseBenchTarget(arg)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	if c.IsSet("input") {
+		var r io.Reader
+		if c.String("input") == "-" {
+			r = os.Stdin
+		} else {
+			f, err := os.Open(c.String("input"))
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			target, err := parseBenchTarget(line)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, target)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// benchWaves splits targets into waves that can each be retrieved
+// concurrently, the same root CID can't be retrieved twice at once so each
+// appears at most once in a wave, in the order the targets are listed
+func benchWaves(targets []benchTarget) [][]benchTarget {
+	var waves [][]benchTarget
+	occurrences := make(map[cid.Cid]int)
+	for _, target := range targets {
+		wave := occurrences[target.rootCid]
+		occurrences[target.rootCid]++
+		if wave == len(waves) {
+			waves = append(waves, nil)
+		}
+		waves[wave] = append(waves[wave], target)
+	}
+	return waves
+}
+
+func Bench(c *cli.Context) error {
+	targets, err := readBenchTargets(c)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("usage: lassie bench [-i <CID list file>] [-c <concurrency>] [-r <repeat>] [<CID>[/path/to/content] ...]")
+	}
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unsupported report format: %s", format)
+	}
+	concurrency := c.Uint("concurrency")
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	repeat := c.Uint("repeat")
+	full := !c.Bool("shallow")
+
+	host, err := libp2p.New(libp2p.ResourceManager(&network.NullResourceManager{}))
+	if err != nil {
+		return err
+	}
+	opts := []lassie.LassieOption{
+		lassie.WithProviderTimeout(c.Duration("timeout")),
+		lassie.WithHost(host),
+	}
+	if c.IsSet("global-timeout") {
+		opts = append(opts, lassie.WithGlobalTimeout(c.Duration("global-timeout")))
+	}
+	if len(benchProviderAddrInfos) > 0 {
+		opts = append(opts, lassie.WithFinder(retriever.NewDirectCandidateFinder(c.Context, host, benchProviderAddrInfos)))
+	}
+	if c.Bool("disable-graphsync") {
+		opts = append(opts, lassie.WithGraphsyncDisabled())
+	}
+	lassie, err := lassie.NewLassie(c.Context, opts...)
+	if err != nil {
+		return err
+	}
+
+	collector := cmdinternal.NewBenchCollector()
+	total := uint(len(targets)) * repeat
+	var completed uint
+	var completedLk sync.Mutex
+
+	fetch := func(target benchTarget) {
+		// blocks are counted in memory for the duration of each retrieval,
+		// nothing is written to disk
+		store := cmdinternal.NewBenchStore()
+		request, err := types.NewRequestForPath(store, target.rootCid, target.path, full)
+		if err != nil {
+			log.Errorw("failed to create request", "cid", target.rootCid, "err", err)
+			return
+		}
+		collector.Start(request.RetrievalID, target.rootCid, time.Now())
+		stats, err := lassie.FetchWithEvents(c.Context, request, collector.RecordEvent)
+		collector.Finish(request.RetrievalID, time.Now(), stats, err)
+
+		completedLk.Lock()
+		completed++
+		blocks, size := store.Written()
+		result := fmt.Sprintf("ok, %d blocks / %s", blocks, humanize.IBytes(size))
+		if err != nil {
+			result = err.Error()
+		}
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s%s: %s\n", completed, total, target.rootCid, target.path, result)
+		completedLk.Unlock()
+	}
+
+	// each round retrieves every target once; rounds, and the waves within
+	// them, are run one after the other because the same CID can't be
+	// retrieved concurrently
+	waves := benchWaves(targets)
+	for round := uint(0); round < repeat && c.Context.Err() == nil; round++ {
+		for _, wave := range waves {
+			jobs := make(chan benchTarget)
+			var wg sync.WaitGroup
+			for i := uint(0); i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for target := range jobs {
+						fetch(target)
+					}
+				}()
+			}
+			for _, target := range wave {
+				if c.Context.Err() != nil {
+					break
+				}
+				jobs <- target
+			}
+			close(jobs)
+			wg.Wait()
+		}
+	}
+
+	report := collector.Report()
+	if format == "json" {
+		return report.WriteJSON(os.Stdout)
+	}
+	return report.WriteText(os.Stdout)
+}
@@ -5,7 +5,9 @@ import (
 	"time"
 
 	"github.com/filecoin-project/lassie/pkg/lassie"
+	"github.com/filecoin-project/lassie/pkg/retriever"
 	httpserver "github.com/filecoin-project/lassie/pkg/server/http"
+	leveldb "github.com/ipfs/go-ds-leveldb"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 	"github.com/urfave/cli/v2"
@@ -68,6 +70,70 @@ var daemonFlags = []cli.Flag{
 		DefaultText: "no limit",
 		EnvVars:     []string{"LASSIE_CONCURRENT_SP_RETRIEVALS"},
 	},
+	&cli.UintFlag{
+		Name:        "sp-suspension-failures",
+		Usage:       "number of failures within the failure window that will cause a storage provider to be suspended",
+		DefaultText: "5",
+		EnvVars:     []string{"LASSIE_SP_SUSPENSION_FAILURES"},
+	},
+	&cli.DurationFlag{
+		Name:        "sp-suspension-failure-window",
+		Usage:       "the period of time over which storage provider failures are counted",
+		DefaultText: "30s",
+		EnvVars:     []string{"LASSIE_SP_SUSPENSION_FAILURE_WINDOW"},
+	},
+	&cli.DurationFlag{
+		Name:        "sp-suspension-duration",
+		Usage:       "how long a storage provider is suspended for after too many failures",
+		DefaultText: "10m",
+		EnvVars:     []string{"LASSIE_SP_SUSPENSION_DURATION"},
+	},
+	&cli.StringFlag{
+		Name:        "reputation-dir",
+		Usage:       "directory in which to persist storage provider retrieval history across restarts",
+		DefaultText: "history is kept in memory only",
+		EnvVars:     []string{"LASSIE_REPUTATION_DIRECTORY"},
+	},
+	&cli.DurationFlag{
+		Name:        "reputation-half-life",
+		Usage:       "the age at which a storage provider retrieval counts for half as much as a new one when ranking providers",
+		DefaultText: "24h",
+		EnvVars:     []string{"LASSIE_REPUTATION_HALF_LIFE"},
+	},
+	&cli.BoolFlag{
+		Name:    "reputation-scoring",
+		Usage:   "prefer graphsync storage providers with a better retrieval history over those offering a smaller retrieval",
+		EnvVars: []string{"LASSIE_REPUTATION_SCORING"},
+	},
+	&cli.DurationFlag{
+		Name:        "candidate-cache-ttl",
+		Usage:       "how long the candidates found for a CID are reused for by later retrievals of it",
+		DefaultText: "not cached",
+		EnvVars:     []string{"LASSIE_CANDIDATE_CACHE_TTL"},
+	},
+	&cli.DurationFlag{
+		Name:        "candidate-cache-negative-ttl",
+		Usage:       "how long finding no candidates for a CID is remembered for by later retrievals of it",
+		DefaultText: "not cached",
+		EnvVars:     []string{"LASSIE_CANDIDATE_CACHE_NEGATIVE_TTL"},
+	},
+	&cli.IntFlag{
+		Name:        "candidate-cache-size",
+		Usage:       "the most CIDs whose candidates are cached at once",
+		DefaultText: "4096",
+		EnvVars:     []string{"LASSIE_CANDIDATE_CACHE_SIZE"},
+	},
+	&cli.BoolFlag{
+		Name:    "allow-providers-param",
+		Usage:   "let requests name the providers to retrieve from with the providers query parameter",
+		EnvVars: []string{"LASSIE_ALLOW_PROVIDERS_PARAM"},
+	},
+	&cli.StringFlag{
+		Name:      "provider-config",
+		Usage:     "a JSON file of provider allow and deny lists and per-provider settings, reloaded when modified or on SIGHUP",
+		TakesFile: true,
+		EnvVars:   []string{"LASSIE_PROVIDER_CONFIG"},
+	},
 	FlagEventRecorderAuth,
 	FlagEventRecorderInstanceId,
 	FlagEventRecorderUrl,
@@ -75,6 +141,34 @@ var daemonFlags = []cli.Flag{
 	FlagVerbose,
 	FlagVeryVerbose,
 	FlagDisableGraphsync,
+	FlagDisableHttp,
+	FlagLocalCar,
+	FlagLocalBlockstore,
+	FlagDht,
+	FlagDelegatedRoutingEndpoint,
+	FlagDisableIndexer,
+	FlagIndexerEndpoint,
+	FlagIndexerEndpointTimeout,
+	FlagIndexerStrategy,
+	FlagIndexerReaderPrivacy,
+	FlagMaxParallelProviders,
+	FlagBitswapPrefetch,
+	FlagBitswapMaxBlockSize,
+	FlagBitswapMaxDepth,
+	FlagBitswapMaxBlocks,
+	FlagMaxAttempts,
+	FlagRetryBackoff,
+	FlagPaidRetrievals,
+	FlagMaxPricePerByte,
+	FlagMaxUnsealPrice,
+	FlagMaxCost,
+	FlagBudget,
+	FlagBudgetPeriod,
+	FlagWallet,
+	FlagLotusApi,
+	FlagLotusApiToken,
+	FlagPaychDir,
+	FlagPaychFunds,
 }
 
 var daemonCmd = &cli.Command{
@@ -95,7 +189,40 @@ func daemonCommand(cctx *cli.Context) error {
 	exposeMetrics := cctx.Bool("expose-metrics")
 	concurrentSPRetrievals := cctx.Uint("concurrent-sp-retrievals")
 	disableGraphsync := cctx.Bool("disable-graphsync")
-	lassieOpts := []lassie.LassieOption{lassie.WithProviderTimeout(20 * time.Second)}
+	providerConfigPath := cctx.String("provider-config")
+	providerTimeout := 20 * time.Second
+	lassieOpts := []lassie.LassieOption{
+		lassie.WithProviderTimeout(providerTimeout),
+		lassie.WithSpTrackerConfig(retriever.SpTrackerConfig{
+			MaxFailuresBeforeSuspend: cctx.Uint("sp-suspension-failures"),
+			FailureHistoryDuration:   cctx.Duration("sp-suspension-failure-window"),
+			SuspensionDuration:       cctx.Duration("sp-suspension-duration"),
+		}),
+		lassie.WithReputationConfig(retriever.ReputationConfig{
+			HalfLife: cctx.Duration("reputation-half-life"),
+		}),
+		lassie.WithMaxParallelProviders(cctx.Int("max-parallel-providers")),
+		lassie.WithTempDir(tempDir),
+		lassie.WithBitswapPrefetch(cctx.Int("bitswap-prefetch")),
+		lassie.WithBitswapLimits(bitswapLimitsFromFlags(cctx)),
+		lassie.WithRetryPolicy(retryPolicyFromFlags(cctx)),
+		lassie.WithCandidateCache(retriever.CandidateCacheConfig{
+			TTL:         cctx.Duration("candidate-cache-ttl"),
+			NegativeTTL: cctx.Duration("candidate-cache-negative-ttl"),
+			Size:        cctx.Int("candidate-cache-size"),
+		}),
+	}
+	if reputationDir := cctx.String("reputation-dir"); reputationDir != "" {
+		reputationDs, err := leveldb.NewDatastore(reputationDir, nil)
+		if err != nil {
+			return fmt.Errorf("failed to open reputation datastore: %w", err)
+		}
+		defer reputationDs.Close()
+		lassieOpts = append(lassieOpts, lassie.WithReputationDatastore(reputationDs))
+	}
+	if cctx.Bool("reputation-scoring") {
+		lassieOpts = append(lassieOpts, lassie.WithCandidateScorer(retriever.ReputationCandidateScorer))
+	}
 	if libp2pHighWater != 0 || libp2pLowWater != 0 {
 		connManager, err := connmgr.NewConnManager(libp2pLowWater, libp2pHighWater)
 		if err != nil {
@@ -110,6 +237,53 @@ func daemonCommand(cctx *cli.Context) error {
 	if disableGraphsync {
 		lassieOpts = append(lassieOpts, lassie.WithGraphsyncDisabled())
 	}
+	// the daemon's host is made by Lassie, which has no direct providers
+	finder, err := candidateFinderFromFlags(cctx, nil, nil)
+	if err != nil {
+		return err
+	}
+	if finder != nil {
+		lassieOpts = append(lassieOpts, lassie.WithFinder(finder))
+	}
+	if cctx.Bool("disable-indexer") {
+		lassieOpts = append(lassieOpts, lassie.WithIndexerDisabled())
+	}
+	indexerOpts, err := indexerOptionsFromFlags(cctx)
+	if err != nil {
+		return err
+	}
+	lassieOpts = append(lassieOpts, lassie.WithIndexerOptions(indexerOpts...))
+	if cctx.Bool("dht") {
+		lassieOpts = append(lassieOpts, lassie.WithDhtFinder())
+	}
+	if cctx.Bool("disable-http") {
+		lassieOpts = append(lassieOpts, lassie.WithHttpDisabled())
+	}
+	localStores, err := localStoresFromFlags(cctx)
+	if err != nil {
+		return err
+	}
+	if localStores != nil {
+		defer localStores.Close()
+		lassieOpts = append(lassieOpts, lassie.WithLocalStores(localStores))
+	}
+	paymentOpts, paychLedger, err := paymentOptionsFromFlags(cctx)
+	if err != nil {
+		return err
+	}
+	if paychLedger != nil {
+		defer paychLedger.Close()
+		lassieOpts = append(lassieOpts, paymentOpts...)
+	}
+	var providerConfigModTime time.Time
+	if providerConfigPath != "" {
+		providerConfig, modTime, err := loadProviderConfig(providerConfigPath)
+		if err != nil {
+			return err
+		}
+		providerConfigModTime = modTime
+		lassieOpts = append(lassieOpts, lassie.WithProviderConfig(providerConfig))
+	}
 	// create a lassie instance
 	lassie, err := lassie.NewLassie(cctx.Context, lassieOpts...)
 	if err != nil {
@@ -119,12 +293,18 @@ func daemonCommand(cctx *cli.Context) error {
 	// create and subscribe an event recorder API if configured
 	setupLassieEventRecorder(cctx, lassie)
 
+	if providerConfigPath != "" {
+		go watchProviderConfig(cctx.Context, lassie, providerConfigPath, providerConfigModTime)
+	}
+
 	httpServer, err := httpserver.NewHttpServer(cctx.Context, lassie, httpserver.HttpServerConfig{
-		Address:             address,
-		Port:                port,
-		TempDir:             tempDir,
-		MaxBlocksPerRequest: maxBlocks,
-		Metrics:             exposeMetrics,
+		Address:                 address,
+		Port:                    port,
+		TempDir:                 tempDir,
+		MaxBlocksPerRequest:     maxBlocks,
+		Metrics:                 exposeMetrics,
+		MaxProviderTimeout:      providerTimeout,
+		AllowProvidersParameter: cctx.Bool("allow-providers-param"),
 	})
 
 	if err != nil {
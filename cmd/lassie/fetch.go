@@ -10,7 +10,6 @@ import (
 	cmdinternal "github.com/filecoin-project/lassie/cmd/lassie/internal"
 	"github.com/filecoin-project/lassie/pkg/events"
 	"github.com/filecoin-project/lassie/pkg/lassie"
-	"github.com/filecoin-project/lassie/pkg/retriever"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-cid"
 	carv2 "github.com/ipld/go-car/v2"
@@ -69,12 +68,44 @@ var fetchCmd = &cli.Command{
 				return nil
 			},
 		},
+		&cli.BoolFlag{
+			Name:  "merge-providers",
+			Usage: "try the --providers ahead of those found through the indexer and any other sources of candidates, rather than retrieving from the --providers alone",
+		},
 		FlagEventRecorderAuth,
 		FlagEventRecorderInstanceId,
 		FlagEventRecorderUrl,
 		FlagVerbose,
 		FlagVeryVerbose,
 		FlagDisableGraphsync,
+		FlagDisableHttp,
+		FlagLocalCar,
+		FlagLocalBlockstore,
+		FlagDht,
+		FlagDelegatedRoutingEndpoint,
+		FlagDisableIndexer,
+		FlagIndexerEndpoint,
+		FlagIndexerEndpointTimeout,
+		FlagIndexerStrategy,
+		FlagIndexerReaderPrivacy,
+		FlagMaxParallelProviders,
+		FlagBitswapPrefetch,
+		FlagBitswapMaxBlockSize,
+		FlagBitswapMaxDepth,
+		FlagBitswapMaxBlocks,
+		FlagMaxAttempts,
+		FlagRetryBackoff,
+		FlagPaidRetrievals,
+		FlagMaxPricePerByte,
+		FlagMaxUnsealPrice,
+		FlagMaxCost,
+		FlagBudget,
+		FlagBudgetPeriod,
+		FlagWallet,
+		FlagLotusApi,
+		FlagLotusApiToken,
+		FlagPaychDir,
+		FlagPaychFunds,
 	},
 }
 
@@ -100,15 +131,56 @@ func Fetch(c *cli.Context) error {
 		return err
 	}
 	hostOpt := lassie.WithHost(host)
-	var opts = []lassie.LassieOption{timeoutOpt, hostOpt}
-	if len(fetchProviderAddrInfos) > 0 {
-		finderOpt := lassie.WithFinder(retriever.NewDirectCandidateFinder(host, fetchProviderAddrInfos))
-		opts = append(opts, finderOpt)
+	var opts = []lassie.LassieOption{
+		timeoutOpt,
+		hostOpt,
+		lassie.WithMaxParallelProviders(c.Int("max-parallel-providers")),
+		lassie.WithBitswapPrefetch(c.Int("bitswap-prefetch")),
+		lassie.WithBitswapLimits(bitswapLimitsFromFlags(c)),
+		lassie.WithRetryPolicy(retryPolicyFromFlags(c)),
+	}
+	finder, err := candidateFinderFromFlags(c, host, fetchProviderAddrInfos)
+	if err != nil {
+		return err
+	}
+	if finder != nil {
+		opts = append(opts, lassie.WithFinder(finder))
 	}
+	if c.Bool("disable-indexer") {
+		opts = append(opts, lassie.WithIndexerDisabled())
+	}
+	indexerOpts, err := indexerOptionsFromFlags(c)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, lassie.WithIndexerOptions(indexerOpts...))
 	disableGraphsync := c.Bool("disable-graphsync")
 	if disableGraphsync {
 		opts = append(opts, lassie.WithGraphsyncDisabled())
 	}
+	// the --providers are retrieved from alone unless they're merged
+	if c.Bool("dht") && (len(fetchProviderAddrInfos) == 0 || c.Bool("merge-providers")) {
+		opts = append(opts, lassie.WithDhtFinder())
+	}
+	if c.Bool("disable-http") {
+		opts = append(opts, lassie.WithHttpDisabled())
+	}
+	localStores, err := localStoresFromFlags(c)
+	if err != nil {
+		return err
+	}
+	if localStores != nil {
+		defer localStores.Close()
+		opts = append(opts, lassie.WithLocalStores(localStores))
+	}
+	paymentOpts, paychLedger, err := paymentOptionsFromFlags(c)
+	if err != nil {
+		return err
+	}
+	if paychLedger != nil {
+		defer paychLedger.Close()
+		opts = append(opts, paymentOpts...)
+	}
 	lassie, err := lassie.NewLassie(c.Context, opts...)
 	if err != nil {
 		return err
@@ -189,6 +261,12 @@ func Fetch(c *cli.Context) error {
 		blockCount,
 		humanize.IBytes(stats.Size),
 	)
+	if len(stats.Providers) > 1 {
+		fmt.Printf("\tProviders:\n")
+		for provider, providerStats := range stats.Providers {
+			fmt.Printf("\t\t%s: %d blocks, %s\n", provider, providerStats.Blocks, humanize.IBytes(providerStats.Size))
+		}
+	}
 
 	return store.Finalize()
 }
@@ -241,6 +319,10 @@ func (pp *progressPrinter) subscriber(event types.RetrievalEvent) {
 	case events.RetrievalEventQueryAsked:
 		fmt.Printf("\rGot query response from [%s] (checking): size=%s, price-per-byte=%s, unseal-price=%s, message=%s\n", types.Identifier(ret), humanize.IBytes(ret.QueryResponse().Size), ret.QueryResponse().MinPricePerByte, ret.QueryResponse().UnsealPrice, ret.QueryResponse().Message)
 	case events.RetrievalEventQueryAskedFiltered:
+		if ret.Rejected() {
+			fmt.Printf("\rRejected query response from [%s]: %s\n", types.Identifier(ret), ret.Reason())
+			break
+		}
 		fmt.Printf("\rGot query response from [%s] (filtered): size=%s, price-per-byte=%s, unseal-price=%s, message=%s\n", types.Identifier(ret), humanize.IBytes(ret.QueryResponse().Size), ret.QueryResponse().MinPricePerByte, ret.QueryResponse().UnsealPrice, ret.QueryResponse().Message)
 	case events.RetrievalEventFailed:
 		if ret.Phase() == types.IndexerPhase {
@@ -248,6 +330,10 @@ func (pp *progressPrinter) subscriber(event types.RetrievalEvent) {
 		} else {
 			fmt.Printf("\rRetrieval failure for [%s]: %s\n", types.Identifier(ret), ret.ErrorMessage())
 		}
+	case events.RetrievalEventMisbehaved:
+		fmt.Printf("\rMisbehaving peer [%s]: %s\n", types.Identifier(ret), ret.Reason())
+	case events.RetrievalEventRetrying:
+		fmt.Printf("\rRetrieval failed, retrying in %s (attempt %d): %s\n", ret.Delay(), ret.Attempt(), ret.Reason())
 	case events.RetrievalEventSuccess:
 		// noop, handled at return from Retrieve()
 	}
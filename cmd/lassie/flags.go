@@ -1,6 +1,16 @@
 package main
 
-import "github.com/urfave/cli/v2"
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/filecoin-project/lassie/pkg/indexerlookup"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/routinglookup"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/urfave/cli/v2"
+)
 
 // IsVerbose is a global var signaling if the CLI is running in
 // verbose mode or not (default: false).
@@ -70,3 +80,239 @@ var FlagDisableGraphsync = &cli.BoolFlag{
 	Usage:   "turn off graphsync retrievals",
 	EnvVars: []string{"LASSIE_DISABLE_GRAPHSYNC"},
 }
+
+// FlagDisableHttp turns off all retrievals from trustless HTTP gateways
+var FlagDisableHttp = &cli.BoolFlag{
+	Name:    "disable-http",
+	Usage:   "turn off HTTP retrievals",
+	EnvVars: []string{"LASSIE_DISABLE_HTTP"},
+}
+
+// FlagMaxParallelProviders splits full DAG graphsync retrievals across
+// multiple storage providers
+var FlagMaxParallelProviders = &cli.IntFlag{
+	Name:        "max-parallel-providers",
+	Usage:       "retrieve the subtrees of a full DAG from up to this many graphsync storage providers at once, only those that don't charge to unseal take part",
+	DefaultText: "1, a single storage provider",
+	EnvVars:     []string{"LASSIE_MAX_PARALLEL_PROVIDERS"},
+}
+
+// FlagBitswapPrefetch sets how many blocks bitswap retrievals fetch ahead of
+// their traversal
+var FlagBitswapPrefetch = &cli.IntFlag{
+	Name:        "bitswap-prefetch",
+	Usage:       "fetch up to this many blocks ahead of the DAG traversal at once in bitswap retrievals, a negative value disables prefetching",
+	DefaultText: "16",
+	EnvVars:     []string{"LASSIE_BITSWAP_PREFETCH"},
+}
+
+// FlagMaxAttempts enables retrying retrievals that fail for a reason that is
+// likely to be transient
+var FlagMaxAttempts = &cli.IntFlag{
+	Name:        "max-attempts",
+	Usage:       "attempt a retrieval up to this many times, with fresh candidates, where every candidate fails for a transient reason",
+	DefaultText: "1, no retries",
+	EnvVars:     []string{"LASSIE_MAX_ATTEMPTS"},
+}
+
+// FlagRetryBackoff is the delay before the first retry of a retrieval
+var FlagRetryBackoff = &cli.DurationFlag{
+	Name:        "retry-backoff",
+	Usage:       "the delay before retrying a retrieval, doubling for each further retry",
+	DefaultText: "1s",
+	EnvVars:     []string{"LASSIE_RETRY_BACKOFF"},
+}
+
+func retryPolicyFromFlags(cctx *cli.Context) retriever.RetryPolicy {
+	return retriever.RetryPolicy{
+		MaxAttempts: cctx.Int("max-attempts"),
+		Backoff:     cctx.Duration("retry-backoff"),
+	}
+}
+
+// FlagBitswapMaxBlockSize is the largest block a bitswap retrieval accepts
+var FlagBitswapMaxBlockSize = &cli.Uint64Flag{
+	Name:        "bitswap-max-block-size",
+	Usage:       "the largest block, in bytes, that bitswap retrievals accept from peers",
+	DefaultText: "2097152",
+	EnvVars:     []string{"LASSIE_BITSWAP_MAX_BLOCK_SIZE"},
+}
+
+// FlagBitswapMaxDepth is the deepest a bitswap retrieval will traverse a DAG
+var FlagBitswapMaxDepth = &cli.Uint64Flag{
+	Name:        "bitswap-max-depth",
+	Usage:       "the greatest number of links bitswap retrievals follow from the root to reach a block",
+	DefaultText: "4096",
+	EnvVars:     []string{"LASSIE_BITSWAP_MAX_DEPTH"},
+}
+
+// FlagBitswapMaxBlocks is the most blocks a bitswap retrieval will fetch
+var FlagBitswapMaxBlocks = &cli.Uint64Flag{
+	Name:        "bitswap-max-blocks",
+	Usage:       "the greatest number of blocks each bitswap retrieval fetches",
+	DefaultText: "no limit",
+	EnvVars:     []string{"LASSIE_BITSWAP_MAX_BLOCKS"},
+}
+
+// FlagDht finds candidates through the IPFS DHT as well
+var FlagDht = &cli.BoolFlag{
+	Name:    "dht",
+	Usage:   "find candidates through the IPFS DHT as well",
+	EnvVars: []string{"LASSIE_DHT"},
+}
+
+// FlagDelegatedRoutingEndpoint is a routing service to find candidates
+// through as well
+var FlagDelegatedRoutingEndpoint = &cli.StringFlag{
+	Name:    "delegated-routing-endpoint",
+	Usage:   "the base URL of a Routing V1 HTTP API service to find candidates through as well",
+	EnvVars: []string{"LASSIE_DELEGATED_ROUTING_ENDPOINT"},
+}
+
+// FlagDisableIndexer stops candidates being found through the indexer
+var FlagDisableIndexer = &cli.BoolFlag{
+	Name:    "disable-indexer",
+	Usage:   "do not find candidates through the indexer, leaving the other sources of candidates",
+	EnvVars: []string{"LASSIE_DISABLE_INDEXER"},
+}
+
+// FlagIndexerEndpoint is an indexer to find candidates through in place of
+// the default, it may be given more than once
+var FlagIndexerEndpoint = &cli.StringSliceFlag{
+	Name:        "indexer-endpoint",
+	Usage:       "the base URL of an indexer HTTP API to find candidates through, may be given more than once",
+	DefaultText: "https://cid.contact",
+	EnvVars:     []string{"LASSIE_INDEXER_ENDPOINT"},
+}
+
+// FlagIndexerEndpointTimeout bounds each lookup sent to an indexer endpoint
+var FlagIndexerEndpointTimeout = &cli.DurationFlag{
+	Name:        "indexer-endpoint-timeout",
+	Usage:       "the longest to wait on each lookup sent to an indexer endpoint",
+	DefaultText: "no timeout",
+	EnvVars:     []string{"LASSIE_INDEXER_ENDPOINT_TIMEOUT"},
+}
+
+// FlagIndexerStrategy is how lookups are sent to the indexer endpoints when
+// there is more than one
+var FlagIndexerStrategy = &cli.StringFlag{
+	Name:    "indexer-strategy",
+	Usage:   "how to look up more than one indexer endpoint: \"failover\" in the order given, \"merge\" the candidates of all of them, or take the \"fastest\" to find any",
+	Value:   string(indexerlookup.EndpointStrategyFailover),
+	EnvVars: []string{"LASSIE_INDEXER_STRATEGY"},
+}
+
+// FlagIndexerReaderPrivacy looks up the indexer without revealing the CIDs
+// being looked up
+var FlagIndexerReaderPrivacy = &cli.BoolFlag{
+	Name:    "indexer-reader-privacy",
+	Usage:   "look up the indexer with double hashed multihashes, so that it doesn't learn which CIDs are retrieved",
+	EnvVars: []string{"LASSIE_INDEXER_READER_PRIVACY"},
+}
+
+// indexerOptionsFromFlags makes the options of the indexer given by flags
+func indexerOptionsFromFlags(cctx *cli.Context) ([]indexerlookup.Option, error) {
+	strategy, err := indexerlookup.ParseEndpointStrategy(cctx.String("indexer-strategy"))
+	if err != nil {
+		return nil, err
+	}
+	opts := []indexerlookup.Option{
+		indexerlookup.WithEndpointStrategy(strategy),
+		indexerlookup.WithReaderPrivacy(cctx.Bool("indexer-reader-privacy")),
+	}
+	if endpoints := cctx.StringSlice("indexer-endpoint"); len(endpoints) > 0 {
+		timeout := cctx.Duration("indexer-endpoint-timeout")
+		indexerEndpoints := make([]indexerlookup.Endpoint, 0, len(endpoints))
+		for _, endpoint := range endpoints {
+			endpointUrl, err := url.Parse(endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid indexer endpoint: %w", err)
+			}
+			indexerEndpoints = append(indexerEndpoints, indexerlookup.Endpoint{URL: endpointUrl, Timeout: timeout})
+		}
+		opts = append(opts, indexerlookup.WithHttpEndpoints(indexerEndpoints...))
+	}
+	return opts, nil
+}
+
+// FlagLocalCar is a CAR file on the local machine to retrieve from
+var FlagLocalCar = &cli.StringSliceFlag{
+	Name:      "local-car",
+	Usage:     "a CAR file to retrieve from before or alongside the network, may be given more than once",
+	TakesFile: true,
+	EnvVars:   []string{"LASSIE_LOCAL_CAR"},
+}
+
+// FlagLocalBlockstore is a blockstore directory on the local machine to
+// retrieve from
+var FlagLocalBlockstore = &cli.StringSliceFlag{
+	Name:      "local-blockstore",
+	Usage:     "a leveldb blockstore directory to retrieve from before or alongside the network, may be given more than once",
+	TakesFile: true,
+	EnvVars:   []string{"LASSIE_LOCAL_BLOCKSTORE"},
+}
+
+// localStoresFromFlags opens the local stores given by flags, there are none
+// if it returns nil
+func localStoresFromFlags(cctx *cli.Context) (*retriever.LocalStores, error) {
+	carPaths := cctx.StringSlice("local-car")
+	blockstoreDirs := cctx.StringSlice("local-blockstore")
+	if len(carPaths) == 0 && len(blockstoreDirs) == 0 {
+		return nil, nil
+	}
+	return retriever.OpenLocalStores(carPaths, blockstoreDirs)
+}
+
+// candidateFinderFromFlags makes a finder searching the direct providers and
+// the sources of candidates given by flags, in that order. Direct providers are
+// searched alone unless --merge-providers merges them with the other sources.
+// It returns nil when there is nothing but the indexer to search, which Lassie
+// does by default. The DHT is left to Lassie, which searches it from its own
+// host.
+func candidateFinderFromFlags(cctx *cli.Context, h host.Host, providers []peer.AddrInfo) (retriever.CandidateFinder, error) {
+	var sources []retriever.CandidateSource
+	if len(providers) > 0 {
+		directFinder := retriever.NewDirectCandidateFinder(cctx.Context, h, providers)
+		if !cctx.Bool("merge-providers") {
+			return directFinder, nil
+		}
+		sources = append(sources, retriever.CandidateSource{Name: "direct", Finder: directFinder})
+	}
+	if endpoint := cctx.String("delegated-routing-endpoint"); endpoint != "" {
+		endpointUrl, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delegated routing endpoint: %w", err)
+		}
+		routingFinder, err := routinglookup.NewCandidateFinder(routinglookup.WithHttpEndpoint(endpointUrl))
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, retriever.CandidateSource{Name: "delegated-routing", Finder: routingFinder})
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	if !cctx.Bool("disable-indexer") {
+		indexerOpts, err := indexerOptionsFromFlags(cctx)
+		if err != nil {
+			return nil, err
+		}
+		indexerFinder, err := indexerlookup.NewCandidateFinder(indexerOpts...)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, retriever.CandidateSource{Name: "indexer", Finder: indexerFinder})
+	}
+	if len(sources) == 1 {
+		return sources[0].Finder, nil
+	}
+	return retriever.NewCompositeCandidateFinder(sources...), nil
+}
+
+func bitswapLimitsFromFlags(cctx *cli.Context) retriever.BitswapLimits {
+	return retriever.BitswapLimits{
+		MaxBlockSize: cctx.Uint64("bitswap-max-block-size"),
+		MaxDepth:     cctx.Uint64("bitswap-max-depth"),
+		MaxBlocks:    cctx.Uint64("bitswap-max-blocks"),
+	}
+}
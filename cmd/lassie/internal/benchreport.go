@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/metrics"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+)
+
+// BenchCollector gathers the events and results of many retrievals in order to
+// produce a BenchReport. It is safe for concurrent use.
+type BenchCollector struct {
+	lk         sync.Mutex
+	start      time.Time
+	end        time.Time
+	retrievals map[types.RetrievalID]*benchRetrieval
+	order      []types.RetrievalID
+}
+
+type benchRetrieval struct {
+	cid       cid.Cid
+	start     time.Time
+	firstByte time.Time
+	stats     *types.RetrievalStats
+	err       error
+	done      bool
+	events    []types.RetrievalEvent
+}
+
+// NewBenchCollector creates a new, empty BenchCollector
+func NewBenchCollector() *BenchCollector {
+	return &BenchCollector{retrievals: make(map[types.RetrievalID]*benchRetrieval)}
+}
+
+// Start records the start of a retrieval
+func (bc *BenchCollector) Start(retrievalId types.RetrievalID, c cid.Cid, start time.Time) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+	if bc.start.IsZero() || start.Before(bc.start) {
+		bc.start = start
+	}
+	bc.retrievals[retrievalId] = &benchRetrieval{cid: c, start: start}
+	bc.order = append(bc.order, retrievalId)
+}
+
+// Finish records the result of a retrieval previously registered with Start
+func (bc *BenchCollector) Finish(retrievalId types.RetrievalID, end time.Time, stats *types.RetrievalStats, err error) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+	if end.After(bc.end) {
+		bc.end = end
+	}
+	if br, ok := bc.retrievals[retrievalId]; ok {
+		br.stats = stats
+		br.err = err
+		br.done = true
+	}
+}
+
+// RecordEvent is a types.RetrievalEventSubscriber that records events for
+// retrievals registered with Start
+func (bc *BenchCollector) RecordEvent(event types.RetrievalEvent) {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+	br, ok := bc.retrievals[event.RetrievalId()]
+	if !ok {
+		return
+	}
+	br.events = append(br.events, event)
+	if event.Code() == types.FirstByteCode && br.firstByte.IsZero() {
+		br.firstByte = event.Time()
+	}
+}
+
+// DurationPercentiles summarises a distribution of durations
+type DurationPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+}
+
+// RatePercentiles summarises a distribution of bytes per second
+type RatePercentiles struct {
+	P50 uint64 `json:"p50"`
+	P90 uint64 `json:"p90"`
+	P99 uint64 `json:"p99"`
+}
+
+// BenchGroupReport summarises retrieval attempts for a single protocol or
+// storage provider
+type BenchGroupReport struct {
+	Attempts    int                 `json:"attempts"`
+	Successes   int                 `json:"successes"`
+	Failures    int                 `json:"failures"`
+	SuccessRate float64             `json:"successRate"`
+	Bytes       uint64              `json:"bytes"`
+	TTFB        DurationPercentiles `json:"ttfb"`
+	Throughput  RatePercentiles     `json:"throughput"`
+
+	ttfbs       []time.Duration
+	throughputs []uint64
+}
+
+// BenchReport is the summary of a benchmark run
+type BenchReport struct {
+	Retrievals     int                          `json:"retrievals"`
+	Successes      int                          `json:"successes"`
+	SuccessRate    float64                      `json:"successRate"`
+	Duration       time.Duration                `json:"duration"`
+	Bytes          uint64                       `json:"bytes"`
+	Blocks         uint64                       `json:"blocks"`
+	TTFB           DurationPercentiles          `json:"ttfb"`
+	Throughput     RatePercentiles              `json:"throughput"`
+	Protocols      map[string]*BenchGroupReport `json:"protocols"`
+	Providers      map[string]*BenchGroupReport `json:"providers"`
+	FailureReasons map[string]int               `json:"failureReasons"`
+	Errors         map[string]int               `json:"errors"`
+}
+
+// Report produces a BenchReport from the retrievals collected so far
+func (bc *BenchCollector) Report() BenchReport {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	report := BenchReport{
+		Duration:       bc.end.Sub(bc.start),
+		Protocols:      make(map[string]*BenchGroupReport),
+		Providers:      make(map[string]*BenchGroupReport),
+		FailureReasons: make(map[string]int),
+		Errors:         make(map[string]int),
+	}
+	group := func(groups map[string]*BenchGroupReport, key string) *BenchGroupReport {
+		if g, ok := groups[key]; ok {
+			return g
+		}
+		g := &BenchGroupReport{}
+		groups[key] = g
+		return g
+	}
+
+	var ttfbs []time.Duration
+	var throughputs []uint64
+	for _, id := range bc.order {
+		br := bc.retrievals[id]
+		if !br.done {
+			continue
+		}
+		report.Retrievals++
+		if br.stats != nil {
+			report.Successes++
+			report.Bytes += br.stats.Size
+			report.Blocks += br.stats.Blocks
+			if !br.firstByte.IsZero() {
+				ttfbs = append(ttfbs, br.firstByte.Sub(br.start))
+			}
+			if br.stats.Duration > 0 {
+				throughputs = append(throughputs, uint64(float64(br.stats.Size)/br.stats.Duration.Seconds()))
+			}
+		} else if br.err != nil {
+			report.Errors[classifyFailure(br.err.Error())]++
+		}
+
+		for _, event := range br.events {
+			if event.Phase() == types.IndexerPhase {
+				continue
+			}
+			protocol := group(report.Protocols, eventProtocol(event))
+			provider := group(report.Providers, eventProvider(event))
+			switch evt := event.(type) {
+			case events.RetrievalEventStarted:
+				if evt.Phase() == types.RetrievalPhase {
+					protocol.Attempts++
+					provider.Attempts++
+				}
+			case events.RetrievalEventFirstByte:
+				ttfb := evt.Time().Sub(evt.PhaseStartTime())
+				protocol.ttfbs = append(protocol.ttfbs, ttfb)
+				provider.ttfbs = append(provider.ttfbs, ttfb)
+			case events.RetrievalEventSuccess:
+				protocol.Successes++
+				provider.Successes++
+				protocol.Bytes += evt.ReceivedSize()
+				provider.Bytes += evt.ReceivedSize()
+				if evt.Duration() > 0 {
+					rate := uint64(float64(evt.ReceivedSize()) / evt.Duration().Seconds())
+					protocol.throughputs = append(protocol.throughputs, rate)
+					provider.throughputs = append(provider.throughputs, rate)
+				}
+			case events.RetrievalEventFailed:
+				reason := classifyFailure(evt.ErrorMessage())
+				report.FailureReasons[fmt.Sprintf("%s: %s", evt.Phase(), reason)]++
+				if evt.Phase() == types.RetrievalPhase {
+					protocol.Failures++
+					provider.Failures++
+				}
+			}
+		}
+	}
+
+	report.SuccessRate = rate(report.Successes, report.Retrievals)
+	report.TTFB = durationPercentiles(ttfbs)
+	report.Throughput = ratePercentiles(throughputs)
+	for _, groups := range []map[string]*BenchGroupReport{report.Protocols, report.Providers} {
+		for key, g := range groups {
+			if g.Attempts == 0 && g.Successes == 0 && g.Failures == 0 {
+				// only saw query phase events for this group
+				delete(groups, key)
+				continue
+			}
+			g.SuccessRate = rate(g.Successes, g.Attempts)
+			g.TTFB = durationPercentiles(g.ttfbs)
+			g.Throughput = ratePercentiles(g.throughputs)
+		}
+	}
+	return report
+}
+
+// WriteJSON writes the report in JSON form
+func (report BenchReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// WriteText writes the report in human readable form
+func (report BenchReport) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Retrievals: %d, succeeded: %d (%.1f%%), duration: %s\n", report.Retrievals, report.Successes, report.SuccessRate*100, report.Duration)
+	fmt.Fprintf(w, "Received: %d blocks, %s\n", report.Blocks, humanize.IBytes(report.Bytes))
+	fmt.Fprintf(w, "TTFB: p50=%s p90=%s p99=%s\n", report.TTFB.P50, report.TTFB.P90, report.TTFB.P99)
+	fmt.Fprintf(w, "Throughput: p50=%s/s p90=%s/s p99=%s/s\n", humanize.IBytes(report.Throughput.P50), humanize.IBytes(report.Throughput.P90), humanize.IBytes(report.Throughput.P99))
+
+	writeGroups := func(title string, groups map[string]*BenchGroupReport) {
+		if len(groups) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n")
+		tw := tabwriter.NewWriter(w, 0, 2, 2, ' ', 0)
+		fmt.Fprintf(tw, "%s\tAttempts\tSuccess\tRate\tTTFB p50\tTTFB p90\tTTFB p99\tRate p50\tRate p90\tRate p99\n", title)
+		for _, key := range sortedKeys(groups) {
+			g := groups[key]
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f%%\t%s\t%s\t%s\t%s/s\t%s/s\t%s/s\n",
+				key, g.Attempts, g.Successes, g.SuccessRate*100,
+				g.TTFB.P50, g.TTFB.P90, g.TTFB.P99,
+				humanize.IBytes(g.Throughput.P50), humanize.IBytes(g.Throughput.P90), humanize.IBytes(g.Throughput.P99))
+		}
+		tw.Flush()
+	}
+	writeGroups("Protocol", report.Protocols)
+	writeGroups("Provider", report.Providers)
+
+	writeCounts := func(title string, counts map[string]int) {
+		if len(counts) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s:\n", title)
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if counts[keys[i]] != counts[keys[j]] {
+				return counts[keys[i]] > counts[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+		for _, k := range keys {
+			fmt.Fprintf(w, "\t%6d  %s\n", counts[k], k)
+		}
+	}
+	writeCounts("Failure reasons", report.FailureReasons)
+	writeCounts("Retrieval errors", report.Errors)
+	return nil
+}
+
+func sortedKeys(groups map[string]*BenchGroupReport) []string {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func rate(n, of int) float64 {
+	if of == 0 {
+		return 0
+	}
+	return float64(n) / float64(of)
+}
+
+// eventProtocol names the protocol an event relates to, if it can be told
+func eventProtocol(event types.RetrievalEvent) string {
+	if protocol, ok := types.EventProtocol(event); ok {
+		return protocol.String()
+	}
+	return "unknown"
+}
+
+func eventProvider(event types.RetrievalEvent) string {
+	if id := types.Identifier(event); id != "" {
+		return id
+	}
+	return "unknown"
+}
+
+var failureMatches = func() []string {
+	matches := make([]string, 0, len(metrics.ErrorMetricMatches)+len(metrics.QueryErrorMetricMatches))
+	for substr := range metrics.ErrorMetricMatches {
+		matches = append(matches, substr)
+	}
+	for substr := range metrics.QueryErrorMetricMatches {
+		matches = append(matches, substr)
+	}
+	sort.Strings(matches)
+	return matches
+}()
+
+const maxFailureReasonLength = 80
+
+// classifyFailure reduces an error message to a failure reason, using the same
+// substring matching that is used for metrics, or a truncated form of the
+// message where there is no match
+func classifyFailure(msg string) string {
+	for _, substr := range failureMatches {
+		if strings.Contains(msg, substr) {
+			return strings.TrimSpace(substr)
+		}
+	}
+	if len(msg) > maxFailureReasonLength {
+		return msg[:maxFailureReasonLength] + "..."
+	}
+	return msg
+}
+
+func durationPercentiles(samples []time.Duration) DurationPercentiles {
+	if len(samples) == 0 {
+		return DurationPercentiles{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return DurationPercentiles{
+		P50: samples[percentileIndex(len(samples), 50)],
+		P90: samples[percentileIndex(len(samples), 90)],
+		P99: samples[percentileIndex(len(samples), 99)],
+	}
+}
+
+func ratePercentiles(samples []uint64) RatePercentiles {
+	if len(samples) == 0 {
+		return RatePercentiles{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return RatePercentiles{
+		P50: samples[percentileIndex(len(samples), 50)],
+		P90: samples[percentileIndex(len(samples), 90)],
+		P99: samples[percentileIndex(len(samples), 99)],
+	}
+}
+
+// percentileIndex uses the nearest-rank method to find the index of the given
+// percentile in a sorted list of samples
+func percentileIndex(count int, percentile int) int {
+	idx := (percentile*count+99)/100 - 1
+	if idx < 0 {
+		return 0
+	}
+	return idx
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchReport(t *testing.T) {
+	c := cid.MustParse("bafkqaalb")
+	start := time.Now()
+	graphsyncCandidate := types.NewRetrievalCandidate(peer.ID("A"), c, &metadata.GraphsyncFilecoinV1{})
+	bitswapCandidate := types.NewRetrievalCandidate(peer.ID(""), c, metadata.Bitswap{})
+
+	collector := NewBenchCollector()
+
+	// successful graphsync retrieval
+	rid1, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	collector.Start(rid1, c, start)
+	collector.RecordEvent(events.Started(rid1, start, types.RetrievalPhase, graphsyncCandidate))
+	collector.RecordEvent(events.FirstByte(rid1, start, graphsyncCandidate))
+	collector.RecordEvent(events.Success(rid1, start, graphsyncCandidate, 2000, 2, time.Second, big.Zero()))
+	collector.Finish(rid1, start.Add(time.Second), &types.RetrievalStats{Size: 2000, Blocks: 2, Duration: time.Second}, nil)
+
+	// failed bitswap retrieval
+	rid2, err := types.NewRetrievalID()
+	require.NoError(t, err)
+	collector.Start(rid2, c, start)
+	collector.RecordEvent(events.Started(rid2, start, types.RetrievalPhase, bitswapCandidate))
+	collector.RecordEvent(events.Failed(rid2, start, types.RetrievalPhase, bitswapCandidate, "timeout after 20s"))
+	collector.Finish(rid2, start.Add(2*time.Second), nil, errors.New("all retrievals failed"))
+
+	report := collector.Report()
+	require.Equal(t, 2, report.Retrievals)
+	require.Equal(t, 1, report.Successes)
+	require.Equal(t, 0.5, report.SuccessRate)
+	require.Equal(t, 2*time.Second, report.Duration)
+	require.Equal(t, uint64(2000), report.Bytes)
+	require.Equal(t, uint64(2000), report.Throughput.P50)
+	require.Equal(t, map[string]int{"retrieval: timeout after": 1}, report.FailureReasons)
+	require.Equal(t, map[string]int{"all retrievals failed": 1}, report.Errors)
+
+	require.Len(t, report.Protocols, 2)
+	gs := report.Protocols["transport-graphsync-filecoinv1"]
+	require.Equal(t, 1, gs.Attempts)
+	require.Equal(t, 1, gs.Successes)
+	require.Equal(t, 1.0, gs.SuccessRate)
+	bs := report.Protocols["transport-bitswap"]
+	require.Equal(t, 1, bs.Attempts)
+	require.Equal(t, 0, bs.Successes)
+	require.Equal(t, 1, bs.Failures)
+
+	require.Len(t, report.Providers, 2)
+	require.Equal(t, 1, report.Providers[peer.ID("A").String()].Successes)
+	require.Equal(t, 1, report.Providers[types.BitswapIndentifier].Failures)
+
+	var buf bytes.Buffer
+	require.NoError(t, report.WriteJSON(&buf))
+	var decoded BenchReport
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, report.Retrievals, decoded.Retrievals)
+	buf.Reset()
+	require.NoError(t, report.WriteText(&buf))
+	require.Contains(t, buf.String(), "transport-bitswap")
+}
+
+func TestPercentileIndex(t *testing.T) {
+	require.Equal(t, 0, percentileIndex(1, 50))
+	require.Equal(t, 0, percentileIndex(1, 99))
+	require.Equal(t, 4, percentileIndex(10, 50))
+	require.Equal(t, 8, percentileIndex(10, 90))
+	require.Equal(t, 98, percentileIndex(100, 99))
+}
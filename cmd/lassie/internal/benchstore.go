@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/ipld/go-ipld-prime/storage"
+	"github.com/multiformats/go-multicodec"
+)
+
+var _ storage.ReadableStorage = (*BenchStore)(nil)
+var _ storage.WritableStorage = (*BenchStore)(nil)
+
+// BenchStore is a thread-safe, memory-only store for a single retrieval that
+// counts the blocks and bytes written to it without keeping the data of raw
+// blocks, which hold the bulk of a DAG's bytes but no links for a traversal to
+// follow. Blocks that may link to others are kept so that traversals can read
+// them back. A raw block that appears more than once in a DAG is not found
+// when it's read back, so it may be retrieved again. It should be discarded
+// once the retrieval is complete.
+type BenchStore struct {
+	lk     sync.RWMutex
+	blocks map[string][]byte
+	count  uint64
+	size   uint64
+}
+
+func NewBenchStore() *BenchStore {
+	return &BenchStore{blocks: make(map[string][]byte)}
+}
+
+func (bs *BenchStore) Has(ctx context.Context, key string) (bool, error) {
+	bs.lk.RLock()
+	defer bs.lk.RUnlock()
+	_, has := bs.blocks[key]
+	return has, nil
+}
+
+func (bs *BenchStore) Get(ctx context.Context, key string) ([]byte, error) {
+	bs.lk.RLock()
+	defer bs.lk.RUnlock()
+	data, has := bs.blocks[key]
+	if !has {
+		c, err := cid.Cast([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		return nil, format.ErrNotFound{Cid: c}
+	}
+	return data, nil
+}
+
+func (bs *BenchStore) Put(ctx context.Context, key string, content []byte) error {
+	c, err := cid.Cast([]byte(key))
+	if err != nil {
+		return err
+	}
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	bs.count++
+	bs.size += uint64(len(content))
+	if multicodec.Code(c.Type()) != multicodec.Raw {
+		bs.blocks[key] = content
+	}
+	return nil
+}
+
+// Written returns the number of blocks, and their total size in bytes, that
+// have been written to the store
+func (bs *BenchStore) Written() (uint64, uint64) {
+	bs.lk.RLock()
+	defer bs.lk.RUnlock()
+	return bs.count, bs.size
+}
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchStore(t *testing.T) {
+	ctx := context.Background()
+	blockCid := func(codec multicodec.Code, data []byte) cid.Cid {
+		mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		return cid.NewCidV1(uint64(codec), mh)
+	}
+	node := []byte("a node with links")
+	nodeCid := blockCid(multicodec.DagPb, node)
+	leaf := []byte("a raw leaf")
+	leafCid := blockCid(multicodec.Raw, leaf)
+
+	store := NewBenchStore()
+	require.NoError(t, store.Put(ctx, nodeCid.KeyString(), node))
+	require.NoError(t, store.Put(ctx, leafCid.KeyString(), leaf))
+	blocks, size := store.Written()
+	require.Equal(t, uint64(2), blocks)
+	require.Equal(t, uint64(len(node)+len(leaf)), size)
+
+	// nodes are kept to be read back, raw leaves are only counted
+	data, err := store.Get(ctx, nodeCid.KeyString())
+	require.NoError(t, err)
+	require.Equal(t, node, data)
+	has, err := store.Has(ctx, leafCid.KeyString())
+	require.NoError(t, err)
+	require.False(t, has)
+	_, err = store.Get(ctx, leafCid.KeyString())
+	require.ErrorIs(t, err, format.ErrNotFound{Cid: leafCid})
+}
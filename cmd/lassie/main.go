@@ -47,6 +47,7 @@ func main() {
 			FlagVeryVerbose,
 		},
 		Commands: []*cli.Command{
+			benchCmd,
 			daemonCmd,
 			fetchCmd,
 			versionCmd,
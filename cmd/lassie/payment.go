@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/lassie"
+	"github.com/filecoin-project/lassie/pkg/paychmgr"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/urfave/cli/v2"
+)
+
+// FlagPaidRetrievals allows retrievals that storage providers ask to be paid
+// for, within the limits of the payment policy flags
+var FlagPaidRetrievals = &cli.BoolFlag{
+	Name:    "paid-retrievals",
+	Usage:   "allow retrievals that storage providers ask to be paid for, paying from payment channels funded by --wallet through --lotus-api",
+	EnvVars: []string{"LASSIE_PAID_RETRIEVALS"},
+}
+
+// FlagMaxPricePerByte is the highest price per byte a paid retrieval accepts
+var FlagMaxPricePerByte = &cli.StringFlag{
+	Name:        "max-price-per-byte",
+	Usage:       "the highest price per byte, in attoFIL, that a paid retrieval may ask",
+	DefaultText: "no limit",
+	EnvVars:     []string{"LASSIE_MAX_PRICE_PER_BYTE"},
+}
+
+// FlagMaxUnsealPrice is the highest unseal price a paid retrieval accepts
+var FlagMaxUnsealPrice = &cli.StringFlag{
+	Name:        "max-unseal-price",
+	Usage:       "the highest unseal price, in attoFIL, that a paid retrieval may ask",
+	DefaultText: "no limit",
+	EnvVars:     []string{"LASSIE_MAX_UNSEAL_PRICE"},
+}
+
+// FlagMaxCost is the most that is paid for a single retrieval
+var FlagMaxCost = &cli.StringFlag{
+	Name:        "max-cost",
+	Usage:       "the most, in attoFIL, that may be paid for a single retrieval, across all of the storage providers it may pay",
+	DefaultText: "no limit",
+	EnvVars:     []string{"LASSIE_MAX_COST"},
+}
+
+// FlagBudget limits the spending of all retrievals, it isn't persisted so the
+// whole budget is available again after a restart
+var FlagBudget = &cli.StringFlag{
+	Name:        "budget",
+	Usage:       "the most, in attoFIL, that may be spent on retrievals within the --budget-period; what has been spent is kept in memory only, so the budget starts afresh when lassie restarts",
+	DefaultText: "no limit",
+	EnvVars:     []string{"LASSIE_BUDGET"},
+}
+
+// FlagBudgetPeriod is the period over which the FlagBudget applies
+var FlagBudgetPeriod = &cli.DurationFlag{
+	Name:        "budget-period",
+	Usage:       "the period over which the --budget applies, e.g. 24h for a daily budget",
+	DefaultText: "the lifetime of the process",
+	EnvVars:     []string{"LASSIE_BUDGET_PERIOD"},
+}
+
+// FlagWallet is the keystore file of the key that funds payment channels
+var FlagWallet = &cli.StringFlag{
+	Name:      "wallet",
+	Usage:     "a keystore file, in the format exported by `lotus wallet export`, holding the key that funds payment channels; a new key is written to it if it doesn't exist",
+	TakesFile: true,
+	EnvVars:   []string{"LASSIE_WALLET"},
+}
+
+// FlagLotusApi is the Lotus node that payment channel messages are sent through
+var FlagLotusApi = &cli.StringFlag{
+	Name:    "lotus-api",
+	Usage:   "the JSON-RPC endpoint of the Lotus node that payment channel messages are sent through, e.g. http://127.0.0.1:1234/rpc/v1",
+	EnvVars: []string{"LASSIE_LOTUS_API"},
+}
+
+// FlagLotusApiToken authorizes requests to the FlagLotusApi
+var FlagLotusApiToken = &cli.StringFlag{
+	Name:    "lotus-api-token",
+	Usage:   "the token sent to the --lotus-api",
+	EnvVars: []string{"LASSIE_LOTUS_API_TOKEN"},
+}
+
+// FlagPaychDir is where the ledger of payment channels is persisted
+var FlagPaychDir = &cli.StringFlag{
+	Name:    "paych-dir",
+	Usage:   "directory in which to persist the ledger of payment channels, lanes and vouchers",
+	EnvVars: []string{"LASSIE_PAYCH_DIRECTORY"},
+}
+
+// FlagPaychFunds is the amount each payment channel is funded with
+var FlagPaychFunds = &cli.StringFlag{
+	Name:    "paych-funds",
+	Usage:   "the amount, in attoFIL, added to a payment channel when it's created and each time it runs out",
+	EnvVars: []string{"LASSIE_PAYCH_FUNDS"},
+}
+
+// attoFilFromFlags parses an amount flag, which is nil if it isn't set
+func attoFilFromFlags(cctx *cli.Context, name string) (abi.TokenAmount, error) {
+	if !cctx.IsSet(name) {
+		return big.Int{}, nil
+	}
+	amount, err := big.FromString(cctx.String(name))
+	if err != nil || amount.Sign() < 0 {
+		return big.Int{}, fmt.Errorf("invalid --%s, expected an amount of attoFIL: %s", name, cctx.String(name))
+	}
+	return amount, nil
+}
+
+func paymentPolicyFromFlags(cctx *cli.Context) (retriever.PaymentPolicy, error) {
+	policy := retriever.PaymentPolicy{BudgetPeriod: cctx.Duration("budget-period")}
+	var err error
+	if policy.MaxPricePerByte, err = attoFilFromFlags(cctx, "max-price-per-byte"); err != nil {
+		return retriever.PaymentPolicy{}, err
+	}
+	if policy.MaxUnsealPrice, err = attoFilFromFlags(cctx, "max-unseal-price"); err != nil {
+		return retriever.PaymentPolicy{}, err
+	}
+	if policy.MaxCost, err = attoFilFromFlags(cctx, "max-cost"); err != nil {
+		return retriever.PaymentPolicy{}, err
+	}
+	if policy.Budget, err = attoFilFromFlags(cctx, "budget"); err != nil {
+		return retriever.PaymentPolicy{}, err
+	}
+	return policy, nil
+}
+
+// paymentOptionsFromFlags sets up paid retrievals if they're allowed, along
+// with the payment channel manager that pays for them. The returned closer,
+// if any, closes the ledger of payment channels once Lassie is done with it.
+func paymentOptionsFromFlags(cctx *cli.Context) ([]lassie.LassieOption, io.Closer, error) {
+	if !cctx.Bool("paid-retrievals") {
+		return nil, nil, nil
+	}
+	for _, required := range []string{"wallet", "lotus-api", "paych-dir", "paych-funds"} {
+		if cctx.String(required) == "" {
+			return nil, nil, fmt.Errorf("--paid-retrievals requires --%s", required)
+		}
+	}
+	policy, err := paymentPolicyFromFlags(cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	channelFunds, err := attoFilFromFlags(cctx, "paych-funds")
+	if err != nil {
+		return nil, nil, err
+	}
+	if channelFunds.Sign() <= 0 {
+		return nil, nil, errors.New("--paych-funds must be greater than zero")
+	}
+	wallet, err := paychmgr.LoadWallet(cctx.String("wallet"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load wallet: %w", err)
+	}
+	ledgerDs, err := leveldb.NewDatastore(cctx.String("paych-dir"), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open payment channel datastore: %w", err)
+	}
+	api := paychmgr.NewNodeRPCClient(cctx.String("lotus-api"), cctx.String("lotus-api-token"))
+	manager, err := paychmgr.NewManager(cctx.Context, ledgerDs, api, wallet, paychmgr.Config{ChannelFunds: channelFunds})
+	if err != nil {
+		ledgerDs.Close()
+		return nil, nil, err
+	}
+	// wait on the channel messages left pending by the last run
+	if err := manager.Start(); err != nil {
+		ledgerDs.Close()
+		return nil, nil, fmt.Errorf("failed to start payment channel manager: %w", err)
+	}
+	return []lassie.LassieOption{
+		lassie.WithPaymentPolicy(policy),
+		lassie.WithPayChannelManager(manager),
+	}, ledgerDs, nil
+}
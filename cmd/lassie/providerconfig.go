@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/lassie"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+)
+
+// providerConfigPollInterval is how often the provider config file is checked
+// for modifications
+const providerConfigPollInterval = 10 * time.Second
+
+func loadProviderConfig(path string) (retriever.ProviderConfig, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return retriever.ProviderConfig{}, time.Time{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return retriever.ProviderConfig{}, time.Time{}, err
+	}
+	cfg, err := retriever.ParseProviderConfig(f)
+	if err != nil {
+		return retriever.ProviderConfig{}, time.Time{}, err
+	}
+	return cfg, fi.ModTime(), nil
+}
+
+// watchProviderConfig reloads the provider config file into the given Lassie
+// instance when the file is modified or when the process receives a SIGHUP.
+// Failed reloads are logged and the previous config remains in place.
+func watchProviderConfig(ctx context.Context, lassie *lassie.Lassie, path string, modTime time.Time) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(providerConfigPollInterval)
+	defer ticker.Stop()
+
+	reload := func(force bool) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Warnw("failed to check provider config", "path", path, "err", err)
+			return
+		}
+		if !force && fi.ModTime().Equal(modTime) {
+			return
+		}
+		cfg, newModTime, err := loadProviderConfig(path)
+		if err != nil {
+			log.Warnw("failed to reload provider config, keeping existing config", "path", path, "err", err)
+			return
+		}
+		modTime = newModTime
+		lassie.UpdateProviderConfig(cfg)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Infow("received SIGHUP, reloading provider config", "path", path)
+			reload(true)
+		case <-ticker.C:
+			reload(false)
+		}
+	}
+}
@@ -138,7 +138,7 @@ func NewClientWithConfig(cfg *Config) (*RetrievalClient, error) {
 	).(*graphsync.GraphSync)
 
 	dtNetwork := dtnetwork.NewFromLibp2pHost(cfg.Host)
-	dtTransport := dttransport.NewTransport(cfg.Host.ID(), graphSync)
+	dtTransport := dttransport.NewTransport(cfg.Host.ID(), doNotSendCidsExchange{graphSync})
 
 	dtRestartConfig := dtimpl.ChannelRestartConfig(cfg.ChannelMonitorConfig)
 
@@ -219,7 +219,8 @@ func (rc *RetrievalClient) RetrieveFromPeer(
 
 	if willingToPay && paymentRequired {
 		// Get the payment channel and create a lane for this retrieval
-		payChanAddr, err := rc.payChanMgr.GetPayChannelWithMinFunds(ctx, minerWallet)
+		var err error
+		payChanAddr, err = rc.payChanMgr.GetPayChannelWithMinFunds(ctx, minerWallet)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get payment channel: %w", err)
 		}
@@ -390,6 +391,13 @@ func (rc *RetrievalClient) RetrieveFromPeer(
 		}
 	}
 
+	// Ask the miner not to send any blocks we already have, so a retrieval can
+	// resume where a previous failed attempt left off
+	if present := presentCids(ctx, linkSystem, rootCid, sel); present.Len() > 0 {
+		log.Infof("Requesting %s from miner peer ID %s without %d blocks already present", rootCid, peerID, present.Len())
+		ctx = withDoNotSendCids(ctx, present)
+	}
+
 	// Submit the retrieval deal proposal to the miner
 	proposalVoucher := retrievalmarket.BindnodeRegistry.TypeToNode(proposal)
 	chanid, err := rc.dataTransfer.OpenPullDataChannel(
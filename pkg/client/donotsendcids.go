@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-graphsync"
+	"github.com/ipfs/go-graphsync/cidset"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+type doNotSendCidsKey struct{}
+
+// withDoNotSendCids attaches a set of CIDs to a context, any graphsync request
+// made with the context will ask the responder not to send them
+func withDoNotSendCids(ctx context.Context, cids *cid.Set) context.Context {
+	return context.WithValue(ctx, doNotSendCidsKey{}, cids)
+}
+
+// doNotSendCidsExchange adds the do-not-send-cids extension to graphsync
+// requests made with a context carrying a set of CIDs. go-data-transfer
+// doesn't give us a way to add our own extensions to the requests it makes on
+// our behalf, but it does pass our context through.
+type doNotSendCidsExchange struct {
+	graphsync.GraphExchange
+}
+
+func (e doNotSendCidsExchange) Request(
+	ctx context.Context,
+	p peer.ID,
+	root ipld.Link,
+	selector ipld.Node,
+	extensions ...graphsync.ExtensionData,
+) (<-chan graphsync.ResponseProgress, <-chan error) {
+	if cids, ok := ctx.Value(doNotSendCidsKey{}).(*cid.Set); ok && cids.Len() > 0 {
+		extensions = append(extensions, graphsync.ExtensionData{
+			Name: graphsync.ExtensionDoNotSendCIDs,
+			Data: cidset.EncodeCidSet(cids),
+		})
+	}
+	return e.GraphExchange.Request(ctx, p, root, selector, extensions...)
+}
+
+// presentCids walks the DAG described by root and selector using only the
+// blocks already available in the LinkSystem, returning the CIDs of those
+// that are present. Walking stops at any block that is missing, so this is
+// the portion of the DAG that a previous attempt at the same retrieval
+// managed to fetch before it failed.
+func presentCids(ctx context.Context, lsys ipld.LinkSystem, root cid.Cid, sel ipld.Node) *cid.Set {
+	present := cid.NewSet()
+	if lsys.StorageReadOpener == nil {
+		return present
+	}
+
+	compiled, err := selector.CompileSelector(sel)
+	if err != nil {
+		return present
+	}
+
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
+		r, err := readOpener(lctx, lnk)
+		if err != nil || r == nil {
+			// not present (or not readable), skip this part of the DAG
+			return nil, traversal.SkipMe{}
+		}
+		if cl, ok := lnk.(cidlink.Link); ok {
+			present.Add(cl.Cid)
+		}
+		return r, nil
+	}
+
+	protoChooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLink := cidlink.Link{Cid: root}
+	prototype, err := protoChooser(rootLink, linking.LinkContext{Ctx: ctx})
+	if err != nil {
+		return present
+	}
+	node, err := lsys.Load(linking.LinkContext{Ctx: ctx}, rootLink, prototype)
+	if err != nil {
+		return present
+	}
+
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: protoChooser,
+			LinkVisitOnlyOnce:              true,
+		},
+	}
+	progress.LastBlock.Link = rootLink
+	// an error part way through the walk, perhaps from an ADL that couldn't
+	// load a missing block, still leaves us with blocks that are present
+	if err := progress.WalkAdv(node, compiled, func(traversal.Progress, datamodel.Node, traversal.VisitReason) error { return nil }); err != nil {
+		log.Debugf("stopped walking local blocks for %s: %v", root, err)
+	}
+	return present
+}
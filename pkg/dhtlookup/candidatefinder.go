@@ -0,0 +1,111 @@
+package dhtlookup
+
+import (
+	"context"
+
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-log/v2"
+	"github.com/ipni/index-provider/metadata"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	_ retriever.CandidateFinder = (*DhtCandidateFinder)(nil)
+
+	logger = log.Logger("dhtlookup")
+)
+
+// DhtCandidateFinder finds candidates by querying the IPFS DHT for providers
+// of a CID from our own libp2p host, without going through an indexer. Peers
+// providing content on the DHT serve it over bitswap, so each provider is a
+// bitswap candidate.
+type DhtCandidateFinder struct {
+	*options
+	self peer.ID
+	dht  *dht.IpfsDHT
+}
+
+// NewCandidateFinder returns a DhtCandidateFinder for the host. Unless
+// WithContentRouting is given, a DHT client is started on the host and joins
+// the DHT through the bootstrap peers, Close stops it.
+func NewCandidateFinder(ctx context.Context, h host.Host, o ...Option) (*DhtCandidateFinder, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	finder := &DhtCandidateFinder{options: opts, self: h.ID()}
+	if finder.contentRouting != nil {
+		return finder, nil
+	}
+	bootstrapPeers := opts.bootstrapPeers
+	if len(bootstrapPeers) == 0 {
+		bootstrapPeers = dht.GetDefaultBootstrapPeerAddrInfos()
+	}
+	finder.dht, err = dht.New(ctx, h, dht.Mode(dht.ModeClient), dht.BootstrapPeers(bootstrapPeers...))
+	if err != nil {
+		return nil, err
+	}
+	if err := finder.dht.Bootstrap(ctx); err != nil {
+		_ = finder.dht.Close()
+		return nil, err
+	}
+	finder.contentRouting = finder.dht
+	return finder, nil
+}
+
+// Close stops the DHT client started by the finder, if there is one
+func (df *DhtCandidateFinder) Close() error {
+	if df.dht == nil {
+		return nil
+	}
+	return df.dht.Close()
+}
+
+func (df *DhtCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	var candidates []types.RetrievalCandidate
+	for provider := range df.contentRouting.FindProvidersAsync(ctx, c, df.maxProviders) {
+		if candidate, ok := df.candidate(c, provider); ok {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return candidates, nil
+}
+
+func (df *DhtCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	providers := df.contentRouting.FindProvidersAsync(ctx, c, df.maxProviders)
+	results := make(chan types.FindCandidatesResult, df.asyncResultsChanBuffer)
+	go func() {
+		defer close(results)
+		for provider := range providers {
+			candidate, ok := df.candidate(c, provider)
+			if !ok {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case results <- types.FindCandidatesResult{Candidate: candidate}:
+			}
+		}
+	}()
+	return results, nil
+}
+
+func (df *DhtCandidateFinder) candidate(c cid.Cid, provider peer.AddrInfo) (types.RetrievalCandidate, bool) {
+	if provider.ID == df.self {
+		return types.RetrievalCandidate{}, false
+	}
+	logger.Debugw("found provider on the DHT", "cid", c, "provider", provider.ID)
+	return types.RetrievalCandidate{
+		MinerPeer: provider,
+		RootCid:   c,
+		Metadata:  types.MetadataContext.New(&metadata.Bitswap{}),
+	}, true
+}
@@ -0,0 +1,180 @@
+package dhtlookup_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/dhtlookup"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	lp2ptest "github.com/libp2p/go-libp2p/core/test"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRouter provides its providers for any CID, up to the count asked for as
+// the DHT does, then blocks until the context is done if it's told to hang
+type fakeRouter struct {
+	providers []peer.AddrInfo
+	hang      bool
+	counts    chan int
+}
+
+func (fr *fakeRouter) Provide(context.Context, cid.Cid, bool) error {
+	return nil
+}
+
+func (fr *fakeRouter) FindProvidersAsync(ctx context.Context, c cid.Cid, count int) <-chan peer.AddrInfo {
+	fr.counts <- count
+	providers := make(chan peer.AddrInfo)
+	go func() {
+		defer close(providers)
+		for i, provider := range fr.providers {
+			if count > 0 && i >= count {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case providers <- provider:
+			}
+		}
+		if fr.hang {
+			<-ctx.Done()
+		}
+	}()
+	return providers
+}
+
+func TestDhtCandidateFinder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := testutil.GenerateCids(1)[0]
+
+	mn := mocknet.New()
+	self, err := mn.GenPeer()
+	require.NoError(t, err)
+	others := make([]peer.AddrInfo, 3)
+	for i := range others {
+		others[i] = peer.AddrInfo{ID: lp2ptest.RandPeerIDFatal(t)}
+	}
+	othersIds := func(n int) []peer.ID {
+		ids := make([]peer.ID, 0, n)
+		for _, other := range others[:n] {
+			ids = append(ids, other.ID)
+		}
+		return ids
+	}
+
+	testCases := []struct {
+		name          string
+		providers     []peer.AddrInfo
+		opts          []dhtlookup.Option
+		expectedCount int
+		expectedIds   []peer.ID
+	}{
+		{
+			name:          "finds the providers",
+			providers:     others,
+			expectedCount: 20,
+			expectedIds:   othersIds(3),
+		},
+		{
+			name:          "skips our own peer",
+			providers:     []peer.AddrInfo{others[0], {ID: self.ID()}, others[1]},
+			expectedCount: 20,
+			expectedIds:   othersIds(2),
+		},
+		{
+			name:          "limits the providers found",
+			providers:     others,
+			opts:          []dhtlookup.Option{dhtlookup.WithMaxProviders(2)},
+			expectedCount: 2,
+			expectedIds:   othersIds(2),
+		},
+		{
+			name:          "finds every provider without a limit",
+			providers:     others,
+			opts:          []dhtlookup.Option{dhtlookup.WithMaxProviders(0)},
+			expectedCount: 0,
+			expectedIds:   othersIds(3),
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			router := &fakeRouter{providers: testCase.providers, counts: make(chan int, 2)}
+			opts := append([]dhtlookup.Option{dhtlookup.WithContentRouting(router)}, testCase.opts...)
+			finder, err := dhtlookup.NewCandidateFinder(ctx, self, opts...)
+			require.NoError(t, err)
+			defer finder.Close()
+
+			candidates, err := finder.FindCandidates(ctx, c)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedCount, <-router.counts)
+			var ids []peer.ID
+			for _, candidate := range candidates {
+				require.Equal(t, c, candidate.RootCid)
+				require.Equal(t, types.MetadataContext.New(&metadata.Bitswap{}), candidate.Metadata)
+				ids = append(ids, candidate.MinerPeer.ID)
+			}
+			require.Equal(t, testCase.expectedIds, ids)
+
+			results, err := finder.FindCandidatesAsync(ctx, c)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedCount, <-router.counts)
+			ids = nil
+			for result := range results {
+				require.NoError(t, result.Err)
+				ids = append(ids, result.Candidate.MinerPeer.ID)
+			}
+			require.Equal(t, testCase.expectedIds, ids)
+		})
+	}
+}
+
+func TestDhtCandidateFinderCancellation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := testutil.GenerateCids(1)[0]
+
+	mn := mocknet.New()
+	self, err := mn.GenPeer()
+	require.NoError(t, err)
+	provider := peer.AddrInfo{ID: lp2ptest.RandPeerIDFatal(t)}
+	router := &fakeRouter{providers: []peer.AddrInfo{provider}, hang: true, counts: make(chan int, 2)}
+	finder, err := dhtlookup.NewCandidateFinder(ctx, self, dhtlookup.WithContentRouting(router))
+	require.NoError(t, err)
+	defer finder.Close()
+
+	// the async lookup streams what is found until it's cancelled
+	lookupCtx, lookupCancel := context.WithCancel(ctx)
+	results, err := finder.FindCandidatesAsync(lookupCtx, c)
+	require.NoError(t, err)
+	select {
+	case <-ctx.Done():
+		require.FailNow(t, "did not receive the provider")
+	case result := <-results:
+		require.NoError(t, result.Err)
+		require.Equal(t, provider.ID, result.Candidate.MinerPeer.ID)
+	}
+	lookupCancel()
+	select {
+	case <-ctx.Done():
+		require.FailNow(t, "results were not closed on cancellation")
+	case _, ok := <-results:
+		require.False(t, ok)
+	}
+
+	// the sync lookup returns the error of a cancelled lookup
+	lookupCtx, lookupCancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer lookupCancel()
+	candidates, err := finder.FindCandidates(lookupCtx, c)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Nil(t, candidates)
+}
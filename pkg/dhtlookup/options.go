@@ -0,0 +1,66 @@
+package dhtlookup
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		asyncResultsChanBuffer int
+		maxProviders           int
+		bootstrapPeers         []peer.AddrInfo
+		contentRouting         routing.ContentRouting
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	opts := options{
+		asyncResultsChanBuffer: 1,
+		maxProviders:           20,
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	return &opts, nil
+}
+
+// WithAsyncResultsChanBuffer sets the channel buffer returned by DhtCandidateFinder.FindCandidatesAsync.
+// Defaults to 1 if unspecified.
+func WithAsyncResultsChanBuffer(i int) Option {
+	return func(o *options) error {
+		o.asyncResultsChanBuffer = i
+		return nil
+	}
+}
+
+// WithMaxProviders sets the most providers found for a CID before the DHT
+// query ends, zero finds as many as the DHT holds.
+// Defaults to 20 if unspecified.
+func WithMaxProviders(n int) Option {
+	return func(o *options) error {
+		o.maxProviders = n
+		return nil
+	}
+}
+
+// WithBootstrapPeers sets the peers the DHT client joins the DHT through.
+// Defaults to the IPFS bootstrap peers if unspecified.
+func WithBootstrapPeers(peers ...peer.AddrInfo) Option {
+	return func(o *options) error {
+		o.bootstrapPeers = peers
+		return nil
+	}
+}
+
+// WithContentRouting sets an existing DHT, or other content router, to find
+// providers through in place of a DHT client started by the finder.
+func WithContentRouting(r routing.ContentRouting) Option {
+	return func(o *options) error {
+		o.contentRouting = r
+		return nil
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/lassie/pkg/events"
 	"github.com/filecoin-project/lassie/pkg/types"
 	logging "github.com/ipfs/go-log/v2"
@@ -85,9 +86,43 @@ type EventDetailsError struct {
 	Error string `json:"error"`
 }
 
+// EventDetailsRetry is for the EventDetails in the case of a retrieval being
+// attempted again
+type EventDetailsRetry struct {
+	Attempt int    `json:"attempt"`
+	Delay   uint64 `json:"delayMs"`
+	Reason  string `json:"reason"`
+}
+
+// EventDetailsQueryRejected is for the EventDetails in the case of a query
+// response being filtered out
+type EventDetailsQueryRejected struct {
+	retrievalmarket.QueryResponse
+	Reason string `json:"reason"`
+}
+
 type EventDetailsIndexer struct {
 	CandidateCount uint64   `json:"candidateCount"`
 	Protocols      []string `json:"protocols"`
+	// Sources counts the candidates found through each source, where the
+	// candidates were found through more than one
+	Sources map[string]uint64 `json:"sources,omitempty"`
+}
+
+// candidateSources counts candidates by their source, it is nil if none of
+// the candidates name a source
+func candidateSources(candidates []types.RetrievalCandidate) map[string]uint64 {
+	var sources map[string]uint64
+	for _, candidate := range candidates {
+		if candidate.Source == "" {
+			continue
+		}
+		if sources == nil {
+			sources = make(map[string]uint64)
+		}
+		sources[candidate.Source]++
+	}
+	return sources
 }
 
 func toStrings(protocols []multicodec.Code) []string {
@@ -105,6 +140,12 @@ func (er *EventRecorder) RecordEvent(event types.RetrievalEvent) {
 		return
 	}
 
+	if event.Code() == types.SuspendedCode || event.Code() == types.UnsuspendedCode {
+		// storage provider suspension events are not part of a retrieval's
+		// lifecycle and aren't understood by the event recorder schema
+		return
+	}
+
 	// TODO: We really need to change the schema here to include protocols
 	// For now, we double up the string here, which isn't great
 	// -- there are no peer ids for SPs so you just record the word
@@ -126,9 +167,17 @@ func (er *EventRecorder) RecordEvent(event types.RetrievalEvent) {
 		evt.EventDetails = &EventDetailsIndexer{
 			CandidateCount: uint64(len(ret.Candidates())),
 			Protocols:      toStrings(ret.Protocols()),
+			Sources:        candidateSources(ret.Candidates()),
 		}
 	case events.RetrievalEventConnected:
-	case events.EventWithQueryResponse: // events.RetrievalEventQueryAsked, events.RetrievalEventQueryAskedFiltered:
+	case events.RetrievalEventQueryAskedFiltered:
+		if ret.Rejected() {
+			evt.EventDetails = &EventDetailsQueryRejected{ret.QueryResponse(), ret.Reason()}
+		} else {
+			qr := ret.QueryResponse()
+			evt.EventDetails = &qr
+		}
+	case events.EventWithQueryResponse: // events.RetrievalEventQueryAsked
 		qr := ret.QueryResponse()
 		evt.EventDetails = &qr
 	case events.RetrievalEventProposed:
@@ -136,6 +185,10 @@ func (er *EventRecorder) RecordEvent(event types.RetrievalEvent) {
 	case events.RetrievalEventFirstByte:
 	case events.RetrievalEventFailed:
 		evt.EventDetails = &EventDetailsError{ret.ErrorMessage()}
+	case events.RetrievalEventMisbehaved:
+		evt.EventDetails = &EventDetailsError{ret.Reason()}
+	case events.RetrievalEventRetrying:
+		evt.EventDetails = &EventDetailsRetry{ret.Attempt(), uint64(ret.Delay().Milliseconds()), ret.Reason()}
 	case events.RetrievalEventSuccess:
 		evt.EventDetails = &EventDetailsSuccess{ret.ReceivedSize(), ret.ReceivedCids(), uint64(ret.Duration().Milliseconds())}
 	}
@@ -396,6 +396,33 @@ func TestEventRecorder(t *testing.T) {
 				require.Equal(t, "transport-bitswap", s)
 			},
 		},
+		{
+			name: "CandidatesFound from sources",
+			exec: func(t *testing.T, ctx context.Context, er *eventrecorder.EventRecorder, id types.RetrievalID, etime, ptime time.Time, spid peer.ID) {
+				indexerCandidate := types.NewRetrievalCandidate(spid, testCid1, metadata.Bitswap{})
+				indexerCandidate.Source = "indexer"
+				directCandidate := types.NewRetrievalCandidate(peer.ID("direct-peer"), testCid1, metadata.Bitswap{})
+				directCandidate.Source = "direct"
+				er.RecordEvent(events.CandidatesFound(id, ptime, testCid1, []types.RetrievalCandidate{indexerCandidate, directCandidate}))
+
+				select {
+				case <-ctx.Done():
+					t.Fatal(ctx.Err())
+				case <-receivedChan:
+				}
+
+				eventList := verifyListNode(t, req, "events", 1)
+				event := verifyListElement(t, eventList, 0)
+				detailsNode, err := event.LookupByString("eventDetails")
+				require.NoError(t, err)
+				require.Equal(t, detailsNode.Length(), int64(3))
+				verifyIntNode(t, detailsNode, "candidateCount", 2)
+				sourcesNode, err := detailsNode.LookupByString("sources")
+				require.NoError(t, err)
+				verifyIntNode(t, sourcesNode, "indexer", 1)
+				verifyIntNode(t, sourcesNode, "direct", 1)
+			},
+		},
 	}
 
 	for _, test := range tests {
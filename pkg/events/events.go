@@ -23,6 +23,10 @@ var (
 	_ types.RetrievalEvent = RetrievalEventFirstByte{}
 	_ types.RetrievalEvent = RetrievalEventFailed{}
 	_ types.RetrievalEvent = RetrievalEventSuccess{}
+	_ types.RetrievalEvent = RetrievalEventSuspended{}
+	_ types.RetrievalEvent = RetrievalEventUnsuspended{}
+	_ types.RetrievalEvent = RetrievalEventRetrying{}
+	_ types.RetrievalEvent = RetrievalEventMisbehaved{}
 )
 
 type EventWithCandidates interface {
@@ -120,10 +124,20 @@ func QueryAsked(retrievalId types.RetrievalID, phaseStartTime time.Time, candida
 type RetrievalEventQueryAskedFiltered struct {
 	spBaseEvent
 	queryResponse retrievalmarket.QueryResponse
+	reason        string
 }
 
+// QueryAskedFiltered is emitted for a query response that passes filtering,
+// so the storage provider may be retrieved from
 func QueryAskedFiltered(retrievalId types.RetrievalID, phaseStartTime time.Time, candidate types.RetrievalCandidate, queryResponse retrievalmarket.QueryResponse) RetrievalEventQueryAskedFiltered {
-	return RetrievalEventQueryAskedFiltered{spBaseEvent{baseEvent{time.Now(), retrievalId, phaseStartTime, candidate.RootCid, candidate.Metadata.Protocols()}, candidate.MinerPeer.ID}, queryResponse}
+	return RetrievalEventQueryAskedFiltered{spBaseEvent{baseEvent{time.Now(), retrievalId, phaseStartTime, candidate.RootCid, candidate.Metadata.Protocols()}, candidate.MinerPeer.ID}, queryResponse, ""}
+}
+
+// QueryAskedRejected is emitted for a query response that is filtered out,
+// such as one asking for more than the payment policy allows, with the reason
+// it was not acceptable
+func QueryAskedRejected(retrievalId types.RetrievalID, phaseStartTime time.Time, candidate types.RetrievalCandidate, queryResponse retrievalmarket.QueryResponse, reason string) RetrievalEventQueryAskedFiltered {
+	return RetrievalEventQueryAskedFiltered{spBaseEvent{baseEvent{time.Now(), retrievalId, phaseStartTime, candidate.RootCid, candidate.Metadata.Protocols()}, candidate.MinerPeer.ID}, queryResponse, reason}
 }
 
 type RetrievalEventProposed struct {
@@ -181,6 +195,59 @@ func Success(retrievalId types.RetrievalID, phaseStartTime time.Time, candidate
 	return RetrievalEventSuccess{spBaseEvent{baseEvent{time.Now(), retrievalId, phaseStartTime, candidate.RootCid, candidate.Metadata.Protocols()}, candidate.MinerPeer.ID}, receivedSize, receivedCids, duration, totalPayment}
 }
 
+// RetrievalEventSuspended signals that a storage provider has been suspended
+// and will not be used for retrievals until the suspension ends. Where the
+// suspension was caused by a failure during a retrieval, the RetrievalId and
+// PayloadCid will be those of the retrieval, otherwise they will be empty.
+type RetrievalEventSuspended struct {
+	spBaseEvent
+	duration time.Duration
+	reason   string
+}
+
+func Suspended(retrievalId types.RetrievalID, payloadCid cid.Cid, storageProviderId peer.ID, duration time.Duration, reason string) RetrievalEventSuspended {
+	now := time.Now()
+	return RetrievalEventSuspended{spBaseEvent{baseEvent{now, retrievalId, now, payloadCid, nil}, storageProviderId}, duration, reason}
+}
+
+// RetrievalEventUnsuspended signals that a storage provider's suspension has
+// ended, either by expiring or being lifted manually
+type RetrievalEventUnsuspended struct {
+	spBaseEvent
+	reason string
+}
+
+func Unsuspended(retrievalId types.RetrievalID, payloadCid cid.Cid, storageProviderId peer.ID, reason string) RetrievalEventUnsuspended {
+	now := time.Now()
+	return RetrievalEventUnsuspended{spBaseEvent{baseEvent{now, retrievalId, now, payloadCid, nil}, storageProviderId}, reason}
+}
+
+// RetrievalEventRetrying signals that every candidate in an attempt at a
+// retrieval has failed and that the retrieval will be attempted again, with
+// fresh candidates, once the delay has passed
+type RetrievalEventRetrying struct {
+	baseEvent
+	attempt int
+	delay   time.Duration
+	reason  string
+}
+
+func Retrying(retrievalId types.RetrievalID, phaseStartTime time.Time, payloadCid cid.Cid, attempt int, delay time.Duration, reason string) RetrievalEventRetrying {
+	return RetrievalEventRetrying{baseEvent{time.Now(), retrievalId, phaseStartTime, payloadCid, nil}, attempt, delay, reason}
+}
+
+// RetrievalEventMisbehaved signals that a storage provider sent data that it
+// should not have, such as a block that doesn't match its CID or one that was
+// never requested
+type RetrievalEventMisbehaved struct {
+	spBaseEvent
+	reason string
+}
+
+func Misbehaved(retrievalId types.RetrievalID, phaseStartTime time.Time, candidate types.RetrievalCandidate, reason string) RetrievalEventMisbehaved {
+	return RetrievalEventMisbehaved{spBaseEvent{baseEvent{time.Now(), retrievalId, phaseStartTime, candidate.RootCid, candidate.Metadata.Protocols()}, candidate.MinerPeer.ID}, reason}
+}
+
 func (r RetrievalEventCandidatesFound) Code() types.EventCode { return types.CandidatesFoundCode }
 func (r RetrievalEventCandidatesFound) Phase() types.Phase    { return types.IndexerPhase }
 func (r RetrievalEventCandidatesFound) String() string {
@@ -214,8 +281,15 @@ func (r RetrievalEventQueryAskedFiltered) Phase() types.Phase    { return types.
 func (r RetrievalEventQueryAskedFiltered) QueryResponse() retrievalmarket.QueryResponse {
 	return r.queryResponse
 } // QueryResponse returns the response from a storage provider to a query-ask
+
+// Rejected returns true if the query response was filtered out
+func (r RetrievalEventQueryAskedFiltered) Rejected() bool { return r.reason != "" }
+
+// Reason returns why the query response was filtered out, or an empty string
+// if it was accepted
+func (r RetrievalEventQueryAskedFiltered) Reason() string { return r.reason }
 func (r RetrievalEventQueryAskedFiltered) String() string {
-	return fmt.Sprintf("QueryAskedFiltered<%s, %s, %s, %s, %v, {%d, %d, %s, %d, %d}>", r.eventTime, r.retrievalId, r.payloadCid, r.storageProviderId, r.protocols, r.queryResponse.Status, r.queryResponse.Size, r.queryResponse.MinPricePerByte, r.queryResponse.MaxPaymentInterval, r.queryResponse.MaxPaymentIntervalIncrease)
+	return fmt.Sprintf("QueryAskedFiltered<%s, %s, %s, %s, %v, {%d, %d, %s, %d, %d}, %q>", r.eventTime, r.retrievalId, r.payloadCid, r.storageProviderId, r.protocols, r.queryResponse.Status, r.queryResponse.Size, r.queryResponse.MinPricePerByte, r.queryResponse.MaxPaymentInterval, r.queryResponse.MaxPaymentIntervalIncrease, r.reason)
 }
 func (r RetrievalEventProposed) Code() types.EventCode { return types.ProposedCode }
 func (r RetrievalEventProposed) Phase() types.Phase    { return types.RetrievalPhase }
@@ -256,3 +330,43 @@ func (r RetrievalEventSuccess) ReceivedCids() uint64 { return r.receivedCids }
 func (r RetrievalEventSuccess) String() string {
 	return fmt.Sprintf("SuccessEvent<%s, %s, %s, %s, %v, { %s, %s, %d, %d }>", r.eventTime, r.retrievalId, r.payloadCid, r.storageProviderId, r.protocols, r.duration, r.totalPayment, r.receivedSize, r.receivedCids)
 }
+
+func (r RetrievalEventSuspended) Code() types.EventCode   { return types.SuspendedCode }
+func (r RetrievalEventSuspended) Phase() types.Phase      { return types.RetrievalPhase }
+func (r RetrievalEventSuspended) Duration() time.Duration { return r.duration }
+
+// Reason returns a description of why the storage provider was suspended
+func (r RetrievalEventSuspended) Reason() string { return r.reason }
+func (r RetrievalEventSuspended) String() string {
+	return fmt.Sprintf("SuspendedEvent<%s, %s, %s, %s, %s, %s>", r.eventTime, r.retrievalId, r.payloadCid, r.storageProviderId, r.duration, r.reason)
+}
+func (r RetrievalEventUnsuspended) Code() types.EventCode { return types.UnsuspendedCode }
+func (r RetrievalEventUnsuspended) Phase() types.Phase    { return types.RetrievalPhase }
+
+// Reason returns a description of why the suspension ended
+func (r RetrievalEventUnsuspended) Reason() string { return r.reason }
+func (r RetrievalEventUnsuspended) String() string {
+	return fmt.Sprintf("UnsuspendedEvent<%s, %s, %s, %s, %s>", r.eventTime, r.retrievalId, r.payloadCid, r.storageProviderId, r.reason)
+}
+func (r RetrievalEventRetrying) Code() types.EventCode      { return types.RetryingCode }
+func (r RetrievalEventRetrying) Phase() types.Phase         { return types.RetrievalPhase }
+func (r RetrievalEventRetrying) StorageProviderId() peer.ID { return peer.ID("") }
+func (r RetrievalEventRetrying) Delay() time.Duration       { return r.delay }
+
+// Attempt returns the number of the attempt about to be made, the first retry
+// is attempt 2
+func (r RetrievalEventRetrying) Attempt() int { return r.attempt }
+
+// Reason returns a description of why the previous attempt failed
+func (r RetrievalEventRetrying) Reason() string { return r.reason }
+func (r RetrievalEventRetrying) String() string {
+	return fmt.Sprintf("RetryingEvent<%s, %s, %s, %d, %s, %s>", r.eventTime, r.retrievalId, r.payloadCid, r.attempt, r.delay, r.reason)
+}
+func (r RetrievalEventMisbehaved) Code() types.EventCode { return types.MisbehavedCode }
+func (r RetrievalEventMisbehaved) Phase() types.Phase    { return types.RetrievalPhase }
+
+// Reason returns a description of how the storage provider misbehaved
+func (r RetrievalEventMisbehaved) Reason() string { return r.reason }
+func (r RetrievalEventMisbehaved) String() string {
+	return fmt.Sprintf("MisbehavedEvent<%s, %s, %s, %s, %v, %s>", r.eventTime, r.retrievalId, r.payloadCid, r.storageProviderId, r.protocols, r.reason)
+}
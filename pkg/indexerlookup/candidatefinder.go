@@ -27,8 +27,13 @@ var (
 	logger = log.Logger("indexerlookup")
 )
 
+// IndexerCandidateFinder finds candidates through one or more indexers. With
+// more than one endpoint, lookups are sent according to the EndpointStrategy,
+// and an endpoint failing a lookup is skipped by later lookups until its
+// cool-down has passed.
 type IndexerCandidateFinder struct {
 	*options
+	health *endpointHealth
 }
 
 func NewCandidateFinder(o ...Option) (*IndexerCandidateFinder, error) {
@@ -38,6 +43,7 @@ func NewCandidateFinder(o ...Option) (*IndexerCandidateFinder, error) {
 	}
 	return &IndexerCandidateFinder{
 		options: opts,
+		health:  newEndpointHealth(opts.endpointCooldown),
 	}, nil
 }
 
@@ -66,8 +72,14 @@ func (idxf *IndexerCandidateFinder) sendJsonRequest(req *http.Request) (*model.F
 	}
 }
 
-func (idxf *IndexerCandidateFinder) FindCandidates(ctx context.Context, cid cid.Cid) ([]types.RetrievalCandidate, error) {
-	req, err := idxf.newFindHttpRequest(ctx, cid)
+// findCandidatesAt looks up a single endpoint
+func (idxf *IndexerCandidateFinder) findCandidatesAt(ctx context.Context, endpoint Endpoint, cid cid.Cid) ([]types.RetrievalCandidate, error) {
+	if idxf.readerPrivacy {
+		return idxf.findCandidatesPrivatelyAt(ctx, endpoint, cid)
+	}
+	ctx, cancel := endpointContext(ctx, endpoint)
+	defer cancel()
+	req, err := idxf.newFindHttpRequest(ctx, endpoint, cid)
 	if err != nil {
 		return nil, err
 	}
@@ -105,7 +117,7 @@ func decodeMetadata(pr model.ProviderResult) (metadata.Metadata, error) {
 	// Metadata may contain more than one protocol, sorted by ascending order of their protocol ID.
 	// Therefore, decode the metadata as metadata.Metadata, then check if it supports Graphsync.
 	// See: https://github.com/ipni/specs/blob/main/IPNI.md#metadata
-	dtm := metadata.Default.New()
+	dtm := types.MetadataContext.New()
 	if err := dtm.UnmarshalBinary(pr.Metadata); err != nil {
 		logger.Debugw("Failed to unmarshal metadata", "err", err)
 		return metadata.Metadata{}, err
@@ -113,31 +125,43 @@ func decodeMetadata(pr model.ProviderResult) (metadata.Metadata, error) {
 	return dtm, nil
 }
 
-func (idxf *IndexerCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
-	req, err := idxf.newFindHttpRequest(ctx, c)
+// findCandidatesAsyncAt streams a lookup of a single endpoint
+func (idxf *IndexerCandidateFinder) findCandidatesAsyncAt(ctx context.Context, endpoint Endpoint, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	if idxf.readerPrivacy {
+		return idxf.findCandidatesPrivatelyAsyncAt(ctx, endpoint, c)
+	}
+	ctx, cancel := endpointContext(ctx, endpoint)
+	req, err := idxf.newFindHttpRequest(ctx, endpoint, c)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/x-ndjson")
 	logger.Debugw("sending outgoing request", "url", req.URL, "accept", req.Header.Get("Accept"))
 	resp, err := idxf.httpClient.Do(req)
 	if err != nil {
+		cancel()
 		logger.Debugw("Failed to perform streaming lookup", "err", err)
 		return nil, err
 	}
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return idxf.decodeProviderResultStream(ctx, c, resp.Body)
+		return idxf.decodeProviderResultStream(ctx, c, resp.Body, cancel)
 	case http.StatusNotFound:
-		return nil, nil
+		resp.Body.Close()
+		cancel()
+		rch := make(chan types.FindCandidatesResult)
+		close(rch)
+		return rch, nil
 	default:
+		resp.Body.Close()
+		cancel()
 		return nil, fmt.Errorf("batch find query failed: %v", http.StatusText(resp.StatusCode))
 	}
 }
 
-func (idxf *IndexerCandidateFinder) newFindHttpRequest(ctx context.Context, c cid.Cid) (*http.Request, error) {
-	endpoint := idxf.findByMultihashEndpoint(c.Hash())
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+func (idxf *IndexerCandidateFinder) newFindHttpRequest(ctx context.Context, endpoint Endpoint, c cid.Cid) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, idxf.findByMultihashEndpoint(endpoint, c.Hash()), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -152,10 +176,11 @@ func (idxf *IndexerCandidateFinder) newFindHttpRequest(ctx context.Context, c ci
 	return req, nil
 }
 
-func (idxf *IndexerCandidateFinder) decodeProviderResultStream(ctx context.Context, c cid.Cid, from io.ReadCloser) (<-chan types.FindCandidatesResult, error) {
+func (idxf *IndexerCandidateFinder) decodeProviderResultStream(ctx context.Context, c cid.Cid, from io.ReadCloser, done context.CancelFunc) (<-chan types.FindCandidatesResult, error) {
 	rch := make(chan types.FindCandidatesResult, idxf.asyncResultsChanBuffer)
 	go func() {
 		defer close(rch)
+		defer done()
 		defer from.Close()
 		scanner := bufio.NewScanner(from)
 		for {
@@ -196,8 +221,8 @@ func (idxf *IndexerCandidateFinder) decodeProviderResultStream(ctx context.Conte
 	return rch, nil
 }
 
-func (idxf *IndexerCandidateFinder) findByMultihashEndpoint(mh multihash.Multihash) string {
+func (idxf *IndexerCandidateFinder) findByMultihashEndpoint(endpoint Endpoint, mh multihash.Multihash) string {
 	// TODO: Replace with URL.JoinPath once minimum go version in CI is updated to 1.19; like this:
-	//       return idxf.httpEndpoint.JoinPath("multihash", mh.B58String()).String()
-	return idxf.httpEndpoint.String() + path.Join("/multihash", mh.B58String())
+	//       return endpoint.URL.JoinPath("multihash", mh.B58String()).String()
+	return endpoint.URL.String() + path.Join("/multihash", mh.B58String())
 }
@@ -0,0 +1,231 @@
+package indexerlookup_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/indexerlookup"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/ipni/storetheindex/api/v0/finder/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	lp2ptest "github.com/libp2p/go-libp2p/core/test"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIndexer serves the providers of a CID over both the JSON and NDJSON
+// find APIs, after its delay, or fails every lookup with its status
+type fakeIndexer struct {
+	*httptest.Server
+	lookups atomic.Int32
+}
+
+func newFakeIndexer(t *testing.T, c cid.Cid, providers []peer.ID, delay time.Duration, status int) *fakeIndexer {
+	bitswap := types.MetadataContext.New(&metadata.Bitswap{})
+	md, err := bitswap.MarshalBinary()
+	require.NoError(t, err)
+	results := make([]model.ProviderResult, 0, len(providers))
+	for _, p := range providers {
+		results = append(results, model.ProviderResult{
+			ContextID: []byte("context"),
+			Metadata:  md,
+			Provider:  peer.AddrInfo{ID: p},
+		})
+	}
+	fi := &fakeIndexer{}
+	fi.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fi.lookups.Add(1)
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if r.URL.Path != "/multihash/"+c.Hash().B58String() {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Accept") == "application/x-ndjson" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			encoder := json.NewEncoder(w)
+			for _, result := range results {
+				require.NoError(t, encoder.Encode(result))
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		body, err := model.MarshalFindResponse(&model.FindResponse{
+			MultihashResults: []model.MultihashResult{{Multihash: c.Hash(), ProviderResults: results}},
+		})
+		require.NoError(t, err)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(fi.Close)
+	return fi
+}
+
+func (fi *fakeIndexer) endpoint(t *testing.T, timeout time.Duration) indexerlookup.Endpoint {
+	u, err := url.Parse(fi.URL)
+	require.NoError(t, err)
+	return indexerlookup.Endpoint{URL: u, Timeout: timeout}
+}
+
+func peersOf(t *testing.T, finder *indexerlookup.IndexerCandidateFinder, ctx context.Context, c cid.Cid, async bool) ([]peer.ID, error) {
+	var candidates []types.RetrievalCandidate
+	if async {
+		results, err := finder.FindCandidatesAsync(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		for result := range results {
+			if result.Err != nil {
+				return nil, result.Err
+			}
+			candidates = append(candidates, result.Candidate)
+		}
+	} else {
+		var err error
+		if candidates, err = finder.FindCandidates(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]peer.ID, 0, len(candidates))
+	for _, candidate := range candidates {
+		require.Equal(t, c, candidate.RootCid)
+		ids = append(ids, candidate.MinerPeer.ID)
+	}
+	return ids, nil
+}
+
+func TestIndexerCandidateFinderEndpoints(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	root := testutil.GenerateCids(1)[0]
+	peers := make([]peer.ID, 3)
+	for i := range peers {
+		peers[i] = lp2ptest.RandPeerIDFatal(t)
+	}
+
+	for _, async := range []bool{false, true} {
+		async := async
+		name := "FindCandidates"
+		if async {
+			name = "FindCandidatesAsync"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Run("failover skips a failing endpoint while it cools down", func(t *testing.T) {
+				req := require.New(t)
+				failing := newFakeIndexer(t, root, nil, 0, http.StatusInternalServerError)
+				healthy := newFakeIndexer(t, root, peers[:2], 0, http.StatusOK)
+				finder, err := indexerlookup.NewCandidateFinder(
+					indexerlookup.WithHttpEndpoints(failing.endpoint(t, 0), healthy.endpoint(t, 0)),
+				)
+				req.NoError(err)
+				for i := 0; i < 2; i++ {
+					found, err := peersOf(t, finder, ctx, root, async)
+					req.NoError(err)
+					req.Equal(peers[:2], found)
+				}
+				req.Equal(int32(1), failing.lookups.Load())
+				req.Equal(int32(2), healthy.lookups.Load())
+			})
+
+			t.Run("failover tries again once the cool-down has passed", func(t *testing.T) {
+				req := require.New(t)
+				failing := newFakeIndexer(t, root, nil, 0, http.StatusInternalServerError)
+				healthy := newFakeIndexer(t, root, peers[:2], 0, http.StatusOK)
+				finder, err := indexerlookup.NewCandidateFinder(
+					indexerlookup.WithHttpEndpoints(failing.endpoint(t, 0), healthy.endpoint(t, 0)),
+					indexerlookup.WithEndpointCooldown(time.Nanosecond),
+				)
+				req.NoError(err)
+				for i := 0; i < 2; i++ {
+					_, err := peersOf(t, finder, ctx, root, async)
+					req.NoError(err)
+				}
+				req.Equal(int32(2), failing.lookups.Load())
+			})
+
+			t.Run("endpoint timeout fails over", func(t *testing.T) {
+				req := require.New(t)
+				slow := newFakeIndexer(t, root, peers[:1], time.Second, http.StatusOK)
+				healthy := newFakeIndexer(t, root, peers[1:2], 0, http.StatusOK)
+				finder, err := indexerlookup.NewCandidateFinder(
+					indexerlookup.WithHttpEndpoints(slow.endpoint(t, 50*time.Millisecond), healthy.endpoint(t, 0)),
+				)
+				req.NoError(err)
+				found, err := peersOf(t, finder, ctx, root, async)
+				req.NoError(err)
+				req.Equal(peers[1:2], found)
+			})
+
+			t.Run("merge dedupes providers", func(t *testing.T) {
+				req := require.New(t)
+				first := newFakeIndexer(t, root, peers[:2], 0, http.StatusOK)
+				second := newFakeIndexer(t, root, peers[1:], 0, http.StatusOK)
+				failing := newFakeIndexer(t, root, nil, 0, http.StatusInternalServerError)
+				finder, err := indexerlookup.NewCandidateFinder(
+					indexerlookup.WithHttpEndpoints(first.endpoint(t, 0), second.endpoint(t, 0), failing.endpoint(t, 0)),
+					indexerlookup.WithEndpointStrategy(indexerlookup.EndpointStrategyMerge),
+				)
+				req.NoError(err)
+				found, err := peersOf(t, finder, ctx, root, async)
+				req.NoError(err)
+				req.ElementsMatch(peers, found)
+			})
+
+			t.Run("fastest takes the first to find candidates", func(t *testing.T) {
+				req := require.New(t)
+				slow := newFakeIndexer(t, root, peers[:1], time.Second, http.StatusOK)
+				empty := newFakeIndexer(t, root, nil, 0, http.StatusOK)
+				fast := newFakeIndexer(t, root, peers[1:], 20*time.Millisecond, http.StatusOK)
+				finder, err := indexerlookup.NewCandidateFinder(
+					indexerlookup.WithHttpEndpoints(slow.endpoint(t, 0), empty.endpoint(t, 0), fast.endpoint(t, 0)),
+					indexerlookup.WithEndpointStrategy(indexerlookup.EndpointStrategyFastest),
+				)
+				req.NoError(err)
+				start := time.Now()
+				found, err := peersOf(t, finder, ctx, root, async)
+				req.NoError(err)
+				req.Equal(peers[1:], found)
+				req.Less(time.Since(start), time.Second)
+			})
+
+			t.Run("every endpoint failing", func(t *testing.T) {
+				req := require.New(t)
+				first := newFakeIndexer(t, root, nil, 0, http.StatusInternalServerError)
+				second := newFakeIndexer(t, root, nil, 0, http.StatusServiceUnavailable)
+				for _, strategy := range []indexerlookup.EndpointStrategy{indexerlookup.EndpointStrategyFailover, indexerlookup.EndpointStrategyMerge, indexerlookup.EndpointStrategyFastest} {
+					finder, err := indexerlookup.NewCandidateFinder(
+						indexerlookup.WithHttpEndpoints(first.endpoint(t, 0), second.endpoint(t, 0)),
+						indexerlookup.WithEndpointStrategy(strategy),
+					)
+					req.NoError(err)
+					_, err = peersOf(t, finder, ctx, root, async)
+					req.ErrorContains(err, first.URL)
+					req.ErrorContains(err, second.URL)
+				}
+			})
+		})
+	}
+}
+
+func TestParseEndpointStrategy(t *testing.T) {
+	strategy, err := indexerlookup.ParseEndpointStrategy("merge")
+	require.NoError(t, err)
+	require.Equal(t, indexerlookup.EndpointStrategyMerge, strategy)
+	_, err = indexerlookup.ParseEndpointStrategy("random")
+	require.Error(t, err)
+}
@@ -0,0 +1,273 @@
+package indexerlookup
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/storetheindex/api/v0/finder/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	b58 "github.com/mr-tron/base58/base58"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+// Reader privacy lookups follow the double hashing of the IPNI spec: the
+// indexer is asked for the second hash of a multihash, and answers with the
+// value keys of its providers encrypted by the multihash itself, so that it
+// never learns what is being looked up. Each value key is the provider ID and
+// context ID of a record, whose metadata is fetched encrypted by the value key.
+
+// nonceLen is the length of the AES-GCM nonce that encrypted payloads begin with
+const nonceLen = 12
+
+var (
+	secondHashPrefix = []byte("CR_DOUBLEHASH\x00")
+	deriveKeyPrefix  = []byte("CR_ENCRYPTIONKEY\x00")
+)
+
+// getMetadataResponse is the encrypted metadata of a value key
+type getMetadataResponse struct {
+	EncryptedMetadata []byte `json:"EncryptedMetadata"`
+}
+
+func sha256Of(prefix []byte, payload []byte) []byte {
+	h := sha256.New()
+	h.Write(prefix)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// secondMultihash is the hash of a multihash that is looked up in its place
+func secondMultihash(mh multihash.Multihash) (multihash.Multihash, error) {
+	return multihash.Encode(sha256Of(secondHashPrefix, mh), multihash.DBL_SHA2_256)
+}
+
+// decryptAES decrypts a payload prefixed with its nonce, with a key derived
+// from the passphrase
+func decryptAES(payload []byte, passphrase []byte) ([]byte, error) {
+	if len(payload) < nonceLen {
+		return nil, errors.New("encrypted payload is shorter than its nonce")
+	}
+	block, err := aes.NewCipher(sha256Of(deriveKeyPrefix, passphrase))
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aesgcm.Open(nil, payload[:nonceLen], payload[nonceLen:], nil)
+}
+
+// splitValueKey splits a value key into the provider ID and context ID it
+// joins, each prefixed by its varint length
+func splitValueKey(valueKey []byte) (peer.ID, []byte, error) {
+	pidLen, read, err := varint.FromUvarint(valueKey)
+	if err != nil {
+		return "", nil, err
+	}
+	valueKey = valueKey[read:]
+	if uint64(len(valueKey)) < pidLen {
+		return "", nil, errors.New("value key is shorter than its provider ID")
+	}
+	pid, err := peer.IDFromBytes(valueKey[:pidLen])
+	if err != nil {
+		return "", nil, err
+	}
+	valueKey = valueKey[pidLen:]
+	ctxIdLen, read, err := varint.FromUvarint(valueKey)
+	if err != nil {
+		return "", nil, err
+	}
+	valueKey = valueKey[read:]
+	if uint64(len(valueKey)) != ctxIdLen {
+		return "", nil, errors.New("value key context ID has the wrong length")
+	}
+	return pid, valueKey, nil
+}
+
+// privateLookup is a reader privacy lookup of a single endpoint, which fetches
+// the provider record of each provider found once
+type privateLookup struct {
+	idxf      *IndexerCandidateFinder
+	endpoint  Endpoint
+	c         cid.Cid
+	providers map[peer.ID]peer.AddrInfo
+}
+
+func (idxf *IndexerCandidateFinder) newPrivateLookup(endpoint Endpoint, c cid.Cid) *privateLookup {
+	return &privateLookup{idxf: idxf, endpoint: endpoint, c: c, providers: make(map[peer.ID]peer.AddrInfo)}
+}
+
+func (pl *privateLookup) get(ctx context.Context, elem ...string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pl.endpoint.URL.String()+path.Join(append([]string{"/"}, elem...)...), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if pl.idxf.httpUserAgent != "" {
+		req.Header.Set("User-Agent", pl.idxf.httpUserAgent)
+	}
+	logger.Debugw("sending outgoing request", "url", req.URL, "accept", req.Header.Get("Accept"))
+	resp, err := pl.idxf.httpClient.Do(req)
+	if err != nil {
+		logger.Debugw("Failed to perform reader privacy lookup", "err", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s query failed: %s", elem[0], http.StatusText(resp.StatusCode))
+	}
+}
+
+// findEncryptedValueKeys looks up the second hash of the CID's multihash
+func (pl *privateLookup) findEncryptedValueKeys(ctx context.Context) ([][]byte, error) {
+	smh, err := secondMultihash(pl.c.Hash())
+	if err != nil {
+		return nil, err
+	}
+	body, err := pl.get(ctx, "multihash", smh.B58String())
+	if err != nil || body == nil {
+		return nil, err
+	}
+	parsedResp, err := model.UnmarshalFindResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	var encValueKeys [][]byte
+	for _, result := range parsedResp.EncryptedMultihashResults {
+		if string(result.Multihash) == string(smh) {
+			encValueKeys = append(encValueKeys, result.EncryptedValueKeys...)
+		}
+	}
+	return encValueKeys, nil
+}
+
+// candidate decrypts an encrypted value key, fetching the metadata and provider
+// record it refers to, and returns the candidate they describe
+func (pl *privateLookup) candidate(ctx context.Context, encValueKey []byte) (types.RetrievalCandidate, error) {
+	valueKey, err := decryptAES(encValueKey, pl.c.Hash())
+	if err != nil {
+		return types.RetrievalCandidate{}, err
+	}
+	pid, contextID, err := splitValueKey(valueKey)
+	if err != nil {
+		return types.RetrievalCandidate{}, err
+	}
+
+	body, err := pl.get(ctx, "metadata", b58.Encode(sha256Of(nil, valueKey)))
+	if err != nil {
+		return types.RetrievalCandidate{}, err
+	}
+	if body == nil {
+		return types.RetrievalCandidate{}, errors.New("no metadata")
+	}
+	var mdResp getMetadataResponse
+	if err := json.Unmarshal(body, &mdResp); err != nil {
+		return types.RetrievalCandidate{}, err
+	}
+	md, err := decryptAES(mdResp.EncryptedMetadata, valueKey)
+	if err != nil {
+		return types.RetrievalCandidate{}, err
+	}
+
+	provider, ok := pl.providers[pid]
+	if !ok {
+		body, err := pl.get(ctx, "providers", pid.String())
+		if err != nil {
+			return types.RetrievalCandidate{}, err
+		}
+		if body == nil {
+			return types.RetrievalCandidate{}, errors.New("no provider record")
+		}
+		var info model.ProviderInfo
+		if err := json.Unmarshal(body, &info); err != nil {
+			return types.RetrievalCandidate{}, err
+		}
+		provider = info.AddrInfo
+		pl.providers[pid] = provider
+	}
+
+	decoded, err := decodeMetadata(model.ProviderResult{ContextID: contextID, Metadata: md, Provider: provider})
+	if err != nil {
+		return types.RetrievalCandidate{}, err
+	}
+	return types.RetrievalCandidate{RootCid: pl.c, MinerPeer: provider, Metadata: decoded}, nil
+}
+
+// findCandidatesPrivatelyAt looks up a single endpoint with reader privacy
+func (idxf *IndexerCandidateFinder) findCandidatesPrivatelyAt(ctx context.Context, endpoint Endpoint, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	ctx, cancel := endpointContext(ctx, endpoint)
+	defer cancel()
+	pl := idxf.newPrivateLookup(endpoint, c)
+	encValueKeys, err := pl.findEncryptedValueKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matches []types.RetrievalCandidate
+	for _, encValueKey := range encValueKeys {
+		candidate, err := pl.candidate(ctx, encValueKey)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			// skip records that can't be resolved, as unreadable metadata is
+			logger.Debugw("Failed to resolve encrypted value key", "cid", c, "err", err)
+			continue
+		}
+		matches = append(matches, candidate)
+	}
+	return matches, nil
+}
+
+// findCandidatesPrivatelyAsyncAt streams a reader privacy lookup of a single
+// endpoint, sending candidates as their records are fetched
+func (idxf *IndexerCandidateFinder) findCandidatesPrivatelyAsyncAt(ctx context.Context, endpoint Endpoint, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	ctx, cancel := endpointContext(ctx, endpoint)
+	pl := idxf.newPrivateLookup(endpoint, c)
+	encValueKeys, err := pl.findEncryptedValueKeys(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	rch := make(chan types.FindCandidatesResult, idxf.asyncResultsChanBuffer)
+	go func() {
+		defer close(rch)
+		defer cancel()
+		for _, encValueKey := range encValueKeys {
+			candidate, err := pl.candidate(ctx, encValueKey)
+			if err != nil {
+				if ctx.Err() != nil {
+					select {
+					case <-ctx.Done():
+					case rch <- types.FindCandidatesResult{Err: ctx.Err()}:
+					}
+					return
+				}
+				logger.Debugw("Failed to resolve encrypted value key", "cid", c, "err", err)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case rch <- types.FindCandidatesResult{Candidate: candidate}:
+			}
+		}
+	}()
+	return rch, nil
+}
@@ -0,0 +1,151 @@
+package indexerlookup_test
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/indexerlookup"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/ipni/storetheindex/api/v0/finder/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	lp2ptest "github.com/libp2p/go-libp2p/core/test"
+	b58 "github.com/mr-tron/base58/base58"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+	"github.com/stretchr/testify/require"
+)
+
+func prefixedSha256(prefix string, payload []byte) []byte {
+	digest := sha256.Sum256(append([]byte(prefix), payload...))
+	return digest[:]
+}
+
+// encryptAES encrypts the way an IPNI double hashed store does, prefixing the
+// payload with its nonce
+func encryptAES(t *testing.T, payload []byte, passphrase []byte) []byte {
+	block, err := aes.NewCipher(prefixedSha256("CR_ENCRYPTIONKEY\x00", passphrase))
+	require.NoError(t, err)
+	aesgcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	nonce := make([]byte, aesgcm.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+	return aesgcm.Seal(nonce, nonce, payload, nil)
+}
+
+func valueKey(pid peer.ID, contextID []byte) []byte {
+	vk := varint.ToUvarint(uint64(len(pid)))
+	vk = append(vk, pid...)
+	vk = append(vk, varint.ToUvarint(uint64(len(contextID)))...)
+	return append(vk, contextID...)
+}
+
+// fakeDhashIndexer serves the encrypted records of a double hashed store
+type fakeDhashIndexer struct {
+	*httptest.Server
+	lk    sync.Mutex
+	paths []string
+}
+
+func newFakeDhashIndexer(t *testing.T, c cid.Cid, providers []peer.AddrInfo) *fakeDhashIndexer {
+	bitswap := types.MetadataContext.New(&metadata.Bitswap{})
+	md, err := bitswap.MarshalBinary()
+	require.NoError(t, err)
+
+	digest := prefixedSha256("CR_DOUBLEHASH\x00", c.Hash())
+	smh, err := multihash.Encode(digest, multihash.DBL_SHA2_256)
+	require.NoError(t, err)
+	responses := make(map[string]interface{})
+	var encValueKeys [][]byte
+	for i, provider := range providers {
+		vk := valueKey(provider.ID, []byte("context"))
+		encValueKeys = append(encValueKeys, encryptAES(t, vk, c.Hash()))
+		responses["/providers/"+provider.ID.String()] = model.ProviderInfo{AddrInfo: provider}
+		// the metadata of the last provider is missing
+		if i < len(providers)-1 {
+			responses["/metadata/"+b58.Encode(prefixedSha256("", vk))] = map[string][]byte{"EncryptedMetadata": encryptAES(t, md, vk)}
+		}
+	}
+	responses["/multihash/"+b58.Encode(smh)] = model.FindResponse{
+		EncryptedMultihashResults: []model.EncryptedMultihashResult{{Multihash: smh, EncryptedValueKeys: encValueKeys}},
+	}
+
+	fi := &fakeDhashIndexer{}
+	fi.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fi.lk.Lock()
+		fi.paths = append(fi.paths, r.URL.String())
+		fi.lk.Unlock()
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(response))
+	}))
+	t.Cleanup(fi.Close)
+	return fi
+}
+
+func TestIndexerCandidateFinderReaderPrivacy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cids := testutil.GenerateCids(2)
+	providers := make([]peer.AddrInfo, 3)
+	for i := range providers {
+		providers[i] = peer.AddrInfo{
+			ID:    lp2ptest.RandPeerIDFatal(t),
+			Addrs: []multiaddr.Multiaddr{multiaddr.StringCast("/ip4/127.0.0.1/tcp/1234")},
+		}
+	}
+	indexer := newFakeDhashIndexer(t, cids[0], providers)
+	endpoint, err := url.Parse(indexer.URL)
+	require.NoError(t, err)
+	finder, err := indexerlookup.NewCandidateFinder(
+		indexerlookup.WithHttpEndpoint(endpoint),
+		indexerlookup.WithReaderPrivacy(true),
+	)
+	require.NoError(t, err)
+
+	for _, async := range []bool{false, true} {
+		found, err := peersOf(t, finder, ctx, cids[0], async)
+		require.NoError(t, err)
+		// the provider without metadata is skipped
+		require.Equal(t, []peer.ID{providers[0].ID, providers[1].ID}, found)
+
+		found, err = peersOf(t, finder, ctx, cids[1], async)
+		require.NoError(t, err)
+		require.Empty(t, found)
+	}
+
+	candidates, err := finder.FindCandidates(ctx, cids[0])
+	require.NoError(t, err)
+	require.Equal(t, providers[0], candidates[0].MinerPeer)
+	require.Equal(t, types.MetadataContext.New(&metadata.Bitswap{}), candidates[0].Metadata)
+
+	// the indexer never learns what was looked up
+	indexer.lk.Lock()
+	defer indexer.lk.Unlock()
+	require.NotEmpty(t, indexer.paths)
+	for _, path := range indexer.paths {
+		for _, c := range cids {
+			require.NotContains(t, path, c.Hash().B58String())
+		}
+		require.NotContains(t, path, "cascade")
+	}
+}
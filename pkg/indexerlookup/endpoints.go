@@ -0,0 +1,309 @@
+package indexerlookup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/multierr"
+)
+
+// endpointHealth tracks the endpoints that have failed lookups, which are
+// cooling down until they may be looked up again
+type endpointHealth struct {
+	lk           sync.Mutex
+	cooldown     time.Duration
+	coolingUntil map[string]time.Time
+}
+
+func newEndpointHealth(cooldown time.Duration) *endpointHealth {
+	return &endpointHealth{cooldown: cooldown, coolingUntil: make(map[string]time.Time)}
+}
+
+// available returns the endpoints that aren't cooling down, in order, or all
+// of them if every one is
+func (eh *endpointHealth) available(endpoints []Endpoint) []Endpoint {
+	eh.lk.Lock()
+	defer eh.lk.Unlock()
+	now := time.Now()
+	available := make([]Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if until, ok := eh.coolingUntil[endpoint.URL.String()]; ok && now.Before(until) {
+			continue
+		}
+		available = append(available, endpoint)
+	}
+	if len(available) == 0 {
+		return endpoints
+	}
+	return available
+}
+
+func (eh *endpointHealth) failed(endpoint Endpoint, err error) {
+	logger.Debugw("Indexer endpoint failed lookup, cooling down", "endpoint", endpoint.URL, "cooldown", eh.cooldown, "err", err)
+	eh.lk.Lock()
+	defer eh.lk.Unlock()
+	eh.coolingUntil[endpoint.URL.String()] = time.Now().Add(eh.cooldown)
+}
+
+func (eh *endpointHealth) succeeded(endpoint Endpoint) {
+	eh.lk.Lock()
+	defer eh.lk.Unlock()
+	delete(eh.coolingUntil, endpoint.URL.String())
+}
+
+func endpointContext(ctx context.Context, endpoint Endpoint) (context.Context, context.CancelFunc) {
+	if endpoint.Timeout > 0 {
+		return context.WithTimeout(ctx, endpoint.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func endpointError(endpoint Endpoint, err error) error {
+	return fmt.Errorf("%s: %w", endpoint.URL, err)
+}
+
+// mergeCandidates adds candidates to those merged so far, skipping providers
+// that have already been found
+func mergeCandidates(merged []types.RetrievalCandidate, seen map[peer.ID]struct{}, candidates []types.RetrievalCandidate) []types.RetrievalCandidate {
+	for _, candidate := range candidates {
+		if _, ok := seen[candidate.MinerPeer.ID]; ok {
+			continue
+		}
+		seen[candidate.MinerPeer.ID] = struct{}{}
+		merged = append(merged, candidate)
+	}
+	return merged
+}
+
+func (idxf *IndexerCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	endpoints := idxf.health.available(idxf.httpEndpoints)
+	if len(endpoints) == 1 || idxf.endpointStrategy == EndpointStrategyFailover {
+		var errs error
+		for _, endpoint := range endpoints {
+			candidates, err := idxf.findCandidatesAt(ctx, endpoint, c)
+			if err == nil {
+				idxf.health.succeeded(endpoint)
+				return candidates, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			idxf.health.failed(endpoint, err)
+			errs = multierr.Append(errs, endpointError(endpoint, err))
+		}
+		return nil, errs
+	}
+
+	// look up every endpoint at once, the fastest to find candidates stops
+	// the others when that's all we want
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	found := make([][]types.RetrievalCandidate, len(endpoints))
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	var fastest sync.Once
+	winner := -1
+	for i, endpoint := range endpoints {
+		i, endpoint := i, endpoint
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			candidates, err := idxf.findCandidatesAt(ctx, endpoint, c)
+			if err != nil {
+				if ctx.Err() == nil {
+					idxf.health.failed(endpoint, err)
+				}
+				errs[i] = endpointError(endpoint, err)
+				return
+			}
+			idxf.health.succeeded(endpoint)
+			found[i] = candidates
+			if idxf.endpointStrategy == EndpointStrategyFastest && len(candidates) > 0 {
+				fastest.Do(func() {
+					winner = i
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if winner >= 0 {
+		return found[winner], nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var merged []types.RetrievalCandidate
+	seen := make(map[peer.ID]struct{})
+	var failures error
+	for i := range endpoints {
+		if errs[i] != nil {
+			failures = multierr.Append(failures, errs[i])
+			continue
+		}
+		merged = mergeCandidates(merged, seen, found[i])
+	}
+	if len(multierr.Errors(failures)) == len(endpoints) {
+		return nil, failures
+	}
+	return merged, nil
+}
+
+func (idxf *IndexerCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	endpoints := idxf.health.available(idxf.httpEndpoints)
+	if len(endpoints) == 1 || idxf.endpointStrategy == EndpointStrategyFailover {
+		var errs error
+		for _, endpoint := range endpoints {
+			results, err := idxf.findCandidatesAsyncAt(ctx, endpoint, c)
+			if err == nil {
+				return idxf.trackStream(ctx, endpoint, results), nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			idxf.health.failed(endpoint, err)
+			errs = multierr.Append(errs, endpointError(endpoint, err))
+		}
+		return nil, errs
+	}
+	return idxf.findCandidatesAsyncAll(ctx, endpoints, c)
+}
+
+// trackStream passes on the results streamed from an endpoint, recording the
+// health of the endpoint once the stream ends
+func (idxf *IndexerCandidateFinder) trackStream(ctx context.Context, endpoint Endpoint, results <-chan types.FindCandidatesResult) <-chan types.FindCandidatesResult {
+	tracked := make(chan types.FindCandidatesResult, idxf.asyncResultsChanBuffer)
+	go func() {
+		defer close(tracked)
+		var err error
+		for result := range results {
+			if result.Err != nil {
+				err = result.Err
+			}
+			select {
+			case <-ctx.Done():
+			case tracked <- result:
+			}
+		}
+		switch {
+		case ctx.Err() != nil:
+		case err != nil:
+			idxf.health.failed(endpoint, err)
+		default:
+			idxf.health.succeeded(endpoint)
+		}
+	}()
+	return tracked
+}
+
+type endpointResult struct {
+	index  int
+	result types.FindCandidatesResult
+}
+
+// findCandidatesAsyncAll streams lookups of all of the endpoints at once,
+// either merging them or passing on the first to find candidates alone
+func (idxf *IndexerCandidateFinder) findCandidatesAsyncAll(ctx context.Context, endpoints []Endpoint, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	cancels := make([]context.CancelFunc, len(endpoints))
+	fanIn := make(chan endpointResult)
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		lookupCtx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		wg.Add(1)
+		go func(i int, endpoint Endpoint, lookupCtx context.Context) {
+			defer wg.Done()
+			forward := func(result types.FindCandidatesResult) {
+				select {
+				case <-lookupCtx.Done():
+				case fanIn <- endpointResult{i, result}:
+				}
+			}
+			results, err := idxf.findCandidatesAsyncAt(lookupCtx, endpoint, c)
+			if err != nil {
+				if lookupCtx.Err() == nil {
+					idxf.health.failed(endpoint, err)
+					forward(types.FindCandidatesResult{Err: endpointError(endpoint, err)})
+				}
+				return
+			}
+			// read the stream to its end so that it's closed, even when the
+			// endpoint has lost the race and been cancelled
+			for result := range results {
+				if lookupCtx.Err() != nil {
+					continue
+				}
+				if result.Err != nil {
+					err = result.Err
+					result.Err = endpointError(endpoint, result.Err)
+				}
+				forward(result)
+			}
+			switch {
+			case lookupCtx.Err() != nil:
+			case err != nil:
+				idxf.health.failed(endpoint, err)
+			default:
+				idxf.health.succeeded(endpoint)
+			}
+		}(i, endpoint, lookupCtx)
+	}
+	go func() {
+		wg.Wait()
+		close(fanIn)
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	rch := make(chan types.FindCandidatesResult, idxf.asyncResultsChanBuffer)
+	go func() {
+		defer close(rch)
+		winner := -1
+		seen := make(map[peer.ID]struct{})
+		var failures error
+		var sent int
+		for next := range fanIn {
+			if next.result.Err != nil {
+				failures = multierr.Append(failures, next.result.Err)
+				continue
+			}
+			if idxf.endpointStrategy == EndpointStrategyFastest {
+				if winner < 0 {
+					winner = next.index
+					for i, cancel := range cancels {
+						if i != winner {
+							cancel()
+						}
+					}
+				}
+				if next.index != winner {
+					continue
+				}
+			}
+			if _, ok := seen[next.result.Candidate.MinerPeer.ID]; ok {
+				continue
+			}
+			seen[next.result.Candidate.MinerPeer.ID] = struct{}{}
+			select {
+			case <-ctx.Done():
+				return
+			case rch <- next.result:
+				sent++
+			}
+		}
+		if sent == 0 && len(multierr.Errors(failures)) == len(endpoints) {
+			select {
+			case <-ctx.Done():
+			case rch <- types.FindCandidatesResult{Err: failures}:
+			}
+		}
+	}()
+	return rch, nil
+}
@@ -1,6 +1,8 @@
 package indexerlookup
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"time"
@@ -10,14 +12,51 @@ type (
 	Option  func(*options) error
 	options struct {
 		asyncResultsChanBuffer int
-		httpEndpoint           *url.URL
+		httpEndpoints          []Endpoint
 		httpClient             *http.Client
 		httpClientTimeout      time.Duration
 		httpUserAgent          string
 		ipfsDhtCascade         bool
+		readerPrivacy          bool
+		endpointStrategy       EndpointStrategy
+		endpointCooldown       time.Duration
 	}
 )
 
+// Endpoint is an indexer HTTP API endpoint
+type Endpoint struct {
+	URL *url.URL
+	// Timeout bounds each lookup sent to the endpoint, including reading the
+	// response; zero leaves lookups bounded by the HTTP client timeout alone
+	Timeout time.Duration
+}
+
+// EndpointStrategy is how lookups are sent to the endpoints when there is
+// more than one
+type EndpointStrategy string
+
+const (
+	// EndpointStrategyFailover looks up each endpoint in turn, in the order
+	// given, until one responds
+	EndpointStrategyFailover EndpointStrategy = "failover"
+	// EndpointStrategyMerge looks up all of the endpoints at once, merging
+	// the candidates they find
+	EndpointStrategyMerge EndpointStrategy = "merge"
+	// EndpointStrategyFastest looks up all of the endpoints at once, taking
+	// the candidates of the first to find any
+	EndpointStrategyFastest EndpointStrategy = "fastest"
+)
+
+// ParseEndpointStrategy parses the name of an EndpointStrategy
+func ParseEndpointStrategy(s string) (EndpointStrategy, error) {
+	switch strategy := EndpointStrategy(s); strategy {
+	case EndpointStrategyFailover, EndpointStrategyMerge, EndpointStrategyFastest:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown indexer endpoint strategy %q", s)
+	}
+}
+
 func newOptions(o ...Option) (*options, error) {
 	const defaultEndpoint = "https://cid.contact"
 	opts := options{
@@ -26,21 +65,23 @@ func newOptions(o ...Option) (*options, error) {
 		httpClientTimeout:      time.Minute,
 		httpUserAgent:          "lassie",
 		ipfsDhtCascade:         true,
+		endpointStrategy:       EndpointStrategyFailover,
+		endpointCooldown:       time.Minute,
 	}
 	for _, apply := range o {
 		if err := apply(&opts); err != nil {
 			return nil, err
 		}
 	}
-	var err error
-	if opts.httpEndpoint == nil {
-		opts.httpEndpoint, err = url.Parse(defaultEndpoint)
+	if len(opts.httpEndpoints) == 0 {
+		defaultUrl, err := url.Parse(defaultEndpoint)
 		if err != nil {
 			// We can also panic here; but considering we can also return error
 			// let there be less panics in this world, and sanity check defaults
 			// in unit tests instead.
 			return nil, err
 		}
+		opts.httpEndpoints = []Endpoint{{URL: defaultUrl}}
 	}
 	opts.httpClient.Timeout = opts.httpClientTimeout
 	return &opts, nil
@@ -68,7 +109,45 @@ func WithHttpClientTimeout(t time.Duration) Option {
 // Defaults to https://cid.contact if unspecified.
 func WithHttpEndpoint(e *url.URL) Option {
 	return func(o *options) error {
-		o.httpEndpoint = e
+		o.httpEndpoints = []Endpoint{{URL: e}}
+		return nil
+	}
+}
+
+// WithHttpEndpoints sets several indexer HTTP API endpoints, which are looked
+// up according to the EndpointStrategy.
+// Defaults to https://cid.contact alone if unspecified.
+func WithHttpEndpoints(endpoints ...Endpoint) Option {
+	return func(o *options) error {
+		for _, e := range endpoints {
+			if e.URL == nil {
+				return errors.New("indexer endpoint has no URL")
+			}
+		}
+		o.httpEndpoints = endpoints
+		return nil
+	}
+}
+
+// WithEndpointStrategy sets how lookups are sent to the endpoints when there
+// is more than one.
+// Defaults to EndpointStrategyFailover if unspecified.
+func WithEndpointStrategy(s EndpointStrategy) Option {
+	return func(o *options) error {
+		if _, err := ParseEndpointStrategy(string(s)); err != nil {
+			return err
+		}
+		o.endpointStrategy = s
+		return nil
+	}
+}
+
+// WithEndpointCooldown sets how long an endpoint that failed a lookup is
+// skipped for, unless every endpoint is cooling down.
+// Defaults to one minute if unspecified.
+func WithEndpointCooldown(d time.Duration) Option {
+	return func(o *options) error {
+		o.endpointCooldown = d
 		return nil
 	}
 }
@@ -100,3 +179,15 @@ func WithIpfsDhtCascade(b bool) Option {
 		return nil
 	}
 }
+
+// WithReaderPrivacy sets whether to look up the indexer with reader privacy,
+// sending it the double hash of each multihash rather than the multihash
+// itself, and decrypting the provider records it finds. The IPFS DHT cascade
+// is not used by these lookups.
+// Disabled by default if unspecified.
+func WithReaderPrivacy(b bool) Option {
+	return func(o *options) error {
+		o.readerPrivacy = b
+		return nil
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/filecoin-project/lassie/pkg/client"
 	"github.com/filecoin-project/lassie/pkg/internal/itest/mocknet"
 	"github.com/filecoin-project/lassie/pkg/internal/itest/unixfs"
+	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/namespace"
@@ -21,7 +22,13 @@ import (
 	"github.com/ipfs/go-graphsync/storeutil"
 	bstore "github.com/ipfs/go-ipfs-blockstore"
 	"github.com/ipfs/go-unixfsnode"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"github.com/stretchr/testify/require"
 )
@@ -34,6 +41,9 @@ func TestRetrieval(t *testing.T) {
 	tests := []struct {
 		name     string
 		generate func(*testing.T, linking.LinkSystem) (srcData unixfs.DirEntry)
+		// resume starts the retrieval with the first half of the DAG already
+		// present locally, as if a previous attempt had failed part way
+		resume bool
 	}{
 		{
 			name: "UnixFSFileDAG",
@@ -53,6 +63,20 @@ func TestRetrieval(t *testing.T) {
 				return unixfs.GenerateDirectory(t, &linkSystem, rndReader, 16<<20, true)
 			},
 		},
+		{
+			name: "UnixFSFileDAG resumed",
+			generate: func(t *testing.T, linkSystem linking.LinkSystem) unixfs.DirEntry {
+				return unixfs.GenerateFile(t, &linkSystem, rndReader, 4<<20)
+			},
+			resume: true,
+		},
+		{
+			name: "UnixFSDirectoryDAG resumed",
+			generate: func(t *testing.T, linkSystem linking.LinkSystem) unixfs.DirEntry {
+				return unixfs.GenerateDirectory(t, &linkSystem, rndReader, 16<<20, false)
+			},
+			resume: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -69,8 +93,29 @@ func TestRetrieval(t *testing.T) {
 			// Generate source data on the remote
 			srcData := tt.generate(t, mrn.Remotes[0].LinkSystem)
 
+			// Pick blocks to already have locally, the first half in the order
+			// they would be sent
+			preload := make([]cid.Cid, 0)
+			var totalSize, preloadedSize uint64
+			if tt.resume {
+				all := traversalCids(t, ctx, mrn.Remotes[0].LinkSystem, srcData.Root)
+				preload = all[:len(all)/2]
+				for i, c := range all {
+					size, err := mrn.Remotes[0].Blockstore().GetSize(ctx, c)
+					require.NoError(t, err)
+					totalSize += uint64(size)
+					if i < len(preload) {
+						preloadedSize += uint64(size)
+					}
+				}
+			}
+
 			// Perform retrieval
-			linkSystemLocal := runRetrieval(t, ctx, mrn, srcData.Root, finishedChan)
+			linkSystemLocal, stats := runRetrieval(t, ctx, mrn, srcData.Root, finishedChan, preload)
+			if tt.resume {
+				// blocks we already had were not sent
+				require.Equal(t, totalSize-preloadedSize, stats.Size)
+			}
 
 			// Check retrieved data by loading it from the blockstore via UnixFS so we
 			// reify the original single file data from the DAG
@@ -84,7 +129,7 @@ func TestRetrieval(t *testing.T) {
 	}
 }
 
-func runRetrieval(t *testing.T, ctx context.Context, mrn *mocknet.MockRetrievalNet, rootCid cid.Cid, finishedChan chan []datatransfer.Event) linking.LinkSystem {
+func runRetrieval(t *testing.T, ctx context.Context, mrn *mocknet.MockRetrievalNet, rootCid cid.Cid, finishedChan chan []datatransfer.Event, preload []cid.Cid) (linking.LinkSystem, *types.RetrievalStats) {
 	req := require.New(t)
 
 	// Setup local datastore and blockstore
@@ -92,6 +137,11 @@ func runRetrieval(t *testing.T, ctx context.Context, mrn *mocknet.MockRetrievalN
 	dtDsLocal := namespace.Wrap(dsLocal, datastore.NewKey("datatransfer"))
 	bsLocal := bstore.NewBlockstore(namespace.Wrap(dsLocal, datastore.NewKey("blockstore")))
 	linkSystemLocal := storeutil.LinkSystemForBlockstore(bsLocal)
+	for _, c := range preload {
+		blk, err := mrn.Remotes[0].Blockstore().Get(ctx, c)
+		req.NoError(err)
+		req.NoError(bsLocal.Put(ctx, blk))
+	}
 
 	// New client
 	client, err := client.NewClient(dtDsLocal, mrn.Self, nil)
@@ -176,7 +226,34 @@ func runRetrieval(t *testing.T, ctx context.Context, mrn *mocknet.MockRetrievalN
 	req.Len(eventSliceFilter(remoteEvents, datatransfer.CleanupComplete), 1)
 	req.Len(eventSliceFilter(remoteEvents, datatransfer.Complete), 1)
 
-	return linkSystemLocal
+	return linkSystemLocal, stats
+}
+
+// traversalCids lists the unique blocks of a DAG in depth-first order
+func traversalCids(t *testing.T, ctx context.Context, lsys linking.LinkSystem, root cid.Cid) []cid.Cid {
+	cids := make([]cid.Cid, 0)
+	seen := cid.NewSet()
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
+		if c := lnk.(cidlink.Link).Cid; seen.Visit(c) {
+			cids = append(cids, c)
+		}
+		return readOpener(lctx, lnk)
+	}
+	protoChooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	node, err := lsys.Load(linking.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	require.NoError(t, err)
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: protoChooser,
+		},
+	}
+	sel, err := selector.CompileSelector(selectorparse.CommonSelector_ExploreAllRecursively)
+	require.NoError(t, err)
+	require.NoError(t, progress.WalkAdv(node, sel, func(traversal.Progress, datamodel.Node, traversal.VisitReason) error { return nil }))
+	return cids
 }
 
 func eventSliceFilter(events []datatransfer.Event, code datatransfer.EventCode) []datatransfer.Event {
@@ -0,0 +1,102 @@
+package itest
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/dhtlookup"
+	"github.com/filecoin-project/lassie/pkg/internal/itest/mocknet"
+	"github.com/filecoin-project/lassie/pkg/internal/itest/unixfs"
+	"github.com/filecoin-project/lassie/pkg/lassie"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/index-provider/metadata"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDhtFetch(t *testing.T) {
+	req := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rndSeed := time.Now().UTC().UnixNano()
+	t.Logf("random seed: %d", rndSeed)
+	var rndReader io.Reader = rand.New(rand.NewSource(rndSeed))
+
+	mrn := mocknet.NewMockRetrievalNet(ctx, t)
+	mrn.AddBitswapPeers(2)
+	srcData := unixfs.GenerateFile(t, &mrn.Remotes[0].LinkSystem, rndReader, 4<<20)
+	req.NoError(mrn.MN.LinkAll())
+
+	// the remotes make up the DHT, with the first providing the file
+	var dhts []*dht.IpfsDHT
+	for _, remote := range mrn.Remotes {
+		d, err := dht.New(ctx, remote.Host, dht.Mode(dht.ModeServer))
+		req.NoError(err)
+		defer d.Close()
+		dhts = append(dhts, d)
+	}
+	req.NoError(mrn.Remotes[0].Host.Connect(ctx, *mrn.Remotes[1].AddrInfo()))
+	req.Eventually(func() bool {
+		return dhts[0].RoutingTable().Size() > 0 && dhts[1].RoutingTable().Size() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	req.NoError(dhts[0].Provide(ctx, srcData.Root, true))
+
+	// we join the DHT through the second remote, so the provider is found and
+	// first connected to once bitswap is listening for new connections
+	finder, err := dhtlookup.NewCandidateFinder(ctx, mrn.Self, dhtlookup.WithBootstrapPeers(*mrn.Remotes[1].AddrInfo()))
+	req.NoError(err)
+	defer finder.Close()
+	lassie, err := lassie.NewLassie(ctx, lassie.WithFinder(finder), lassie.WithHost(mrn.Self), lassie.WithGlobalTimeout(5*time.Second))
+	req.NoError(err)
+
+	var candidates []types.RetrievalCandidate
+	req.Eventually(func() bool {
+		candidates, err = finder.FindCandidates(ctx, srcData.Root)
+		return err == nil && len(candidates) > 0
+	}, 5*time.Second, 100*time.Millisecond)
+	req.Len(candidates, 1)
+	req.Equal(mrn.Remotes[0].ID, candidates[0].MinerPeer.ID)
+	req.Equal(srcData.Root, candidates[0].RootCid)
+	req.IsType(&metadata.Bitswap{}, candidates[0].Metadata.Get(multicodec.TransportBitswap))
+
+	// content nobody provides finds no candidates
+	missing, err := finder.FindCandidates(ctx, cid.MustParse("bafkqaalb"))
+	req.NoError(err)
+	req.Empty(missing)
+
+	outFile, err := os.CreateTemp(t.TempDir(), "lassie-test-")
+	req.NoError(err)
+	defer func() {
+		req.NoError(outFile.Close())
+	}()
+	outCar, err := storage.NewReadableWritable(outFile, []cid.Cid{srcData.Root}, carv2.WriteAsCarV1(true))
+	req.NoError(err)
+	request, err := types.NewRequestForPath(outCar, srcData.Root, "", true)
+	req.NoError(err)
+	stats, err := lassie.Fetch(ctx, request)
+	req.NoError(err)
+	req.Equal(mrn.Remotes[0].ID, stats.StorageProviderId)
+	req.NoError(outCar.Finalize())
+	_, err = outFile.Seek(0, io.SeekStart)
+	req.NoError(err)
+	reader, err := storage.OpenReadable(outFile)
+	req.NoError(err)
+
+	linkSys := cidlink.DefaultLinkSystem()
+	linkSys.SetReadStorage(reader)
+	linkSys.NodeReifier = unixfsnode.Reify
+	linkSys.TrustedStorage = true
+	gotDir := unixfs.ToDirEntry(t, linkSys, srcData.Root, true)
+	unixfs.CompareDirEntries(t, srcData, gotDir)
+}
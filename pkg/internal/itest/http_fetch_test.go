@@ -29,11 +29,11 @@ import (
 )
 
 func TestHttpFetch(t *testing.T) {
-	shallowQuery := func(q url.Values) {
+	shallowQuery := func(q url.Values, _ []testpeer.TestPeer) {
 		q.Set("depthType", "shallow")
 	}
 
-	type queryModifier func(url.Values)
+	type queryModifier func(url.Values, []testpeer.TestPeer)
 	type bodyValidator func(*testing.T, unixfs.DirEntry, []byte)
 
 	testCases := []struct {
@@ -42,6 +42,7 @@ func TestHttpFetch(t *testing.T) {
 		bitswapRemotes   int
 		disableGraphsync bool
 		expectFail       bool
+		expectStatus     int
 		modifyHttpConfig func(httpserver.HttpServerConfig) httpserver.HttpServerConfig
 		generate         func(*testing.T, io.Reader, []testpeer.TestPeer) []unixfs.DirEntry
 		paths            []string
@@ -497,6 +498,100 @@ func TestHttpFetch(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:           "bitswap, with request overrides",
+			bitswapRemotes: 1,
+			generate: func(t *testing.T, rndReader io.Reader, remotes []testpeer.TestPeer) []unixfs.DirEntry {
+				return []unixfs.DirEntry{unixfs.GenerateFile(t, &remotes[0].LinkSystem, rndReader, 4<<20)}
+			},
+			modifyHttpConfig: func(cfg httpserver.HttpServerConfig) httpserver.HttpServerConfig {
+				// a longer providerTimeout is reduced to this rather than rejected
+				cfg.MaxProviderTimeout = 20 * time.Second
+				return cfg
+			},
+			modifyQueries: []queryModifier{func(q url.Values, remotes []testpeer.TestPeer) {
+				q.Set("providerTimeout", "1h")
+				q.Set("protocols", "bitswap")
+				q.Set("paidRetrievals", "deny")
+				q.Set("allowProviders", remotes[0].ID.String())
+				q.Set("maxBlocks", "3")
+			}},
+			validateBodies: []bodyValidator{func(t *testing.T, srcData unixfs.DirEntry, body []byte) {
+				// 3 blocks max, start at the root and then two blocks into the sharded data
+				wantCids := []cid.Cid{
+					srcData.Root,
+					srcData.SelfCids[0],
+					srcData.SelfCids[1],
+				}
+				validateCarBody(t, body, srcData.Root, wantCids, true)
+			}},
+		},
+		{
+			name:           "bitswap, with protocols excluding bitswap",
+			bitswapRemotes: 1,
+			generate: func(t *testing.T, rndReader io.Reader, remotes []testpeer.TestPeer) []unixfs.DirEntry {
+				return []unixfs.DirEntry{unixfs.GenerateFile(t, &remotes[0].LinkSystem, rndReader, 4<<20)}
+			},
+			modifyQueries: []queryModifier{func(q url.Values, _ []testpeer.TestPeer) {
+				q.Set("protocols", "graphsync")
+			}},
+			expectFail: true,
+		},
+		{
+			name:           "bitswap, with the provider denied",
+			bitswapRemotes: 1,
+			generate: func(t *testing.T, rndReader io.Reader, remotes []testpeer.TestPeer) []unixfs.DirEntry {
+				return []unixfs.DirEntry{unixfs.GenerateFile(t, &remotes[0].LinkSystem, rndReader, 4<<20)}
+			},
+			modifyQueries: []queryModifier{func(q url.Values, remotes []testpeer.TestPeer) {
+				q.Set("denyProviders", remotes[0].ID.String())
+			}},
+			expectStatus: http.StatusNotFound,
+		},
+		{
+			name:           "bitswap, with providers",
+			bitswapRemotes: 1,
+			generate: func(t *testing.T, rndReader io.Reader, remotes []testpeer.TestPeer) []unixfs.DirEntry {
+				return []unixfs.DirEntry{unixfs.GenerateFile(t, &remotes[0].LinkSystem, rndReader, 4<<20)}
+			},
+			modifyHttpConfig: func(cfg httpserver.HttpServerConfig) httpserver.HttpServerConfig {
+				cfg.AllowProvidersParameter = true
+				return cfg
+			},
+			modifyQueries: []queryModifier{func(q url.Values, remotes []testpeer.TestPeer) {
+				q.Set("providers", fmt.Sprintf("%s/p2p/%s", remotes[0].Host.Addrs()[0], remotes[0].ID))
+			}},
+		},
+		{
+			name:           "bitswap, with providers not allowed",
+			bitswapRemotes: 1,
+			generate: func(t *testing.T, rndReader io.Reader, remotes []testpeer.TestPeer) []unixfs.DirEntry {
+				return []unixfs.DirEntry{unixfs.GenerateFile(t, &remotes[0].LinkSystem, rndReader, 4<<20)}
+			},
+			modifyQueries: []queryModifier{func(q url.Values, remotes []testpeer.TestPeer) {
+				q.Set("providers", fmt.Sprintf("%s/p2p/%s", remotes[0].Host.Addrs()[0], remotes[0].ID))
+			}},
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "bitswap, with invalid request overrides",
+			bitswapRemotes: 2,
+			generate: func(t *testing.T, rndReader io.Reader, remotes []testpeer.TestPeer) []unixfs.DirEntry {
+				return []unixfs.DirEntry{
+					unixfs.GenerateFile(t, &remotes[0].LinkSystem, rndReader, 4<<20),
+					unixfs.GenerateFile(t, &remotes[1].LinkSystem, rndReader, 4<<20),
+				}
+			},
+			modifyQueries: []queryModifier{
+				func(q url.Values, _ []testpeer.TestPeer) {
+					q.Set("providerTimeout", "soon")
+				},
+				func(q url.Values, _ []testpeer.TestPeer) {
+					q.Set("paidRetrievals", "allow")
+				},
+			},
+			expectStatus: http.StatusBadRequest,
+		},
 		{
 			name:             "parallel, separate graphsync and bitswap retrievals",
 			graphsyncRemotes: 1,
@@ -580,7 +675,7 @@ func TestHttpFetch(t *testing.T) {
 					getReq.Header.Add("Accept", "application/vnd.ipld.car")
 					if testCase.modifyQueries != nil && testCase.modifyQueries[i] != nil {
 						q := getReq.URL.Query()
-						testCase.modifyQueries[i](q)
+						testCase.modifyQueries[i](q, mrn.Remotes)
 						getReq.URL.RawQuery = q.Encode()
 					}
 					t.Log("Fetching", getReq.URL.String())
@@ -614,7 +709,9 @@ func TestHttpFetch(t *testing.T) {
 			}
 
 			for i, resp := range responses {
-				if testCase.expectFail {
+				if testCase.expectStatus != 0 {
+					req.Equal(testCase.expectStatus, resp.StatusCode)
+				} else if testCase.expectFail {
 					req.Equal(http.StatusGatewayTimeout, resp.StatusCode)
 				} else {
 					req.Equal(http.StatusOK, resp.StatusCode)
@@ -0,0 +1,39 @@
+package limitstore
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+)
+
+// LimitLinkSystem returns a copy of the LinkSystem that fails to write more
+// than limit unique blocks
+func LimitLinkSystem(lsys linking.LinkSystem, limit uint64) linking.LinkSystem {
+	writeOpener := lsys.StorageWriteOpener
+	if writeOpener == nil {
+		return lsys
+	}
+	var lk sync.Mutex
+	written := make(map[string]struct{})
+	lsys.StorageWriteOpener = func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+		w, commit, err := writeOpener(lctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return w, func(lnk datamodel.Link) error {
+			lk.Lock()
+			if _, has := written[lnk.Binary()]; !has {
+				if uint64(len(written)) >= limit {
+					lk.Unlock()
+					return ErrExceededLimit{limit}
+				}
+				written[lnk.Binary()] = struct{}{}
+			}
+			lk.Unlock()
+			return commit(lnk)
+		}, nil
+	}
+	return lsys
+}
@@ -6,7 +6,13 @@ import (
 
 	"github.com/filecoin-project/lassie/pkg/internal/limitstore"
 	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/ipfs/go-cid"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
 )
 
@@ -58,3 +64,38 @@ func TestLimitStore(t *testing.T) {
 	req.EqualError(err, limitstore.ErrExceededLimit{Limit: 5}.Error())
 
 }
+
+func TestLimitLinkSystem(t *testing.T) {
+	req := require.New(t)
+	ms := &memstore.Store{Bag: make(map[string][]byte)}
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(ms)
+	lsys.SetWriteStorage(ms)
+	lsys = limitstore.LimitLinkSystem(lsys, 3)
+
+	lp := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}}
+	store := func(data []byte) error {
+		_, err := lsys.Store(linking.LinkContext{}, lp, basicnode.NewBytes(data))
+		return err
+	}
+
+	blocks := [][]byte{testutil.RandomBytes(100), testutil.RandomBytes(100), testutil.RandomBytes(100)}
+	for _, data := range blocks {
+		req.NoError(store(data))
+	}
+	// writing the same blocks again doesn't count towards the limit
+	for _, data := range blocks {
+		req.NoError(store(data))
+	}
+	req.Len(ms.Bag, 3)
+
+	// write block over limit
+	err := store(testutil.RandomBytes(100))
+	req.EqualError(err, limitstore.ErrExceededLimit{Limit: 3}.Error())
+	req.Len(ms.Bag, 3)
+}
@@ -0,0 +1,18 @@
+// Package lrucache creates the LRU caches used throughout Lassie, whose sizes
+// are either constants or defaulted from configuration to be positive.
+package lrucache
+
+import (
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// New creates an LRU cache holding up to size entries. It panics if size
+// isn't positive, which is the only way creating the cache can fail and is a
+// programming error rather than a runtime condition.
+func New(size int) *lru.Cache {
+	cache, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return cache
+}
@@ -0,0 +1,318 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	init8 "github.com/filecoin-project/go-state-types/builtin/v8/init"
+	"github.com/filecoin-project/go-state-types/builtin/v8/paych"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/filecoin-project/lassie/pkg/paychmgr"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// MockPaychCodeCid is the code CID of the payment channel actor on the
+// MockChainNode
+var MockPaychCodeCid = func() cid.Cid {
+	mh, err := multihash.Sum([]byte("fil/8/paymentchannel"), multihash.IDENTITY, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}()
+
+const mockNetworkVersion = network.Version18
+
+// MockChainNode is an in-process chain node serving the parts of the Lotus
+// JSON-RPC API used by paychmgr. Messages are executed as soon as they are
+// pushed, creating payment channel actors and moving funds between balances.
+type MockChainNode struct {
+	lk         sync.Mutex
+	server     *httptest.Server
+	nonces     map[address.Address]uint64
+	balances   map[address.Address]abi.TokenAmount
+	channels   map[address.Address]paych.ConstructorParams
+	lookups    map[cid.Cid]*paychmgr.MsgLookup
+	pushed     []paychmgr.SignedMessage
+	nextId     uint64
+	height     abi.ChainEpoch
+	holding    bool
+	releasedCh chan struct{}
+}
+
+// NewMockChainNode starts a MockChainNode, it should be closed once done
+func NewMockChainNode() *MockChainNode {
+	mcn := &MockChainNode{
+		nonces:     make(map[address.Address]uint64),
+		balances:   make(map[address.Address]abi.TokenAmount),
+		channels:   make(map[address.Address]paych.ConstructorParams),
+		lookups:    make(map[cid.Cid]*paychmgr.MsgLookup),
+		nextId:     1000,
+		height:     100,
+		releasedCh: make(chan struct{}),
+	}
+	close(mcn.releasedCh)
+	mcn.server = httptest.NewServer(http.HandlerFunc(mcn.handle))
+	return mcn
+}
+
+// Endpoint is the URL of the node's JSON-RPC API
+func (mcn *MockChainNode) Endpoint() string {
+	return mcn.server.URL + "/rpc/v1"
+}
+
+func (mcn *MockChainNode) Close() {
+	mcn.Release()
+	mcn.server.Close()
+}
+
+// SetBalance sets the balance of an address, messages from addresses without
+// enough balance fail
+func (mcn *MockChainNode) SetBalance(addr address.Address, balance abi.TokenAmount) {
+	mcn.lk.Lock()
+	defer mcn.lk.Unlock()
+	mcn.balances[addr] = balance
+}
+
+// Balance returns the balance of an address, including payment channels
+func (mcn *MockChainNode) Balance(addr address.Address) abi.TokenAmount {
+	mcn.lk.Lock()
+	defer mcn.lk.Unlock()
+	if balance, ok := mcn.balances[addr]; ok {
+		return balance
+	}
+	return big.Zero()
+}
+
+// Channel returns the parameters a payment channel was created with
+func (mcn *MockChainNode) Channel(addr address.Address) (paych.ConstructorParams, bool) {
+	mcn.lk.Lock()
+	defer mcn.lk.Unlock()
+	params, ok := mcn.channels[addr]
+	return params, ok
+}
+
+// PushedMessages returns the messages pushed to the node so far
+func (mcn *MockChainNode) PushedMessages() []paychmgr.SignedMessage {
+	mcn.lk.Lock()
+	defer mcn.lk.Unlock()
+	return append([]paychmgr.SignedMessage{}, mcn.pushed...)
+}
+
+// Hold stops StateWaitMsg from returning until Release is called, as if
+// messages were taking a long time to land on chain
+func (mcn *MockChainNode) Hold() {
+	mcn.lk.Lock()
+	defer mcn.lk.Unlock()
+	if !mcn.holding {
+		mcn.holding = true
+		mcn.releasedCh = make(chan struct{})
+	}
+}
+
+// Release lets StateWaitMsg return after a call to Hold
+func (mcn *MockChainNode) Release() {
+	mcn.lk.Lock()
+	defer mcn.lk.Unlock()
+	if mcn.holding {
+		mcn.holding = false
+		close(mcn.releasedCh)
+	}
+}
+
+type mockRPCRequest struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Id     int64             `json:"id"`
+}
+
+type mockRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type mockRPCResponse struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Result  interface{}   `json:"result,omitempty"`
+	Error   *mockRPCError `json:"error,omitempty"`
+	Id      int64         `json:"id"`
+}
+
+func (mcn *MockChainNode) handle(res http.ResponseWriter, req *http.Request) {
+	var rpcReq mockRPCRequest
+	if err := json.NewDecoder(req.Body).Decode(&rpcReq); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := mcn.call(req, rpcReq.Method, rpcReq.Params)
+	rpcRes := mockRPCResponse{Jsonrpc: "2.0", Result: result, Id: rpcReq.Id}
+	if err != nil {
+		rpcRes.Error = &mockRPCError{Code: 1, Message: err.Error()}
+	}
+	res.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(res).Encode(rpcRes)
+}
+
+func (mcn *MockChainNode) call(req *http.Request, method string, params []json.RawMessage) (interface{}, error) {
+	param := func(i int, v interface{}) error {
+		if i >= len(params) {
+			return fmt.Errorf("missing param %d", i)
+		}
+		return json.Unmarshal(params[i], v)
+	}
+
+	switch method {
+	case "Filecoin.MpoolGetNonce":
+		var addr address.Address
+		if err := param(0, &addr); err != nil {
+			return nil, err
+		}
+		mcn.lk.Lock()
+		defer mcn.lk.Unlock()
+		return mcn.nonces[addr], nil
+	case "Filecoin.GasEstimateMessageGas":
+		var msg paychmgr.Message
+		if err := param(0, &msg); err != nil {
+			return nil, err
+		}
+		msg.GasLimit = 1_000_000
+		msg.GasFeeCap = big.NewInt(100)
+		msg.GasPremium = big.NewInt(10)
+		return &msg, nil
+	case "Filecoin.MpoolPush":
+		var smsg paychmgr.SignedMessage
+		if err := param(0, &smsg); err != nil {
+			return nil, err
+		}
+		return mcn.push(smsg)
+	case "Filecoin.StateWaitMsg":
+		var msgCid cid.Cid
+		if err := param(0, &msgCid); err != nil {
+			return nil, err
+		}
+		mcn.lk.Lock()
+		releasedCh := mcn.releasedCh
+		mcn.lk.Unlock()
+		select {
+		case <-releasedCh:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		mcn.lk.Lock()
+		defer mcn.lk.Unlock()
+		lookup, ok := mcn.lookups[msgCid]
+		if !ok {
+			return nil, fmt.Errorf("message %s not found", msgCid)
+		}
+		return lookup, nil
+	case "Filecoin.StateNetworkVersion":
+		return mockNetworkVersion, nil
+	case "Filecoin.StateActorCodeCIDs":
+		var version network.Version
+		if err := param(0, &version); err != nil {
+			return nil, err
+		}
+		if version != mockNetworkVersion {
+			return nil, fmt.Errorf("unknown network version %d", version)
+		}
+		return map[string]cid.Cid{"paymentchannel": MockPaychCodeCid}, nil
+	default:
+		return nil, fmt.Errorf("method %s not found", method)
+	}
+}
+
+// push validates a signed message and executes it
+func (mcn *MockChainNode) push(smsg paychmgr.SignedMessage) (cid.Cid, error) {
+	msg := smsg.Message
+	msgCid, err := msg.Cid()
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := paychmgr.VerifySignature(&smsg.Signature, msg.From, msgCid.Bytes()); err != nil {
+		return cid.Undef, err
+	}
+
+	mcn.lk.Lock()
+	defer mcn.lk.Unlock()
+
+	if msg.Nonce != mcn.nonces[msg.From] {
+		return cid.Undef, fmt.Errorf("unexpected nonce %d, expected %d", msg.Nonce, mcn.nonces[msg.From])
+	}
+	if msg.GasLimit <= 0 {
+		return cid.Undef, fmt.Errorf("message has no gas limit")
+	}
+	mcn.nonces[msg.From]++
+	mcn.pushed = append(mcn.pushed, smsg)
+	mcn.height++
+
+	exitCode, ret := mcn.execute(msg)
+	mcn.lookups[msgCid] = &paychmgr.MsgLookup{
+		Message: msgCid,
+		Receipt: paychmgr.MessageReceipt{ExitCode: exitCode, Return: ret, GasUsed: msg.GasLimit / 2},
+		Height:  mcn.height,
+	}
+	return msgCid, nil
+}
+
+// execute applies a message to the node's state, it must be called with the
+// lock held
+func (mcn *MockChainNode) execute(msg paychmgr.Message) (exitcode.ExitCode, []byte) {
+	fromBalance, ok := mcn.balances[msg.From]
+	if !ok || fromBalance.LessThan(msg.Value) {
+		return exitcode.SysErrInsufficientFunds, nil
+	}
+
+	switch {
+	case msg.To == builtin.InitActorAddr && msg.Method == builtin.MethodsInit.Exec:
+		var execParams init8.ExecParams
+		if err := execParams.UnmarshalCBOR(bytes.NewReader(msg.Params)); err != nil {
+			return exitcode.ErrSerialization, nil
+		}
+		if execParams.CodeCID != MockPaychCodeCid {
+			return exitcode.ErrForbidden, nil
+		}
+		var constructorParams paych.ConstructorParams
+		if err := constructorParams.UnmarshalCBOR(bytes.NewReader(execParams.ConstructorParams)); err != nil {
+			return exitcode.ErrSerialization, nil
+		}
+		if constructorParams.From != msg.From {
+			return exitcode.ErrIllegalArgument, nil
+		}
+		mcn.nextId++
+		idAddress, err := address.NewIDAddress(mcn.nextId)
+		if err != nil {
+			return exitcode.ErrIllegalState, nil
+		}
+		robustAddress, err := address.NewActorAddress([]byte(fmt.Sprintf("paych-%d", mcn.nextId)))
+		if err != nil {
+			return exitcode.ErrIllegalState, nil
+		}
+		var ret bytes.Buffer
+		if err := (&init8.ExecReturn{IDAddress: idAddress, RobustAddress: robustAddress}).MarshalCBOR(&ret); err != nil {
+			return exitcode.ErrIllegalState, nil
+		}
+		mcn.channels[robustAddress] = constructorParams
+		mcn.balances[msg.From] = big.Sub(fromBalance, msg.Value)
+		mcn.balances[robustAddress] = msg.Value
+		return exitcode.Ok, ret.Bytes()
+	case msg.Method == builtin.MethodSend:
+		if _, ok := mcn.channels[msg.To]; !ok {
+			return exitcode.SysErrInvalidReceiver, nil
+		}
+		mcn.balances[msg.From] = big.Sub(fromBalance, msg.Value)
+		mcn.balances[msg.To] = big.Add(mcn.balances[msg.To], msg.Value)
+		return exitcode.Ok, nil
+	default:
+		return exitcode.SysErrInvalidMethod, nil
+	}
+}
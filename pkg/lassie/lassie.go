@@ -2,9 +2,11 @@ package lassie
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/filecoin-project/lassie/pkg/client"
+	"github.com/filecoin-project/lassie/pkg/dhtlookup"
 	"github.com/filecoin-project/lassie/pkg/indexerlookup"
 	"github.com/filecoin-project/lassie/pkg/internal"
 	"github.com/filecoin-project/lassie/pkg/retriever"
@@ -13,8 +15,13 @@ import (
 	"github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// ErrNoCandidateFinder is returned when the indexer is disabled and there is
+// neither a Finder nor the DHT to find candidates through instead
+var ErrNoCandidateFinder = errors.New("no candidate finder: the indexer is disabled without a finder or the DHT")
+
 // Lassie represents a reusable retrieval client.
 type Lassie struct {
 	cfg       *LassieConfig
@@ -24,12 +31,33 @@ type Lassie struct {
 // LassieConfig customizes the behavior of a Lassie instance.
 type LassieConfig struct {
 	Finder                 retriever.CandidateFinder
+	FindWithDht            bool
+	DisableIndexer         bool
+	IndexerOptions         []indexerlookup.Option
+	CandidateCacheConfig   retriever.CandidateCacheConfig
 	Host                   host.Host
 	ProviderTimeout        time.Duration
 	ConcurrentSPRetrievals uint
 	GlobalTimeout          time.Duration
 	Libp2pOptions          []libp2p.Option
 	DisableGraphsync       bool
+	DisableHttp            bool
+	ProviderConfig         retriever.ProviderConfig
+	SpTrackerConfig        retriever.SpTrackerConfig
+	ReputationConfig       retriever.ReputationConfig
+	ReputationDatastore    datastore.Datastore
+	CandidateScorer        retriever.CandidateScorer
+	CoordinationKind       types.CoordinationKind
+	HedgeDelay             time.Duration
+	MaxParallelProviders   int
+	TempDir                string
+	BitswapPrefetch        int
+	BitswapLimits          retriever.BitswapLimits
+	RetryPolicy            retriever.RetryPolicy
+	PaidRetrievals         bool
+	PaymentPolicy          retriever.PaymentPolicy
+	PayChannelManager      client.PayChannelManager
+	LocalStores            *retriever.LocalStores
 }
 
 type LassieOption func(cfg *LassieConfig)
@@ -46,18 +74,20 @@ func NewLassie(ctx context.Context, opts ...LassieOption) (*Lassie, error) {
 // NewLassieWithConfig creates a new Lassie instance with a custom
 // configuration.
 func NewLassieWithConfig(ctx context.Context, cfg *LassieConfig) (*Lassie, error) {
-	if cfg.Finder == nil {
-		var err error
-		cfg.Finder, err = indexerlookup.NewCandidateFinder()
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	if cfg.ProviderTimeout == 0 {
 		cfg.ProviderTimeout = 20 * time.Second
 	}
 
+	if cfg.BitswapPrefetch == 0 {
+		cfg.BitswapPrefetch = retriever.DefaultMaxPrefetch
+	}
+	if cfg.BitswapLimits.MaxBlockSize == 0 {
+		cfg.BitswapLimits.MaxBlockSize = retriever.DefaultBitswapLimits.MaxBlockSize
+	}
+	if cfg.BitswapLimits.MaxDepth == 0 {
+		cfg.BitswapLimits.MaxDepth = retriever.DefaultBitswapLimits.MaxDepth
+	}
+
 	datastore := sync.MutexWrap(datastore.NewMapDatastore())
 
 	if cfg.Host == nil {
@@ -68,23 +98,89 @@ func NewLassieWithConfig(ctx context.Context, cfg *LassieConfig) (*Lassie, error
 		}
 	}
 
-	retrievalClient, err := client.NewClient(datastore, cfg.Host, nil)
+	// candidates are found through the Finder, or the indexer without one, and
+	// through the DHT as well when it's enabled
+	var sources []retriever.CandidateSource
+	if cfg.Finder != nil {
+		sources = append(sources, retriever.CandidateSource{Name: "finder", Finder: cfg.Finder})
+	} else if !cfg.DisableIndexer {
+		indexerFinder, err := indexerlookup.NewCandidateFinder(cfg.IndexerOptions...)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, retriever.CandidateSource{Name: "indexer", Finder: indexerFinder})
+	}
+	if cfg.FindWithDht {
+		dhtFinder, err := dhtlookup.NewCandidateFinder(ctx, cfg.Host)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			_ = dhtFinder.Close()
+		}()
+		sources = append(sources, retriever.CandidateSource{Name: "dht", Finder: dhtFinder})
+	}
+	switch len(sources) {
+	case 0:
+		return nil, ErrNoCandidateFinder
+	case 1:
+		cfg.Finder = sources[0].Finder
+	default:
+		cfg.Finder = retriever.NewCompositeCandidateFinder(sources...)
+	}
+	if cfg.CandidateCacheConfig.TTL > 0 || cfg.CandidateCacheConfig.NegativeTTL > 0 {
+		cfg.Finder = retriever.NewCachingCandidateFinder(cfg.Finder, cfg.CandidateCacheConfig)
+	}
+
+	retrievalClient, err := client.NewClient(datastore, cfg.Host, cfg.PayChannelManager)
 	if err != nil {
 		return nil, err
 	}
 
 	bitswapRetriever := retriever.NewBitswapRetrieverFromHost(ctx, cfg.Host, retriever.BitswapConfig{
 		BlockTimeout: cfg.ProviderTimeout,
+		MaxPrefetch:  cfg.BitswapPrefetch,
+		Limits:       cfg.BitswapLimits,
 	})
+	// the protocols of peers given with a request are discovered once and
+	// shared by the requests that follow
+	protocolDiscovery := retriever.NewProtocolDiscovery(ctx, cfg.Host, retriever.ProtocolDiscoveryConfig{})
 	retrieverCfg := retriever.RetrieverConfig{
 		DefaultMinerConfig: retriever.MinerConfig{
 			RetrievalTimeout:        cfg.ProviderTimeout,
 			MaxConcurrentRetrievals: cfg.ConcurrentSPRetrievals,
 		},
 		DisableGraphsync: cfg.DisableGraphsync,
+		DisableHttp:      cfg.DisableHttp,
+		MinerBlacklist:   cfg.ProviderConfig.MinerBlacklist,
+		MinerWhitelist:   cfg.ProviderConfig.MinerWhitelist,
+		MinerConfigs:     cfg.ProviderConfig.MinerConfigs,
+		SpTrackerConfig:  cfg.SpTrackerConfig,
+
+		ReputationConfig:    cfg.ReputationConfig,
+		ReputationDatastore: cfg.ReputationDatastore,
+		CandidateScorer:     cfg.CandidateScorer,
+		CoordinationKind:    cfg.CoordinationKind,
+		HedgeDelay:          cfg.HedgeDelay,
+
+		MaxParallelProviders: cfg.MaxParallelProviders,
+		TempDir:              cfg.TempDir,
+		RetryPolicy:          cfg.RetryPolicy,
+		PaidRetrievals:       cfg.PaidRetrievals,
+		PaymentPolicy:        cfg.PaymentPolicy,
+		LocalStores:          cfg.LocalStores,
+		FixedPeerFinder: func(peers []peer.AddrInfo) retriever.CandidateFinder {
+			return retriever.NewDirectCandidateFinderWithDiscovery(protocolDiscovery, peers)
+		},
+	}
+
+	finder := cfg.Finder
+	if cfg.LocalStores != nil {
+		finder = retriever.NewLocalCandidateFinder(cfg.LocalStores, finder)
 	}
 
-	retriever, err := retriever.NewRetriever(ctx, retrieverCfg, retrievalClient, cfg.Finder, bitswapRetriever)
+	retriever, err := retriever.NewRetriever(ctx, retrieverCfg, retrievalClient, finder, bitswapRetriever)
 	if err != nil {
 		return nil, err
 	}
@@ -151,13 +247,237 @@ func WithGraphsyncDisabled() LassieOption {
 	}
 }
 
+func WithHttpDisabled() LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.DisableHttp = true
+	}
+}
+
+// WithDhtFinder finds candidates through the IPFS DHT, queried from the Lassie
+// host, as well as through the Finder or the indexer.
+func WithDhtFinder() LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.FindWithDht = true
+	}
+}
+
+// WithCandidateCache caches the candidates found for each CID, and that none
+// were found, for the TTLs of the config. Caching is off unless one of them is
+// set.
+func WithCandidateCache(cacheCfg retriever.CandidateCacheConfig) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.CandidateCacheConfig = cacheCfg
+	}
+}
+
+// WithIndexerDisabled stops candidates being found through the indexer when no
+// Finder is given, leaving the DHT, which must then be enabled with
+// WithDhtFinder.
+func WithIndexerDisabled() LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.DisableIndexer = true
+	}
+}
+
+// WithIndexerOptions configures the indexer candidates are found through when
+// no Finder is given, such as its endpoints and how they are looked up.
+func WithIndexerOptions(opts ...indexerlookup.Option) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.IndexerOptions = append(cfg.IndexerOptions, opts...)
+	}
+}
+
+// WithProviderConfig allows you to specify the initial storage provider
+// blacklist, whitelist and per-provider timeout and concurrency settings. These
+// may be replaced at runtime with UpdateProviderConfig.
+func WithProviderConfig(providerConfig retriever.ProviderConfig) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.ProviderConfig = providerConfig
+	}
+}
+
+// WithSpTrackerConfig allows you to specify the policy for suspending storage
+// providers after repeated failures. Zero values will use the defaults.
+func WithSpTrackerConfig(spTrackerConfig retriever.SpTrackerConfig) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.SpTrackerConfig = spTrackerConfig
+	}
+}
+
+// WithReputationDatastore allows you to specify a datastore in which to
+// persist the retrieval history of storage providers, so that their
+// reliability and performance is remembered across restarts.
+func WithReputationDatastore(ds datastore.Datastore) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.ReputationDatastore = ds
+	}
+}
+
+// WithReputationConfig allows you to specify how the retrieval history of
+// storage providers is weighted over time.
+func WithReputationConfig(reputationConfig retriever.ReputationConfig) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.ReputationConfig = reputationConfig
+	}
+}
+
+// WithCandidateScorer allows you to specify how graphsync candidates that have
+// responded to a query are ordered for retrieval.
+func WithCandidateScorer(scorer retriever.CandidateScorer) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.CandidateScorer = scorer
+	}
+}
+
+// WithCoordinationKind allows you to specify how retrievals over different
+// protocols are coordinated: types.RaceCoordination (the default) starts all
+// protocols together, types.SequentialCoordination tries one protocol at a
+// time and types.HedgedCoordination starts the preferred protocol first and
+// the others after the hedge delay.
+func WithCoordinationKind(kind types.CoordinationKind) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.CoordinationKind = kind
+	}
+}
+
+// WithHedgeDelay allows you to specify how long hedged coordination waits for
+// a first byte from the preferred protocol, once it has started retrieving,
+// before starting the others.
+func WithHedgeDelay(delay time.Duration) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.HedgeDelay = delay
+	}
+}
+
+// WithMaxParallelProviders allows you to split retrievals of a full DAG over
+// graphsync across up to this many storage providers at once, each retrieving
+// different subtrees of the root block. Only storage providers that don't
+// charge to unseal take part, and blocks are still written in the order of a
+// single retrieval. Bitswap retrievals are not split, a bitswap session
+// already spreads its wants across the peers it has. A value of 0 or 1
+// retrieves from a single storage provider.
+func WithMaxParallelProviders(maxProviders int) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.MaxParallelProviders = maxProviders
+	}
+}
+
+// WithTempDir allows you to specify where the blocks of a retrieval split
+// across storage providers are held until they can be written in order. The
+// system temporary directory is used by default.
+func WithTempDir(tempDir string) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.TempDir = tempDir
+	}
+}
+
+// WithBitswapPrefetch allows you to specify how many blocks a bitswap
+// retrieval may fetch ahead of its traversal of the DAG at once. A value of 0
+// uses retriever.DefaultMaxPrefetch and a negative value fetches each block
+// only once the traversal reaches it.
+func WithBitswapPrefetch(maxPrefetch int) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.BitswapPrefetch = maxPrefetch
+	}
+}
+
+// WithBitswapLimits allows you to cap the resources that each bitswap
+// retrieval may use. MaxBlockSize and MaxDepth left at 0 use those of
+// retriever.DefaultBitswapLimits, MaxBlocks left at 0 is uncapped.
+func WithBitswapLimits(limits retriever.BitswapLimits) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.BitswapLimits = limits
+	}
+}
+
+// WithRetryPolicy allows you to specify whether, and how often, a retrieval is
+// attempted again after every candidate has failed. Each retry finds
+// candidates afresh and skips storage providers that have already failed.
+func WithRetryPolicy(retryPolicy retriever.RetryPolicy) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.RetryPolicy = retryPolicy
+	}
+}
+
+// WithPaymentPolicy allows paid retrievals from storage providers, within the
+// limits of the given policy. Query responses that ask for more than the
+// policy allows are filtered out.
+func WithPaymentPolicy(paymentPolicy retriever.PaymentPolicy) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.PaidRetrievals = true
+		cfg.PaymentPolicy = paymentPolicy
+	}
+}
+
+// WithPayChannelManager allows you to specify the PayChannelManager used to
+// pay storage providers, such as a paychmgr.Manager. Paid retrievals must also
+// be allowed with WithPaymentPolicy.
+func WithPayChannelManager(payChannelManager client.PayChannelManager) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.PayChannelManager = payChannelManager
+	}
+}
+
+// WithLocalStores allows you to specify CAR files and blockstores on the local
+// machine to retrieve from. Local retrievals are raced against the network with
+// the default race coordination, and tried first with hedged or sequential
+// coordination. The stores are not closed by Lassie.
+func WithLocalStores(localStores *retriever.LocalStores) LassieOption {
+	return func(cfg *LassieConfig) {
+		cfg.LocalStores = localStores
+	}
+}
+
+// Fetch performs a retrieval for the given request.
 func (l *Lassie) Fetch(ctx context.Context, request types.RetrievalRequest) (*types.RetrievalStats, error) {
+	return l.FetchWithEvents(ctx, request, nil)
+}
+
+// FetchWithEvents performs a retrieval for the given request. The optional
+// eventsCb will be called synchronously with each event that occurs during the
+// course of this retrieval, in addition to any subscribers registered with
+// RegisterSubscriber.
+func (l *Lassie) FetchWithEvents(ctx context.Context, request types.RetrievalRequest, eventsCb func(types.RetrievalEvent)) (*types.RetrievalStats, error) {
 	var cancel context.CancelFunc
 	if l.cfg.GlobalTimeout != time.Duration(0) {
 		ctx, cancel = context.WithTimeout(ctx, l.cfg.GlobalTimeout)
 		defer cancel()
 	}
-	return l.retriever.Retrieve(ctx, request, func(types.RetrievalEvent) {})
+	if eventsCb == nil {
+		eventsCb = func(types.RetrievalEvent) {}
+	}
+	return l.retriever.Retrieve(ctx, request, eventsCb)
+}
+
+// UpdateProviderConfig replaces the storage provider blacklist, whitelist and
+// per-provider settings. Only retrieval candidates evaluated after the update
+// will be affected, retrievals already in progress are not interrupted.
+func (l *Lassie) UpdateProviderConfig(providerConfig retriever.ProviderConfig) {
+	l.retriever.UpdateProviderConfig(providerConfig)
+}
+
+// SuspendedStorageProviders lists the storage providers that are currently
+// suspended, along with their recent failure history.
+func (l *Lassie) SuspendedStorageProviders() []retriever.StorageProviderSuspension {
+	return l.retriever.SuspendedStorageProviders()
+}
+
+// SuspendStorageProvider suspends a storage provider for the given duration,
+// or the configured suspension duration if zero.
+func (l *Lassie) SuspendStorageProvider(storageProviderId peer.ID, duration time.Duration) {
+	l.retriever.SuspendStorageProvider(storageProviderId, duration)
+}
+
+// UnsuspendStorageProvider lifts the suspension of a storage provider,
+// returning false if it was not suspended.
+func (l *Lassie) UnsuspendStorageProvider(storageProviderId peer.ID) bool {
+	return l.retriever.UnsuspendStorageProvider(storageProviderId)
+}
+
+// StorageProviderReputations lists the recorded retrieval history of all
+// storage providers.
+func (l *Lassie) StorageProviderReputations() []retriever.StorageProviderReputation {
+	return l.retriever.StorageProviderReputations()
 }
 
 // RegisterSubscriber registers a subscriber to receive retrieval events.
@@ -14,6 +14,7 @@ var (
 	BlockstoreCacheHitCount            = stats.Int64("blockstore_cache_hit_total", "The number of blocks from the local blockstore served to peers", stats.UnitDimensionless)
 	BytesTransferredTotal              = stats.Int64("data_transferred_bytes_total", "The number of bytes transferred from storage providers to retrieval clients", stats.UnitBytes)
 	RetrievalDealCost                  = stats.Int64("retrieval_deal_cost_fil", "The cost in FIL of a retrieval deal with a storage provider", stats.UnitDimensionless)
+	RetrievalSpend                     = stats.Int64("retrieval_spend_attofil", "The amount in attoFIL paid to storage providers for retrievals", stats.UnitDimensionless)
 	RetrievalDealActiveCount           = stats.Int64("retrieval_deal_active_total", "The number of active retrieval deals that have not yet succeeded or failed", stats.UnitDimensionless)
 	RetrievalDealDuration              = stats.Float64("retrieval_deal_duration_seconds", "The duration in seconds of a retrieval deal with a storage provider", stats.UnitSeconds)
 	RetrievalDealFailCount             = stats.Int64("retrieval_deal_fail_total", "The number of failed retrieval deals with storage providers", stats.UnitDimensionless)
@@ -41,12 +42,15 @@ var (
 	IndexerCandidatesPerRequestCount          = stats.Int64("indexer_candidates_per_request_total", "The number of indexer candidates received per request", stats.UnitDimensionless)
 	RequestWithIndexerCandidatesCount         = stats.Int64("request_with_indexer_candidates_total", "The number of requests that result in non-zero candidates from the indexer", stats.UnitDimensionless)
 	RequestWithIndexerCandidatesFilteredCount = stats.Int64("request_with_indexer_candidates_filtered_total", "The number of requests that result in non-zero candidates from the indexer after filtering", stats.UnitDimensionless)
+	CandidateCacheHitCount                    = stats.Int64("candidate_cache_hit_total", "The number of candidate lookups answered from the cache or by a lookup already in flight", stats.UnitDimensionless)
+	CandidateCacheMissCount                   = stats.Int64("candidate_cache_miss_total", "The number of candidate lookups passed on to the candidate finder", stats.UnitDimensionless)
 
 	// Query
 	RequestWithSuccessfulQueriesCount         = stats.Int64("request_with_successful_queries_total", "The number of requests that result in a non-zero number of successful queries from SPs", stats.UnitDimensionless)
 	RequestWithSuccessfulQueriesFilteredCount = stats.Int64("request_with_successful_queries_filtered_total", "The number of requests that result in a non-zero number of successful queries from SPs after filtering", stats.UnitDimensionless)
 	SuccessfulQueriesPerRequestCount          = stats.Int64("successful_queries_per_request_total", "The number of successful queries received per request", stats.UnitDimensionless)
 	SuccessfulQueriesPerRequestFilteredCount  = stats.Int64("successful_queries_per_request_filtered_total", "The number of successful queries received per request after filtering", stats.UnitDimensionless)
+	QueryRejectedCount                        = stats.Int64("query_rejected_total", "The number of successful queries filtered out for asking for payment that is not allowed", stats.UnitDimensionless)
 
 	// Retrieval
 	FailedRetrievalsPerRequestCount = stats.Int64("failed_retrievals_per_request_total", "The number of failed retrieval attempts per request", stats.UnitDimensionless)
@@ -108,6 +112,14 @@ var (
 		Measure:     BlockstoreCacheHitCount,
 		Aggregation: view.Count(),
 	}
+	candidateCacheHitView = &view.View{
+		Measure:     CandidateCacheHitCount,
+		Aggregation: view.Count(),
+	}
+	candidateCacheMissView = &view.View{
+		Measure:     CandidateCacheMissCount,
+		Aggregation: view.Count(),
+	}
 	bytesTransferredView = &view.View{
 		Measure:     BytesTransferredTotal,
 		Aggregation: view.Sum(),
@@ -144,6 +156,10 @@ var (
 		Measure:     RetrievalDealCost,
 		Aggregation: view.Distribution(),
 	}
+	retrievalSpendView = &view.View{
+		Measure:     RetrievalSpend,
+		Aggregation: view.Sum(),
+	}
 	retrievalDealDurationView = &view.View{
 		Measure:     RetrievalDealDuration,
 		Aggregation: view.Distribution(0, 10, 20, 30, 40, 50, 60, 120, 240, 480, 540, 600),
@@ -236,6 +252,10 @@ var (
 		Measure:     QueryErrorOtherCount,
 		Aggregation: view.Count(),
 	}
+	queryRejectedView = &view.View{
+		Measure:     QueryRejectedCount,
+		Aggregation: view.Count(),
+	}
 )
 
 var DefaultViews = []*view.View{
@@ -244,6 +264,8 @@ var DefaultViews = []*view.View{
 	bitswapRetreiverRequestView,
 	blockstoreCacheHitView,
 	bytesTransferredView,
+	candidateCacheHitView,
+	candidateCacheMissView,
 	failedRetrievalsPerRequestView,
 	requestWithIndexerCandidatesFilteredView,
 	requestWithIndexerCandidatesView,
@@ -252,6 +274,7 @@ var DefaultViews = []*view.View{
 	indexerCandidatesPerRequestView,
 	retrievalDealActiveView,
 	retrievalDealCostView,
+	retrievalSpendView,
 	retrievalDealDurationView,
 	retrievalDealFailView,
 	retrievalDealSuccessView,
@@ -275,4 +298,5 @@ var DefaultViews = []*view.View{
 	queryErrorDAGStoreView,
 	queryErrorDealNotFoundView,
 	queryErrorOtherView,
+	queryRejectedView,
 }
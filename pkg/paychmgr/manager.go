@@ -0,0 +1,394 @@
+package paychmgr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	init8 "github.com/filecoin-project/go-state-types/builtin/v8/init"
+	"github.com/filecoin-project/go-state-types/builtin/v8/paych"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("paychmgr")
+
+var (
+	ErrLaneNotAllocated  = errors.New("lane not allocated")
+	ErrVoucherAmountLess = errors.New("voucher amount is less than a previous voucher on the lane")
+)
+
+// DefaultMessageConfidence is the number of epochs to wait after a message
+// lands on chain before it is relied upon
+const DefaultMessageConfidence = 5
+
+// Config configures how payment channels are funded
+type Config struct {
+	// ChannelFunds is the amount added to a payment channel when it's created
+	// and each time it is topped up
+	ChannelFunds abi.TokenAmount
+	// MinChannelFunds is the least a payment channel may have available when
+	// a retrieval starts, below this it is topped up with ChannelFunds. If nil
+	// channels are topped up only once they have nothing left.
+	MinChannelFunds abi.TokenAmount
+	// MessageConfidence is the number of epochs to wait after a message lands
+	// on chain, defaults to DefaultMessageConfidence
+	MessageConfidence uint64
+}
+
+// Manager is a client.PayChannelManager that keeps its key in a local Wallet and
+// sends messages to create and fund payment channels through a Lotus
+// compatible node. Its ledger of channels, lanes and vouchers is persisted in a
+// datastore.
+type Manager struct {
+	ctx    context.Context
+	api    NodeAPI
+	wallet *Wallet
+	store  *store
+	cfg    Config
+
+	// lk protects the ledger; targetLks serialize the creation and funding of
+	// the channel for each target, which can wait on the chain for some time;
+	// msgLk serializes sending messages from the wallet so that messages for
+	// different targets aren't given the same nonce
+	lk        sync.Mutex
+	targetLks map[address.Address]*sync.Mutex
+	msgLk     sync.Mutex
+}
+
+// NewManager creates a Manager whose ledger is persisted in the given
+// datastore. Pending messages are only waited on once Start is called.
+func NewManager(ctx context.Context, ds datastore.Batching, api NodeAPI, wallet *Wallet, cfg Config) (*Manager, error) {
+	if cfg.ChannelFunds.Nil() || cfg.ChannelFunds.Sign() <= 0 {
+		return nil, errors.New("ChannelFunds must be greater than zero")
+	}
+	if cfg.MinChannelFunds.Nil() {
+		cfg.MinChannelFunds = big.NewInt(1)
+	}
+	if cfg.MessageConfidence == 0 {
+		cfg.MessageConfidence = DefaultMessageConfidence
+	}
+	return &Manager{
+		ctx:       ctx,
+		api:       api,
+		wallet:    wallet,
+		store:     newStore(ds),
+		cfg:       cfg,
+		targetLks: make(map[address.Address]*sync.Mutex),
+	}, nil
+}
+
+// Start waits, in the background, on any messages that were sent to create or
+// fund a channel but had not landed on chain when the Manager last stopped
+func (m *Manager) Start() error {
+	infos, err := m.store.list(m.ctx)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.PendingMsg == nil {
+			continue
+		}
+		target := info.Target
+		targetLk := m.targetLock(target)
+		targetLk.Lock()
+		go func() {
+			defer targetLk.Unlock()
+			if err := m.waitPending(m.ctx, target); err != nil {
+				log.Errorf("failed waiting on pending message for payment channel to %s: %s", target, err.Error())
+			}
+		}()
+	}
+	return nil
+}
+
+// GetPayChannelWithMinFunds returns the payment channel to a target, creating
+// it or adding funds to it first if it has less than MinChannelFunds
+// available. It waits for those messages to land on chain.
+func (m *Manager) GetPayChannelWithMinFunds(ctx context.Context, target address.Address) (address.Address, error) {
+	targetLk := m.targetLock(target)
+	targetLk.Lock()
+	defer targetLk.Unlock()
+
+	if err := m.waitPending(ctx, target); err != nil {
+		return address.Undef, err
+	}
+
+	m.lk.Lock()
+	info, err := m.store.get(ctx, target)
+	if errors.Is(err, ErrChannelNotFound) {
+		info = &ChannelInfo{
+			Control:       m.wallet.Address(),
+			Target:        target,
+			Amount:        big.Zero(),
+			PendingAmount: big.Zero(),
+			Lanes:         make(map[uint64]LaneState),
+		}
+		err = nil
+	}
+	m.lk.Unlock()
+	if err != nil {
+		return address.Undef, err
+	}
+
+	if info.Channel != nil && info.Available().GreaterThanEqual(m.cfg.MinChannelFunds) {
+		return *info.Channel, nil
+	}
+
+	var msgCid cid.Cid
+	if info.Channel == nil {
+		log.Infof("Creating payment channel to %s with %s", target, m.cfg.ChannelFunds)
+		msgCid, err = m.createChannel(ctx, target)
+	} else {
+		log.Infof("Adding %s to payment channel %s", m.cfg.ChannelFunds, *info.Channel)
+		msgCid, err = m.pushMessage(ctx, *info.Channel, m.cfg.ChannelFunds, builtin.MethodSend, nil)
+	}
+	if err != nil {
+		return address.Undef, err
+	}
+
+	if err := m.update(ctx, target, info, func(info *ChannelInfo) {
+		info.PendingMsg = &msgCid
+		info.PendingAmount = m.cfg.ChannelFunds
+	}); err != nil {
+		return address.Undef, err
+	}
+
+	if err := m.waitPending(ctx, target); err != nil {
+		return address.Undef, err
+	}
+	info, err = m.get(ctx, target)
+	if err != nil {
+		return address.Undef, err
+	}
+	return *info.Channel, nil
+}
+
+// AllocateLane allocates a lane for a retrieval from the payment channel,
+// lanes are never reused
+func (m *Manager) AllocateLane(ctx context.Context, channel address.Address) (uint64, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	info, err := m.store.byChannel(ctx, channel)
+	if err != nil {
+		return 0, err
+	}
+	lane := info.NextLane
+	info.NextLane++
+	if err := m.store.put(ctx, info); err != nil {
+		return 0, err
+	}
+	return lane, nil
+}
+
+// CreateVoucher creates and signs a voucher for the cumulative amount paid on
+// a lane. The voucher's nonce is replaced with the next nonce for the lane,
+// which is persisted before the voucher is returned. If there are not enough
+// funds available in the channel no voucher is created and the shortfall is
+// returned.
+func (m *Manager) CreateVoucher(ctx context.Context, channel address.Address, voucher paych.SignedVoucher) (*paych.SignedVoucher, big.Int, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	info, err := m.store.byChannel(ctx, channel)
+	if err != nil {
+		return nil, big.Zero(), err
+	}
+	if voucher.Lane >= info.NextLane {
+		return nil, big.Zero(), fmt.Errorf("%w: %d", ErrLaneNotAllocated, voucher.Lane)
+	}
+
+	laneState, hasVouchers := info.Lanes[voucher.Lane]
+	nonce := uint64(1)
+	laneAmount := big.Zero()
+	if hasVouchers {
+		nonce = laneState.Nonce + 1
+		laneAmount = laneState.Amount
+	}
+	if voucher.Amount.Nil() {
+		return nil, big.Zero(), errors.New("voucher has no amount")
+	}
+	if voucher.Amount.LessThan(laneAmount) {
+		return nil, big.Zero(), fmt.Errorf("%w: %s < %s", ErrVoucherAmountLess, voucher.Amount, laneAmount)
+	}
+
+	// only the increase on this lane is new spending from the channel
+	if shortfall := big.Sub(big.Sub(voucher.Amount, laneAmount), info.Available()); shortfall.Sign() > 0 {
+		return nil, shortfall, nil
+	}
+
+	voucher.ChannelAddr = channel
+	voucher.Nonce = nonce
+	voucher.Signature = nil
+	signingBytes, err := voucher.SigningBytes()
+	if err != nil {
+		return nil, big.Zero(), err
+	}
+	voucher.Signature, err = m.wallet.Sign(signingBytes)
+	if err != nil {
+		return nil, big.Zero(), err
+	}
+
+	info.Lanes[voucher.Lane] = LaneState{Nonce: nonce, Amount: voucher.Amount}
+	if err := m.store.put(ctx, info); err != nil {
+		return nil, big.Zero(), err
+	}
+	return &voucher, big.Zero(), nil
+}
+
+// ChannelInfo returns the ledger of the payment channel to a target
+func (m *Manager) ChannelInfo(ctx context.Context, target address.Address) (*ChannelInfo, error) {
+	return m.get(ctx, target)
+}
+
+func (m *Manager) targetLock(target address.Address) *sync.Mutex {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	targetLk, ok := m.targetLks[target]
+	if !ok {
+		targetLk = &sync.Mutex{}
+		m.targetLks[target] = targetLk
+	}
+	return targetLk
+}
+
+func (m *Manager) get(ctx context.Context, target address.Address) (*ChannelInfo, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.store.get(ctx, target)
+}
+
+// update applies a change to the latest persisted ledger for a target, or to
+// the given new ledger if there is none yet
+func (m *Manager) update(ctx context.Context, target address.Address, newInfo *ChannelInfo, change func(*ChannelInfo)) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	info, err := m.store.get(ctx, target)
+	if errors.Is(err, ErrChannelNotFound) {
+		info, err = newInfo, nil
+	}
+	if err != nil {
+		return err
+	}
+	change(info)
+	return m.store.put(ctx, info)
+}
+
+// waitPending waits for a pending message creating or funding the channel to a
+// target to land on chain and updates the ledger with the result; the target
+// lock must be held
+func (m *Manager) waitPending(ctx context.Context, target address.Address) error {
+	info, err := m.get(ctx, target)
+	if errors.Is(err, ErrChannelNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.PendingMsg == nil {
+		return nil
+	}
+
+	lookup, err := m.api.StateWaitMsg(ctx, *info.PendingMsg, m.cfg.MessageConfidence)
+	if err != nil {
+		// the message may still land, so it remains pending
+		return fmt.Errorf("waiting for message %s: %w", *info.PendingMsg, err)
+	}
+	msgErr := lookup.Err()
+	var channel address.Address
+	if msgErr == nil && info.Channel == nil {
+		var execReturn init8.ExecReturn
+		if err := execReturn.UnmarshalCBOR(bytes.NewReader(lookup.Receipt.Return)); err != nil {
+			msgErr = fmt.Errorf("decoding payment channel create return: %w", err)
+		}
+		channel = execReturn.RobustAddress
+	}
+
+	if err := m.update(ctx, target, info, func(info *ChannelInfo) {
+		if msgErr == nil {
+			if info.Channel == nil {
+				info.Channel = &channel
+			}
+			info.Amount = big.Add(info.Amount, info.PendingAmount)
+		}
+		info.PendingMsg = nil
+		info.PendingAmount = big.Zero()
+	}); err != nil {
+		return err
+	}
+	if msgErr != nil {
+		return msgErr
+	}
+	log.Infof("Message %s for payment channel to %s landed, adding %s", lookup.Message, target, info.PendingAmount)
+	return nil
+}
+
+// createChannel sends a message to the init actor to create a payment channel
+// to the target, funded with ChannelFunds
+func (m *Manager) createChannel(ctx context.Context, target address.Address) (cid.Cid, error) {
+	version, err := m.api.StateNetworkVersion(ctx)
+	if err != nil {
+		return cid.Undef, err
+	}
+	codeCids, err := m.api.StateActorCodeCIDs(ctx, version)
+	if err != nil {
+		return cid.Undef, err
+	}
+	paychCodeCid, ok := codeCids["paymentchannel"]
+	if !ok {
+		return cid.Undef, fmt.Errorf("no payment channel actor for network version %d", version)
+	}
+
+	var constructorParams bytes.Buffer
+	if err := (&paych.ConstructorParams{From: m.wallet.Address(), To: target}).MarshalCBOR(&constructorParams); err != nil {
+		return cid.Undef, err
+	}
+	var execParams bytes.Buffer
+	if err := (&init8.ExecParams{CodeCID: paychCodeCid, ConstructorParams: constructorParams.Bytes()}).MarshalCBOR(&execParams); err != nil {
+		return cid.Undef, err
+	}
+	return m.pushMessage(ctx, builtin.InitActorAddr, m.cfg.ChannelFunds, builtin.MethodsInit.Exec, execParams.Bytes())
+}
+
+// pushMessage signs a message from the wallet and submits it to the node
+func (m *Manager) pushMessage(ctx context.Context, to address.Address, value abi.TokenAmount, method abi.MethodNum, params []byte) (cid.Cid, error) {
+	// the nonce must not be taken by another message before this one is in
+	// the node's message pool
+	m.msgLk.Lock()
+	defer m.msgLk.Unlock()
+
+	nonce, err := m.api.MpoolGetNonce(ctx, m.wallet.Address())
+	if err != nil {
+		return cid.Undef, err
+	}
+	msg, err := m.api.GasEstimateMessageGas(ctx, &Message{
+		To:         to,
+		From:       m.wallet.Address(),
+		Nonce:      nonce,
+		Value:      value,
+		Method:     method,
+		Params:     params,
+		GasFeeCap:  big.Zero(),
+		GasPremium: big.Zero(),
+	})
+	if err != nil {
+		return cid.Undef, fmt.Errorf("estimating gas: %w", err)
+	}
+	msgCid, err := msg.Cid()
+	if err != nil {
+		return cid.Undef, err
+	}
+	signature, err := m.wallet.Sign(msgCid.Bytes())
+	if err != nil {
+		return cid.Undef, err
+	}
+	return m.api.MpoolPush(ctx, &SignedMessage{Message: *msg, Signature: *signature})
+}
@@ -0,0 +1,263 @@
+package paychmgr_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v8/paych"
+	"github.com/filecoin-project/lassie/pkg/client"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/paychmgr"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+var _ client.PayChannelManager = (*paychmgr.Manager)(nil)
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	node := testutil.NewMockChainNode()
+	defer node.Close()
+	wallet, err := paychmgr.NewWallet()
+	require.NoError(t, err)
+	node.SetBalance(wallet.Address(), big.NewInt(1000))
+	target, err := address.NewIDAddress(1234)
+	require.NoError(t, err)
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	cfg := paychmgr.Config{ChannelFunds: big.NewInt(100), MinChannelFunds: big.NewInt(10)}
+	mgr, err := paychmgr.NewManager(ctx, ds, paychmgr.NewNodeRPCClient(node.Endpoint(), ""), wallet, cfg)
+	require.NoError(t, err)
+	require.NoError(t, mgr.Start())
+
+	// creates a channel funded with ChannelFunds
+	channel, err := mgr.GetPayChannelWithMinFunds(ctx, target)
+	require.NoError(t, err)
+	params, ok := node.Channel(channel)
+	require.True(t, ok)
+	require.Equal(t, wallet.Address(), params.From)
+	require.Equal(t, target, params.To)
+	require.Equal(t, big.NewInt(100), node.Balance(channel))
+	require.Equal(t, big.NewInt(900), node.Balance(wallet.Address()))
+
+	// the existing channel is reused while it has enough funds
+	again, err := mgr.GetPayChannelWithMinFunds(ctx, target)
+	require.NoError(t, err)
+	require.Equal(t, channel, again)
+	require.Len(t, node.PushedMessages(), 1)
+
+	lane0, err := mgr.AllocateLane(ctx, channel)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lane0)
+	lane1, err := mgr.AllocateLane(ctx, channel)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lane1)
+
+	createVoucher := func(lane uint64, amount int64, expectedNonce uint64) {
+		voucher, shortfall, err := mgr.CreateVoucher(ctx, channel, paych.SignedVoucher{ChannelAddr: channel, Lane: lane, Amount: big.NewInt(amount)})
+		require.NoError(t, err)
+		require.Equal(t, big.Zero(), shortfall)
+		require.Equal(t, expectedNonce, voucher.Nonce)
+		require.Equal(t, big.NewInt(amount), voucher.Amount)
+		signingBytes, err := voucher.SigningBytes()
+		require.NoError(t, err)
+		require.NoError(t, paychmgr.VerifySignature(voucher.Signature, wallet.Address(), signingBytes))
+	}
+
+	// nonces increase per lane, regardless of the nonce asked for
+	createVoucher(lane0, 30, 1)
+	createVoucher(lane0, 50, 2)
+	createVoucher(lane1, 10, 1)
+
+	// amounts on a lane are cumulative
+	_, _, err = mgr.CreateVoucher(ctx, channel, paych.SignedVoucher{Lane: lane0, Amount: big.NewInt(40)})
+	require.ErrorIs(t, err, paychmgr.ErrVoucherAmountLess)
+	// lanes must be allocated
+	_, _, err = mgr.CreateVoucher(ctx, channel, paych.SignedVoucher{Lane: 2, Amount: big.NewInt(1)})
+	require.ErrorIs(t, err, paychmgr.ErrLaneNotAllocated)
+	// 40 is available, so an increase of 50 on lane 1 falls 10 short
+	voucher, shortfall, err := mgr.CreateVoucher(ctx, channel, paych.SignedVoucher{Lane: lane1, Amount: big.NewInt(60)})
+	require.NoError(t, err)
+	require.Nil(t, voucher)
+	require.Equal(t, big.NewInt(10), shortfall)
+	createVoucher(lane1, 45, 2)
+
+	info, err := mgr.ChannelInfo(ctx, target)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(5), info.Available())
+
+	// with less than MinChannelFunds available the channel is topped up
+	again, err = mgr.GetPayChannelWithMinFunds(ctx, target)
+	require.NoError(t, err)
+	require.Equal(t, channel, again)
+	require.Len(t, node.PushedMessages(), 2)
+	require.Equal(t, big.NewInt(200), node.Balance(channel))
+	info, err = mgr.ChannelInfo(ctx, target)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(105), info.Available())
+
+	// the ledger survives a restart, lanes and nonces are never reused
+	mgr, err = paychmgr.NewManager(ctx, ds, paychmgr.NewNodeRPCClient(node.Endpoint(), ""), wallet, cfg)
+	require.NoError(t, err)
+	require.NoError(t, mgr.Start())
+	lane2, err := mgr.AllocateLane(ctx, channel)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lane2)
+	createVoucher(lane0, 60, 3)
+	createVoucher(lane2, 10, 1)
+}
+
+func TestManagerConcurrentChannels(t *testing.T) {
+	ctx := context.Background()
+	node := testutil.NewMockChainNode()
+	defer node.Close()
+	wallet, err := paychmgr.NewWallet()
+	require.NoError(t, err)
+	node.SetBalance(wallet.Address(), big.NewInt(1000))
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	cfg := paychmgr.Config{ChannelFunds: big.NewInt(100)}
+	mgr, err := paychmgr.NewManager(ctx, ds, paychmgr.NewNodeRPCClient(node.Endpoint(), ""), wallet, cfg)
+	require.NoError(t, err)
+	require.NoError(t, mgr.Start())
+
+	// messages for channels to different targets are sent at once, each must
+	// take its own nonce
+	channels := make([]address.Address, 5)
+	var wg sync.WaitGroup
+	for i := range channels {
+		i := i
+		target, err := address.NewIDAddress(uint64(1000 + i))
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			channel, err := mgr.GetPayChannelWithMinFunds(ctx, target)
+			require.NoError(t, err)
+			channels[i] = channel
+		}()
+	}
+	wg.Wait()
+	require.Len(t, node.PushedMessages(), len(channels))
+
+	// each channel's ledger is found by its address
+	for i, channel := range channels {
+		params, ok := node.Channel(channel)
+		require.True(t, ok)
+		require.Equal(t, uint64(1000+i), mustID(t, params.To))
+		lane, err := mgr.AllocateLane(ctx, channel)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), lane)
+	}
+	unknown, err := address.NewIDAddress(9999)
+	require.NoError(t, err)
+	_, err = mgr.AllocateLane(ctx, unknown)
+	require.ErrorIs(t, err, paychmgr.ErrChannelNotFound)
+}
+
+func mustID(t *testing.T, addr address.Address) uint64 {
+	id, err := address.IDFromAddress(addr)
+	require.NoError(t, err)
+	return id
+}
+
+func TestManagerPendingMessage(t *testing.T) {
+	ctx := context.Background()
+	node := testutil.NewMockChainNode()
+	defer node.Close()
+	wallet, err := paychmgr.NewWallet()
+	require.NoError(t, err)
+	node.SetBalance(wallet.Address(), big.NewInt(1000))
+	target, err := address.NewIDAddress(1234)
+	require.NoError(t, err)
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	cfg := paychmgr.Config{ChannelFunds: big.NewInt(100)}
+	mgr, err := paychmgr.NewManager(ctx, ds, paychmgr.NewNodeRPCClient(node.Endpoint(), ""), wallet, cfg)
+	require.NoError(t, err)
+	require.NoError(t, mgr.Start())
+
+	// the create message is sent but we stop waiting before it lands
+	node.Hold()
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = mgr.GetPayChannelWithMinFunds(timeoutCtx, target)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	info, err := mgr.ChannelInfo(ctx, target)
+	require.NoError(t, err)
+	require.NotNil(t, info.PendingMsg)
+	require.Nil(t, info.Channel)
+
+	// after a restart the pending message is waited on rather than sending
+	// another
+	mgr, err = paychmgr.NewManager(ctx, ds, paychmgr.NewNodeRPCClient(node.Endpoint(), ""), wallet, cfg)
+	require.NoError(t, err)
+	require.NoError(t, mgr.Start())
+	node.Release()
+	channel, err := mgr.GetPayChannelWithMinFunds(ctx, target)
+	require.NoError(t, err)
+	require.Len(t, node.PushedMessages(), 1)
+	require.Equal(t, big.NewInt(100), node.Balance(channel))
+	info, err = mgr.ChannelInfo(ctx, target)
+	require.NoError(t, err)
+	require.Nil(t, info.PendingMsg)
+	require.Equal(t, big.NewInt(100), info.Available())
+}
+
+func TestManagerFailedMessage(t *testing.T) {
+	ctx := context.Background()
+	node := testutil.NewMockChainNode()
+	defer node.Close()
+	wallet, err := paychmgr.NewWallet()
+	require.NoError(t, err)
+	target, err := address.NewIDAddress(1234)
+	require.NoError(t, err)
+
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	mgr, err := paychmgr.NewManager(ctx, ds, paychmgr.NewNodeRPCClient(node.Endpoint(), ""), wallet, paychmgr.Config{ChannelFunds: big.NewInt(100)})
+	require.NoError(t, err)
+	require.NoError(t, mgr.Start())
+
+	// the wallet has no funds so the create message fails on chain
+	_, err = mgr.GetPayChannelWithMinFunds(ctx, target)
+	require.ErrorContains(t, err, "exit code")
+	info, err := mgr.ChannelInfo(ctx, target)
+	require.NoError(t, err)
+	require.Nil(t, info.PendingMsg)
+	require.Nil(t, info.Channel)
+	require.Equal(t, abi.NewTokenAmount(0), info.Amount)
+
+	// once funded, creation is tried again
+	node.SetBalance(wallet.Address(), big.NewInt(1000))
+	channel, err := mgr.GetPayChannelWithMinFunds(ctx, target)
+	require.NoError(t, err)
+	require.Equal(t, big.NewInt(100), node.Balance(channel))
+}
+
+func TestLoadWallet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.key")
+
+	// a key is created where there is none
+	wallet, err := paychmgr.LoadWallet(path)
+	require.NoError(t, err)
+	require.Equal(t, address.SECP256K1, wallet.Address().Protocol())
+
+	loaded, err := paychmgr.LoadWallet(path)
+	require.NoError(t, err)
+	require.Equal(t, wallet.Address(), loaded.Address())
+
+	signature, err := loaded.Sign([]byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, paychmgr.VerifySignature(signature, wallet.Address(), []byte("data")))
+	require.Error(t, paychmgr.VerifySignature(signature, wallet.Address(), []byte("other data")))
+
+	_, err = paychmgr.NewWalletFromKeyInfo(paychmgr.KeyInfo{Type: "bls", PrivateKey: make([]byte, 32)})
+	require.ErrorIs(t, err, paychmgr.ErrUnsupportedKeyType)
+}
@@ -0,0 +1,129 @@
+package paychmgr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+/*
+	Message types ripped from lotus chain types to avoid the lotus dependency.
+	Only what's needed to send messages to a node's mpool is included.
+*/
+
+var messagePrefix = cid.Prefix{
+	Version:  1,
+	Codec:    cid.DagCBOR,
+	MhType:   multihash.BLAKE2B_MIN + 31,
+	MhLength: -1,
+}
+
+// Message is an unsigned Filecoin chain message, compatible with the JSON
+// and CBOR encodings of the Lotus API
+type Message struct {
+	Version    uint64
+	To         address.Address
+	From       address.Address
+	Nonce      uint64
+	Value      abi.TokenAmount
+	GasLimit   int64
+	GasFeeCap  abi.TokenAmount
+	GasPremium abi.TokenAmount
+	Method     abi.MethodNum
+	Params     []byte
+}
+
+// MarshalCBOR encodes the message as a CBOR tuple, as it's stored on chain
+func (m *Message) MarshalCBOR(w io.Writer) error {
+	cw := cbg.NewCborWriter(w)
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, 10); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, m.Version); err != nil {
+		return err
+	}
+	if err := m.To.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	if err := m.From.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, m.Nonce); err != nil {
+		return err
+	}
+	if err := marshalTokenAmount(cw, m.Value); err != nil {
+		return err
+	}
+	if m.GasLimit >= 0 {
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(m.GasLimit)); err != nil {
+			return err
+		}
+	} else {
+		if err := cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-m.GasLimit-1)); err != nil {
+			return err
+		}
+	}
+	if err := marshalTokenAmount(cw, m.GasFeeCap); err != nil {
+		return err
+	}
+	if err := marshalTokenAmount(cw, m.GasPremium); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(m.Method)); err != nil {
+		return err
+	}
+	return cbg.WriteByteArray(cw, m.Params)
+}
+
+// Cid returns the CID of the message, which is what's signed to send it
+func (m *Message) Cid() (cid.Cid, error) {
+	var buf bytes.Buffer
+	if err := m.MarshalCBOR(&buf); err != nil {
+		return cid.Undef, err
+	}
+	return messagePrefix.Sum(buf.Bytes())
+}
+
+// SignedMessage is a message signed by the key of its From address
+type SignedMessage struct {
+	Message   Message
+	Signature crypto.Signature
+}
+
+// MessageReceipt is the result of executing a message on chain
+type MessageReceipt struct {
+	ExitCode exitcode.ExitCode
+	Return   []byte
+	GasUsed  int64
+}
+
+// MsgLookup is the response to waiting for a message to land on chain
+type MsgLookup struct {
+	Message cid.Cid
+	Receipt MessageReceipt
+	Height  abi.ChainEpoch
+}
+
+// Err returns an error if the message failed to execute
+func (ml *MsgLookup) Err() error {
+	if ml.Receipt.ExitCode != exitcode.Ok {
+		return fmt.Errorf("message %s failed with exit code %s", ml.Message, ml.Receipt.ExitCode)
+	}
+	return nil
+}
+
+func marshalTokenAmount(w io.Writer, amount abi.TokenAmount) error {
+	if amount.Nil() {
+		amount = big.Zero()
+	}
+	return amount.MarshalCBOR(w)
+}
@@ -0,0 +1,158 @@
+package paychmgr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/ipfs/go-cid"
+)
+
+// NodeAPI is the subset of the Lotus full node API used to create and fund
+// payment channels. Messages are signed locally, so the node needs no access
+// to the wallet's key.
+type NodeAPI interface {
+	// MpoolGetNonce returns the next nonce for messages from an address
+	MpoolGetNonce(ctx context.Context, addr address.Address) (uint64, error)
+	// GasEstimateMessageGas fills in the gas fields of a message
+	GasEstimateMessageGas(ctx context.Context, msg *Message) (*Message, error)
+	// MpoolPush submits a signed message to the node's message pool
+	MpoolPush(ctx context.Context, msg *SignedMessage) (cid.Cid, error)
+	// StateWaitMsg waits for a message to land on chain with the given number
+	// of confirmations
+	StateWaitMsg(ctx context.Context, msgCid cid.Cid, confidence uint64) (*MsgLookup, error)
+	// StateNetworkVersion returns the network version at the chain head
+	StateNetworkVersion(ctx context.Context) (network.Version, error)
+	// StateActorCodeCIDs returns the code CIDs of the builtin actors for a
+	// network version, keyed by actor name
+	StateActorCodeCIDs(ctx context.Context, version network.Version) (map[string]cid.Cid, error)
+}
+
+var _ NodeAPI = (*NodeRPCClient)(nil)
+
+// NodeRPCClient calls a Lotus compatible node over its JSON-RPC API
+type NodeRPCClient struct {
+	endpoint   string
+	token      string
+	httpClient *http.Client
+	nextId     int64
+}
+
+// NewNodeRPCClient creates a client for the JSON-RPC API at the given endpoint,
+// such as http://127.0.0.1:1234/rpc/v1. The token is sent as a bearer token
+// if it is not empty.
+func NewNodeRPCClient(endpoint string, token string) *NodeRPCClient {
+	return &NodeRPCClient{
+		endpoint:   endpoint,
+		token:      token,
+		httpClient: http.DefaultClient,
+	}
+}
+
+type rpcRequest struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+	Id      int64         `json:"id"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// RPCError is an error returned by the node in response to a call
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("RPC error (%d): %s", e.Code, e.Message)
+}
+
+func (c *NodeRPCClient) call(ctx context.Context, method string, result interface{}, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(rpcRequest{
+		Jsonrpc: "2.0",
+		Method:  "Filecoin." + method,
+		Params:  params,
+		Id:      atomic.AddInt64(&c.nextId, 1),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("calling %s: unexpected HTTP status %s", method, resp.Status)
+	}
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("calling %s: %w", method, err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("calling %s: %w", method, rpcResp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(rpcResp.Result, result)
+}
+
+func (c *NodeRPCClient) MpoolGetNonce(ctx context.Context, addr address.Address) (uint64, error) {
+	var nonce uint64
+	return nonce, c.call(ctx, "MpoolGetNonce", &nonce, addr)
+}
+
+func (c *NodeRPCClient) GasEstimateMessageGas(ctx context.Context, msg *Message) (*Message, error) {
+	var estimated Message
+	// a nil send spec and tipset key estimate with defaults at the chain head
+	if err := c.call(ctx, "GasEstimateMessageGas", &estimated, msg, nil, nil); err != nil {
+		return nil, err
+	}
+	return &estimated, nil
+}
+
+func (c *NodeRPCClient) MpoolPush(ctx context.Context, msg *SignedMessage) (cid.Cid, error) {
+	var msgCid cid.Cid
+	return msgCid, c.call(ctx, "MpoolPush", &msgCid, msg)
+}
+
+func (c *NodeRPCClient) StateWaitMsg(ctx context.Context, msgCid cid.Cid, confidence uint64) (*MsgLookup, error) {
+	var lookup MsgLookup
+	// -1 is no limit on how far back to look for the message, and replaced
+	// messages are allowed as the node may reprice them
+	if err := c.call(ctx, "StateWaitMsg", &lookup, msgCid, confidence, -1, true); err != nil {
+		return nil, err
+	}
+	return &lookup, nil
+}
+
+func (c *NodeRPCClient) StateNetworkVersion(ctx context.Context) (network.Version, error) {
+	var version network.Version
+	return version, c.call(ctx, "StateNetworkVersion", &version, nil)
+}
+
+func (c *NodeRPCClient) StateActorCodeCIDs(ctx context.Context, version network.Version) (map[string]cid.Cid, error) {
+	var codeCids map[string]cid.Cid
+	return codeCids, c.call(ctx, "StateActorCodeCIDs", &codeCids, version)
+}
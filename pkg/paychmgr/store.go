@@ -0,0 +1,163 @@
+package paychmgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+)
+
+var ErrChannelNotFound = errors.New("payment channel not found")
+
+// ChannelInfo is the ledger for a payment channel to a single target. It is
+// persisted whenever it changes so that lanes and voucher nonces are never
+// reused across restarts.
+type ChannelInfo struct {
+	// Channel is the address of the payment channel, nil until it has been
+	// created on chain
+	Channel *address.Address
+	// Control is the address that funds the channel and signs its vouchers
+	Control address.Address
+	// Target is the address the channel pays
+	Target address.Address
+	// Amount is the total that has been confirmed as added to the channel
+	Amount abi.TokenAmount
+	// PendingAmount is being added to the channel by PendingMsg
+	PendingAmount abi.TokenAmount
+	// PendingMsg is a message creating or adding funds to the channel that is
+	// waiting to land on chain
+	PendingMsg *cid.Cid
+	// NextLane is the next lane to be allocated
+	NextLane uint64
+	// Lanes holds the last voucher created for each lane
+	Lanes map[uint64]LaneState
+}
+
+// LaneState is the nonce and cumulative amount of the last voucher created for
+// a lane
+type LaneState struct {
+	Nonce  uint64
+	Amount abi.TokenAmount
+}
+
+// Redeemable returns the total that can be redeemed with the vouchers created
+// so far, across all lanes
+func (ci *ChannelInfo) Redeemable() abi.TokenAmount {
+	total := big.Zero()
+	for _, lane := range ci.Lanes {
+		total = big.Add(total, lane.Amount)
+	}
+	return total
+}
+
+// Available returns what remains in the channel to create vouchers with
+func (ci *ChannelInfo) Available() abi.TokenAmount {
+	return big.Sub(ci.Amount, ci.Redeemable())
+}
+
+// store persists ChannelInfo, keyed by the channel's target, and indexes the
+// target of each channel by the channel's address
+type store struct {
+	ds       datastore.Batching
+	channels datastore.Batching
+}
+
+func newStore(ds datastore.Batching) *store {
+	return &store{
+		ds:       namespace.Wrap(ds, datastore.NewKey("/paych")),
+		channels: namespace.Wrap(ds, datastore.NewKey("/paych-channels")),
+	}
+}
+
+func (s *store) get(ctx context.Context, target address.Address) (*ChannelInfo, error) {
+	byts, err := s.ds.Get(ctx, datastore.NewKey(target.String()))
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, ErrChannelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeChannelInfo(byts)
+}
+
+func (s *store) put(ctx context.Context, info *ChannelInfo) error {
+	byts, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if info.Channel != nil {
+		// the index is written first, byChannel checks the ledger it points
+		// to is for the channel
+		channelKey := datastore.NewKey(info.Channel.String())
+		if err := s.channels.Put(ctx, channelKey, info.Target.Bytes()); err != nil {
+			return err
+		}
+		if err := s.channels.Sync(ctx, channelKey); err != nil {
+			return err
+		}
+	}
+	if err := s.ds.Put(ctx, datastore.NewKey(info.Target.String()), byts); err != nil {
+		return err
+	}
+	return s.ds.Sync(ctx, datastore.NewKey(info.Target.String()))
+}
+
+func (s *store) list(ctx context.Context) ([]*ChannelInfo, error) {
+	results, err := s.ds.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	var infos []*ChannelInfo
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		info, err := decodeChannelInfo(result.Value)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s *store) byChannel(ctx context.Context, channel address.Address) (*ChannelInfo, error) {
+	targetBytes, err := s.channels.Get(ctx, datastore.NewKey(channel.String()))
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, ErrChannelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	target, err := address.NewFromBytes(targetBytes)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.get(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if info.Channel == nil || *info.Channel != channel {
+		return nil, ErrChannelNotFound
+	}
+	return info, nil
+}
+
+func decodeChannelInfo(byts []byte) (*ChannelInfo, error) {
+	var info ChannelInfo
+	if err := json.Unmarshal(byts, &info); err != nil {
+		return nil, err
+	}
+	if info.Lanes == nil {
+		info.Lanes = make(map[uint64]LaneState)
+	}
+	return &info, nil
+}
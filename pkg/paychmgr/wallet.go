@@ -0,0 +1,144 @@
+package paychmgr
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/minio/blake2b-simd"
+)
+
+// KeyTypeSecp256k1 is the Lotus name for secp256k1 wallet keys, the only type
+// of key a Wallet supports
+const KeyTypeSecp256k1 = "secp256k1"
+
+var ErrUnsupportedKeyType = errors.New("unsupported key type")
+
+// KeyInfo is a private key in the format exported by `lotus wallet export`
+// (hex encoded JSON)
+type KeyInfo struct {
+	Type       string
+	PrivateKey []byte
+}
+
+// Wallet holds the secp256k1 key that controls payment channels, it signs
+// both the messages that create and fund channels and the vouchers that pay
+// from them
+type Wallet struct {
+	privateKey *secp256k1.PrivateKey
+	address    address.Address
+}
+
+// NewWallet creates a wallet with a newly generated key
+func NewWallet() (*Wallet, error) {
+	privateKey, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return newWallet(privateKey)
+}
+
+// NewWalletFromKeyInfo creates a wallet with an existing key
+func NewWalletFromKeyInfo(keyInfo KeyInfo) (*Wallet, error) {
+	if keyInfo.Type != KeyTypeSecp256k1 {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKeyType, keyInfo.Type)
+	}
+	if len(keyInfo.PrivateKey) != secp256k1.PrivKeyBytesLen {
+		return nil, fmt.Errorf("invalid private key length: %d", len(keyInfo.PrivateKey))
+	}
+	return newWallet(secp256k1.PrivKeyFromBytes(keyInfo.PrivateKey))
+}
+
+// LoadWallet reads the key for a wallet from a keystore file in the format
+// exported by `lotus wallet export`. If the file does not exist a new key is
+// generated and written to it.
+func LoadWallet(path string) (*Wallet, error) {
+	byts, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		wallet, err := NewWallet()
+		if err != nil {
+			return nil, err
+		}
+		return wallet, wallet.Save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := hex.DecodeString(strings.TrimSpace(string(byts)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode keystore file %s: %w", path, err)
+	}
+	var keyInfo KeyInfo
+	if err := json.Unmarshal(encoded, &keyInfo); err != nil {
+		return nil, fmt.Errorf("failed to decode keystore file %s: %w", path, err)
+	}
+	return NewWalletFromKeyInfo(keyInfo)
+}
+
+func newWallet(privateKey *secp256k1.PrivateKey) (*Wallet, error) {
+	addr, err := address.NewSecp256k1Address(privateKey.PubKey().SerializeUncompressed())
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{privateKey: privateKey, address: addr}, nil
+}
+
+// Save writes the wallet's key to a keystore file, readable only by the
+// current user
+func (w *Wallet) Save(path string) error {
+	encoded, err := json.Marshal(w.KeyInfo())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hex.EncodeToString(encoded)), 0600)
+}
+
+// KeyInfo returns the wallet's key for export
+func (w *Wallet) KeyInfo() KeyInfo {
+	return KeyInfo{Type: KeyTypeSecp256k1, PrivateKey: w.privateKey.Serialize()}
+}
+
+// Address returns the address of the wallet's key
+func (w *Wallet) Address() address.Address {
+	return w.address
+}
+
+// Sign signs data in the same way as a Lotus wallet, the blake2b-256 hash of
+// the data is signed and the signature is in [R || S || V] form
+func (w *Wallet) Sign(data []byte) (*crypto.Signature, error) {
+	hash := blake2b.Sum256(data)
+	compact := ecdsa.SignCompact(w.privateKey, hash[:], false)
+	// compact signatures are [V+27 || R || S]
+	signature := append(compact[1:], compact[0]-27)
+	return &crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: signature}, nil
+}
+
+// VerifySignature checks that a signature made with Sign is valid for the
+// data and was made by the key of the given address
+func VerifySignature(signature *crypto.Signature, addr address.Address, data []byte) error {
+	if signature == nil || signature.Type != crypto.SigTypeSecp256k1 || len(signature.Data) != 65 {
+		return errors.New("invalid secp256k1 signature")
+	}
+	hash := blake2b.Sum256(data)
+	compact := append([]byte{signature.Data[64] + 27}, signature.Data[:64]...)
+	publicKey, _, err := ecdsa.RecoverCompact(compact, hash[:])
+	if err != nil {
+		return fmt.Errorf("invalid secp256k1 signature: %w", err)
+	}
+	signer, err := address.NewSecp256k1Address(publicKey.SerializeUncompressed())
+	if err != nil {
+		return err
+	}
+	if signer != addr {
+		return fmt.Errorf("signature is from %s, not %s", signer, addr)
+	}
+	return nil
+}
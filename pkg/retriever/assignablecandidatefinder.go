@@ -10,15 +10,20 @@ import (
 	"github.com/filecoin-project/lassie/pkg/events"
 	"github.com/filecoin-project/lassie/pkg/internal/candidatebuffer"
 	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 // AssignableCandidateFinder finds and filters candidates for a given retrieval
 type AssignableCandidateFinder struct {
 	isAcceptableStorageProvider IsAcceptableStorageProvider
 	candidateFinder             CandidateFinder
+	fixedPeerFinder             FixedPeerFinder
 	clock                       clock.Clock
 }
 
+// FixedPeerFinder creates a CandidateFinder for a request's FixedPeers
+type FixedPeerFinder func(peers []peer.AddrInfo) CandidateFinder
+
 const BufferWindow = 5 * time.Millisecond
 
 func NewAssignableCandidateFinder(candidateFinder CandidateFinder, isAcceptableStorageProvider IsAcceptableStorageProvider) AssignableCandidateFinder {
@@ -27,6 +32,14 @@ func NewAssignableCandidateFinder(candidateFinder CandidateFinder, isAcceptableS
 func NewAssignableCandidateFinderWithClock(candidateFinder CandidateFinder, isAcceptableStorageProvider IsAcceptableStorageProvider, clock clock.Clock) AssignableCandidateFinder {
 	return AssignableCandidateFinder{candidateFinder: candidateFinder, isAcceptableStorageProvider: isAcceptableStorageProvider, clock: clock}
 }
+
+// WithFixedPeerFinder returns a copy of the AssignableCandidateFinder that
+// finds candidates for requests with FixedPeers using the given FixedPeerFinder
+func (acf AssignableCandidateFinder) WithFixedPeerFinder(fixedPeerFinder FixedPeerFinder) AssignableCandidateFinder {
+	acf.fixedPeerFinder = fixedPeerFinder
+	return acf
+}
+
 func (acf AssignableCandidateFinder) FindCandidates(ctx context.Context, request types.RetrievalRequest, eventsCallback func(types.RetrievalEvent), onCandidates func([]types.RetrievalCandidate)) error {
 	ctx, cancelCtx := context.WithCancel(ctx)
 	defer cancelCtx()
@@ -34,7 +47,16 @@ func (acf AssignableCandidateFinder) FindCandidates(ctx context.Context, request
 
 	eventsCallback(events.Started(request.RetrievalID, phaseStarted, types.IndexerPhase, types.RetrievalCandidate{RootCid: request.Cid}))
 
-	candidateStream, err := acf.candidateFinder.FindCandidatesAsync(ctx, request.Cid)
+	candidateFinder := acf.candidateFinder
+	if len(request.FixedPeers) > 0 {
+		if acf.fixedPeerFinder == nil {
+			err := ErrFixedPeersNotSupported
+			eventsCallback(events.Failed(request.RetrievalID, phaseStarted, types.IndexerPhase, types.RetrievalCandidate{RootCid: request.Cid}, err.Error()))
+			return fmt.Errorf("could not get retrieval candidates for %s: %w", request.Cid, err)
+		}
+		candidateFinder = acf.fixedPeerFinder(request.FixedPeers)
+	}
+	candidateStream, err := candidateFinder.FindCandidatesAsync(ctx, request.Cid)
 
 	if err != nil {
 		eventsCallback(events.Failed(request.RetrievalID, phaseStarted, types.IndexerPhase, types.RetrievalCandidate{RootCid: request.Cid}, err.Error()))
@@ -47,6 +69,14 @@ func (acf AssignableCandidateFinder) FindCandidates(ctx context.Context, request
 
 		acceptableCandidates := make([]types.RetrievalCandidate, 0)
 		for _, candidate := range candidates {
+			// skip storage providers that have already failed in a previous
+			// attempt at this retrieval
+			if isExcludedStorageProvider(ctx, candidate.MinerPeer.ID) {
+				continue
+			}
+			if !isRequestedStorageProvider(request, candidate.MinerPeer.ID) {
+				continue
+			}
 			if acf.isAcceptableStorageProvider == nil || acf.isAcceptableStorageProvider(candidate.MinerPeer.ID) {
 				acceptableCandidates = append(acceptableCandidates, candidate)
 			}
@@ -72,3 +102,26 @@ func (acf AssignableCandidateFinder) FindCandidates(ctx context.Context, request
 	}
 	return nil
 }
+
+// isRequestedStorageProvider checks a storage provider against the request's
+// ProviderAllowlist and ProviderDenylist, which the local stores aren't
+// subject to
+func isRequestedStorageProvider(request types.RetrievalRequest, storageProviderId peer.ID) bool {
+	if storageProviderId == LocalStorageProviderId {
+		return true
+	}
+	for _, denied := range request.ProviderDenylist {
+		if denied == storageProviderId {
+			return false
+		}
+	}
+	if len(request.ProviderAllowlist) == 0 {
+		return true
+	}
+	for _, allowed := range request.ProviderAllowlist {
+		if allowed == storageProviderId {
+			return true
+		}
+	}
+	return false
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/filecoin-project/lassie/pkg/internal/testutil"
 	"github.com/filecoin-project/lassie/pkg/retriever"
 	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -197,3 +198,106 @@ func TestAssignableCandidateFinder(t *testing.T) {
 	}
 
 }
+
+func TestAssignableCandidateFinderRequestOverrides(t *testing.T) {
+	ctx := context.Background()
+	cid1 := cid.MustParse("bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi")
+	toCandidates := func(peers ...string) []types.RetrievalCandidate {
+		candidates := make([]types.RetrievalCandidate, 0, len(peers))
+		for _, p := range peers {
+			candidates = append(candidates, types.RetrievalCandidate{MinerPeer: peer.AddrInfo{ID: peer.ID(p)}, RootCid: cid1})
+		}
+		return candidates
+	}
+
+	testCases := []struct {
+		name               string
+		noFixedPeerFinder  bool
+		candidates         []string
+		request            types.RetrievalRequest
+		expectedCandidates []string
+		expectedErr        error
+	}{
+		{
+			name:               "no overrides",
+			expectedCandidates: []string{"fiz", "bang", "booz"},
+		},
+		{
+			name:               "allowlist",
+			request:            types.RetrievalRequest{ProviderAllowlist: []peer.ID{"fiz", "booz", "apples"}},
+			expectedCandidates: []string{"fiz", "booz"},
+		},
+		{
+			name:               "denylist",
+			request:            types.RetrievalRequest{ProviderDenylist: []peer.ID{"fiz"}},
+			expectedCandidates: []string{"bang", "booz"},
+		},
+		{
+			name:               "allowlist with the local stores",
+			candidates:         []string{"fiz", string(retriever.LocalStorageProviderId)},
+			request:            types.RetrievalRequest{ProviderAllowlist: []peer.ID{"booz"}},
+			expectedCandidates: []string{string(retriever.LocalStorageProviderId)},
+		},
+		{
+			name: "allowlist and denylist",
+			request: types.RetrievalRequest{
+				ProviderAllowlist: []peer.ID{"fiz", "booz"},
+				ProviderDenylist:  []peer.ID{"fiz"},
+			},
+			expectedCandidates: []string{"booz"},
+		},
+		{
+			name:               "fixed peers",
+			request:            types.RetrievalRequest{FixedPeers: []peer.AddrInfo{{ID: "apples"}, {ID: "oranges"}, {ID: "blocked"}}},
+			expectedCandidates: []string{"apples", "oranges"},
+		},
+		{
+			name:              "fixed peers without a fixed peer finder",
+			noFixedPeerFinder: true,
+			request:           types.RetrievalRequest{FixedPeers: []peer.AddrInfo{{ID: "apples"}}},
+			expectedErr:       retriever.ErrFixedPeersNotSupported,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := require.New(t)
+			ctx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+
+			peers := testCase.candidates
+			if peers == nil {
+				peers = []string{"fiz", "bang", "booz"}
+			}
+			candidateFinder := &testutil.MockCandidateFinder{Candidates: map[cid.Cid][]types.RetrievalCandidate{cid1: toCandidates(peers...)}}
+			isAcceptableStorageProvider := func(testPeer peer.ID) bool { return testPeer != peer.ID("blocked") }
+			retrievalCandidateFinder := retriever.NewAssignableCandidateFinder(candidateFinder, isAcceptableStorageProvider)
+			if !testCase.noFixedPeerFinder {
+				retrievalCandidateFinder = retrievalCandidateFinder.WithFixedPeerFinder(func(peers []peer.AddrInfo) retriever.CandidateFinder {
+					candidates := make([]types.RetrievalCandidate, 0, len(peers))
+					for _, p := range peers {
+						candidates = append(candidates, types.RetrievalCandidate{MinerPeer: p, RootCid: cid1})
+					}
+					return &testutil.MockCandidateFinder{Candidates: map[cid.Cid][]types.RetrievalCandidate{cid1: candidates}}
+				})
+			}
+
+			request := testCase.request
+			request.RetrievalID = types.RetrievalID(uuid.New())
+			request.Cid = cid1
+			request.LinkSystem = cidlink.DefaultLinkSystem()
+			var candidates []string
+			err := retrievalCandidateFinder.FindCandidates(ctx, request, func(types.RetrievalEvent) {}, func(incoming []types.RetrievalCandidate) {
+				for _, candidate := range incoming {
+					candidates = append(candidates, string(candidate.MinerPeer.ID))
+				}
+			})
+			if testCase.expectedErr != nil {
+				req.ErrorIs(err, testCase.expectedErr)
+				return
+			}
+			req.NoError(err)
+			req.Equal(testCase.expectedCandidates, candidates)
+		})
+	}
+}
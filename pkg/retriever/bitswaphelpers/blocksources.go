@@ -0,0 +1,46 @@
+package bitswaphelpers
+
+import (
+	"github.com/filecoin-project/lassie/pkg/internal/lrucache"
+	"github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-libipfs/bitswap/client"
+	"github.com/ipfs/go-libipfs/blocks"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DefaultBlockSourcesSize is the number of recently received blocks that
+// BlockSources remembers the source of
+const DefaultBlockSourcesSize = 4096
+
+var _ client.BlockReceivedNotifier = (*BlockSources)(nil)
+
+// BlockSources records which peer each wanted block was received from, so that
+// bitswap retrievals can attribute the blocks they load to the peers that sent
+// them. It is notified by the bitswap client before the blocks are handed to
+// sessions, and only remembers the most recently received blocks.
+type BlockSources struct {
+	sources *lru.Cache
+}
+
+// NewBlockSources makes a new BlockSources remembering the sources of up to
+// size blocks
+func NewBlockSources(size int) *BlockSources {
+	return &BlockSources{sources: lrucache.New(size)}
+}
+
+// ReceivedBlocks records the peer the given blocks were received from
+func (bs *BlockSources) ReceivedBlocks(from peer.ID, blks []blocks.Block) {
+	for _, blk := range blks {
+		bs.sources.Add(blk.Cid(), from)
+	}
+}
+
+// Source returns the peer a block was last received from, if it is known
+func (bs *BlockSources) Source(c cid.Cid) (peer.ID, bool) {
+	from, ok := bs.sources.Get(c)
+	if !ok {
+		return peer.ID(""), false
+	}
+	return from.(peer.ID), true
+}
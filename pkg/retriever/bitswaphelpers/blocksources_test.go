@@ -0,0 +1,44 @@
+package bitswaphelpers_test
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever/bitswaphelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockSources(t *testing.T) {
+	req := require.New(t)
+	blks := testutil.GenerateBlocksOfSize(5, 100)
+	peers := testutil.GeneratePeers(2)
+
+	blockSources := bitswaphelpers.NewBlockSources(4)
+	blockSources.ReceivedBlocks(peers[0], blks[:2])
+	blockSources.ReceivedBlocks(peers[1], blks[2:4])
+
+	for i, expected := range []struct {
+		peerIndex int
+		known     bool
+	}{{0, true}, {0, true}, {1, true}, {1, true}, {0, false}} {
+		from, ok := blockSources.Source(blks[i].Cid())
+		req.Equal(expected.known, ok)
+		if expected.known {
+			req.Equal(peers[expected.peerIndex], from)
+		}
+	}
+
+	// the most recent source is remembered
+	blockSources.ReceivedBlocks(peers[1], blks[:1])
+	from, ok := blockSources.Source(blks[0].Cid())
+	req.True(ok)
+	req.Equal(peers[1], from)
+
+	// only the most recently received blocks are remembered
+	blockSources.ReceivedBlocks(peers[0], blks[4:])
+	_, ok = blockSources.Source(blks[1].Cid())
+	req.False(ok)
+	from, ok = blockSources.Source(blks[4].Cid())
+	req.True(ok)
+	req.Equal(peers[0], from)
+}
@@ -1,38 +1,67 @@
 package bitswaphelpers
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 )
 
+// ErrHashMismatch indicates that the data written for a block does not match
+// its CID
+var ErrHashMismatch = errors.New("block data does not match CID")
+
+// ErrBlockTooLarge indicates that the data written for a block is larger than
+// allowed
+var ErrBlockTooLarge = errors.New("block exceeds maximum size")
+
 type cumulativeCountWriter struct {
-	io.Writer
-	totalWritten uint64
+	w            io.Writer
+	buf          bytes.Buffer
+	maxBlockSize uint64
 	committer    linking.BlockWriteCommitter
 	cb           func(count uint64)
 }
 
 func (ccw *cumulativeCountWriter) Write(p []byte) (n int, err error) {
-	written, err := ccw.Writer.Write(p)
-	if err != nil {
-		return written, err
+	if ccw.maxBlockSize > 0 && uint64(ccw.buf.Len()+len(p)) > ccw.maxBlockSize {
+		return 0, fmt.Errorf("%w of %d bytes", ErrBlockTooLarge, ccw.maxBlockSize)
 	}
-	ccw.totalWritten += uint64(written)
-	return written, nil
+	return ccw.buf.Write(p)
 }
 
 func (ccw *cumulativeCountWriter) Commit(link datamodel.Link) error {
-	err := ccw.committer(link)
+	cl, ok := link.(cidlink.Link)
+	if !ok {
+		return fmt.Errorf("unsupported link type: %v", link)
+	}
+	computed, err := cl.Cid.Prefix().Sum(ccw.buf.Bytes())
 	if err != nil {
 		return err
 	}
-	ccw.cb(ccw.totalWritten)
+	if !bytes.Equal(computed.Hash(), cl.Cid.Hash()) {
+		return fmt.Errorf("%w: %s", ErrHashMismatch, cl.Cid)
+	}
+	if _, err := ccw.w.Write(ccw.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := ccw.committer(link); err != nil {
+		return err
+	}
+	ccw.cb(uint64(ccw.buf.Len()))
 	return nil
 }
 
-func NewByteCountingLinkSystem(lsys *linking.LinkSystem, bytesWritten func(count uint64)) *linking.LinkSystem {
+// NewByteCountingLinkSystem returns a copy of the LinkSystem that calls
+// bytesWritten with the size of each block written to it. Blocks are held
+// until they are committed, when they are verified against their CID and only
+// passed on to the original LinkSystem if they match. Blocks larger than
+// maxBlockSize fail to write, a maxBlockSize of zero allows any size.
+func NewByteCountingLinkSystem(lsys *linking.LinkSystem, maxBlockSize uint64, bytesWritten func(count uint64)) *linking.LinkSystem {
 	newLsys := *lsys // copy all values from old system
 	oldWriteOpener := lsys.StorageWriteOpener
 	newLsys.StorageWriteOpener = func(lctx linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
@@ -40,7 +69,7 @@ func NewByteCountingLinkSystem(lsys *linking.LinkSystem, bytesWritten func(count
 		if err != nil {
 			return w, committer, err
 		}
-		ccw := &cumulativeCountWriter{w, 0, committer, bytesWritten}
+		ccw := &cumulativeCountWriter{w: w, maxBlockSize: maxBlockSize, committer: committer, cb: bytesWritten}
 		return ccw, ccw.Commit, err
 	}
 	return &newLsys
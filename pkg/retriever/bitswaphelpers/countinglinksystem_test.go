@@ -0,0 +1,54 @@
+package bitswaphelpers_test
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever/bitswaphelpers"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestByteCountingLinkSystem(t *testing.T) {
+	req := require.New(t)
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+
+	store := &memstore.Store{}
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	var counted []uint64
+	countingLsys := bitswaphelpers.NewByteCountingLinkSystem(&lsys, 150, func(count uint64) {
+		counted = append(counted, count)
+	})
+
+	write := func(data []byte, lnk cidlink.Link) error {
+		w, commit, err := countingLsys.StorageWriteOpener(linking.LinkContext{})
+		req.NoError(err)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		return commit(lnk)
+	}
+
+	// a valid block is written and counted
+	req.NoError(write(blks[0].RawData(), cidlink.Link{Cid: blks[0].Cid()}))
+	has, err := store.Has(nil, blks[0].Cid().KeyString())
+	req.NoError(err)
+	req.True(has)
+	req.Equal([]uint64{100}, counted)
+
+	// data that doesn't match the CID is not written
+	err = write(blks[1].RawData(), cidlink.Link{Cid: blks[2].Cid()})
+	req.ErrorIs(err, bitswaphelpers.ErrHashMismatch)
+	has, err = store.Has(nil, blks[2].Cid().KeyString())
+	req.NoError(err)
+	req.False(has)
+
+	// nor is a block that is too large
+	err = write(append(blks[1].RawData(), blks[2].RawData()...), cidlink.Link{Cid: blks[1].Cid()})
+	req.ErrorIs(err, bitswaphelpers.ErrBlockTooLarge)
+	req.Equal([]uint64{100}, counted)
+}
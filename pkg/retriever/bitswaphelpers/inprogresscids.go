@@ -3,21 +3,38 @@ package bitswaphelpers
 import (
 	"sync"
 
+	"github.com/filecoin-project/lassie/pkg/internal/lrucache"
 	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/hashicorp/golang-lru"
 	"github.com/ipfs/go-cid"
 )
 
+// recentlyWantedSize is the number of CIDs that InProgressCids remembers were
+// wanted after they are no longer in progress, so that blocks arriving late,
+// such as duplicates from a second peer, aren't mistaken for unrequested ones
+const recentlyWantedSize = 16384
+
 type InProgressCids struct {
 	inProgressCidsLk sync.RWMutex
 	inProgressCids   map[cid.Cid]map[types.RetrievalID]uint64
+	recentlyWanted   *lru.Cache
 }
 
 func NewInProgressCids() *InProgressCids {
 	return &InProgressCids{
 		inProgressCids: make(map[cid.Cid]map[types.RetrievalID]uint64),
+		recentlyWanted: lrucache.New(recentlyWantedSize),
 	}
 }
 
+// WasWanted returns true if the CID is in progress or recently was
+func (ipc *InProgressCids) WasWanted(c cid.Cid) bool {
+	ipc.inProgressCidsLk.RLock()
+	_, ok := ipc.inProgressCids[c]
+	ipc.inProgressCidsLk.RUnlock()
+	return ok || ipc.recentlyWanted.Contains(c)
+}
+
 func (ipc *InProgressCids) Get(c cid.Cid) []types.RetrievalID {
 	ipc.inProgressCidsLk.RLock()
 	defer ipc.inProgressCidsLk.RUnlock()
@@ -41,6 +58,7 @@ func (ipc *InProgressCids) Inc(c cid.Cid, retrievalID types.RetrievalID) {
 		ipc.inProgressCids[c] = retrievalIDMap
 	}
 	retrievalIDMap[retrievalID]++ // will start at zero value and set if not present
+	ipc.recentlyWanted.Add(c, struct{}{})
 }
 
 func (ipc *InProgressCids) Dec(c cid.Cid, retrievalID types.RetrievalID) {
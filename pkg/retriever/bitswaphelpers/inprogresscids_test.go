@@ -53,6 +53,11 @@ func TestInProgressCids(t *testing.T) {
 	req.ElementsMatch([]types.RetrievalID{}, inProgressCids.Get(cids[0]))
 	req.ElementsMatch([]types.RetrievalID{}, inProgressCids.Get(cids[1]))
 	req.ElementsMatch([]types.RetrievalID{}, inProgressCids.Get(cids[2]))
+	// but remembered as having been wanted
+	req.True(inProgressCids.WasWanted(cids[0]))
+	req.True(inProgressCids.WasWanted(cids[1]))
+	req.True(inProgressCids.WasWanted(cids[2]))
+	req.False(inProgressCids.WasWanted(testutil.GenerateCids(1)[0]))
 
 	// add back valus (but different cids)
 	inProgressCids.Inc(cids[2], retrievalIDs[0])
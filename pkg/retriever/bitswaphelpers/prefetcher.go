@@ -0,0 +1,246 @@
+package bitswaphelpers
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-libipfs/blocks"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+)
+
+// FetchBlock fetches a single block
+type FetchBlock func(ctx context.Context, c cid.Cid) (blocks.Block, error)
+
+// Prefetcher fetches the blocks of a selector traversal ahead of the traversal
+// reaching them. As each block is loaded by the traversal, the links in it that
+// the selector will explore are queued in the order the traversal will reach
+// them, and up to a maximum number of them are fetched at once. The traversal
+// itself is unchanged, it still loads each block in selector order, taking it
+// from the Prefetcher with Get and handing it back with Loaded.
+//
+// Links are only looked ahead to from blocks decoded as plain nodes, links that
+// are only reached once a node has been reified as an ADL are fetched when the
+// traversal reaches them.
+type Prefetcher struct {
+	ctx          context.Context
+	fetch        FetchBlock
+	lsys         *linking.LinkSystem
+	protoChooser traversal.LinkTargetNodePrototypeChooser
+	max          int
+
+	lk        sync.Mutex
+	selectors map[cid.Cid]selector.Selector
+	// queue holds links waiting to be fetched as a stack, the next link the
+	// traversal will reach is last
+	queue   []cid.Cid
+	queued  map[cid.Cid]struct{}
+	fetches map[cid.Cid]*prefetch
+}
+
+type prefetch struct {
+	done chan struct{}
+	blk  blocks.Block
+	err  error
+}
+
+// NewPrefetcher makes a Prefetcher for a traversal of the given selector from
+// root. Blocks are decoded with lsys and fetched with fetch, with up to max
+// fetches in progress, or held waiting for the traversal, at once. A max of
+// zero or less disables prefetching, so that each block is fetched only as the
+// traversal reaches it.
+func NewPrefetcher(ctx context.Context, root cid.Cid, sel selector.Selector, lsys *linking.LinkSystem, protoChooser traversal.LinkTargetNodePrototypeChooser, max int, fetch FetchBlock) *Prefetcher {
+	return &Prefetcher{
+		ctx:          ctx,
+		fetch:        fetch,
+		lsys:         lsys,
+		protoChooser: protoChooser,
+		max:          max,
+		selectors:    map[cid.Cid]selector.Selector{root: sel},
+		queued:       make(map[cid.Cid]struct{}),
+		fetches:      make(map[cid.Cid]*prefetch),
+	}
+}
+
+// Get returns a block, waiting for it if it is being prefetched or fetching it
+// directly if not
+func (p *Prefetcher) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	p.lk.Lock()
+	pf, ok := p.fetches[c]
+	delete(p.queued, c)
+	p.lk.Unlock()
+	if !ok {
+		return p.fetch(ctx, c)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-pf.done:
+	}
+	if pf.err != nil {
+		p.lk.Lock()
+		p.remove(c)
+		p.lk.Unlock()
+		return nil, pf.err
+	}
+	return pf.blk, nil
+}
+
+// Loaded is called with each block the traversal loads, whether it was
+// fetched or found locally. The block is released from the Prefetcher and the
+// links in it that the traversal will explore are queued to be fetched.
+func (p *Prefetcher) Loaded(c cid.Cid, data []byte) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.remove(c)
+	sel, ok := p.selectors[c]
+	if !ok {
+		return
+	}
+	delete(p.selectors, c)
+	if p.max <= 0 {
+		return
+	}
+
+	// errors here will also be met by the traversal, which reports them, so
+	// they only end the look ahead
+	node, err := p.decode(c, data)
+	if err != nil {
+		log.Debugw("unable to decode block to prefetch its links", "cid", c, "err", err)
+		return
+	}
+	var links []lookaheadLink
+	if err := lookahead(node, sel, &links); err != nil {
+		log.Debugw("unable to find links to prefetch", "cid", c, "err", err)
+		return
+	}
+	// push in reverse so that the first link is the next popped
+	for i := len(links) - 1; i >= 0; i-- {
+		next := links[i].link.Cid
+		if _, ok := p.selectors[next]; !ok {
+			p.selectors[next] = links[i].sel
+		}
+		if _, ok := p.fetches[next]; ok {
+			continue
+		}
+		p.queue = append(p.queue, next)
+		p.queued[next] = struct{}{}
+	}
+	p.startFetches()
+}
+
+func (p *Prefetcher) decode(c cid.Cid, data []byte) (datamodel.Node, error) {
+	lnk := cidlink.Link{Cid: c}
+	decoder, err := p.lsys.DecoderChooser(lnk)
+	if err != nil {
+		return nil, err
+	}
+	prototype, err := p.protoChooser(lnk, linking.LinkContext{Ctx: p.ctx})
+	if err != nil {
+		return nil, err
+	}
+	nb := prototype.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+// remove releases a fetch, freeing space for another, it must be called with
+// the lock held
+func (p *Prefetcher) remove(c cid.Cid) {
+	if _, ok := p.fetches[c]; ok {
+		delete(p.fetches, c)
+		p.startFetches()
+	}
+}
+
+// startFetches fetches queued links while there is space to, it must be
+// called with the lock held
+func (p *Prefetcher) startFetches() {
+	for len(p.fetches) < p.max && len(p.queue) > 0 {
+		next := p.queue[len(p.queue)-1]
+		p.queue = p.queue[:len(p.queue)-1]
+		if _, ok := p.queued[next]; !ok {
+			// fetched directly since it was queued
+			continue
+		}
+		delete(p.queued, next)
+		pf := &prefetch{done: make(chan struct{})}
+		p.fetches[next] = pf
+		go func(c cid.Cid) {
+			pf.blk, pf.err = p.fetch(p.ctx, c)
+			close(pf.done)
+		}(next)
+	}
+}
+
+type lookaheadLink struct {
+	link cidlink.Link
+	sel  selector.Selector
+}
+
+// lookahead collects the links that a traversal of sel over node will explore,
+// in the order it will explore them, with the selector it will apply to each
+func lookahead(node datamodel.Node, sel selector.Selector, links *[]lookaheadLink) error {
+	if _, ok := sel.(selector.Reifiable); ok {
+		// look past the ADL at the plain node, at worst this misses links
+		var err error
+		if sel, err = sel.Explore(node, datamodel.PathSegment{}); err != nil || sel == nil {
+			return err
+		}
+	}
+	switch node.Kind() {
+	case datamodel.Kind_Map, datamodel.Kind_List:
+	default:
+		return nil
+	}
+
+	explore := func(ps datamodel.PathSegment, child datamodel.Node) error {
+		next, err := sel.Explore(node, ps)
+		if err != nil || next == nil {
+			return err
+		}
+		if child.Kind() != datamodel.Kind_Link {
+			return lookahead(child, next, links)
+		}
+		lnk, err := child.AsLink()
+		if err != nil {
+			return err
+		}
+		if cl, ok := lnk.(cidlink.Link); ok {
+			*links = append(*links, lookaheadLink{cl, next})
+		}
+		return nil
+	}
+
+	interests := sel.Interests()
+	if interests == nil {
+		for itr := selector.NewSegmentIterator(node); !itr.Done(); {
+			ps, child, err := itr.Next()
+			if err != nil {
+				return err
+			}
+			if err := explore(ps, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, ps := range interests {
+		child, err := node.LookupBySegment(ps)
+		if err != nil {
+			continue
+		}
+		if err := explore(ps, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package bitswaphelpers_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/retriever/bitswaphelpers"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-libipfs/blocks"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetcher(t *testing.T) {
+	ctx := context.Background()
+
+	// a root with two lists of ten leaves, under "a" and "b"
+	store := &memstore.Store{}
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	linkProto := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   uint64(multicodec.Sha2_256),
+		MhLength: 32,
+	}}
+	storeNode := func(n datamodel.Node) datamodel.Link {
+		lnk, err := lsys.Store(linking.LinkContext{Ctx: ctx}, linkProto, n)
+		require.NoError(t, err)
+		return lnk
+	}
+	leafLinks := map[string][]cid.Cid{}
+	storeList := func(name string) datamodel.Link {
+		list, err := qp.BuildList(basicnode.Prototype.Any, 10, func(la datamodel.ListAssembler) {
+			for i := 0; i < 10; i++ {
+				lnk := storeNode(basicnode.NewString(fmt.Sprintf("%s leaf %d", name, i)))
+				leafLinks[name] = append(leafLinks[name], lnk.(cidlink.Link).Cid)
+				qp.ListEntry(la, qp.Link(lnk))
+			}
+		})
+		require.NoError(t, err)
+		return storeNode(list)
+	}
+	aLink, bLink := storeList("a"), storeList("b")
+	root, err := qp.BuildMap(basicnode.Prototype.Any, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "a", qp.Link(aLink))
+		qp.MapEntry(ma, "b", qp.Link(bLink))
+	})
+	require.NoError(t, err)
+	rootLink := storeNode(root)
+	rootCid := rootLink.(cidlink.Link).Cid
+
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	exploreAll := ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge()))
+	exploreA := ssb.ExploreFields(func(efsb builder.ExploreFieldsSpecBuilder) {
+		efsb.Insert("a", exploreAll)
+	})
+	allCids := append(append([]cid.Cid{rootCid, aLink.(cidlink.Link).Cid, bLink.(cidlink.Link).Cid}, leafLinks["a"]...), leafLinks["b"]...)
+	aCids := append([]cid.Cid{rootCid, aLink.(cidlink.Link).Cid}, leafLinks["a"]...)
+
+	testCases := []struct {
+		name             string
+		selector         builder.SelectorSpec
+		max              int
+		expectedFetched  []cid.Cid
+		expectedInFlight int
+	}{
+		{
+			name:             "prefetches up to max at once",
+			selector:         exploreAll,
+			max:              4,
+			expectedFetched:  allCids,
+			expectedInFlight: 4,
+		},
+		{
+			name:             "only prefetches links the selector explores",
+			selector:         exploreA,
+			max:              4,
+			expectedFetched:  aCids,
+			expectedInFlight: 4,
+		},
+		{
+			name:             "no prefetching",
+			selector:         exploreAll,
+			max:              0,
+			expectedFetched:  allCids,
+			expectedInFlight: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			req := require.New(t)
+
+			var lk sync.Mutex
+			var fetched []cid.Cid
+			var inFlight, maxInFlight int
+			fetch := func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+				lk.Lock()
+				fetched = append(fetched, c)
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				lk.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				lk.Lock()
+				inFlight--
+				lk.Unlock()
+				data, err := store.Get(ctx, c.KeyString())
+				if err != nil {
+					return nil, err
+				}
+				return blocks.NewBlockWithCid(data, c)
+			}
+
+			sel, err := selector.CompileSelector(testCase.selector.Node())
+			req.NoError(err)
+			prefetcher := bitswaphelpers.NewPrefetcher(ctx, rootCid, sel, &lsys, basicnode.Chooser, testCase.max, fetch)
+
+			// traverse, loading blocks through the prefetcher in selector order
+			var loaded []cid.Cid
+			traversalLsys := cidlink.DefaultLinkSystem()
+			traversalLsys.StorageReadOpener = func(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
+				c := lnk.(cidlink.Link).Cid
+				blk, err := prefetcher.Get(lctx.Ctx, c)
+				if err != nil {
+					return nil, err
+				}
+				loaded = append(loaded, c)
+				prefetcher.Loaded(c, blk.RawData())
+				return bytes.NewReader(blk.RawData()), nil
+			}
+			rootNode, err := traversalLsys.Load(linking.LinkContext{Ctx: ctx}, rootLink, basicnode.Prototype.Any)
+			req.NoError(err)
+			err = traversal.Progress{Cfg: &traversal.Config{
+				Ctx:                            ctx,
+				LinkSystem:                     traversalLsys,
+				LinkTargetNodePrototypeChooser: basicnode.Chooser,
+			}}.WalkAdv(rootNode, sel, func(traversal.Progress, datamodel.Node, traversal.VisitReason) error { return nil })
+			req.NoError(err)
+
+			req.ElementsMatch(testCase.expectedFetched, loaded)
+			lk.Lock()
+			defer lk.Unlock()
+			req.ElementsMatch(testCase.expectedFetched, fetched)
+			req.Equal(testCase.expectedInFlight, maxInFlight)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package bitswaphelpers
+
+import (
+	"github.com/ipfs/go-cid"
+	bsmsg "github.com/ipfs/go-libipfs/bitswap/message"
+	"github.com/ipfs/go-libipfs/bitswap/tracer"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var _ tracer.Tracer = (*UnrequestedBlocks)(nil)
+
+// UnrequestedBlocks watches the messages received by the bitswap client for
+// blocks that were never wanted. The client drops such blocks without telling
+// anyone, so this lets the peers sending them be held to account.
+type UnrequestedBlocks struct {
+	wasWanted     func(cid.Cid) bool
+	onUnrequested func(peer.ID, cid.Cid)
+}
+
+// NewUnrequestedBlocks makes a new UnrequestedBlocks that calls onUnrequested
+// for each block received for which wasWanted returns false
+func NewUnrequestedBlocks(wasWanted func(cid.Cid) bool, onUnrequested func(peer.ID, cid.Cid)) *UnrequestedBlocks {
+	return &UnrequestedBlocks{wasWanted: wasWanted, onUnrequested: onUnrequested}
+}
+
+// MessageReceived checks the blocks in a message received from a peer
+func (ub *UnrequestedBlocks) MessageReceived(from peer.ID, msg bsmsg.BitSwapMessage) {
+	for _, blk := range msg.Blocks() {
+		if !ub.wasWanted(blk.Cid()) {
+			ub.onUnrequested(from, blk.Cid())
+		}
+	}
+}
+
+// MessageSent does nothing, only received messages are of interest
+func (ub *UnrequestedBlocks) MessageSent(peer.ID, bsmsg.BitSwapMessage) {}
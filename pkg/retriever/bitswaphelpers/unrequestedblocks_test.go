@@ -0,0 +1,45 @@
+package bitswaphelpers_test
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever/bitswaphelpers"
+	"github.com/ipfs/go-cid"
+	bsmsg "github.com/ipfs/go-libipfs/bitswap/message"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnrequestedBlocks(t *testing.T) {
+	req := require.New(t)
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	peers := testutil.GeneratePeers(2)
+
+	wanted := map[cid.Cid]bool{blks[0].Cid(): true, blks[1].Cid(): true}
+	type unrequested struct {
+		from peer.ID
+		c    cid.Cid
+	}
+	var received []unrequested
+	unrequestedBlocks := bitswaphelpers.NewUnrequestedBlocks(
+		func(c cid.Cid) bool { return wanted[c] },
+		func(from peer.ID, c cid.Cid) { received = append(received, unrequested{from, c}) },
+	)
+
+	msg := bsmsg.New(false)
+	msg.AddBlock(blks[0])
+	msg.AddBlock(blks[1])
+	unrequestedBlocks.MessageReceived(peers[0], msg)
+	req.Empty(received)
+
+	msg = bsmsg.New(false)
+	msg.AddBlock(blks[1])
+	msg.AddBlock(blks[2])
+	unrequestedBlocks.MessageReceived(peers[1], msg)
+	req.Equal([]unrequested{{peers[1], blks[2].Cid()}}, received)
+
+	// sent messages are ignored
+	unrequestedBlocks.MessageSent(peers[0], msg)
+	req.Len(received, 1)
+}
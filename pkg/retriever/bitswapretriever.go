@@ -3,20 +3,25 @@ package retriever
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/internal/limitstore"
 	"github.com/filecoin-project/lassie/pkg/retriever/bitswaphelpers"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-libipfs/bitswap/client"
 	"github.com/ipfs/go-libipfs/bitswap/network"
+	"github.com/ipfs/go-libipfs/blocks"
 	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/ipld/go-ipld-prime/datamodel"
 	"github.com/ipld/go-ipld-prime/linking"
@@ -46,6 +51,11 @@ type InProgressCids interface {
 	Dec(cid.Cid, types.RetrievalID)
 }
 
+// BlockSources reports the peer that a block was received from
+type BlockSources interface {
+	Source(cid.Cid) (peer.ID, bool)
+}
+
 // BitswapRetriever uses bitswap to retrieve data
 // BitswapRetriever retieves using a combination of a go-bitswap client specially configured per retrieval,
 // underneath a blockservice and a go-fetcher Fetcher.
@@ -55,19 +65,64 @@ type InProgressCids interface {
 type BitswapRetriever struct {
 	bstore         MultiBlockstore
 	inProgressCids InProgressCids
+	blockSources   BlockSources
 	routing        IndexerRouting
 	blockService   blockservice.BlockService
 	clock          clock.Clock
 	cfg            BitswapConfig
+	activeLk       sync.Mutex
+	active         map[types.RetrievalID]*activeBitswapRetrieval
 	// this is purely for testing purposes, to insure that we receive all candidates
 	awaitReceivedCandidates chan<- struct{}
 }
 
 const shortenedDelay = 4 * time.Millisecond
 
+// DefaultMaxPrefetch is a reasonable number of blocks to fetch ahead of a
+// bitswap retrieval's traversal
+const DefaultMaxPrefetch = 16
+
+// DefaultMaxUnrequestedBlocks is the number of unrequested blocks a peer may
+// send a retrieval before it is reported as misbehaving. A few are tolerated
+// as a peer may reasonably send a block it was asked for by an earlier
+// session, or one we have since forgotten we wanted.
+const DefaultMaxUnrequestedBlocks = 8
+
+// BitswapLimits caps the resources that a single bitswap retrieval may use, so
+// that neither the peers serving it nor the DAG requested can exhaust them.
+// Zero leaves a limit uncapped, DefaultBitswapLimits are suited to untrusted
+// peers.
+type BitswapLimits struct {
+	// MaxBlockSize is the largest block, in bytes, that will be accepted
+	MaxBlockSize uint64
+	// MaxDepth is the greatest number of links that will be followed from the
+	// root to reach a block
+	MaxDepth uint64
+	// MaxBlocks is the greatest number of blocks that will be fetched
+	MaxBlocks uint64
+}
+
+// DefaultBitswapLimits are reasonable limits for retrievals from untrusted
+// peers. Bitswap peers don't send blocks larger than 2MiB, and the number of
+// blocks is left to the request.
+var DefaultBitswapLimits = BitswapLimits{
+	MaxBlockSize: 2 << 20,
+	MaxDepth:     4096,
+}
+
 // BitswapConfig contains configurable parameters for bitswap fetching
 type BitswapConfig struct {
 	BlockTimeout time.Duration
+	// MaxPrefetch is the maximum number of blocks fetched ahead of a
+	// retrieval's traversal at once. Zero fetches each block only once the
+	// traversal reaches it.
+	MaxPrefetch int
+	// Limits caps the resources each retrieval may use
+	Limits BitswapLimits
+	// MaxUnrequestedBlocks is the number of blocks no retrieval wanted that a
+	// candidate may send before it's reported as misbehaving, defaults to
+	// DefaultMaxUnrequestedBlocks
+	MaxUnrequestedBlocks int
 }
 
 // NewBitswapRetrieverFromHost constructs a new bitswap retriever for the given libp2p host
@@ -75,26 +130,122 @@ func NewBitswapRetrieverFromHost(ctx context.Context, host host.Host, cfg Bitswa
 	bstore := bitswaphelpers.NewMultiblockstore()
 	inProgressCids := bitswaphelpers.NewInProgressCids()
 	routing := bitswaphelpers.NewIndexerRouting(inProgressCids.Get)
+	blockSources := bitswaphelpers.NewBlockSources(bitswaphelpers.DefaultBlockSourcesSize)
+	var retriever *BitswapRetriever
+	unrequestedBlocks := bitswaphelpers.NewUnrequestedBlocks(inProgressCids.WasWanted, func(from peer.ID, c cid.Cid) {
+		retriever.UnrequestedBlock(from, c)
+	})
 	bsnet := network.NewFromIpfsHost(host, routing)
-	bitswap := client.New(ctx, bsnet, bstore, client.ProviderSearchDelay(shortenedDelay))
-	bsnet.Start(bitswap)
+	bitswap := client.New(ctx, bsnet, bstore,
+		client.ProviderSearchDelay(shortenedDelay),
+		client.WithBlockReceivedNotifier(blockSources),
+		client.WithTracer(unrequestedBlocks),
+	)
 	bsrv := blockservice.New(bstore, bitswap)
-	return NewBitswapRetrieverFromDeps(bsrv, routing, inProgressCids, bstore, cfg, clock.New(), nil)
+	retriever = NewBitswapRetrieverFromDeps(bsrv, routing, inProgressCids, bstore, blockSources, cfg, clock.New(), nil)
+	// only start receiving messages once the retriever can be told about
+	// unrequested blocks
+	bsnet.Start(bitswap)
+	return retriever
 }
 
-// NewBitswapRetrieverFromDeps is primarily for testing, constructing behavior from direct dependencies
-func NewBitswapRetrieverFromDeps(bsrv blockservice.BlockService, routing IndexerRouting, inProgressCids InProgressCids, bstore MultiBlockstore, cfg BitswapConfig, clock clock.Clock, awaitReceivedCandidates chan<- struct{}) *BitswapRetriever {
+// NewBitswapRetrieverFromDeps is primarily for testing, constructing behavior from direct dependencies.
+// blockSources may be nil, in which case blocks are not attributed to the peers they were received from.
+func NewBitswapRetrieverFromDeps(bsrv blockservice.BlockService, routing IndexerRouting, inProgressCids InProgressCids, bstore MultiBlockstore, blockSources BlockSources, cfg BitswapConfig, clock clock.Clock, awaitReceivedCandidates chan<- struct{}) *BitswapRetriever {
+	if cfg.MaxUnrequestedBlocks == 0 {
+		cfg.MaxUnrequestedBlocks = DefaultMaxUnrequestedBlocks
+	}
 	return &BitswapRetriever{
 		bstore:                  bstore,
 		inProgressCids:          inProgressCids,
+		blockSources:            blockSources,
 		routing:                 routing,
 		blockService:            bsrv,
 		clock:                   clock,
 		cfg:                     cfg,
+		active:                  make(map[types.RetrievalID]*activeBitswapRetrieval),
 		awaitReceivedCandidates: awaitReceivedCandidates,
 	}
 }
 
+// activeBitswapRetrieval tracks the candidates and wants of a retrieval in
+// progress, so that misbehaviour by a peer that isn't tied to a block the
+// retrieval loads can still be reported against it
+type activeBitswapRetrieval struct {
+	candidates map[peer.ID]struct{}
+	// wanted holds every CID the retrieval has asked for, so a block it wanted
+	// is never taken as unrequested, however long ago it was asked for
+	wanted map[cid.Cid]struct{}
+	// unrequested counts the unrequested blocks sent by each candidate
+	unrequested map[peer.ID]int
+	misbehaved  func(from peer.ID, reason string)
+}
+
+func (br *BitswapRetriever) startActive(retrievalID types.RetrievalID, misbehaved func(peer.ID, string)) {
+	br.activeLk.Lock()
+	defer br.activeLk.Unlock()
+	br.active[retrievalID] = &activeBitswapRetrieval{
+		candidates:  make(map[peer.ID]struct{}),
+		wanted:      make(map[cid.Cid]struct{}),
+		unrequested: make(map[peer.ID]int),
+		misbehaved:  misbehaved,
+	}
+}
+
+func (br *BitswapRetriever) addActiveWant(retrievalID types.RetrievalID, c cid.Cid) {
+	br.activeLk.Lock()
+	defer br.activeLk.Unlock()
+	if ar, ok := br.active[retrievalID]; ok {
+		ar.wanted[c] = struct{}{}
+	}
+}
+
+func (br *BitswapRetriever) addActiveCandidates(retrievalID types.RetrievalID, candidates []types.RetrievalCandidate) {
+	br.activeLk.Lock()
+	defer br.activeLk.Unlock()
+	ar, ok := br.active[retrievalID]
+	if !ok {
+		return
+	}
+	for _, candidate := range candidates {
+		ar.candidates[candidate.MinerPeer.ID] = struct{}{}
+	}
+}
+
+// endActive stops tracking a retrieval, once it returns no more misbehaviour
+// will be reported for it
+func (br *BitswapRetriever) endActive(retrievalID types.RetrievalID) {
+	br.activeLk.Lock()
+	defer br.activeLk.Unlock()
+	delete(br.active, retrievalID)
+}
+
+// UnrequestedBlock reports that a peer sent a block that no retrieval wanted.
+// Each retrieval in progress that has the peer as a candidate, and didn't
+// want the block itself, counts it against the peer and is told that the peer
+// misbehaved once it has sent MaxUnrequestedBlocks.
+func (br *BitswapRetriever) UnrequestedBlock(from peer.ID, c cid.Cid) {
+	br.activeLk.Lock()
+	defer br.activeLk.Unlock()
+	var counted bool
+	for _, ar := range br.active {
+		if _, ok := ar.candidates[from]; !ok {
+			continue
+		}
+		if _, ok := ar.wanted[c]; ok {
+			continue
+		}
+		counted = true
+		ar.unrequested[from]++
+		if ar.unrequested[from] == br.cfg.MaxUnrequestedBlocks {
+			ar.misbehaved(from, fmt.Sprintf("sent %d unrequested blocks, the last %s", ar.unrequested[from], c))
+		}
+	}
+	if !counted {
+		log.Debugf("Peer %s not serving any retrieval sent unrequested block %s", from, c)
+	}
+}
+
 // Retrieve initializes a new bitswap session
 func (br *BitswapRetriever) Retrieve(ctx context.Context, request types.RetrievalRequest, events func(types.RetrievalEvent)) types.CandidateRetrieval {
 	return &bitswapRetrieval{br, blockservice.NewSession(ctx, br.blockService), ctx, request, events}
@@ -110,31 +261,41 @@ type bitswapRetrieval struct {
 
 // RetrieveFromCandidates retrieves via go-bitswap backed with the given candidates, under the auspices of a fetcher.Fetcher
 func (br *bitswapRetrieval) RetrieveFromAsyncCandidates(ayncCandidates types.InboundAsyncCandidates) (*types.RetrievalStats, error) {
-	selector := br.request.GetSelector()
 	phaseStartTime := br.clock.Now()
-	// this is a hack cause we aren't able to track bitswap fetches per peer for now, so instead we just create a single peer for all events
+	// the retrieval as a whole isn't from any one peer, so events for it use an
+	// empty peer ID, as do events for blocks we can't attribute to a peer
 	bitswapCandidate := types.NewRetrievalCandidate(peer.ID(""), br.request.Cid, metadata.Bitswap{})
 	br.events(events.Started(br.request.RetrievalID, phaseStartTime, types.RetrievalPhase, bitswapCandidate))
+	misbehaved := func(from peer.ID, reason string) {
+		candidate := types.NewRetrievalCandidate(from, br.request.Cid, metadata.Bitswap{})
+		br.events(events.Misbehaved(br.request.RetrievalID, phaseStartTime, candidate, reason))
+	}
+
+	sel, err := selector.ParseSelector(br.request.GetSelector())
+	if err != nil {
+		br.events(events.Failed(br.request.RetrievalID, phaseStartTime, types.RetrievalPhase, bitswapCandidate, err.Error()))
+		return nil, err
+	}
 
 	// setup the linksystem to record bytes & blocks written -- since this isn't automatic w/o go-data-transfer
 	ctx, cancel := context.WithCancel(br.ctx)
+	blockTimeout := br.request.ProviderTimeout
+	if blockTimeout == 0 {
+		blockTimeout = br.cfg.BlockTimeout
+	}
 	var lastBytesReceivedTimer *clock.Timer
-	if br.cfg.BlockTimeout != 0 {
-		lastBytesReceivedTimer = br.clock.AfterFunc(br.cfg.BlockTimeout, cancel)
+	if blockTimeout != 0 {
+		lastBytesReceivedTimer = br.clock.AfterFunc(blockTimeout, cancel)
 	}
 
 	totalWritten := uint64(0)
 	blockCount := uint64(0)
 	cb := func(bytesWritten uint64) {
-		// record first byte received
-		if totalWritten == 0 {
-			br.events(events.FirstByte(br.request.RetrievalID, phaseStartTime, bitswapCandidate))
-		}
 		atomic.AddUint64(&totalWritten, bytesWritten)
 		atomic.AddUint64(&blockCount, 1)
 		// reset the timer
 		if bytesWritten > 0 && lastBytesReceivedTimer != nil {
-			lastBytesReceivedTimer.Reset(br.cfg.BlockTimeout)
+			lastBytesReceivedTimer.Reset(blockTimeout)
 		}
 	}
 
@@ -145,6 +306,8 @@ func (br *bitswapRetrieval) RetrieveFromAsyncCandidates(ayncCandidates types.Inb
 		// we never received any candidates, so we give up on bitswap retrieval
 		return nil, nil
 	}
+	br.startActive(br.request.RetrievalID, misbehaved)
+	br.addActiveCandidates(br.request.RetrievalID, nextCandidates)
 	br.routing.AddProviders(br.request.RetrievalID, nextCandidates)
 	go func() {
 		for {
@@ -158,21 +321,75 @@ func (br *bitswapRetrieval) RetrieveFromAsyncCandidates(ayncCandidates types.Inb
 				}
 				return
 			}
+			br.addActiveCandidates(br.request.RetrievalID, nextCandidates)
 			br.routing.AddProviders(br.request.RetrievalID, nextCandidates)
 		}
 	}()
-	// setup providers linksystem for this retrieval
-	br.bstore.AddLinkSystem(br.request.RetrievalID, bitswaphelpers.NewByteCountingLinkSystem(&br.request.LinkSystem, cb))
+	// setup providers linksystem for this retrieval; blocks are written to the
+	// retrieval's LinkSystem by the loader in traversal order, so writes to the
+	// blockstore, which may be of blocks prefetched ahead of the traversal, are
+	// discarded
+	br.bstore.AddLinkSystem(br.request.RetrievalID, withDiscardedWrites(br.request.LinkSystem))
+	limits := br.cfg.Limits
+	storage := &br.request.LinkSystem
+	if limits.MaxBlocks > 0 {
+		limited := limitstore.LimitLinkSystem(br.request.LinkSystem, limits.MaxBlocks)
+		storage = &limited
+	}
+	storage = bitswaphelpers.NewByteCountingLinkSystem(storage, limits.MaxBlockSize, cb)
 
 	// copy the link system
 	wrappedLsys := br.request.LinkSystem
 	// replace the opener with a blockservice wrapper (we still want any known adls + reifiers, hence the copy)
-	wrappedLsys.StorageReadOpener = loaderForSession(br.request.RetrievalID, br.inProgressCids, br.bsGetter)
+	providers := make(map[peer.ID]types.ProviderStats)
+	source := func(c cid.Cid) peer.ID {
+		from := peer.ID("")
+		if br.blockSources != nil {
+			from, _ = br.blockSources.Source(c)
+		}
+		return from
+	}
+	received := func(c cid.Cid, size uint64) {
+		from := source(c)
+		stats, seen := providers[from]
+		stats.Size += size
+		stats.Blocks++
+		providers[from] = stats
+		// record the first byte received from each peer
+		if !seen {
+			candidate := bitswapCandidate
+			if from != peer.ID("") {
+				candidate = types.NewRetrievalCandidate(from, br.request.Cid, metadata.Bitswap{})
+				br.events(events.Connected(br.request.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate))
+			}
+			br.events(events.FirstByte(br.request.RetrievalID, phaseStartTime, candidate))
+		}
+	}
+	fetch := func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		br.addActiveWant(br.request.RetrievalID, c)
+		br.inProgressCids.Inc(c, br.request.RetrievalID)
+		defer br.inProgressCids.Dec(c, br.request.RetrievalID)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		return br.bsGetter.GetBlock(ctx, c)
+	}
+	prefetcher := bitswaphelpers.NewPrefetcher(ctx, br.request.Cid, sel, &br.request.LinkSystem, protoChooser, br.cfg.MaxPrefetch, fetch)
+	invalid := func(c cid.Cid, err error) {
+		if from := source(c); from != peer.ID("") {
+			misbehaved(from, err.Error())
+		}
+	}
+	loader := loaderForSession(br.request.LinkSystem.StorageReadOpener, prefetcher, storage, received, invalid)
+	wrappedLsys.StorageReadOpener = withMaxDepth(loader, limits.MaxDepth)
 	// run the retrieval
-	err = easyTraverse(ctx, cidlink.Link{Cid: br.request.Cid}, selector, &wrappedLsys)
+	err = easyTraverse(ctx, cidlink.Link{Cid: br.request.Cid}, sel, &wrappedLsys)
 	cancel()
 
 	// unregister relevant provider records & LinkSystem
+	br.endActive(br.request.RetrievalID)
 	br.routing.RemoveProviders(br.request.RetrievalID)
 	br.bstore.RemoveLinkSystem(br.request.RetrievalID)
 	if err != nil {
@@ -183,19 +400,30 @@ func (br *bitswapRetrieval) RetrieveFromAsyncCandidates(ayncCandidates types.Inb
 	duration := br.clock.Since(phaseStartTime)
 	speed := uint64(float64(totalWritten) / duration.Seconds())
 
-	// record success
-	br.events(events.Success(
-		br.request.RetrievalID,
-		phaseStartTime,
-		bitswapCandidate,
-		totalWritten,
-		blockCount,
-		duration,
-		big.Zero()))
+	// record success for each peer that blocks were received from, and for
+	// any blocks that couldn't be attributed to a peer
+	unattributed, hasUnattributed := providers[peer.ID("")]
+	delete(providers, peer.ID(""))
+	storageProviderId := peer.ID("")
+	for _, from := range sortedPeers(providers) {
+		stats := providers[from]
+		candidate := types.NewRetrievalCandidate(from, br.request.Cid, metadata.Bitswap{})
+		br.events(events.Success(br.request.RetrievalID, phaseStartTime, candidate, stats.Size, stats.Blocks, duration, big.Zero()))
+		// the storage provider reported for the retrieval is the one that sent the most
+		if storageProviderId == peer.ID("") || stats.Size > providers[storageProviderId].Size {
+			storageProviderId = from
+		}
+	}
+	if len(providers) == 0 {
+		br.events(events.Success(br.request.RetrievalID, phaseStartTime, bitswapCandidate, totalWritten, blockCount, duration, big.Zero()))
+		providers = nil
+	} else if hasUnattributed {
+		br.events(events.Success(br.request.RetrievalID, phaseStartTime, bitswapCandidate, unattributed.Size, unattributed.Blocks, duration, big.Zero()))
+	}
 
 	// return stats
 	return &types.RetrievalStats{
-		StorageProviderId: peer.ID(""),
+		StorageProviderId: storageProviderId,
 		RootCid:           br.request.Cid,
 		Size:              totalWritten,
 		Blocks:            blockCount,
@@ -204,34 +432,121 @@ func (br *bitswapRetrieval) RetrieveFromAsyncCandidates(ayncCandidates types.Inb
 		TotalPayment:      big.Zero(),
 		NumPayments:       0,
 		AskPrice:          big.Zero(),
+		Providers:         providers,
 	}, nil
 }
 
-func loaderForSession(retrievalID types.RetrievalID, inProgressCids InProgressCids, bs blockservice.BlockGetter) linking.BlockReadOpener {
+func sortedPeers(providers map[peer.ID]types.ProviderStats) []peer.ID {
+	peers := make([]peer.ID, 0, len(providers))
+	for p := range providers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+// loaderForSession loads blocks over bitswap, unless they are already present
+// in local storage, perhaps from an earlier failed attempt at the same
+// retrieval, in which case they are loaded from there and not requested.
+// Blocks are taken from the prefetcher, which may already have them, and
+// written to storage as they are loaded. received is called with each block
+// that is requested, and invalid with each that storage rejects as not
+// matching its CID.
+func loaderForSession(local linking.BlockReadOpener, prefetcher *bitswaphelpers.Prefetcher, storage *linking.LinkSystem, received func(cid.Cid, uint64), invalid func(cid.Cid, error)) linking.BlockReadOpener {
 	return func(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
 		cidLink, ok := lnk.(cidlink.Link)
 		if !ok {
 			return nil, fmt.Errorf("invalid link type for loading: %v", lnk)
 		}
-		inProgressCids.Inc(cidLink.Cid, retrievalID)
-		select {
-		case <-lctx.Ctx.Done():
-			return nil, lctx.Ctx.Err()
-		default:
+		if local != nil {
+			if r, err := local(lctx, lnk); err == nil {
+				data, err := io.ReadAll(r)
+				if err != nil {
+					return nil, err
+				}
+				prefetcher.Loaded(cidLink.Cid, data)
+				return bytes.NewReader(data), nil
+			}
 		}
-		blk, err := bs.GetBlock(lctx.Ctx, cidLink.Cid)
-		inProgressCids.Dec(cidLink.Cid, retrievalID)
+		blk, err := prefetcher.Get(lctx.Ctx, cidLink.Cid)
 		if err != nil {
 			return nil, err
 		}
+		w, commit, err := storage.StorageWriteOpener(lctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(blk.RawData()); err != nil {
+			return nil, err
+		}
+		if err := commit(lnk); err != nil {
+			if errors.Is(err, bitswaphelpers.ErrHashMismatch) {
+				invalid(cidLink.Cid, err)
+			}
+			return nil, err
+		}
+		received(cidLink.Cid, uint64(len(blk.RawData())))
+		prefetcher.Loaded(cidLink.Cid, blk.RawData())
 
 		return bytes.NewReader(blk.RawData()), nil
 	}
 }
 
-func easyTraverse(ctx context.Context, root datamodel.Link, traverseSelector datamodel.Node, lsys *linking.LinkSystem) error {
-	protoChooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+// withMaxDepth wraps a loader to fail loading blocks more than maxDepth links
+// from the root, a maxDepth of zero allows any depth. Loads must be made in
+// traversal order, as they are by a single traversal, so that the links
+// followed to reach each block can be worked out from the path it is loaded
+// at.
+func withMaxDepth(loader linking.BlockReadOpener, maxDepth uint64) linking.BlockReadOpener {
+	if maxDepth == 0 {
+		return loader
+	}
+	type pathDepth struct {
+		path  datamodel.Path
+		depth uint64
+	}
+	// the blocks on the way to the one being loaded, deepest last
+	var stack []pathDepth
+	return func(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
+		for len(stack) > 0 && !isPathPrefix(stack[len(stack)-1].path, lctx.LinkPath) {
+			stack = stack[:len(stack)-1]
+		}
+		depth := uint64(0)
+		if len(stack) > 0 {
+			depth = stack[len(stack)-1].depth + 1
+		}
+		if depth > maxDepth {
+			return nil, fmt.Errorf("%w of %d at %s", ErrMaxDepthExceeded, maxDepth, lctx.LinkPath)
+		}
+		stack = append(stack, pathDepth{lctx.LinkPath, depth})
+		return loader(lctx, lnk)
+	}
+}
+
+func isPathPrefix(prefix datamodel.Path, path datamodel.Path) bool {
+	prefixSegments, segments := prefix.Segments(), path.Segments()
+	if len(prefixSegments) > len(segments) {
+		return false
+	}
+	for i, ps := range prefixSegments {
+		if !ps.Equals(segments[i]) {
+			return false
+		}
+	}
+	return true
+}
 
+// withDiscardedWrites copies a LinkSystem, discarding any blocks written to it
+func withDiscardedWrites(lsys linking.LinkSystem) *linking.LinkSystem {
+	lsys.StorageWriteOpener = func(linking.LinkContext) (io.Writer, linking.BlockWriteCommitter, error) {
+		return io.Discard, func(datamodel.Link) error { return nil }, nil
+	}
+	return &lsys
+}
+
+var protoChooser = dagpb.AddSupportToChooser(basicnode.Chooser)
+
+func easyTraverse(ctx context.Context, root datamodel.Link, traverseSelector selector.Selector, lsys *linking.LinkSystem) error {
 	// retrieve first node
 	prototype, err := protoChooser(root, linking.LinkContext{Ctx: ctx})
 	if err != nil {
@@ -250,9 +565,5 @@ func easyTraverse(ctx context.Context, root datamodel.Link, traverseSelector dat
 		},
 	}
 	progress.LastBlock.Link = root
-	compiledSelector, err := selector.ParseSelector(traverseSelector)
-	if err != nil {
-		return err
-	}
-	return progress.WalkAdv(node, compiledSelector, func(prog traversal.Progress, n datamodel.Node, reason traversal.VisitReason) error { return nil })
+	return progress.WalkAdv(node, traverseSelector, func(prog traversal.Progress, n datamodel.Node, reason traversal.VisitReason) error { return nil })
 }
@@ -4,11 +4,13 @@ import (
 	"context"
 	"errors"
 	"io"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/events"
 	"github.com/filecoin-project/lassie/pkg/internal/testutil"
 	"github.com/filecoin-project/lassie/pkg/retriever"
 	"github.com/filecoin-project/lassie/pkg/retriever/bitswaphelpers"
@@ -26,6 +28,7 @@ import (
 	"github.com/ipld/go-ipld-prime/storage/memstore"
 	"github.com/ipld/go-ipld-prime/traversal/selector"
 	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,17 +58,71 @@ func TestBitswapRetriever(t *testing.T) {
 	depth10Selector := ssb.ExploreRecursive(selector.RecursionLimitDepth(10),
 		ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
 	remoteBlockDuration := 50 * time.Millisecond
+	peers := testutil.GeneratePeers(2)
+	sourcesOf := func(from peer.ID, blks []blocks.Block) map[cid.Cid]peer.ID {
+		sources := make(map[cid.Cid]peer.ID, len(blks))
+		for _, blk := range blks {
+			sources[blk.Cid()] = from
+		}
+		return sources
+	}
+	mergeSources := func(sourceMaps ...map[cid.Cid]peer.ID) map[cid.Cid]peer.ID {
+		merged := make(map[cid.Cid]peer.ID)
+		for _, sources := range sourceMaps {
+			for c, from := range sources {
+				merged[c] = from
+			}
+		}
+		return merged
+	}
+	// corrupt replaces the data of a block with that of the block after it
+	corrupt := func(blks []blocks.Block, index int) []blocks.Block {
+		corrupted := append([]blocks.Block{}, blks...)
+		blk, err := blocks.NewBlockWithCid(blks[index+1].RawData(), blks[index].Cid())
+		require.NoError(t, err)
+		corrupted[index] = blk
+		return corrupted
+	}
+	fullRemoteStats := map[cid.Cid]*types.RetrievalStats{
+		cid1: {
+			RootCid:      cid1,
+			Size:         sizeOf(tbc1.AllBlocks()),
+			Blocks:       100,
+			Duration:     remoteBlockDuration * 100,
+			AverageSpeed: uint64(float64(sizeOf(tbc1.AllBlocks())) / (remoteBlockDuration * 100).Seconds()),
+			TotalPayment: big.Zero(),
+			AskPrice:     big.Zero(),
+		},
+		cid2: {
+			RootCid:      cid2,
+			Size:         sizeOf(tbc2.AllBlocks()),
+			Blocks:       100,
+			Duration:     remoteBlockDuration * 100,
+			AverageSpeed: uint64(float64(sizeOf(tbc2.AllBlocks())) / (remoteBlockDuration * 100).Seconds()),
+			TotalPayment: big.Zero(),
+			AskPrice:     big.Zero(),
+		},
+	}
+	candidates1 := testutil.GenerateRetrievalCandidates(5)
+	candidates2 := testutil.GenerateRetrievalCandidates(7)
 	testCases := []struct {
-		name               string
-		localLinkSystems   map[cid.Cid]*linking.LinkSystem
-		remoteLinkSystems  map[cid.Cid]*linking.LinkSystem
-		selector           []ipld.Node
-		expectedCandidates map[cid.Cid][]types.RetrievalCandidate
-		expectedEvents     map[cid.Cid][]types.EventCode
-		expectedStats      map[cid.Cid]*types.RetrievalStats
-		expectedErrors     map[cid.Cid]struct{}
-		expectedCids       []cid.Cid
-		cfg                retriever.BitswapConfig
+		name                 string
+		localLinkSystems     map[cid.Cid]*linking.LinkSystem
+		remoteLinkSystems    map[cid.Cid]*linking.LinkSystem
+		blockSources         map[cid.Cid]peer.ID
+		unrequestedBlockFrom map[cid.Cid]peer.ID
+		// unrequestedBlocks is the number of blocks sent by each peer in
+		// unrequestedBlockFrom, they are the root if unrequestedRoot is set
+		unrequestedBlocks   int
+		unrequestedRoot     bool
+		selector            []ipld.Node
+		expectedCandidates  map[cid.Cid][]types.RetrievalCandidate
+		expectedEvents      map[cid.Cid][]types.EventCode
+		expectedStats       map[cid.Cid]*types.RetrievalStats
+		expectedErrors      map[cid.Cid]struct{}
+		expectedCids        []cid.Cid
+		expectedMisbehaving map[cid.Cid][]peer.ID
+		cfg                 retriever.BitswapConfig
 	}{
 		{
 			name: "successful full remote fetch",
@@ -81,25 +138,58 @@ func TestBitswapRetriever(t *testing.T) {
 				cid1: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
 				cid2: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
 			},
+			expectedCids:  allCids,
+			expectedStats: fullRemoteStats,
+		},
+		{
+			name: "successful remote fetch from multiple peers",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			// cid1 is received from two peers, cid2 from one peer except for
+			// some blocks that aren't attributed to any peer
+			blockSources: mergeSources(
+				sourcesOf(peers[0], tbc1.Blocks(0, 70)),
+				sourcesOf(peers[1], tbc1.Blocks(70, 100)),
+				sourcesOf(peers[1], tbc2.Blocks(0, 90)),
+			),
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: testutil.GenerateRetrievalCandidates(5),
+				cid2: testutil.GenerateRetrievalCandidates(7),
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode, types.SuccessCode},
+				cid2: {types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.FirstByteCode, types.SuccessCode, types.SuccessCode},
+			},
 			expectedCids: allCids,
 			expectedStats: map[cid.Cid]*types.RetrievalStats{
 				cid1: {
-					RootCid:      cid1,
-					Size:         sizeOf(tbc1.AllBlocks()),
-					Blocks:       100,
-					Duration:     remoteBlockDuration * 100,
-					AverageSpeed: uint64(float64(sizeOf(tbc1.AllBlocks())) / (remoteBlockDuration * 100).Seconds()),
-					TotalPayment: big.Zero(),
-					AskPrice:     big.Zero(),
+					StorageProviderId: peers[0],
+					RootCid:           cid1,
+					Size:              sizeOf(tbc1.AllBlocks()),
+					Blocks:            100,
+					Duration:          remoteBlockDuration * 100,
+					AverageSpeed:      uint64(float64(sizeOf(tbc1.AllBlocks())) / (remoteBlockDuration * 100).Seconds()),
+					TotalPayment:      big.Zero(),
+					AskPrice:          big.Zero(),
+					Providers: map[peer.ID]types.ProviderStats{
+						peers[0]: {Size: sizeOf(tbc1.Blocks(0, 70)), Blocks: 70},
+						peers[1]: {Size: sizeOf(tbc1.Blocks(70, 100)), Blocks: 30},
+					},
 				},
 				cid2: {
-					RootCid:      cid2,
-					Size:         sizeOf(tbc2.AllBlocks()),
-					Blocks:       100,
-					Duration:     remoteBlockDuration * 100,
-					AverageSpeed: uint64(float64(sizeOf(tbc2.AllBlocks())) / (remoteBlockDuration * 100).Seconds()),
-					TotalPayment: big.Zero(),
-					AskPrice:     big.Zero(),
+					StorageProviderId: peers[1],
+					RootCid:           cid2,
+					Size:              sizeOf(tbc2.AllBlocks()),
+					Blocks:            100,
+					Duration:          remoteBlockDuration * 100,
+					AverageSpeed:      uint64(float64(sizeOf(tbc2.AllBlocks())) / (remoteBlockDuration * 100).Seconds()),
+					TotalPayment:      big.Zero(),
+					AskPrice:          big.Zero(),
+					Providers: map[peer.ID]types.ProviderStats{
+						peers[1]: {Size: sizeOf(tbc2.Blocks(0, 90)), Blocks: 90},
+					},
 				},
 			},
 		},
@@ -121,7 +211,8 @@ func TestBitswapRetriever(t *testing.T) {
 				cid1: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
 				cid2: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
 			},
-			expectedCids: allCids,
+			// blocks already present locally are not requested
+			expectedCids: cidsOf(append(append(tbc1.Blocks(50, 100), tbc2.Blocks(25, 45)...), tbc2.Blocks(75, 100)...)),
 			expectedStats: map[cid.Cid]*types.RetrievalStats{
 				cid1: {
 					RootCid:      cid1,
@@ -161,7 +252,45 @@ func TestBitswapRetriever(t *testing.T) {
 				cid1: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
 				cid2: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
 			},
-			expectedCids: append(tbc1Cids[:5], tbc2Cids[:5]...),
+			expectedCids: append(append([]cid.Cid{}, tbc1Cids[:5]...), tbc2Cids[:5]...),
+			expectedStats: map[cid.Cid]*types.RetrievalStats{
+				cid1: {
+					RootCid:      cid1,
+					Size:         sizeOf(tbc1.AllBlocks()[:5]),
+					Blocks:       5,
+					Duration:     remoteBlockDuration * 5,
+					AverageSpeed: uint64(float64(sizeOf(tbc1.AllBlocks()[:5])) / (remoteBlockDuration * 5).Seconds()),
+					TotalPayment: big.Zero(),
+					AskPrice:     big.Zero(),
+				},
+				cid2: {
+					RootCid:      cid2,
+					Size:         sizeOf(tbc2.AllBlocks()[:5]),
+					Blocks:       5,
+					Duration:     remoteBlockDuration * 5,
+					AverageSpeed: uint64(float64(sizeOf(tbc2.AllBlocks()[:5])) / (remoteBlockDuration * 5).Seconds()),
+					TotalPayment: big.Zero(),
+					AskPrice:     big.Zero(),
+				},
+			},
+		},
+		{
+			name: "successful selective remote fetch with prefetching",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			selector: []ipld.Node{depth10Selector, depth10Selector},
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: testutil.GenerateRetrievalCandidates(5),
+				cid2: testutil.GenerateRetrievalCandidates(7),
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
+				cid2: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
+			},
+			// links beyond the selector's reach are not prefetched
+			expectedCids: append(append([]cid.Cid{}, tbc1Cids[:5]...), tbc2Cids[:5]...),
 			expectedStats: map[cid.Cid]*types.RetrievalStats{
 				cid1: {
 					RootCid:      cid1,
@@ -182,6 +311,9 @@ func TestBitswapRetriever(t *testing.T) {
 					AskPrice:     big.Zero(),
 				},
 			},
+			cfg: retriever.BitswapConfig{
+				MaxPrefetch: 8,
+			},
 		},
 		{
 			name: "fail remote fetch about non-zero blocks",
@@ -221,6 +353,183 @@ func TestBitswapRetriever(t *testing.T) {
 				cid2: {},
 			},
 		},
+		{
+			name: "fail remote fetch exceeding max blocks",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: testutil.GenerateRetrievalCandidates(5),
+				cid2: testutil.GenerateRetrievalCandidates(7),
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.FirstByteCode, types.FailedCode},
+				cid2: {types.StartedCode, types.FirstByteCode, types.FailedCode},
+			},
+			expectedErrors: map[cid.Cid]struct{}{
+				cid1: {},
+				cid2: {},
+			},
+			cfg: retriever.BitswapConfig{
+				Limits: retriever.BitswapLimits{MaxBlocks: 50},
+			},
+		},
+		{
+			name: "fail remote fetch exceeding max depth",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: testutil.GenerateRetrievalCandidates(5),
+				cid2: testutil.GenerateRetrievalCandidates(7),
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.FirstByteCode, types.FailedCode},
+				cid2: {types.StartedCode, types.FirstByteCode, types.FailedCode},
+			},
+			// the chain is only fetched as deep as allowed
+			expectedCids: append(append([]cid.Cid{}, tbc1Cids[:21]...), tbc2Cids[:21]...),
+			expectedErrors: map[cid.Cid]struct{}{
+				cid1: {},
+				cid2: {},
+			},
+			cfg: retriever.BitswapConfig{
+				Limits: retriever.BitswapLimits{MaxDepth: 20},
+			},
+		},
+		{
+			name: "fail remote fetch of blocks exceeding max block size",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: testutil.GenerateRetrievalCandidates(5),
+				cid2: testutil.GenerateRetrievalCandidates(7),
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.FailedCode},
+				cid2: {types.StartedCode, types.FailedCode},
+			},
+			expectedErrors: map[cid.Cid]struct{}{
+				cid1: {},
+				cid2: {},
+			},
+			cfg: retriever.BitswapConfig{
+				Limits: retriever.BitswapLimits{MaxBlockSize: 500},
+			},
+		},
+		{
+			name: "fail remote fetch of blocks not matching their CIDs",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(corrupt(tbc1.AllBlocks(), 10)),
+				cid2: makeLsys(corrupt(tbc2.AllBlocks(), 10)),
+			},
+			blockSources: map[cid.Cid]peer.ID{
+				tbc1Cids[10]: peers[0],
+				tbc2Cids[10]: peers[1],
+			},
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: testutil.GenerateRetrievalCandidates(5),
+				cid2: testutil.GenerateRetrievalCandidates(7),
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.FirstByteCode, types.MisbehavedCode, types.FailedCode},
+				cid2: {types.StartedCode, types.FirstByteCode, types.MisbehavedCode, types.FailedCode},
+			},
+			expectedMisbehaving: map[cid.Cid][]peer.ID{
+				cid1: {peers[0]},
+				cid2: {peers[1]},
+			},
+			expectedErrors: map[cid.Cid]struct{}{
+				cid1: {},
+				cid2: {},
+			},
+		},
+		{
+			name: "successful remote fetch with unrequested blocks",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			unrequestedBlockFrom: map[cid.Cid]peer.ID{
+				cid1: candidates1[0].MinerPeer.ID,
+				// not a candidate for the retrieval, so not reported
+				cid2: peers[0],
+			},
+			unrequestedBlocks: 2,
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: candidates1,
+				cid2: candidates2,
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.MisbehavedCode, types.FirstByteCode, types.SuccessCode},
+				cid2: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
+			},
+			expectedMisbehaving: map[cid.Cid][]peer.ID{
+				cid1: {candidates1[0].MinerPeer.ID},
+			},
+			expectedCids:  allCids,
+			expectedStats: fullRemoteStats,
+			cfg: retriever.BitswapConfig{
+				MaxUnrequestedBlocks: 2,
+			},
+		},
+		{
+			name: "successful remote fetch with fewer unrequested blocks than the maximum",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			unrequestedBlockFrom: map[cid.Cid]peer.ID{
+				cid1: candidates1[0].MinerPeer.ID,
+				cid2: candidates2[0].MinerPeer.ID,
+			},
+			unrequestedBlocks: 1,
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: candidates1,
+				cid2: candidates2,
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
+				cid2: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
+			},
+			expectedMisbehaving: map[cid.Cid][]peer.ID{},
+			expectedCids:        allCids,
+			expectedStats:       fullRemoteStats,
+			cfg: retriever.BitswapConfig{
+				MaxUnrequestedBlocks: 2,
+			},
+		},
+		{
+			name: "successful remote fetch with blocks the retrieval wanted but were forgotten",
+			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
+				cid1: makeLsys(tbc1.AllBlocks()),
+				cid2: makeLsys(tbc2.AllBlocks()),
+			},
+			unrequestedBlockFrom: map[cid.Cid]peer.ID{
+				cid1: candidates1[0].MinerPeer.ID,
+				cid2: candidates2[0].MinerPeer.ID,
+			},
+			unrequestedBlocks: 2,
+			unrequestedRoot:   true,
+			expectedCandidates: map[cid.Cid][]types.RetrievalCandidate{
+				cid1: candidates1,
+				cid2: candidates2,
+			},
+			expectedEvents: map[cid.Cid][]types.EventCode{
+				cid1: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
+				cid2: {types.StartedCode, types.FirstByteCode, types.SuccessCode},
+			},
+			expectedMisbehaving: map[cid.Cid][]peer.ID{},
+			expectedCids:        allCids,
+			expectedStats:       fullRemoteStats,
+			cfg: retriever.BitswapConfig{
+				MaxUnrequestedBlocks: 2,
+			},
+		},
 		{
 			name: "timeout",
 			remoteLinkSystems: map[cid.Cid]*linking.LinkSystem{
@@ -295,6 +604,8 @@ func TestBitswapRetriever(t *testing.T) {
 			clock := clock.NewMock()
 
 			unlockExchange := make(chan struct{})
+			var bsr *retriever.BitswapRetriever
+			sentUnrequested := make(map[cid.Cid]bool)
 			exchange := &mockExchange{
 				getLsys: func(ctx context.Context) (*linking.LinkSystem, error) {
 					select {
@@ -307,21 +618,37 @@ func TestBitswapRetriever(t *testing.T) {
 					if err != nil {
 						return nil, err
 					}
+					var root cid.Cid
 					switch id {
 					case rid1:
-						return linkSystemForCid(cid1, remoteLinkSystems), nil
+						root = cid1
 					case rid2:
-						return linkSystemForCid(cid2, remoteLinkSystems), nil
+						root = cid2
 					default:
 						return nil, errors.New("unrecognized retrieval")
 					}
+					if from, ok := testCase.unrequestedBlockFrom[root]; ok && !sentUnrequested[root] {
+						sentUnrequested[root] = true
+						for i := 0; i < testCase.unrequestedBlocks; i++ {
+							c := testutil.GenerateCids(1)[0]
+							if testCase.unrequestedRoot {
+								c = root
+							}
+							bsr.UnrequestedBlock(from, c)
+						}
+					}
+					return linkSystemForCid(root, remoteLinkSystems), nil
 				},
 			}
 			bsrv := blockservice.New(mbs, exchange)
 			mir := newMockIndexerRouting()
 			mipc := &mockInProgressCids{}
 			awaitReceivedCandidates := make(chan struct{}, 1)
-			bsr := retriever.NewBitswapRetrieverFromDeps(bsrv, mir, mipc, mbs, testCase.cfg, clock, awaitReceivedCandidates)
+			var blockSources retriever.BlockSources
+			if testCase.blockSources != nil {
+				blockSources = mockBlockSources(testCase.blockSources)
+			}
+			bsr = retriever.NewBitswapRetrieverFromDeps(bsrv, mir, mipc, mbs, blockSources, testCase.cfg, clock, awaitReceivedCandidates)
 			receivedEvents := make(map[cid.Cid][]types.RetrievalEvent)
 			retrievalCollector := func(evt types.RetrievalEvent) {
 				receivedEvents[evt.PayloadCid()] = append(receivedEvents[evt.PayloadCid()], evt)
@@ -412,6 +739,27 @@ func TestBitswapRetriever(t *testing.T) {
 				}
 			}
 			req.Equal(testCase.expectedEvents, receivedCodes)
+			if testCase.expectedMisbehaving != nil {
+				misbehaving := make(map[cid.Cid][]peer.ID)
+				for key, retrievalEvents := range receivedEvents {
+					for _, event := range retrievalEvents {
+						if misbehaved, ok := event.(events.RetrievalEventMisbehaved); ok {
+							misbehaving[key] = append(misbehaving[key], misbehaved.StorageProviderId())
+						}
+					}
+				}
+				req.Equal(testCase.expectedMisbehaving, misbehaving)
+			}
+			if testCase.blockSources != nil {
+				// success is recorded with each peer's share of the retrieval
+				for key, retrievalEvents := range receivedEvents {
+					for _, event := range retrievalEvents {
+						if success, ok := event.(events.RetrievalEventSuccess); ok && success.StorageProviderId() != peer.ID("") {
+							req.Equal(expectedStats[key].Providers[success.StorageProviderId()].Size, success.ReceivedSize())
+						}
+					}
+				}
+			}
 			req.Equal(expectedCandidates, mir.candidatesAdded)
 			req.Equal(map[types.RetrievalID]struct{}{rid1: {}, rid2: {}}, mir.candidatesRemoved)
 			if testCase.expectedCids != nil {
@@ -460,6 +808,13 @@ func (me *mockExchange) NewSession(_ context.Context) exchange.Fetcher {
 	return me
 }
 
+type mockBlockSources map[cid.Cid]peer.ID
+
+func (mbs mockBlockSources) Source(c cid.Cid) (peer.ID, bool) {
+	from, ok := mbs[c]
+	return from, ok
+}
+
 type mockIndexerRouting struct {
 	incomingRetrievals map[types.RetrievalID]struct{}
 	candidatesAdded    map[types.RetrievalID][]types.RetrievalCandidate
@@ -497,6 +852,14 @@ func makeLsys(blocks []blocks.Block) *linking.LinkSystem {
 	return &lsys
 }
 
+func cidsOf(blocks []blocks.Block) []cid.Cid {
+	cids := make([]cid.Cid, 0, len(blocks))
+	for _, block := range blocks {
+		cids = append(cids, block.Cid())
+	}
+	return cids
+}
+
 func sizeOf(blocks []blocks.Block) uint64 {
 	total := uint64(0)
 	for _, block := range blocks {
@@ -527,15 +890,20 @@ func (cms *correctedMemStore) GetStream(ctx context.Context, key string) (io.Rea
 }
 
 type mockInProgressCids struct {
+	lk          sync.Mutex
 	incremented []cid.Cid
 	decremented []cid.Cid
 }
 
 func (mipc *mockInProgressCids) Inc(c cid.Cid, _ types.RetrievalID) {
+	mipc.lk.Lock()
+	defer mipc.lk.Unlock()
 	mipc.incremented = append(mipc.incremented, c)
 }
 
 func (mipc *mockInProgressCids) Dec(c cid.Cid, _ types.RetrievalID) {
+	mipc.lk.Lock()
+	defer mipc.lk.Unlock()
 	mipc.decremented = append(mipc.decremented, c)
 }
 
@@ -0,0 +1,222 @@
+package retriever
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/lassie/pkg/internal/lrucache"
+	"github.com/filecoin-project/lassie/pkg/metrics"
+	"github.com/filecoin-project/lassie/pkg/types"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+	"go.opencensus.io/stats"
+)
+
+const (
+	// DefaultCandidateCacheSize is the number of CIDs whose lookups are cached
+	// when CandidateCacheConfig doesn't set a Size
+	DefaultCandidateCacheSize = 4096
+	// DefaultCandidateLookupTimeout bounds a lookup made by a
+	// CachingCandidateFinder when CandidateCacheConfig doesn't set a
+	// LookupTimeout
+	DefaultCandidateLookupTimeout = time.Minute
+)
+
+var _ CandidateFinder = (*CachingCandidateFinder)(nil)
+
+// CandidateCacheConfig configures a CachingCandidateFinder
+type CandidateCacheConfig struct {
+	// TTL is how long the candidates found for a CID are reused for, zero
+	// doesn't cache lookups that find candidates
+	TTL time.Duration
+	// NegativeTTL is how long a lookup finding no candidates for a CID is
+	// reused for, zero doesn't cache lookups that find nothing
+	NegativeTTL time.Duration
+	// Size is the most CIDs whose lookups are cached at once, the least
+	// recently used are evicted first
+	Size int
+	// LookupTimeout bounds each lookup made through the wrapped finder
+	LookupTimeout time.Duration
+}
+
+// CachingCandidateFinder wraps a CandidateFinder, reusing the candidates it
+// finds for a CID for the TTL, and remembering that it found none for the
+// NegativeTTL. Failed lookups are not cached.
+//
+// Concurrent lookups for a CID share a single lookup through the wrapped
+// finder, and each receives the candidates as they are found. The shared
+// lookup runs apart from the contexts of those waiting on it, bounded by the
+// LookupTimeout, so one giving up doesn't fail the others, and a lookup left
+// with no one waiting still completes and is cached.
+type CachingCandidateFinder struct {
+	finder   CandidateFinder
+	cfg      CandidateCacheConfig
+	clock    clock.Clock
+	lk       sync.Mutex
+	cache    *lru.Cache
+	inflight map[cid.Cid]*candidateLookup
+}
+
+// candidateLookup is a lookup through the wrapped finder, which may still be
+// in flight
+type candidateLookup struct {
+	lk         sync.Mutex
+	candidates []types.RetrievalCandidate
+	err        error
+	// updated is closed and replaced whenever a candidate is found
+	updated chan struct{}
+	done    chan struct{}
+	expires time.Time
+}
+
+func NewCachingCandidateFinder(finder CandidateFinder, cfg CandidateCacheConfig) *CachingCandidateFinder {
+	return NewCachingCandidateFinderWithClock(finder, cfg, clock.New())
+}
+
+func NewCachingCandidateFinderWithClock(finder CandidateFinder, cfg CandidateCacheConfig, clock clock.Clock) *CachingCandidateFinder {
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultCandidateCacheSize
+	}
+	if cfg.LookupTimeout <= 0 {
+		cfg.LookupTimeout = DefaultCandidateLookupTimeout
+	}
+	return &CachingCandidateFinder{
+		finder:   finder,
+		cfg:      cfg,
+		clock:    clock,
+		cache:    lrucache.New(cfg.Size),
+		inflight: make(map[cid.Cid]*candidateLookup),
+	}
+}
+
+// lookup returns a cached lookup for the CID, joins one in flight, or else
+// starts a new one
+func (ccf *CachingCandidateFinder) lookup(c cid.Cid) *candidateLookup {
+	ccf.lk.Lock()
+	defer ccf.lk.Unlock()
+	if cached, ok := ccf.cache.Get(c); ok {
+		l := cached.(*candidateLookup)
+		if ccf.clock.Now().Before(l.expires) {
+			stats.Record(context.Background(), metrics.CandidateCacheHitCount.M(1))
+			return l
+		}
+		ccf.cache.Remove(c)
+	}
+	if l, ok := ccf.inflight[c]; ok {
+		stats.Record(context.Background(), metrics.CandidateCacheHitCount.M(1))
+		return l
+	}
+	stats.Record(context.Background(), metrics.CandidateCacheMissCount.M(1))
+	l := &candidateLookup{updated: make(chan struct{}), done: make(chan struct{})}
+	ccf.inflight[c] = l
+	go ccf.run(c, l)
+	return l
+}
+
+func (ccf *CachingCandidateFinder) run(c cid.Cid, l *candidateLookup) {
+	ctx, cancel := context.WithTimeout(context.Background(), ccf.cfg.LookupTimeout)
+	defer cancel()
+	results, err := ccf.finder.FindCandidatesAsync(ctx, c)
+	if err == nil && results != nil {
+		for result := range results {
+			if result.Err != nil {
+				err = result.Err
+				break
+			}
+			l.lk.Lock()
+			l.candidates = append(l.candidates, result.Candidate)
+			close(l.updated)
+			l.updated = make(chan struct{})
+			l.lk.Unlock()
+		}
+	}
+
+	ccf.lk.Lock()
+	defer ccf.lk.Unlock()
+	delete(ccf.inflight, c)
+	l.lk.Lock()
+	l.err = err
+	ttl := ccf.cfg.TTL
+	if len(l.candidates) == 0 {
+		ttl = ccf.cfg.NegativeTTL
+	}
+	if err == nil && ttl > 0 {
+		l.expires = ccf.clock.Now().Add(ttl)
+		ccf.cache.Add(c, l)
+	}
+	l.lk.Unlock()
+	close(l.done)
+}
+
+// next returns the candidates found from the index given on, once there are
+// any or the lookup is done, along with whether the lookup is done and its
+// error
+func (l *candidateLookup) next(ctx context.Context, from int) ([]types.RetrievalCandidate, bool, error) {
+	for {
+		l.lk.Lock()
+		candidates := l.candidates[from:]
+		updated := l.updated
+		l.lk.Unlock()
+		select {
+		case <-l.done:
+			l.lk.Lock()
+			defer l.lk.Unlock()
+			return l.candidates[from:], true, l.err
+		default:
+		}
+		if len(candidates) > 0 {
+			return candidates, false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, true, ctx.Err()
+		case <-updated:
+		case <-l.done:
+		}
+	}
+}
+
+func (ccf *CachingCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	l := ccf.lookup(c)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.done:
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	return append([]types.RetrievalCandidate{}, l.candidates...), nil
+}
+
+func (ccf *CachingCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	l := ccf.lookup(c)
+	results := make(chan types.FindCandidatesResult)
+	go func() {
+		defer close(results)
+		var sent int
+		for {
+			candidates, done, err := l.next(ctx, sent)
+			for _, candidate := range candidates {
+				select {
+				case <-ctx.Done():
+					return
+				case results <- types.FindCandidatesResult{Candidate: candidate}:
+					sent++
+				}
+			}
+			if err != nil && ctx.Err() == nil {
+				select {
+				case <-ctx.Done():
+				case results <- types.FindCandidatesResult{Err: err}:
+				}
+			}
+			if done {
+				return
+			}
+		}
+	}()
+	return results, nil
+}
@@ -0,0 +1,185 @@
+package retriever_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedCandidateFinder counts its lookups, and holds back all but the first
+// candidate of each until the gate is opened, if there is one
+type gatedCandidateFinder struct {
+	lookups    atomic.Int32
+	gate       chan struct{}
+	err        error
+	candidates map[cid.Cid][]types.RetrievalCandidate
+}
+
+func (gcf *gatedCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	panic("not used by the cache")
+}
+
+func (gcf *gatedCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	gcf.lookups.Add(1)
+	if gcf.err != nil {
+		return nil, gcf.err
+	}
+	results := make(chan types.FindCandidatesResult)
+	go func() {
+		defer close(results)
+		for i, candidate := range gcf.candidates[c] {
+			if i == 1 && gcf.gate != nil {
+				<-gcf.gate
+			}
+			results <- types.FindCandidatesResult{Candidate: candidate}
+		}
+	}()
+	return results, nil
+}
+
+func collectCandidates(t *testing.T, ctx context.Context, finder retriever.CandidateFinder, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	results, err := finder.FindCandidatesAsync(ctx, c)
+	require.NoError(t, err)
+	var candidates []types.RetrievalCandidate
+	for result := range results {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		candidates = append(candidates, result.Candidate)
+	}
+	return candidates, nil
+}
+
+func TestCachingCandidateFinder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cids := testutil.GenerateCids(3)
+	peers := testutil.GeneratePeers(2)
+	found := map[cid.Cid][]types.RetrievalCandidate{
+		cids[0]: {types.NewRetrievalCandidate(peers[0], cids[0], &metadata.Bitswap{}), types.NewRetrievalCandidate(peers[1], cids[0], &metadata.Bitswap{})},
+		cids[1]: {types.NewRetrievalCandidate(peers[0], cids[1], &metadata.Bitswap{})},
+	}
+	cacheCfg := retriever.CandidateCacheConfig{TTL: time.Minute, NegativeTTL: 10 * time.Second}
+
+	t.Run("caches candidates for the TTL", func(t *testing.T) {
+		req := require.New(t)
+		clk := clock.NewMock()
+		finder := &gatedCandidateFinder{candidates: found}
+		ccf := retriever.NewCachingCandidateFinderWithClock(finder, cacheCfg, clk)
+
+		candidates, err := ccf.FindCandidates(ctx, cids[0])
+		req.NoError(err)
+		req.Equal(found[cids[0]], candidates)
+		candidates, err = collectCandidates(t, ctx, ccf, cids[0])
+		req.NoError(err)
+		req.Equal(found[cids[0]], candidates)
+		req.Equal(int32(1), finder.lookups.Load())
+
+		clk.Add(time.Minute)
+		candidates, err = ccf.FindCandidates(ctx, cids[0])
+		req.NoError(err)
+		req.Equal(found[cids[0]], candidates)
+		req.Equal(int32(2), finder.lookups.Load())
+	})
+
+	t.Run("caches finding nothing for the negative TTL", func(t *testing.T) {
+		req := require.New(t)
+		clk := clock.NewMock()
+		finder := &gatedCandidateFinder{candidates: found}
+		ccf := retriever.NewCachingCandidateFinderWithClock(finder, cacheCfg, clk)
+
+		for i := 0; i < 3; i++ {
+			candidates, err := ccf.FindCandidates(ctx, cids[2])
+			req.NoError(err)
+			req.Empty(candidates)
+		}
+		req.Equal(int32(1), finder.lookups.Load())
+		clk.Add(10 * time.Second)
+		_, err := ccf.FindCandidates(ctx, cids[2])
+		req.NoError(err)
+		req.Equal(int32(2), finder.lookups.Load())
+
+		// without a negative TTL nothing found is looked up every time
+		ccf = retriever.NewCachingCandidateFinderWithClock(finder, retriever.CandidateCacheConfig{TTL: time.Minute}, clk)
+		for i := 0; i < 3; i++ {
+			_, err := ccf.FindCandidates(ctx, cids[2])
+			req.NoError(err)
+		}
+		req.Equal(int32(5), finder.lookups.Load())
+	})
+
+	t.Run("does not cache failures", func(t *testing.T) {
+		req := require.New(t)
+		finder := &gatedCandidateFinder{err: errors.New("indexer down")}
+		ccf := retriever.NewCachingCandidateFinderWithClock(finder, cacheCfg, clock.NewMock())
+		_, err := ccf.FindCandidates(ctx, cids[0])
+		req.ErrorContains(err, "indexer down")
+		_, err = collectCandidates(t, ctx, ccf, cids[0])
+		req.ErrorContains(err, "indexer down")
+		req.Equal(int32(2), finder.lookups.Load())
+	})
+
+	t.Run("evicts the least recently used beyond its size", func(t *testing.T) {
+		req := require.New(t)
+		finder := &gatedCandidateFinder{candidates: found}
+		sizedCfg := cacheCfg
+		sizedCfg.Size = 1
+		ccf := retriever.NewCachingCandidateFinderWithClock(finder, sizedCfg, clock.NewMock())
+		for _, c := range []cid.Cid{cids[0], cids[0], cids[1], cids[0]} {
+			_, err := ccf.FindCandidates(ctx, c)
+			req.NoError(err)
+		}
+		req.Equal(int32(3), finder.lookups.Load())
+	})
+
+	t.Run("shares concurrent lookups", func(t *testing.T) {
+		req := require.New(t)
+		finder := &gatedCandidateFinder{candidates: found, gate: make(chan struct{})}
+		ccf := retriever.NewCachingCandidateFinderWithClock(finder, cacheCfg, clock.NewMock())
+
+		// a caller giving up doesn't stop the others
+		cancelledCtx, cancelCaller := context.WithCancel(ctx)
+		cancelledResults, err := ccf.FindCandidatesAsync(cancelledCtx, cids[0])
+		req.NoError(err)
+		first := <-cancelledResults
+		req.Equal(found[cids[0]][0], first.Candidate)
+		cancelCaller()
+
+		var wg sync.WaitGroup
+		received := make([][]types.RetrievalCandidate, 3)
+		for i := range received {
+			i := i
+			results, err := ccf.FindCandidatesAsync(ctx, cids[0])
+			req.NoError(err)
+			// candidates found so far are received before the lookup completes
+			first := <-results
+			req.Equal(found[cids[0]][0], first.Candidate)
+			received[i] = append(received[i], first.Candidate)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for result := range results {
+					received[i] = append(received[i], result.Candidate)
+				}
+			}()
+		}
+		close(finder.gate)
+		wg.Wait()
+		for _, candidates := range received {
+			req.Equal(found[cids[0]], candidates)
+		}
+		req.Equal(int32(1), finder.lookups.Load())
+	})
+}
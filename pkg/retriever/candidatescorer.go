@@ -0,0 +1,88 @@
+package retriever
+
+import (
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/lassie/pkg/types"
+)
+
+// QueriedCandidate is a graphsync candidate that has successfully responded
+// to a query, along with what is known about it, for the purpose of ranking it
+// against other candidates for the same retrieval.
+type QueriedCandidate struct {
+	types.RetrievalCandidate
+	QueryResponse retrievalmarket.QueryResponse
+	// QueryDuration is the time taken from the start of the query phase to
+	// receive the query response
+	QueryDuration time.Duration
+	// Reputation is the recorded graphsync retrieval history of the storage
+	// provider, it will be zero if there is none
+	Reputation ProtocolReputation
+}
+
+// CandidateScorer decides the order in which graphsync candidates that have
+// successfully responded to a query are retrieved from. Only one graphsync
+// retrieval is attempted at a time, so when more than one candidate is ready,
+// the most preferable is chosen.
+type CandidateScorer interface {
+	// Prefer returns true if candidate a should be retrieved from before
+	// candidate b
+	Prefer(a, b QueriedCandidate) bool
+}
+
+// CandidateScorerFunc adapts a comparison function to a CandidateScorer
+type CandidateScorerFunc func(a, b QueriedCandidate) bool
+
+func (csf CandidateScorerFunc) Prefer(a, b QueriedCandidate) bool {
+	return csf(a, b)
+}
+
+// DefaultCandidateScorer prefers, in order: unsealed candidates, a lower total
+// cost, a smaller size, and finally the fastest to respond to the query.
+var DefaultCandidateScorer CandidateScorer = CandidateScorerFunc(func(a, b QueriedCandidate) bool {
+	// Always prefer unsealed to sealed, no matter what
+	if a.QueryResponse.UnsealPrice.IsZero() && !b.QueryResponse.UnsealPrice.IsZero() {
+		return true
+	}
+
+	// Select lower price, or continue if equal
+	aTotalCost := totalCost(&a.QueryResponse)
+	bTotalCost := totalCost(&b.QueryResponse)
+	if !aTotalCost.Equals(bTotalCost) {
+		return aTotalCost.LessThan(bTotalCost)
+	}
+
+	// Select smaller size, or continue if equal
+	if a.QueryResponse.Size != b.QueryResponse.Size {
+		return a.QueryResponse.Size < b.QueryResponse.Size
+	}
+
+	// Select the fastest to respond
+	return a.QueryDuration < b.QueryDuration
+})
+
+// ReputationCandidateScorer orders candidates as the DefaultCandidateScorer
+// does, but prefers a better historical reputation over a smaller size.
+var ReputationCandidateScorer CandidateScorer = CandidateScorerFunc(func(a, b QueriedCandidate) bool {
+	// Always prefer unsealed to sealed, no matter what
+	if a.QueryResponse.UnsealPrice.IsZero() && !b.QueryResponse.UnsealPrice.IsZero() {
+		return true
+	}
+
+	// Select lower price, or continue if equal
+	aTotalCost := totalCost(&a.QueryResponse)
+	bTotalCost := totalCost(&b.QueryResponse)
+	if !aTotalCost.Equals(bTotalCost) {
+		return aTotalCost.LessThan(bTotalCost)
+	}
+
+	// Select the better historical reputation, or continue if equal
+	aScore := a.Reputation.Score()
+	bScore := b.Reputation.Score()
+	if aScore != bScore {
+		return aScore > bScore
+	}
+
+	return DefaultCandidateScorer.Prefer(a, b)
+})
@@ -0,0 +1,113 @@
+package retriever
+
+import (
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCandidateScorers(t *testing.T) {
+	unsealed := retrievalmarket.QueryResponse{Size: 10, MinPricePerByte: big.Zero(), UnsealPrice: big.Zero()}
+	sealed := retrievalmarket.QueryResponse{Size: 10, MinPricePerByte: big.Zero(), UnsealPrice: big.NewInt(1)}
+	pricey := retrievalmarket.QueryResponse{Size: 10, MinPricePerByte: big.NewInt(1), UnsealPrice: big.Zero()}
+	large := retrievalmarket.QueryResponse{Size: 100, MinPricePerByte: big.Zero(), UnsealPrice: big.Zero()}
+	reliable := ProtocolReputation{Successes: 10}
+	unreliable := ProtocolReputation{Successes: 1, Failures: 10}
+	slow := ProtocolReputation{Successes: 10, TTFB: time.Minute}
+
+	testCases := []struct {
+		name     string
+		scorer   CandidateScorer
+		a        QueriedCandidate
+		b        QueriedCandidate
+		expected bool
+	}{
+		{
+			name:     "default: unsealed over sealed",
+			scorer:   DefaultCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, Reputation: unreliable},
+			b:        QueriedCandidate{QueryResponse: sealed, Reputation: reliable},
+			expected: true,
+		},
+		{
+			name:     "default: cheaper over more expensive",
+			scorer:   DefaultCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed},
+			b:        QueriedCandidate{QueryResponse: pricey},
+			expected: true,
+		},
+		{
+			name:     "default: ignores reputation",
+			scorer:   DefaultCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: large, Reputation: reliable},
+			b:        QueriedCandidate{QueryResponse: unsealed, Reputation: unreliable},
+			expected: false,
+		},
+		{
+			name:     "default: smaller over larger",
+			scorer:   DefaultCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, QueryDuration: time.Second},
+			b:        QueriedCandidate{QueryResponse: large, QueryDuration: time.Millisecond},
+			expected: true,
+		},
+		{
+			name:     "default: fastest query when otherwise equal",
+			scorer:   DefaultCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, QueryDuration: time.Second},
+			b:        QueriedCandidate{QueryResponse: unsealed, QueryDuration: time.Millisecond},
+			expected: false,
+		},
+		{
+			name:     "reputation: unsealed over sealed",
+			scorer:   ReputationCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, Reputation: unreliable},
+			b:        QueriedCandidate{QueryResponse: sealed, Reputation: reliable},
+			expected: true,
+		},
+		{
+			name:     "reputation: cheaper over reputation",
+			scorer:   ReputationCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, Reputation: unreliable},
+			b:        QueriedCandidate{QueryResponse: pricey, Reputation: reliable},
+			expected: true,
+		},
+		{
+			name:     "reputation: reputation over size",
+			scorer:   ReputationCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: large, Reputation: reliable},
+			b:        QueriedCandidate{QueryResponse: unsealed},
+			expected: true,
+		},
+		{
+			name:     "reputation: unknown over unreliable",
+			scorer:   ReputationCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, Reputation: unreliable},
+			b:        QueriedCandidate{QueryResponse: large},
+			expected: false,
+		},
+		{
+			name:     "reputation: fast over slow",
+			scorer:   ReputationCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, Reputation: slow},
+			b:        QueriedCandidate{QueryResponse: unsealed, Reputation: reliable},
+			expected: false,
+		},
+		{
+			name:     "reputation: smaller when equal reputation",
+			scorer:   ReputationCandidateScorer,
+			a:        QueriedCandidate{QueryResponse: unsealed, QueryDuration: time.Second},
+			b:        QueriedCandidate{QueryResponse: large, QueryDuration: time.Millisecond},
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.scorer.Prefer(tc.a, tc.b))
+		})
+	}
+}
@@ -3,6 +3,8 @@ package combinators
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/filecoin-project/lassie/pkg/retriever/coordinators"
 	"github.com/filecoin-project/lassie/pkg/types"
@@ -16,6 +18,15 @@ type SplitRetriever[T comparable] struct {
 	AsyncCandidateSplitter types.AsyncCandidateSplitter[T]
 	CandidateRetrievers    map[T]types.CandidateRetriever
 	CoordinationKind       types.CoordinationKind
+	// HedgeDelay is how long to wait for a first byte, once the first
+	// retriever has started retrieving, before starting the remaining
+	// retrievers with HedgedCoordination, defaults to
+	// coordinators.DefaultHedgeDelay
+	HedgeDelay time.Duration
+	// Preference is the order in which retrievers are queued with the
+	// coordinator, this matters for sequential and hedged coordination. Keys
+	// not listed are queued last in no particular order.
+	Preference []T
 }
 
 func (m SplitRetriever[T]) Retrieve(ctx context.Context, request types.RetrievalRequest, events func(types.RetrievalEvent)) types.CandidateRetrieval {
@@ -24,6 +35,8 @@ func (m SplitRetriever[T]) Retrieve(ctx context.Context, request types.Retrieval
 		retrievalSplitter:   m.AsyncCandidateSplitter.SplitRetrievalRequest(ctx, request, events),
 		candidateRetrievers: m.CandidateRetrievers,
 		coordinationKind:    m.CoordinationKind,
+		hedgeDelay:          m.HedgeDelay,
+		preference:          m.Preference,
 		ctx:                 ctx,
 		request:             request,
 		events:              events,
@@ -34,6 +47,8 @@ type splitRetrieval[T comparable] struct {
 	retrievalSplitter   types.AsyncRetrievalSplitter[T]
 	candidateRetrievers map[T]types.CandidateRetriever
 	coordinationKind    types.CoordinationKind
+	hedgeDelay          time.Duration
+	preference          []T
 	ctx                 context.Context
 	request             types.RetrievalRequest
 	events              func(types.RetrievalEvent)
@@ -41,16 +56,38 @@ type splitRetrieval[T comparable] struct {
 
 func (m splitRetrieval[T]) RetrieveFromAsyncCandidates(asyncCandidates types.InboundAsyncCandidates) (*types.RetrievalStats, error) {
 	asyncSplitCandidates, errChan := m.retrievalSplitter.SplitAsyncCandidates(asyncCandidates)
-	coordinator, err := coordinators.Coordinator(m.coordinationKind)
+	events := m.events
+	var hedge coordinators.HedgeConfig
+	if m.coordinationKind == types.HedgedCoordination {
+		// signal the coordinator when any retriever starts retrieving and on
+		// the first byte from any retriever
+		started := make(chan struct{})
+		firstByte := make(chan struct{})
+		var startedOnce, firstByteOnce sync.Once
+		events = func(event types.RetrievalEvent) {
+			switch event.Code() {
+			case types.StartedCode:
+				if event.Phase() == types.RetrievalPhase {
+					startedOnce.Do(func() { close(started) })
+				}
+			case types.FirstByteCode:
+				firstByteOnce.Do(func() { close(firstByte) })
+			}
+			m.events(event)
+		}
+		hedge = coordinators.HedgeConfig{Delay: m.hedgeDelay, Started: started, FirstByte: firstByte}
+	}
+	coordinator, err := coordinators.Coordinator(m.coordinationKind, hedge)
 	if err != nil {
 		return nil, err
 	}
 	stats, err := coordinator(m.ctx, func(ctx context.Context, retrievalCall func(types.RetrievalTask)) {
 		candidateRetrievals := make(map[T]types.CandidateRetrieval, len(m.candidateRetrievers))
 		for key, candidateRetriever := range m.candidateRetrievers {
-			candidateRetrievals[key] = candidateRetriever.Retrieve(ctx, m.request, m.events)
+			candidateRetrievals[key] = candidateRetriever.Retrieve(ctx, m.request, events)
 		}
-		for key, asyncCandidates := range asyncSplitCandidates {
+		for _, key := range orderKeys(asyncSplitCandidates, m.preference) {
+			asyncCandidates := asyncSplitCandidates[key]
 			if asyncCandidateRetrieval, ok := candidateRetrievals[key]; ok {
 				retrievalCall(types.AsyncRetrievalTask{
 					Candidates:              asyncCandidates,
@@ -65,3 +102,27 @@ func (m splitRetrieval[T]) RetrieveFromAsyncCandidates(asyncCandidates types.Inb
 	}
 	return stats, err
 }
+
+// orderKeys returns the keys of the split candidates with those in the
+// preference list first, in that order
+func orderKeys[T comparable](asyncSplitCandidates map[T]types.InboundAsyncCandidates, preference []T) []T {
+	keys := make([]T, 0, len(asyncSplitCandidates))
+	for _, key := range preference {
+		if _, ok := asyncSplitCandidates[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	for key := range asyncSplitCandidates {
+		var preferred bool
+		for _, p := range preference {
+			if p == key {
+				preferred = true
+				break
+			}
+		}
+		if !preferred {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,276 @@
+package retriever
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"go.uber.org/multierr"
+)
+
+var _ CandidateFinder = (*CompositeCandidateFinder)(nil)
+
+// CandidateSource is one of the CandidateFinders searched by a
+// CompositeCandidateFinder
+type CandidateSource struct {
+	// Name tags the candidates found through the source, unless they have
+	// already been tagged by the finder
+	Name   string
+	Finder CandidateFinder
+	// Timeout bounds the search of the source, which is cut short without
+	// failing once it has passed; zero leaves it to the caller's context
+	Timeout time.Duration
+}
+
+// CompositeCandidateFinder searches several CandidateSources at once, such as
+// the indexer, the DHT and a list of our own peers, merging what they find.
+// Candidates are tagged with the source that found them, and a peer found by
+// more than one source is a single candidate supporting all of the protocols
+// they found it with.
+//
+// Sources are given in priority order. FindCandidates orders candidates by the
+// first source to find them, which also names them. FindCandidatesAsync sends
+// candidates as they are found, so a peer found again with protocols not yet
+// sent is sent again with just those protocols.
+//
+// The search fails only when every source fails; the failures of some sources
+// are logged while candidates are found through the others.
+type CompositeCandidateFinder struct {
+	sources []CandidateSource
+}
+
+// NewCompositeCandidateFinder returns a CompositeCandidateFinder for the
+// sources, in priority order
+func NewCompositeCandidateFinder(sources ...CandidateSource) *CompositeCandidateFinder {
+	return &CompositeCandidateFinder{sources: sources}
+}
+
+func (ccf *CompositeCandidateFinder) sourceContext(ctx context.Context, source CandidateSource) (context.Context, context.CancelFunc) {
+	if source.Timeout > 0 {
+		return context.WithTimeout(ctx, source.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// sourceFailed filters out the failure of a source whose timeout cut short
+// its search, which isn't a failure of the search as a whole
+func sourceFailed(ctx context.Context, sourceCtx context.Context, source CandidateSource, err error) error {
+	if ctx.Err() == nil && sourceCtx.Err() == context.DeadlineExceeded {
+		log.Debugw("candidate source timed out", "source", source.Name, "timeout", source.Timeout)
+		return nil
+	}
+	return fmt.Errorf("%s: %w", source.Name, err)
+}
+
+func (ccf *CompositeCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	found := make([][]types.RetrievalCandidate, len(ccf.sources))
+	errs := make([]error, len(ccf.sources))
+	var wg sync.WaitGroup
+	for i, source := range ccf.sources {
+		i, source := i, source
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sourceCtx, cancel := ccf.sourceContext(ctx, source)
+			defer cancel()
+			candidates, err := source.Finder.FindCandidates(sourceCtx, c)
+			if err != nil {
+				errs[i] = sourceFailed(ctx, sourceCtx, source, err)
+			}
+			found[i] = candidates
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var failures error
+	var failed int
+	merged := newCandidateMerger()
+	var ordered []peer.ID
+	for i, source := range ccf.sources {
+		if errs[i] != nil {
+			failures = multierr.Append(failures, errs[i])
+			failed++
+			continue
+		}
+		for _, candidate := range found[i] {
+			if _, ok := merged.candidates[candidate.MinerPeer.ID]; !ok {
+				ordered = append(ordered, candidate.MinerPeer.ID)
+			}
+			merged.add(tagCandidate(candidate, source))
+		}
+	}
+	if failed == len(ccf.sources) && failed > 0 {
+		return nil, failures
+	}
+	if failures != nil {
+		log.Debugw("failed to find candidates through some sources", "cid", c, "err", failures)
+	}
+	candidates := make([]types.RetrievalCandidate, 0, len(ordered))
+	for _, id := range ordered {
+		candidates = append(candidates, merged.candidates[id])
+	}
+	return candidates, nil
+}
+
+type sourcedResult struct {
+	source CandidateSource
+	result types.FindCandidatesResult
+}
+
+func (ccf *CompositeCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	sourced := make(chan sourcedResult)
+	var failures error
+	var started int
+	var wg sync.WaitGroup
+	for _, source := range ccf.sources {
+		sourceCtx, cancel := ccf.sourceContext(ctx, source)
+		results, err := source.Finder.FindCandidatesAsync(sourceCtx, c)
+		if err != nil {
+			failures = multierr.Append(failures, fmt.Errorf("%s: %w", source.Name, err))
+			cancel()
+			continue
+		}
+		started++
+		wg.Add(1)
+		go func(source CandidateSource, sourceCtx context.Context, results <-chan types.FindCandidatesResult) {
+			defer wg.Done()
+			defer cancel()
+			if results == nil {
+				// a finder may have nothing to stream at all
+				return
+			}
+			for {
+				select {
+				case <-sourceCtx.Done():
+					return
+				case result, ok := <-results:
+					if !ok {
+						return
+					}
+					if result.Err != nil {
+						if result.Err = sourceFailed(ctx, sourceCtx, source, result.Err); result.Err == nil {
+							return
+						}
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case sourced <- sourcedResult{source, result}:
+					}
+				}
+			}
+		}(source, sourceCtx, results)
+	}
+	if started == 0 && failures != nil {
+		return nil, failures
+	}
+	if failures != nil {
+		log.Debugw("failed to find candidates through some sources", "cid", c, "err", failures)
+	}
+	go func() {
+		wg.Wait()
+		close(sourced)
+	}()
+
+	results := make(chan types.FindCandidatesResult)
+	go func() {
+		defer close(results)
+		merged := newCandidateMerger()
+		var sent int
+		for next := range sourced {
+			if next.result.Err != nil {
+				failures = multierr.Append(failures, next.result.Err)
+				log.Debugw("failed to find candidates through source", "cid", c, "source", next.source.Name, "err", next.result.Err)
+				continue
+			}
+			candidate, ok := merged.add(tagCandidate(next.result.Candidate, next.source))
+			if !ok {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case results <- types.FindCandidatesResult{Candidate: candidate}:
+				sent++
+			}
+		}
+		if sent == 0 && failures != nil {
+			select {
+			case <-ctx.Done():
+			case results <- types.FindCandidatesResult{Err: failures}:
+			}
+		}
+	}()
+	return results, nil
+}
+
+func tagCandidate(candidate types.RetrievalCandidate, source CandidateSource) types.RetrievalCandidate {
+	if candidate.Source == "" {
+		candidate.Source = source.Name
+	}
+	return candidate
+}
+
+// candidateMerger merges candidates for the same peer
+type candidateMerger struct {
+	candidates map[peer.ID]types.RetrievalCandidate
+}
+
+func newCandidateMerger() *candidateMerger {
+	return &candidateMerger{candidates: make(map[peer.ID]types.RetrievalCandidate)}
+}
+
+// add merges a candidate with those found before it, returning a candidate
+// with just the protocols that hadn't been found for its peer before, if
+// there are any
+func (cm *candidateMerger) add(candidate types.RetrievalCandidate) (types.RetrievalCandidate, bool) {
+	existing, ok := cm.candidates[candidate.MinerPeer.ID]
+	if !ok {
+		cm.candidates[candidate.MinerPeer.ID] = candidate
+		return candidate, true
+	}
+	var newProtocols []metadata.Protocol
+	for _, code := range candidate.Metadata.Protocols() {
+		if existing.Metadata.Get(code) == nil {
+			newProtocols = append(newProtocols, candidate.Metadata.Get(code))
+		}
+	}
+	existing.MinerPeer.Addrs = mergeAddrs(existing.MinerPeer.Addrs, candidate.MinerPeer.Addrs)
+	if len(newProtocols) == 0 {
+		cm.candidates[candidate.MinerPeer.ID] = existing
+		return types.RetrievalCandidate{}, false
+	}
+	existing.Metadata = types.MetadataContext.New(append(protocolsOf(existing.Metadata), newProtocols...)...)
+	cm.candidates[candidate.MinerPeer.ID] = existing
+	candidate.MinerPeer.Addrs = existing.MinerPeer.Addrs
+	candidate.Metadata = types.MetadataContext.New(newProtocols...)
+	return candidate, true
+}
+
+func protocolsOf(md metadata.Metadata) []metadata.Protocol {
+	codes := md.Protocols()
+	protocols := make([]metadata.Protocol, 0, len(codes))
+	for _, code := range codes {
+		protocols = append(protocols, md.Get(code))
+	}
+	return protocols
+}
+
+func mergeAddrs(addrs []multiaddr.Multiaddr, more []multiaddr.Multiaddr) []multiaddr.Multiaddr {
+	merged := append([]multiaddr.Multiaddr{}, addrs...)
+	for _, addr := range more {
+		if !multiaddr.Contains(merged, addr) {
+			merged = append(merged, addr)
+		}
+	}
+	return merged
+}
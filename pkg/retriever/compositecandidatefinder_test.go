@@ -0,0 +1,130 @@
+package retriever_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledCandidateFinder finds nothing until its context is done
+type stalledCandidateFinder struct{}
+
+func (stalledCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (stalledCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	results := make(chan types.FindCandidatesResult, 1)
+	go func() {
+		defer close(results)
+		<-ctx.Done()
+		results <- types.FindCandidatesResult{Err: ctx.Err()}
+	}()
+	return results, nil
+}
+
+func TestCompositeCandidateFinder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	root := testutil.GenerateCids(1)[0]
+	peers := testutil.GeneratePeers(3)
+	addr1 := multiaddr.StringCast("/ip4/127.0.0.1/tcp/1")
+	addr2 := multiaddr.StringCast("/ip4/127.0.0.1/tcp/2")
+
+	directCandidate := types.NewRetrievalCandidate(peers[0], root, &metadata.Bitswap{})
+	directCandidate.MinerPeer.Addrs = []multiaddr.Multiaddr{addr1}
+	indexerCandidates := []types.RetrievalCandidate{
+		types.NewRetrievalCandidate(peers[0], root, &metadata.Bitswap{}, &metadata.GraphsyncFilecoinV1{}),
+		types.NewRetrievalCandidate(peers[1], root, &types.IpfsGatewayHttp{}),
+	}
+	indexerCandidates[0].MinerPeer.Addrs = []multiaddr.Multiaddr{addr2}
+	// already tagged by a composite finder of its own
+	taggedCandidate := types.NewRetrievalCandidate(peers[2], root, &metadata.Bitswap{})
+	taggedCandidate.Source = "inner"
+
+	sources := []retriever.CandidateSource{
+		{Name: "direct", Finder: &testutil.MockCandidateFinder{Candidates: map[cid.Cid][]types.RetrievalCandidate{root: {directCandidate}}}},
+		{Name: "indexer", Finder: &testutil.MockCandidateFinder{Candidates: map[cid.Cid][]types.RetrievalCandidate{root: indexerCandidates}}},
+		{Name: "nested", Finder: &testutil.MockCandidateFinder{Candidates: map[cid.Cid][]types.RetrievalCandidate{root: {taggedCandidate}}}},
+		{Name: "failing", Finder: &testutil.MockCandidateFinder{Error: errors.New("unreachable")}},
+		{Name: "stalled", Finder: stalledCandidateFinder{}, Timeout: 20 * time.Millisecond},
+	}
+	finder := retriever.NewCompositeCandidateFinder(sources...)
+
+	t.Run("FindCandidates", func(t *testing.T) {
+		req := require.New(t)
+		candidates, err := finder.FindCandidates(ctx, root)
+		req.NoError(err)
+		req.Len(candidates, 3)
+
+		req.Equal(peer.AddrInfo{ID: peers[0], Addrs: []multiaddr.Multiaddr{addr1, addr2}}, candidates[0].MinerPeer)
+		req.Equal("direct", candidates[0].Source)
+		req.ElementsMatch([]multicodec.Code{multicodec.TransportBitswap, multicodec.TransportGraphsyncFilecoinv1}, candidates[0].Metadata.Protocols())
+		req.Equal(peers[1], candidates[1].MinerPeer.ID)
+		req.Equal("indexer", candidates[1].Source)
+		req.Equal([]multicodec.Code{types.TransportIpfsGatewayHttp}, candidates[1].Metadata.Protocols())
+		req.Equal(peers[2], candidates[2].MinerPeer.ID)
+		req.Equal("inner", candidates[2].Source)
+	})
+
+	t.Run("FindCandidatesAsync", func(t *testing.T) {
+		req := require.New(t)
+		results, err := finder.FindCandidatesAsync(ctx, root)
+		req.NoError(err)
+		sources := make(map[peer.ID][]string)
+		protocols := make(map[peer.ID][]multicodec.Code)
+		for result := range results {
+			req.NoError(result.Err)
+			id := result.Candidate.MinerPeer.ID
+			sources[id] = append(sources[id], result.Candidate.Source)
+			protocols[id] = append(protocols[id], result.Candidate.Metadata.Protocols()...)
+		}
+		// each protocol of a peer is sent once, by whichever source found it
+		// first
+		req.Len(protocols, 3)
+		req.ElementsMatch([]multicodec.Code{multicodec.TransportBitswap, multicodec.TransportGraphsyncFilecoinv1}, protocols[peers[0]])
+		req.Subset([]string{"direct", "indexer"}, sources[peers[0]])
+		req.Equal([]multicodec.Code{types.TransportIpfsGatewayHttp}, protocols[peers[1]])
+		req.Equal([]string{"indexer"}, sources[peers[1]])
+		req.Equal([]string{"inner"}, sources[peers[2]])
+	})
+
+	t.Run("all sources failing", func(t *testing.T) {
+		req := require.New(t)
+		failing := retriever.NewCompositeCandidateFinder(sources[3], retriever.CandidateSource{
+			Name:   "also failing",
+			Finder: &testutil.MockCandidateFinder{Error: errors.New("down")},
+		})
+		_, err := failing.FindCandidates(ctx, root)
+		req.ErrorContains(err, "failing: unreachable")
+		req.ErrorContains(err, "also failing: down")
+		_, err = failing.FindCandidatesAsync(ctx, root)
+		req.ErrorContains(err, "failing: unreachable")
+	})
+
+	t.Run("source timing out finds nothing", func(t *testing.T) {
+		req := require.New(t)
+		stalled := retriever.NewCompositeCandidateFinder(sources[4])
+		candidates, err := stalled.FindCandidates(ctx, root)
+		req.NoError(err)
+		req.Empty(candidates)
+		results, err := stalled.FindCandidatesAsync(ctx, root)
+		req.NoError(err)
+		for result := range results {
+			req.Fail("unexpected result", result)
+		}
+	})
+}
@@ -9,12 +9,16 @@ import (
 	"github.com/filecoin-project/lassie/pkg/types"
 )
 
-func Coordinator(kind types.CoordinationKind) (types.RetrievalCoordinator, error) {
+// Coordinator returns the coordinator for the given kind, hedge configures
+// HedgedCoordination and is ignored for other kinds
+func Coordinator(kind types.CoordinationKind, hedge HedgeConfig) (types.RetrievalCoordinator, error) {
 	switch kind {
 	case types.RaceCoordination:
 		return Race, nil
 	case types.SequentialCoordination:
 		return Sequence, nil
+	case types.HedgedCoordination:
+		return Hedge(hedge), nil
 	default:
 		return nil, errors.New("unrecognized retriever kind")
 	}
@@ -0,0 +1,143 @@
+package coordinators
+
+import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"go.uber.org/multierr"
+)
+
+// DefaultHedgeDelay is the time a hedged retrieval will wait for a first byte
+// from the first retrieval before starting the others
+const DefaultHedgeDelay = 2 * time.Second
+
+// HedgeConfig configures a hedged coordinator
+type HedgeConfig struct {
+	// Delay is how long to wait for a first byte from the first retrieval,
+	// once it has started, before starting the others, defaults to
+	// DefaultHedgeDelay
+	Delay time.Duration
+	// Started is signalled when the first retrieval begins retrieving, as
+	// opposed to finding candidates, and starts the delay. If nil, the delay
+	// starts with the coordinator.
+	Started <-chan struct{}
+	// FirstByte is signalled when the first retrieval receives its first byte
+	FirstByte <-chan struct{}
+}
+
+// Hedge creates a coordinator that runs the first queued retrieval straight
+// away and holds back any that follow. The held back retrievals are started
+// if the delay passes after the Started signal without a FirstByte signal, or
+// as soon as every started retrieval has finished without success. Once
+// started, retrievals race as they would with the Race coordinator.
+func Hedge(cfg HedgeConfig) types.RetrievalCoordinator {
+	return HedgeWithClock(clock.New(), cfg)
+}
+
+// HedgeWithClock is Hedge with a custom clock
+func HedgeWithClock(clock clock.Clock, cfg HedgeConfig) types.RetrievalCoordinator {
+	delay := cfg.Delay
+	if delay == 0 {
+		delay = DefaultHedgeDelay
+	}
+	return func(ctx context.Context, queueOperations types.QueueRetrievalsFn) (*types.RetrievalStats, error) {
+		resultChan := make(chan types.RetrievalResult)
+		taskChan := make(chan types.RetrievalTask)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		go func() {
+			defer close(taskChan)
+			queueOperations(ctx, func(nextRetrieval types.RetrievalTask) {
+				select {
+				case <-ctx.Done():
+				case taskChan <- nextRetrieval:
+				}
+			})
+		}()
+
+		var running int
+		start := func(nextRetrieval types.RetrievalTask) {
+			running++
+			go func() {
+				stats, err := nextRetrieval.Run()
+				select {
+				case <-ctx.Done():
+				case resultChan <- types.RetrievalResult{Stats: stats, Err: err}:
+				}
+			}()
+		}
+
+		started, firstByte := cfg.Started, cfg.FirstByte
+		var timerChan <-chan time.Time
+		stopTimer := func() bool { return false }
+		startTimer := func() {
+			timer := clock.Timer(delay)
+			timerChan = timer.C
+			stopTimer = timer.Stop
+		}
+		defer func() { stopTimer() }()
+		if started == nil {
+			startTimer()
+		}
+
+		var pending []types.RetrievalTask
+		var hedged bool
+		startPending := func() {
+			hedged = true
+			started = nil
+			timerChan = nil
+			for _, nextRetrieval := range pending {
+				start(nextRetrieval)
+			}
+			pending = nil
+		}
+
+		var totalErr error
+		queueDone := false
+		for !queueDone || running > 0 || len(pending) > 0 {
+			select {
+			case nextRetrieval, ok := <-taskChan:
+				if !ok {
+					queueDone = true
+					taskChan = nil
+					continue
+				}
+				if running == 0 || hedged {
+					start(nextRetrieval)
+				} else {
+					pending = append(pending, nextRetrieval)
+				}
+			case <-started:
+				// the first retrieval has found candidates and is retrieving,
+				// give it the delay to receive a first byte
+				started = nil
+				startTimer()
+			case <-firstByte:
+				// the first retrieval is progressing, only start the others if
+				// it fails
+				firstByte = nil
+				started = nil
+				timerChan = nil
+			case <-timerChan:
+				startPending()
+			case result := <-resultChan:
+				running--
+				if result.Err != nil {
+					totalErr = multierr.Append(totalErr, result.Err)
+				}
+				if result.Stats != nil {
+					return result.Stats, nil
+				}
+				if running == 0 {
+					startPending()
+				}
+			case <-ctx.Done():
+				return nil, context.Canceled
+			}
+		}
+		return nil, totalErr
+	}
+}
@@ -0,0 +1,209 @@
+package coordinators_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/lassie/pkg/retriever/coordinators"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedge(t *testing.T) {
+	ctx := context.Background()
+	hedgeDelay := 200 * time.Millisecond
+	apples := &types.RetrievalStats{StorageProviderId: peer.ID("apples")}
+	oranges := &types.RetrievalStats{StorageProviderId: peer.ID("oranges")}
+
+	testCases := []struct {
+		name    string
+		results []timeoutResult
+		// firstByte signals a first byte once the first retrieval has started
+		firstByte bool
+		// retrieving passes a started signal, which is only sent by a step
+		retrieving bool
+		// steps advance the clock, expecting the given number of retrievals to
+		// be started after each
+		steps         []hedgeStep
+		expectedStats *types.RetrievalStats
+		expectedErr   error
+	}{
+		{
+			name: "first succeeds before delay, others not started",
+			results: []timeoutResult{
+				{duration: 100 * time.Millisecond, stats: apples},
+				{duration: 100 * time.Millisecond, stats: oranges},
+			},
+			steps:         []hedgeStep{{advance: 100 * time.Millisecond}},
+			expectedStats: apples,
+		},
+		{
+			name: "no first byte before delay, others started",
+			results: []timeoutResult{
+				{duration: 500 * time.Millisecond, stats: apples},
+				{duration: 100 * time.Millisecond, stats: oranges},
+			},
+			steps: []hedgeStep{
+				{advance: hedgeDelay, started: 1},
+				{advance: 100 * time.Millisecond},
+			},
+			expectedStats: oranges,
+		},
+		{
+			name: "first byte before delay, others not started",
+			results: []timeoutResult{
+				{duration: 500 * time.Millisecond, stats: apples},
+				{duration: 100 * time.Millisecond, stats: oranges},
+			},
+			firstByte: true,
+			steps: []hedgeStep{
+				{advance: hedgeDelay},
+				{advance: 300 * time.Millisecond},
+			},
+			expectedStats: apples,
+		},
+		{
+			name: "first fails before delay, others started",
+			results: []timeoutResult{
+				{duration: 50 * time.Millisecond, err: errors.New("something went wrong")},
+				{duration: 100 * time.Millisecond, stats: oranges},
+			},
+			steps: []hedgeStep{
+				{advance: 50 * time.Millisecond, started: 1},
+				{advance: 100 * time.Millisecond},
+			},
+			expectedStats: oranges,
+		},
+		{
+			name: "first byte then failure, others started",
+			results: []timeoutResult{
+				{duration: 300 * time.Millisecond, err: errors.New("something went wrong")},
+				{duration: 100 * time.Millisecond, stats: oranges},
+			},
+			firstByte: true,
+			steps: []hedgeStep{
+				{advance: hedgeDelay},
+				{advance: 100 * time.Millisecond, started: 1},
+				{advance: 100 * time.Millisecond},
+			},
+			expectedStats: oranges,
+		},
+		{
+			name: "delay starts once the first is retrieving",
+			results: []timeoutResult{
+				{duration: time.Second, stats: apples},
+				{duration: 100 * time.Millisecond, stats: oranges},
+			},
+			retrieving: true,
+			steps: []hedgeStep{
+				{advance: hedgeDelay, retrieving: true},
+				{advance: hedgeDelay - time.Millisecond},
+				{advance: time.Millisecond, started: 1},
+				{advance: 100 * time.Millisecond},
+			},
+			expectedStats: oranges,
+		},
+		{
+			name: "all fail, returns errors",
+			results: []timeoutResult{
+				{duration: 50 * time.Millisecond, err: errors.New("something went wrong")},
+				{duration: 50 * time.Millisecond, err: errors.New("something else went wrong")},
+			},
+			steps: []hedgeStep{
+				{advance: 50 * time.Millisecond, started: 1},
+				{advance: 50 * time.Millisecond},
+			},
+			expectedErr: errors.New("something went wrong; something else went wrong"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			clock := clock.NewMock()
+			startChan := make(chan struct{})
+			resultChan := make(chan types.RetrievalResult)
+			firstByte := make(chan struct{})
+			hedge := coordinators.HedgeConfig{Delay: hedgeDelay, FirstByte: firstByte}
+			var started chan struct{}
+			if testCase.retrieving {
+				started = make(chan struct{})
+				hedge.Started = started
+			}
+			childCtx, childCancel := context.WithCancel(ctx)
+			defer childCancel()
+
+			go func() {
+				retrievalCalls := func(ctx context.Context, callRetrieval func(types.RetrievalTask)) {
+					for _, result := range testCase.results {
+						callRetrieval(types.AsyncRetrievalTask{
+							AsyncCandidateRetrieval: &timeoutRetriever{result, ctx, clock, startChan},
+						})
+					}
+				}
+				stats, err := coordinators.HedgeWithClock(clock, hedge)(childCtx, retrievalCalls)
+				select {
+				case <-ctx.Done():
+				case resultChan <- types.RetrievalResult{Stats: stats, Err: err}:
+				}
+			}()
+
+			// only the first retrieval starts straight away
+			expectStarts(ctx, t, startChan, 1)
+			if testCase.firstByte {
+				close(firstByte)
+				expectStarts(ctx, t, startChan, 0)
+			}
+			for _, step := range testCase.steps {
+				clock.Add(step.advance)
+				expectStarts(ctx, t, startChan, step.started)
+				if step.retrieving {
+					close(started)
+					expectStarts(ctx, t, startChan, 0)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				require.FailNow(t, "failed to receive result")
+			case result := <-resultChan:
+				require.Equal(t, testCase.expectedStats, result.Stats)
+				if testCase.expectedErr != nil {
+					require.EqualError(t, result.Err, testCase.expectedErr.Error())
+				} else {
+					require.NoError(t, result.Err)
+				}
+			}
+		})
+	}
+}
+
+type hedgeStep struct {
+	advance time.Duration
+	started int
+	// retrieving signals that the first retrieval has started retrieving
+	// after advancing
+	retrieving bool
+}
+
+func expectStarts(ctx context.Context, t *testing.T, startChan <-chan struct{}, count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case <-ctx.Done():
+			require.FailNow(t, "failed to start retrievers")
+		case <-startChan:
+		}
+	}
+	// give the coordinator a chance to start anything unexpected
+	select {
+	case <-startChan:
+		require.FailNow(t, "unexpected retrieval started")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
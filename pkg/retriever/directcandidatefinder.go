@@ -4,12 +4,8 @@ import (
 	"context"
 	"sync"
 
-	datatransfer "github.com/filecoin-project/go-data-transfer/v2"
-	"github.com/filecoin-project/lassie/pkg/internal/lp2ptransports"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-cid"
-	gsnet "github.com/ipfs/go-graphsync/network"
-	bsnet "github.com/ipfs/go-libipfs/bitswap/network"
 	"github.com/ipni/index-provider/metadata"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -19,14 +15,23 @@ var _ CandidateFinder = &DirectCandidateFinder{}
 
 // DirectCandidateFinder finds candidate protocols from a fixed set of peers
 type DirectCandidateFinder struct {
-	h         host.Host
+	discovery *ProtocolDiscovery
 	providers []peer.AddrInfo
 }
 
-// NewDirectCandidateFinder returns a new DirectCandidateFinder for the given providers
-func NewDirectCandidateFinder(h host.Host, providers []peer.AddrInfo) *DirectCandidateFinder {
+// NewDirectCandidateFinder returns a new DirectCandidateFinder for the given
+// providers, discovering their protocols with a ProtocolDiscovery of its own
+// that lasts for the context
+func NewDirectCandidateFinder(ctx context.Context, h host.Host, providers []peer.AddrInfo) *DirectCandidateFinder {
+	return NewDirectCandidateFinderWithDiscovery(NewProtocolDiscovery(ctx, h, ProtocolDiscoveryConfig{}), providers)
+}
+
+// NewDirectCandidateFinderWithDiscovery returns a new DirectCandidateFinder for
+// the given providers, discovering their protocols with a ProtocolDiscovery
+// that may be shared with other finders
+func NewDirectCandidateFinderWithDiscovery(discovery *ProtocolDiscovery, providers []peer.AddrInfo) *DirectCandidateFinder {
 	return &DirectCandidateFinder{
-		h:         h,
+		discovery: discovery,
 		providers: providers,
 	}
 }
@@ -45,7 +50,7 @@ func (cs candidateSender) sendCandidate(addr peer.AddrInfo, protocols ...metadat
 	case cs.candidateResults <- types.FindCandidatesResult{Candidate: types.RetrievalCandidate{
 		MinerPeer: addr,
 		RootCid:   cs.rootCid,
-		Metadata:  metadata.Default.New(protocols...),
+		Metadata:  types.MetadataContext.New(protocols...),
 	}}:
 		return nil
 	}
@@ -61,8 +66,8 @@ func (cs candidateSender) sendError(err error) error {
 	}
 }
 
-// FindCandidatesAsync finds supported protocols for each peer
-// TODO: Cache the results?
+// FindCandidatesAsync finds supported protocols for each peer. Peers backing
+// off after failing to be reached are skipped.
 func (d *DirectCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
 	candidateResults := make(chan types.FindCandidatesResult)
 	ctx, cancel := context.WithCancel(ctx)
@@ -73,24 +78,16 @@ func (d *DirectCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.C
 		provider := provider
 		go func() {
 			defer wg.Done()
-			err := d.h.Connect(ctx, provider)
+			discovered, err := d.discovery.Discover(ctx, provider)
 			// don't add peers that we can't connect to
 			if err != nil {
 				_ = cs.sendError(err)
 				return
 			}
-			// check for support for Boost libp2p transports protocol
-			transportsClient := lp2ptransports.NewTransportsClient(d.h)
-			qr, err := transportsClient.SendQuery(ctx, provider.ID)
-			if err == nil {
-				log.Debugw("retrieving metadata from transports protocol", "peer", provider.ID)
-				// if present, construct metadata from Boost libp2p transports response
-				d.retrievalCandidatesFromTransportsProtocol(ctx, qr, provider, cs)
-			} else {
-				log.Debugw("retrieving metadata from libp2p protocol list", "peer", provider.ID)
-				// if not present, just make guesses based on list of supported libp2p
-				// protocols catalogued via identify protocol
-				d.retrievalCandidatesFromProtocolProbing(ctx, provider, cs)
+			for _, candidate := range discovered {
+				if err := cs.sendCandidate(candidate.AddrInfo, candidate.Protocols...); err != nil {
+					return
+				}
 			}
 		}()
 	}
@@ -101,62 +98,6 @@ func (d *DirectCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.C
 	return candidateResults, nil
 }
 
-func (d *DirectCandidateFinder) retrievalCandidatesFromProtocolProbing(ctx context.Context, provider peer.AddrInfo, cs candidateSender) {
-	var protocols []metadata.Protocol
-	s, err := d.h.NewStream(ctx, provider.ID,
-		bsnet.ProtocolBitswap,
-		bsnet.ProtocolBitswapOneOne,
-		bsnet.ProtocolBitswapOneZero,
-		bsnet.ProtocolBitswapNoVers,
-	)
-	if err == nil {
-		s.Close()
-		protocols = append(protocols, &metadata.Bitswap{})
-	}
-	// must support both graphsync & data transfer to do graphsync filecoin v1 retrieval
-	s, err = d.h.NewStream(ctx, provider.ID,
-		gsnet.ProtocolGraphsync_2_0_0)
-	if err == nil {
-		s.Close()
-		s, err = d.h.NewStream(ctx, provider.ID, datatransfer.ProtocolDataTransfer1_2)
-		if err == nil {
-			s.Close()
-			protocols = append(protocols, &metadata.GraphsyncFilecoinV1{})
-
-		}
-	}
-	_ = cs.sendCandidate(provider, protocols...)
-}
-
-func (d *DirectCandidateFinder) retrievalCandidatesFromTransportsProtocol(ctx context.Context, qr *lp2ptransports.QueryResponse, provider peer.AddrInfo, cs candidateSender) {
-	for _, protocol := range qr.Protocols {
-		// try to parse addr infos directly
-		addrs, err := peer.AddrInfosFromP2pAddrs(protocol.Addresses...)
-		// if no peer id is present, use provider's id
-		if err != nil {
-			addrs = []peer.AddrInfo{{
-				ID:    provider.ID,
-				Addrs: protocol.Addresses,
-			}}
-		}
-		switch protocol.Name {
-		case "libp2p":
-			for _, addr := range addrs {
-				if err := cs.sendCandidate(addr, &metadata.GraphsyncFilecoinV1{}); err != nil {
-					return
-				}
-			}
-		case "bitswap":
-			for _, addr := range addrs {
-				if err := cs.sendCandidate(addr, &metadata.Bitswap{}); err != nil {
-					return
-				}
-			}
-		default:
-		}
-	}
-}
-
 func (d *DirectCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
 	var candidates []types.RetrievalCandidate
 	candidatesResults, err := d.FindCandidatesAsync(ctx, c)
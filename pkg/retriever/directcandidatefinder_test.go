@@ -0,0 +1,197 @@
+package retriever_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/lassie/pkg/internal/lp2ptransports"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servesTransports answers transports protocol queries with bitswap at the
+// host's own addresses, counting the queries
+func servesTransports(t *testing.T, h host.Host) *atomic.Int32 {
+	var queries atomic.Int32
+	h.SetStreamHandler(lp2ptransports.TransportsProtocolID, func(s network.Stream) {
+		defer s.Close()
+		queries.Add(1)
+		response := lp2ptransports.QueryResponse{Protocols: []lp2ptransports.Protocol{{Name: "bitswap", Addresses: h.Addrs()}}}
+		require.NoError(t, lp2ptransports.BindnodeRegistry.TypeToWriter(&response, s, dagcbor.Encode))
+	})
+	return &queries
+}
+
+func addrInfo(h host.Host) peer.AddrInfo {
+	return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+}
+
+func TestDirectCandidateFinderProtocolDiscovery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	root := testutil.GenerateCids(1)[0]
+	cfg := retriever.ProtocolDiscoveryConfig{TTL: time.Minute, Backoff: 10 * time.Second, MaxBackoff: 15 * time.Second}
+
+	t.Run("caches protocols and refreshes them in the background", func(t *testing.T) {
+		req := require.New(t)
+		mn := mocknet.New()
+		self, err := mn.GenPeer()
+		req.NoError(err)
+		remote, err := mn.GenPeer()
+		req.NoError(err)
+		req.NoError(mn.LinkAll())
+		queries := servesTransports(t, remote)
+
+		clk := clock.NewMock()
+		discovery := retriever.NewProtocolDiscoveryWithClock(ctx, self, cfg, clk)
+		for i := 0; i < 3; i++ {
+			// finders may share discoveries
+			finder := retriever.NewDirectCandidateFinderWithDiscovery(discovery, []peer.AddrInfo{addrInfo(remote)})
+			candidates, err := finder.FindCandidates(ctx, root)
+			req.NoError(err)
+			req.Len(candidates, 1)
+			req.Equal(remote.ID(), candidates[0].MinerPeer.ID)
+			req.Equal(root, candidates[0].RootCid)
+			req.Equal([]multicodec.Code{multicodec.TransportBitswap}, candidates[0].Metadata.Protocols())
+		}
+		req.Equal(int32(1), queries.Load())
+
+		// once stale, protocols are used while they are refreshed
+		clk.Add(time.Minute)
+		finder := retriever.NewDirectCandidateFinderWithDiscovery(discovery, []peer.AddrInfo{addrInfo(remote)})
+		candidates, err := finder.FindCandidates(ctx, root)
+		req.NoError(err)
+		req.Len(candidates, 1)
+		req.Eventually(func() bool { return queries.Load() == 2 }, time.Second, 10*time.Millisecond)
+		req.Eventually(func() bool {
+			_, err := finder.FindCandidates(ctx, root)
+			return err == nil && queries.Load() == 2
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("backs off from unreachable peers", func(t *testing.T) {
+		req := require.New(t)
+		mn := mocknet.New()
+		self, err := mn.GenPeer()
+		req.NoError(err)
+		remote, err := mn.GenPeer()
+		req.NoError(err)
+		queries := servesTransports(t, remote)
+
+		clk := clock.NewMock()
+		finder := retriever.NewDirectCandidateFinderWithDiscovery(retriever.NewProtocolDiscoveryWithClock(ctx, self, cfg, clk), []peer.AddrInfo{addrInfo(remote)})
+		findProtocols := func() ([]multicodec.Code, error) {
+			candidates, err := finder.FindCandidates(ctx, root)
+			if err != nil || len(candidates) == 0 {
+				return nil, err
+			}
+			return candidates[0].Metadata.Protocols(), nil
+		}
+
+		// the failing discovery errors, then the peer is skipped quietly
+		_, err = findProtocols()
+		req.Error(err)
+		found, err := findProtocols()
+		req.NoError(err)
+		req.Empty(found)
+
+		// the backoff grows with each failure
+		clk.Add(10 * time.Second)
+		_, err = findProtocols()
+		req.Error(err)
+		req.NoError(mn.LinkAll())
+		clk.Add(10 * time.Second)
+		found, err = findProtocols()
+		req.NoError(err)
+		req.Empty(found)
+		req.Equal(int32(0), queries.Load())
+
+		// until it's reached again
+		clk.Add(5 * time.Second)
+		found, err = findProtocols()
+		req.NoError(err)
+		req.Equal([]multicodec.Code{multicodec.TransportBitswap}, found)
+		req.Equal(int32(1), queries.Load())
+	})
+
+	t.Run("keeps the protocols of a peer that fails to be refreshed", func(t *testing.T) {
+		req := require.New(t)
+		mn := mocknet.New()
+		self, err := mn.GenPeer()
+		req.NoError(err)
+		remote, err := mn.GenPeer()
+		req.NoError(err)
+		req.NoError(mn.LinkAll())
+		queries := servesTransports(t, remote)
+
+		clk := clock.NewMock()
+		discovery := retriever.NewProtocolDiscoveryWithClock(ctx, self, cfg, clk)
+		candidates, err := discovery.Discover(ctx, addrInfo(remote))
+		req.NoError(err)
+		req.Len(candidates, 1)
+
+		// the refresh fails once the peer can't be reached
+		req.NoError(mn.DisconnectPeers(self.ID(), remote.ID()))
+		req.NoError(mn.UnlinkPeers(self.ID(), remote.ID()))
+		clk.Add(time.Minute)
+		req.Never(func() bool {
+			candidates, err := discovery.Discover(ctx, addrInfo(remote))
+			return err != nil || len(candidates) != 1
+		}, 200*time.Millisecond, 10*time.Millisecond)
+
+		// and is tried again after backing off
+		_, err = mn.LinkPeers(self.ID(), remote.ID())
+		req.NoError(err)
+		clk.Add(10 * time.Second)
+		_, err = discovery.Discover(ctx, addrInfo(remote))
+		req.NoError(err)
+		req.Eventually(func() bool { return queries.Load() == 2 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("shares the first discovery of a peer", func(t *testing.T) {
+		req := require.New(t)
+		mn := mocknet.New()
+		self, err := mn.GenPeer()
+		req.NoError(err)
+		remote, err := mn.GenPeer()
+		req.NoError(err)
+		req.NoError(mn.LinkAll())
+		var queries atomic.Int32
+		release := make(chan struct{})
+		remote.SetStreamHandler(lp2ptransports.TransportsProtocolID, func(s network.Stream) {
+			defer s.Close()
+			queries.Add(1)
+			<-release
+			response := lp2ptransports.QueryResponse{Protocols: []lp2ptransports.Protocol{{Name: "bitswap", Addresses: remote.Addrs()}}}
+			require.NoError(t, lp2ptransports.BindnodeRegistry.TypeToWriter(&response, s, dagcbor.Encode))
+		})
+
+		discovery := retriever.NewProtocolDiscoveryWithClock(ctx, self, cfg, clock.NewMock())
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				candidates, err := discovery.Discover(ctx, addrInfo(remote))
+				assert.NoError(t, err)
+				assert.Len(t, candidates, 1)
+			}()
+		}
+		req.Eventually(func() bool { return queries.Load() == 1 }, time.Second, 10*time.Millisecond)
+		close(release)
+		wg.Wait()
+		req.Equal(int32(1), queries.Load())
+	})
+}
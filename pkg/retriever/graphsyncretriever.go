@@ -26,43 +26,38 @@ type CandidateErrorCallback func(types.RetrievalCandidate, error)
 
 type GetStorageProviderTimeout func(peer peer.ID) time.Duration
 type IsAcceptableStorageProvider func(peer peer.ID) bool
-type IsAcceptableQueryResponse func(peer peer.ID, req types.RetrievalRequest, queryResponse *retrievalmarket.QueryResponse) bool
 
-type queryCandidate struct {
-	*retrievalmarket.QueryResponse
-	Duration time.Duration
-}
-
-// queryCompare compares two QueryResponses and returns true if the first is
-// preferable to the second. This is used for the PriorityWaitQueue that will
-// prioritise execution of retrievals if two queries are available to compare
-// at the same time.
-var queryCompare prioritywaitqueue.ComparePriority[*queryCandidate] = func(a, b *queryCandidate) bool {
-	// Always prefer unsealed to sealed, no matter what
-	if a.UnsealPrice.IsZero() && !b.UnsealPrice.IsZero() {
-		return true
-	}
-
-	// Select lower price, or continue if equal
-	aTotalCost := totalCost(a.QueryResponse)
-	bTotalCost := totalCost(b.QueryResponse)
-	if !aTotalCost.Equals(bTotalCost) {
-		return aTotalCost.LessThan(bTotalCost)
-	}
-
-	// Select smaller size, or continue if equal
-	if a.Size != b.Size {
-		return a.Size < b.Size
-	}
+// IsAcceptableQueryResponse returns an error describing why a query response
+// is not acceptable, or nil if it is
+type IsAcceptableQueryResponse func(peer peer.ID, req types.RetrievalRequest, queryResponse *retrievalmarket.QueryResponse) error
 
-	// Select the fastest to respond
-	return a.Duration < b.Duration
-}
+// ReleaseQueryResponse is called for a storage provider whose query response
+// was accepted but which was dropped before a deal was proposed to it
+type ReleaseQueryResponse func(peer peer.ID, req types.RetrievalRequest)
+type GetStorageProviderReputation func(peer peer.ID) ProtocolReputation
 
 type GraphSyncRetriever struct {
 	GetStorageProviderTimeout GetStorageProviderTimeout
 	IsAcceptableQueryResponse IsAcceptableQueryResponse
-	Client                    RetrievalClient
+	// ReleaseQueryResponse undoes what IsAcceptableQueryResponse set aside for
+	// a storage provider that won't be retrieved from, it may be nil
+	ReleaseQueryResponse ReleaseQueryResponse
+	// GetStorageProviderReputation provides the historical stats of a storage
+	// provider to the CandidateScorer, it may be nil
+	GetStorageProviderReputation GetStorageProviderReputation
+	// CandidateScorer decides which of the candidates that have responded to a
+	// query should be retrieved from first, DefaultCandidateScorer is used if
+	// nil
+	CandidateScorer CandidateScorer
+	// MaxParallelProviders, when greater than 1, splits retrievals of a full
+	// DAG by the blocks linked from its root and retrieves them from up to this
+	// many storage providers at once. Only storage providers that don't charge
+	// to unseal take part in a split.
+	MaxParallelProviders int
+	// TempDir is where the blocks of a split retrieval are held until they can
+	// be written in order, the system temporary directory is used if empty
+	TempDir string
+	Client  RetrievalClient
 }
 
 type retrievalResult struct {
@@ -82,10 +77,12 @@ type graphsyncRetrieval struct {
 }
 
 type graphsyncCandidateRetrieval struct {
-	waitQueue          prioritywaitqueue.PriorityWaitQueue[*queryCandidate]
+	waitQueue          prioritywaitqueue.PriorityWaitQueue[*QueriedCandidate]
 	retrievalStartTime time.Time
 	resultChan         chan retrievalResult
 	finishChan         chan struct{}
+	// parallel is set when the retrieval is split across storage providers
+	parallel *parallelRetrieval
 }
 
 // RetrieveFromCandidates performs a retrieval for a given CID by querying the indexer, then
@@ -116,10 +113,19 @@ func (cfg *GraphSyncRetriever) Retrieve(
 func (r *graphsyncRetrieval) RetrieveFromAsyncCandidates(asyncCandidates types.InboundAsyncCandidates) (*types.RetrievalStats, error) {
 	ctx, cancelCtx := context.WithCancel(r.ctx)
 
+	scorer := r.CandidateScorer
+	if scorer == nil {
+		scorer = DefaultCandidateScorer
+	}
 	retrieval := &graphsyncCandidateRetrieval{
 		resultChan: make(chan retrievalResult),
 		finishChan: make(chan struct{}),
-		waitQueue:  prioritywaitqueue.New(queryCompare),
+		waitQueue: prioritywaitqueue.New(func(a, b *QueriedCandidate) bool {
+			return scorer.Prefer(*a, *b)
+		}),
+	}
+	if r.MaxParallelProviders > 1 && ipld.DeepEqual(r.request.GetSelector(), selectorparse.CommonSelector_ExploreAllRecursively) {
+		retrieval.parallel = newParallelRetrieval(r.MaxParallelProviders, r.TempDir)
 	}
 	// start retrievals
 	queryStartTime := time.Now()
@@ -158,6 +164,9 @@ func (r *graphsyncRetrieval) RetrieveFromAsyncCandidates(asyncCandidates types.I
 	case <-time.After(100 * time.Millisecond):
 		log.Warn("Unable to successfully cancel all retrieval attempts withing 100ms")
 	}
+	if retrieval.parallel != nil {
+		retrieval.parallel.close()
+	}
 	return stats, err
 }
 
@@ -221,14 +230,17 @@ func runRetrievalCandidate(
 	// remain the queryStartTime if we didn't get to retrieval for this candidate.
 	phaseStartTime := queryStartTime
 
-	var timeout time.Duration
-	if cfg.GetStorageProviderTimeout != nil {
+	timeout := req.ProviderTimeout
+	if timeout == 0 && cfg.GetStorageProviderTimeout != nil {
 		timeout = cfg.GetStorageProviderTimeout(candidate.MinerPeer.ID)
 	}
 
 	var stats *types.RetrievalStats
 	var retrievalErr error
 	var done func()
+	// proposed is set once a deal is proposed to the storage provider, from
+	// then on it may be paid
+	var proposed bool
 
 	retrieval.sendEvent(events.Started(req.RetrievalID, phaseStartTime, types.QueryPhase, candidate))
 
@@ -249,9 +261,13 @@ func runRetrievalCandidate(
 
 	if queryResponse != nil {
 		retrieval.sendEvent(events.QueryAsked(req.RetrievalID, phaseStartTime, candidate, *queryResponse))
-		if queryResponse.Status != retrievalmarket.QueryResponseAvailable ||
-			(cfg.IsAcceptableQueryResponse != nil && !cfg.IsAcceptableQueryResponse(candidate.MinerPeer.ID, req, queryResponse)) {
+		if queryResponse.Status != retrievalmarket.QueryResponseAvailable {
 			queryResponse = nil
+		} else if cfg.IsAcceptableQueryResponse != nil {
+			if err := cfg.IsAcceptableQueryResponse(candidate.MinerPeer.ID, req, queryResponse); err != nil {
+				retrieval.sendEvent(events.QueryAskedRejected(req.RetrievalID, phaseStartTime, candidate, *queryResponse, err.Error()))
+				queryResponse = nil
+			}
 		}
 	}
 
@@ -259,7 +275,15 @@ func runRetrievalCandidate(
 		retrieval.sendEvent(events.QueryAskedFiltered(req.RetrievalID, phaseStartTime, candidate, *queryResponse))
 
 		// if query is successful, then wait for priority and execute retrieval
-		done = retrieval.waitQueue.Wait(&queryCandidate{queryResponse, time.Since(phaseStartTime)})
+		queried := &QueriedCandidate{
+			RetrievalCandidate: candidate,
+			QueryResponse:      *queryResponse,
+			QueryDuration:      time.Since(phaseStartTime),
+		}
+		if cfg.GetStorageProviderReputation != nil {
+			queried.Reputation = cfg.GetStorageProviderReputation(candidate.MinerPeer.ID)
+		}
+		done = retrieval.waitQueue.Wait(queried)
 
 		if retrieval.canSendResult() { // move on to retrieval phase
 			// only one goroutine is allowed to execute past here at a time, so retrieval.retrievalStartTime
@@ -292,19 +316,51 @@ func runRetrievalCandidate(
 				}
 			}
 
-			retrieval.sendEvent(events.Started(req.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate))
+			onStart := func() {
+				proposed = true
+				retrieval.sendEvent(events.Started(req.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate))
+			}
 
-			stats, retrievalErr = retrievalPhase(
-				ctx,
-				cfg,
-				req.LinkSystem,
-				client,
-				timeout,
-				candidate,
-				queryResponse,
-				req.GetSelector(),
-				eventsCallback,
-			)
+			part := partAlone
+			if retrieval.parallel != nil {
+				part = retrieval.parallel.claim(queryResponse)
+			}
+			switch part {
+			case partSplit:
+				// the next candidate is let through once this one has joined the
+				// retrieval, rather than once it has finished
+				var releaseOnce sync.Once
+				release := done
+				done = func() { releaseOnce.Do(release) }
+				stats, retrievalErr = retrieval.parallel.retrieve(
+					ctx,
+					cfg,
+					req,
+					client,
+					timeout,
+					candidate,
+					queryResponse,
+					eventsCallback,
+					onStart,
+					done,
+				)
+			case partNone:
+				// it would charge to unseal for each of its deals in the split
+				// retrieval already under way, so it is left out
+			default:
+				onStart()
+				stats, retrievalErr = retrievalPhase(
+					ctx,
+					cfg,
+					req.LinkSystem,
+					client,
+					timeout,
+					candidate,
+					queryResponse,
+					req.GetSelector(),
+					eventsCallback,
+				)
+			}
 
 			if retrievalErr != nil {
 				msg := retrievalErr.Error()
@@ -312,7 +368,7 @@ func runRetrievalCandidate(
 					msg = fmt.Sprintf("timeout after %s", timeout)
 				}
 				retrieval.sendEvent(events.Failed(req.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate, msg))
-			} else {
+			} else if stats != nil {
 				retrieval.sendEvent(events.Success(
 					req.RetrievalID,
 					phaseStartTime,
@@ -322,6 +378,11 @@ func runRetrievalCandidate(
 					stats.Duration,
 					stats.TotalPayment),
 				)
+				if part == partSplit {
+					// only the last storage provider to finish its part reports
+					// the result of the whole retrieval
+					stats, retrievalErr = retrieval.parallel.leave(ctx)
+				}
 			}
 		} // else we didn't get to retrieval phase because we were cancelled
 	} // else we didn't get to retrieval phase because query failed
@@ -345,6 +406,11 @@ func runRetrievalCandidate(
 		}
 	} // else nothing to do, we were cancelled
 
+	if queryResponse != nil && !proposed && cfg.ReleaseQueryResponse != nil {
+		// accepted but dropped without being retrieved from
+		cfg.ReleaseQueryResponse(candidate.MinerPeer.ID, req)
+	}
+
 	if done != nil {
 		done() // allow prioritywaitqueue to move on to next candidate
 	}
@@ -110,8 +110,11 @@ func TestQueryFiltering(t *testing.T) {
 
 			cfg := &GraphSyncRetriever{
 				GetStorageProviderTimeout: func(peer peer.ID) time.Duration { return time.Second },
-				IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, queryResponse *retrievalmarket.QueryResponse) bool {
-					return tc.paid || big.Add(big.Mul(queryResponse.MinPricePerByte, big.NewIntUnsigned(queryResponse.Size)), queryResponse.UnsealPrice).Equals(big.Zero())
+				IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, queryResponse *retrievalmarket.QueryResponse) error {
+					if tc.paid || big.Add(big.Mul(queryResponse.MinPricePerByte, big.NewIntUnsigned(queryResponse.Size)), queryResponse.UnsealPrice).Equals(big.Zero()) {
+						return nil
+					}
+					return ErrPaidRetrievalNotAllowed
 				},
 				Client: mockClient,
 			}
@@ -119,6 +122,7 @@ func TestQueryFiltering(t *testing.T) {
 			retrievingPeers := make([]peer.ID, 0)
 			candidateQueries := make([]candidateQuery, 0)
 			candidateQueriesFiltered := make([]candidateQuery, 0)
+			candidateQueriesRejected := make([]candidateQuery, 0)
 
 			// perform retrieval and test top-level results, we should only error in this test
 			stats, err := cfg.Retrieve(context.Background(), types.RetrievalRequest{
@@ -131,7 +135,12 @@ func TestQueryFiltering(t *testing.T) {
 				case events.RetrievalEventQueryAsked:
 					candidateQueries = append(candidateQueries, candidateQuery{ret.StorageProviderId(), ret.QueryResponse()})
 				case events.RetrievalEventQueryAskedFiltered:
-					candidateQueriesFiltered = append(candidateQueriesFiltered, candidateQuery{ret.StorageProviderId(), ret.QueryResponse()})
+					if ret.Rejected() {
+						require.Equal(t, ErrPaidRetrievalNotAllowed.Error(), ret.Reason())
+						candidateQueriesRejected = append(candidateQueriesRejected, candidateQuery{ret.StorageProviderId(), ret.QueryResponse()})
+					} else {
+						candidateQueriesFiltered = append(candidateQueriesFiltered, candidateQuery{ret.StorageProviderId(), ret.QueryResponse()})
+					}
 				case events.RetrievalEventStarted:
 					if ret.Phase() == types.RetrievalPhase {
 						retrievingPeers = append(retrievingPeers, event.StorageProviderId())
@@ -157,6 +166,15 @@ func TestQueryFiltering(t *testing.T) {
 				require.True(t, found)
 			}
 
+			// every available query response not retrieved from was rejected
+			available := 0
+			for _, qr := range tc.queryResponses {
+				if qr.Status == retrievalmarket.QueryResponseAvailable {
+					available++
+				}
+			}
+			require.Len(t, candidateQueriesRejected, available-len(tc.expectedPeers))
+
 			// verify that the list of retrievals matches the expected filtered list
 			require.Len(t, mockClient.GetReceivedRetrievals(), len(tc.expectedPeers))
 			require.Len(t, candidateQueriesFiltered, len(tc.expectedPeers))
@@ -189,6 +207,8 @@ func TestRetrievalRacing(t *testing.T) {
 		retrievalReturns          map[string]testutil.DelayedRetrievalReturn
 		expectedRetrievalAttempts []string
 		expectedRetrieval         string
+		candidateScorer           CandidateScorer
+		reputations               map[string]ProtocolReputation
 	}{
 		{
 			name: "single fast",
@@ -309,6 +329,61 @@ func TestRetrievalRacing(t *testing.T) {
 			expectedRetrievalAttempts: []string{"foo", "bang"},
 			expectedRetrieval:         "bang",
 		},
+		// quickest query ("foo") fails retrieval, the other 3 line up in the queue,
+		// with reputation scoring the historically most reliable is chosen over the
+		// smaller and faster
+		{
+			name: "racing chooses best reputation",
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo":  {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond},
+				"bar":  {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 3, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond * 100},
+				"baz":  {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond * 100},
+				"bang": {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 4, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond * 100},
+			},
+			expectedQueryReturns: []string{"foo", "bar", "baz", "bang"},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo":  {ResultErr: errors.New("Nope"), Delay: time.Millisecond * 200},
+				"bar":  {ResultStats: &types.RetrievalStats{StorageProviderId: peer.ID("bar"), Size: 3}, Delay: time.Millisecond * 20},
+				"baz":  {ResultStats: &types.RetrievalStats{StorageProviderId: peer.ID("baz"), Size: 2}, Delay: time.Millisecond * 20},
+				"bang": {ResultStats: &types.RetrievalStats{StorageProviderId: peer.ID("bang"), Size: 4}, Delay: time.Millisecond * 20},
+			},
+			reputations: map[string]ProtocolReputation{
+				"baz":  {Successes: 1, Failures: 10},
+				"bang": {Successes: 10},
+			},
+			candidateScorer:           ReputationCandidateScorer,
+			expectedRetrievalAttempts: []string{"foo", "bang"},
+			expectedRetrieval:         "bang",
+		},
+		// quickest query ("foo") fails retrieval, the other 3 line up in the queue,
+		// a custom scorer prefers "bar" over the smaller "baz"
+		{
+			name: "racing uses custom scorer",
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo":  {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond},
+				"bar":  {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 3, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond * 100},
+				"baz":  {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond * 100},
+				"bang": {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 4, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond * 100},
+			},
+			expectedQueryReturns: []string{"foo", "bar", "baz", "bang"},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo":  {ResultErr: errors.New("Nope"), Delay: time.Millisecond * 200},
+				"bar":  {ResultStats: &types.RetrievalStats{StorageProviderId: peer.ID("bar"), Size: 3}, Delay: time.Millisecond * 20},
+				"baz":  {ResultStats: &types.RetrievalStats{StorageProviderId: peer.ID("baz"), Size: 2}, Delay: time.Millisecond * 20},
+				"bang": {ResultStats: &types.RetrievalStats{StorageProviderId: peer.ID("bang"), Size: 4}, Delay: time.Millisecond * 20},
+			},
+			candidateScorer: CandidateScorerFunc(func(a, b QueriedCandidate) bool {
+				if a.MinerPeer.ID == peer.ID("bar") {
+					return true
+				}
+				if b.MinerPeer.ID == peer.ID("bar") {
+					return false
+				}
+				return DefaultCandidateScorer.Prefer(a, b)
+			}),
+			expectedRetrievalAttempts: []string{"foo", "bar"},
+			expectedRetrieval:         "bar",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -322,10 +397,21 @@ func TestRetrievalRacing(t *testing.T) {
 			for p := range tc.queryReturns {
 				candidates = append(candidates, types.RetrievalCandidate{MinerPeer: peer.AddrInfo{ID: peer.ID(p)}})
 			}
+			var releasedLk sync.Mutex
+			released := make(map[peer.ID]struct{})
 			cfg := &GraphSyncRetriever{
 				GetStorageProviderTimeout: func(peer peer.ID) time.Duration { return time.Second },
-				IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) bool { return true },
-				Client:                    mockClient,
+				IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) error { return nil },
+				ReleaseQueryResponse: func(peer peer.ID, req types.RetrievalRequest) {
+					releasedLk.Lock()
+					defer releasedLk.Unlock()
+					released[peer] = struct{}{}
+				},
+				GetStorageProviderReputation: func(p peer.ID) ProtocolReputation {
+					return tc.reputations[string(p)]
+				},
+				CandidateScorer: tc.candidateScorer,
+				Client:          mockClient,
 			}
 
 			retrievingPeers := make([]peer.ID, 0)
@@ -391,10 +477,38 @@ func TestRetrievalRacing(t *testing.T) {
 				require.NotNil(t, rr)
 				require.Same(t, selectorparse.CommonSelector_ExploreAllRecursively, rr.Selector) // default selector
 			}
+
+			// accepted candidates that weren't retrieved from are released,
+			// those that were retrieved from may have been paid so are not
+			require.Eventually(t, func() bool {
+				releasedLk.Lock()
+				defer releasedLk.Unlock()
+				for _, query := range candidateQueriesFiltered {
+					_, ok := released[query.peer]
+					if !ok && !containsPeer(retrievingPeers, query.peer) {
+						return false
+					}
+				}
+				return true
+			}, time.Second, 10*time.Millisecond)
+			releasedLk.Lock()
+			for _, p := range retrievingPeers {
+				require.NotContains(t, released, p)
+			}
+			releasedLk.Unlock()
 		})
 	}
 }
 
+func containsPeer(peers []peer.ID, p peer.ID) bool {
+	for _, other := range peers {
+		if other == p {
+			return true
+		}
+	}
+	return false
+}
+
 // run two retrievals simultaneously on a single CidRetrieval
 func TestMultipleRetrievals(t *testing.T) {
 	retrievalID := types.RetrievalID(uuid.New())
@@ -427,7 +541,7 @@ func TestMultipleRetrievals(t *testing.T) {
 
 	cfg := &GraphSyncRetriever{
 		GetStorageProviderTimeout: func(peer peer.ID) time.Duration { return time.Second },
-		IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) bool { return true },
+		IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) error { return nil },
 		Client:                    mockClient,
 	}
 
@@ -546,7 +660,7 @@ func TestRetrievalReuse(t *testing.T) {
 
 	cfg := &GraphSyncRetriever{
 		GetStorageProviderTimeout: func(peer peer.ID) time.Duration { return time.Second },
-		IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) bool { return true },
+		IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) error { return nil },
 		Client:                    mockClient,
 	}
 
@@ -633,7 +747,7 @@ func TestRetrievalSelector(t *testing.T) {
 
 	cfg := &GraphSyncRetriever{
 		GetStorageProviderTimeout: func(peer peer.ID) time.Duration { return time.Second },
-		IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) bool { return true },
+		IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) error { return nil },
 		Client:                    mockClient,
 	}
 
@@ -0,0 +1,500 @@
+package retriever
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+	"go.uber.org/multierr"
+)
+
+var (
+	// ErrNoHttpEndpoint indicates that a candidate has no address that can be
+	// retrieved from over HTTP
+	ErrNoHttpEndpoint = errors.New("no HTTP endpoint")
+	// ErrUnexpectedBlock indicates that a CAR streamed over HTTP held a block
+	// other than the next one the request's traversal needed
+	ErrUnexpectedBlock = errors.New("unexpected block")
+	// ErrSelectorNotSupported indicates that a request was made with a
+	// selector that can't be expressed as a path and scope for HTTP retrieval
+	ErrSelectorNotSupported = errors.New("selector not supported over HTTP")
+	// ErrBlockIntegrity indicates that a CAR streamed over HTTP held a block
+	// whose data doesn't match its CID
+	ErrBlockIntegrity = errors.New("block does not match its CID")
+)
+
+const (
+	// httpDialTimeout bounds connecting to a storage provider over HTTP
+	httpDialTimeout = 30 * time.Second
+	// httpResponseHeaderTimeout bounds the wait for a storage provider to
+	// respond to an HTTP request, the body is bounded by the provider timeout
+	httpResponseHeaderTimeout = time.Minute
+)
+
+// defaultHttpClient makes the HTTP requests of an HttpRetriever without a
+// Client of its own. It has no overall timeout as a CAR may take a long time
+// to stream, but connections and responses that never come are given up on.
+var defaultHttpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   httpDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: httpResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	},
+}
+
+// HttpRetriever retrieves CARs from storage providers serving the trustless
+// IPFS gateway HTTP API. Candidates are retrieved from one at a time, in the
+// order they are found, until one succeeds. The blocks of each CAR are
+// verified as they are streamed by traversing the request's selector over
+// them, so a CAR is only accepted if it holds exactly the blocks the traversal
+// needs, in the order it needs them.
+//
+// Graphsync candidates with a piece CID and an HTTP endpoint are retrieved
+// from by downloading the whole piece from the endpoint's /piece API instead.
+// The CAR in the piece is streamed in the same way, except that blocks the
+// traversal doesn't need are passed over and the download ends as soon as the
+// traversal is complete. This relies on the piece holding the DAG in the order
+// it is traversed, as deal CARs are written. Only candidates that carry an
+// HTTP multiaddr among their MinerPeer addresses can be retrieved from this
+// way, which indexer results for graphsync rarely do, so in practice these are
+// found by direct candidate finders and protocol discovery rather than the
+// indexer.
+type HttpRetriever struct {
+	// GetStorageProviderTimeout is the time to wait for each block from a
+	// storage provider before retrieval from it fails
+	GetStorageProviderTimeout GetStorageProviderTimeout
+	// Client makes the HTTP requests, a client with connection and response
+	// header timeouts is used if nil
+	Client *http.Client
+	// Clock is used to time retrievals, a real clock is used if nil
+	Clock clock.Clock
+}
+
+var _ types.CandidateRetriever = (*HttpRetriever)(nil)
+
+type httpRetrieval struct {
+	*HttpRetriever
+	ctx     context.Context
+	request types.RetrievalRequest
+	events  func(types.RetrievalEvent)
+}
+
+// Retrieve sets up a retrieval of the request over HTTP
+func (cfg *HttpRetriever) Retrieve(ctx context.Context, request types.RetrievalRequest, events func(types.RetrievalEvent)) types.CandidateRetrieval {
+	if events == nil {
+		events = func(types.RetrievalEvent) {}
+	}
+	return &httpRetrieval{cfg, ctx, request, events}
+}
+
+func (r *httpRetrieval) RetrieveFromAsyncCandidates(asyncCandidates types.InboundAsyncCandidates) (*types.RetrievalStats, error) {
+	sel, err := selector.ParseSelector(r.request.GetSelector())
+	if err != nil {
+		return nil, err
+	}
+
+	var retrievalErrors error
+	for {
+		hasCandidates, candidates, err := asyncCandidates.Next(r.ctx)
+		if !hasCandidates || err != nil {
+			break
+		}
+		for _, candidate := range candidates {
+			stats, err := r.retrieveFromCandidate(candidate, sel)
+			if err == nil {
+				return stats, nil
+			}
+			retrievalErrors = multierr.Append(retrievalErrors, fmt.Errorf("%w: %s", ErrRetrievalFailed, err))
+			if r.ctx.Err() != nil {
+				return nil, r.ctx.Err()
+			}
+		}
+	}
+	if retrievalErrors == nil {
+		// we never received any candidates, so we give up on HTTP retrieval
+		return nil, nil
+	}
+	return nil, multierr.Append(retrievalErrors, ErrAllRetrievalsFailed)
+}
+
+func (r *httpRetrieval) retrieveFromCandidate(candidate types.RetrievalCandidate, sel selector.Selector) (*types.RetrievalStats, error) {
+	clk := r.Clock
+	if clk == nil {
+		clk = clock.New()
+	}
+	phaseStartTime := clk.Now()
+	r.events(events.Started(r.request.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate))
+	fail := func(err error) (*types.RetrievalStats, error) {
+		r.events(events.Failed(r.request.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate, err.Error()))
+		return nil, err
+	}
+
+	requestUrl, isPiece, err := r.candidateRequestUrl(candidate)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	timeout := r.request.ProviderTimeout
+	if timeout == 0 && r.GetStorageProviderTimeout != nil {
+		timeout = r.GetStorageProviderTimeout(candidate.MinerPeer.ID)
+	}
+	var lastBytesReceivedTimer *clock.Timer
+	if timeout != 0 {
+		lastBytesReceivedTimer = clk.AfterFunc(timeout, cancel)
+		defer lastBytesReceivedTimer.Stop()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
+	if err != nil {
+		return fail(err)
+	}
+	if !isPiece {
+		req.Header.Set("Accept", "application/vnd.ipld.car")
+	}
+	client := r.Client
+	if client == nil {
+		client = defaultHttpClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("unexpected HTTP status: %s", resp.Status))
+	}
+	r.events(events.Connected(r.request.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate))
+
+	// pieces are padded, the padding following the CAR is read as its end
+	blockReader, err := newCarSectionReader(resp.Body)
+	if err != nil {
+		return fail(err)
+	}
+	var totalWritten, blockCount uint64
+	stream := &carBlockStream{
+		reader:       blockReader,
+		storage:      &r.request.LinkSystem,
+		seen:         make(map[cid.Cid]struct{}),
+		skipUnwanted: isPiece,
+		progress: func() {
+			if lastBytesReceivedTimer != nil {
+				lastBytesReceivedTimer.Reset(timeout)
+			}
+		},
+		received: func(size uint64) {
+			if blockCount == 0 {
+				r.events(events.FirstByte(r.request.RetrievalID, phaseStartTime, candidate))
+			}
+			totalWritten += size
+			blockCount++
+		},
+	}
+	wrappedLsys := r.request.LinkSystem
+	wrappedLsys.StorageReadOpener = stream.load
+	if err := easyTraverse(ctx, cidlink.Link{Cid: r.request.Cid}, sel, &wrappedLsys); err != nil {
+		if errors.Is(err, ErrUnexpectedBlock) || errors.Is(err, ErrBlockIntegrity) {
+			r.events(events.Misbehaved(r.request.RetrievalID, phaseStartTime, candidate, err.Error()))
+		}
+		return fail(err)
+	}
+	// anything in a CAR beyond the blocks the traversal needed is more than was
+	// asked for, while the rest of a piece is simply not downloaded
+	if _, _, err := blockReader.next(); !isPiece && err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("%w after traversal completed", ErrUnexpectedBlock)
+			r.events(events.Misbehaved(r.request.RetrievalID, phaseStartTime, candidate, err.Error()))
+		}
+		return fail(err)
+	}
+
+	duration := clk.Since(phaseStartTime)
+	speed := uint64(float64(totalWritten) / duration.Seconds())
+	r.events(events.Success(r.request.RetrievalID, phaseStartTime, candidate, totalWritten, blockCount, duration, big.Zero()))
+	return &types.RetrievalStats{
+		StorageProviderId: candidate.MinerPeer.ID,
+		RootCid:           r.request.Cid,
+		Size:              totalWritten,
+		Blocks:            blockCount,
+		Duration:          duration,
+		AverageSpeed:      speed,
+		TotalPayment:      big.Zero(),
+		NumPayments:       0,
+		AskPrice:          big.Zero(),
+	}, nil
+}
+
+// carSectionReader reads the sections of the CARv1 payload of a CAR, which
+// may be a CARv2, without checking that their data matches their CIDs. A zero
+// length section is read as the end of the CAR, as pieces are padded with
+// zeros.
+type carSectionReader struct {
+	r *bufio.Reader
+}
+
+func newCarSectionReader(r io.Reader) (*carSectionReader, error) {
+	br := bufio.NewReader(r)
+	version, err := car.ReadVersion(br)
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case 1:
+		return &carSectionReader{br}, nil
+	case 2:
+		var header car.Header
+		if _, err := header.ReadFrom(br); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(int(header.DataOffset) - car.PragmaSize - car.HeaderSize); err != nil {
+			return nil, err
+		}
+		payload := bufio.NewReader(io.LimitReader(br, int64(header.DataSize)))
+		if version, err := car.ReadVersion(payload); err != nil {
+			return nil, err
+		} else if version != 1 {
+			return nil, fmt.Errorf("invalid data payload header version; expected 1, got %d", version)
+		}
+		return &carSectionReader{payload}, nil
+	default:
+		return nil, fmt.Errorf("invalid car version: %d", version)
+	}
+}
+
+// next reads the CID and data of the next section, or io.EOF at the end
+func (csr *carSectionReader) next() (cid.Cid, []byte, error) {
+	size, err := varint.ReadUvarint(csr.r)
+	if err != nil {
+		if size > 0 && err == io.EOF {
+			return cid.Undef, nil, io.ErrUnexpectedEOF
+		}
+		return cid.Undef, nil, err
+	}
+	if size == 0 {
+		return cid.Undef, nil, io.EOF
+	}
+	if size > car.DefaultMaxAllowedSectionSize {
+		return cid.Undef, nil, fmt.Errorf("CAR section of %d bytes is too large", size)
+	}
+	section := make([]byte, size)
+	if _, err := io.ReadFull(csr.r, section); err != nil {
+		return cid.Undef, nil, err
+	}
+	n, c, err := cid.CidFromBytes(section)
+	if err != nil {
+		return cid.Undef, nil, err
+	}
+	return c, section[n:], nil
+}
+
+// carBlockStream serves the blocks of a CAR being streamed to a traversal,
+// requiring that each block the traversal loads for the first time is the next
+// in the CAR, or with skipUnwanted, that it is found further on in the CAR.
+// Each block loaded must match its CID. Blocks are written to storage as they
+// are loaded, blocks loaded again are read back from storage as a CAR need
+// only hold each block once.
+type carBlockStream struct {
+	reader       *carSectionReader
+	storage      *linking.LinkSystem
+	seen         map[cid.Cid]struct{}
+	skipUnwanted bool
+	progress     func()
+	received     func(size uint64)
+}
+
+func (cbs *carBlockStream) load(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
+	cidLink, ok := lnk.(cidlink.Link)
+	if !ok {
+		return nil, fmt.Errorf("invalid link type for loading: %v", lnk)
+	}
+	if _, ok := cbs.seen[cidLink.Cid]; ok {
+		return cbs.storage.StorageReadOpener(lctx, lnk)
+	}
+	var data []byte
+	for {
+		c, sectionData, err := cbs.reader.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("CAR ended before block %s", cidLink.Cid)
+			}
+			return nil, err
+		}
+		cbs.progress()
+		if c.Equals(cidLink.Cid) {
+			data = sectionData
+			break
+		}
+		if !cbs.skipUnwanted {
+			return nil, fmt.Errorf("%w %s in place of %s", ErrUnexpectedBlock, c, cidLink.Cid)
+		}
+	}
+	hashed, err := cidLink.Cid.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !hashed.Equals(cidLink.Cid) {
+		return nil, fmt.Errorf("%w: %s", ErrBlockIntegrity, cidLink.Cid)
+	}
+	cbs.seen[cidLink.Cid] = struct{}{}
+
+	if err := storeBlock(cbs.storage, lctx, lnk, data); err != nil {
+		return nil, err
+	}
+	cbs.received(uint64(len(data)))
+	return bytes.NewReader(data), nil
+}
+
+// storeBlock writes a retrieved block to storage, unless it is already there,
+// perhaps from an earlier attempt at the same retrieval
+func storeBlock(storage *linking.LinkSystem, lctx linking.LinkContext, lnk datamodel.Link, data []byte) error {
+	if storage.StorageReadOpener != nil {
+		if _, err := storage.StorageReadOpener(lctx, lnk); err == nil {
+			return nil
+		}
+	}
+	w, commit, err := storage.StorageWriteOpener(lctx)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return commit(lnk)
+}
+
+// candidateRequestUrl determines the URL to retrieve from a candidate, and
+// whether it is of a piece rather than of a CAR of the request alone
+func (r *httpRetrieval) candidateRequestUrl(candidate types.RetrievalCandidate) (string, bool, error) {
+	endpoint, err := candidateHttpEndpoint(candidate)
+	if err != nil {
+		return "", false, err
+	}
+	if candidate.Metadata.Get(types.TransportIpfsGatewayHttp) == nil {
+		if pieceCid, ok := candidatePieceCid(candidate); ok {
+			return pieceRequestUrl(endpoint, pieceCid), true, nil
+		}
+	}
+	path, scope, err := requestPathScope(r.request)
+	if err != nil {
+		return "", false, err
+	}
+	return carRequestUrl(endpoint, r.request.Cid, path, scope), false, nil
+}
+
+// requestPathScope determines the path and scope to request over HTTP for a
+// request, a request without them can only be made if it is for the full DAG
+func requestPathScope(request types.RetrievalRequest) (string, types.DagScope, error) {
+	if request.Scope != "" {
+		return request.Path, request.Scope, nil
+	}
+	if request.Selector != nil {
+		return "", "", ErrSelectorNotSupported
+	}
+	return "", types.DagScopeAll, nil
+}
+
+// carRequestUrl builds the URL of a trustless gateway request for a CAR
+func carRequestUrl(endpoint *url.URL, root cid.Cid, path string, scope types.DagScope) string {
+	u := *endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ipfs/" + root.String() + path
+	u.RawQuery = url.Values{"dag-scope": []string{string(scope)}}.Encode()
+	return u.String()
+}
+
+// pieceRequestUrl builds the URL of a request for a whole piece
+func pieceRequestUrl(endpoint *url.URL, pieceCid cid.Cid) string {
+	u := *endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/piece/" + pieceCid.String()
+	return u.String()
+}
+
+// candidatePieceCid finds the piece CID of a graphsync candidate, if it has one
+func candidatePieceCid(candidate types.RetrievalCandidate) (cid.Cid, bool) {
+	gsMetadata, ok := candidate.Metadata.Get(multicodec.TransportGraphsyncFilecoinv1).(*metadata.GraphsyncFilecoinV1)
+	if !ok || !gsMetadata.PieceCID.Defined() {
+		return cid.Undef, false
+	}
+	return gsMetadata.PieceCID, true
+}
+
+// isHttpPieceCandidate determines whether a candidate's piece can be retrieved
+// over HTTP, which needs both a piece CID and an HTTP endpoint
+func isHttpPieceCandidate(candidate types.RetrievalCandidate) bool {
+	if _, ok := candidatePieceCid(candidate); !ok {
+		return false
+	}
+	_, err := candidateHttpEndpoint(candidate)
+	return err == nil
+}
+
+// candidateHttpEndpoint finds the first of a candidate's addresses that is an
+// HTTP endpoint
+func candidateHttpEndpoint(candidate types.RetrievalCandidate) (*url.URL, error) {
+	for _, addr := range candidate.MinerPeer.Addrs {
+		if endpoint, err := httpEndpoint(addr); err == nil {
+			return endpoint, nil
+		}
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNoHttpEndpoint, candidate.MinerPeer.ID)
+}
+
+// httpEndpoint converts the multiaddr of an HTTP endpoint, such as
+// /dns/example.com/tcp/443/https or /ip4/127.0.0.1/tcp/80/http, to a URL
+func httpEndpoint(addr multiaddr.Multiaddr) (*url.URL, error) {
+	var host, port, scheme string
+	multiaddr.ForEach(addr, func(c multiaddr.Component) bool {
+		switch c.Protocol().Code {
+		case multiaddr.P_IP4, multiaddr.P_IP6, multiaddr.P_DNS, multiaddr.P_DNS4, multiaddr.P_DNS6:
+			host = c.Value()
+		case multiaddr.P_TCP:
+			port = c.Value()
+		case multiaddr.P_TLS, multiaddr.P_HTTPS:
+			scheme = "https"
+		case multiaddr.P_HTTP:
+			if scheme == "" {
+				scheme = "http"
+			}
+		}
+		return true
+	})
+	if host == "" || scheme == "" {
+		return nil, fmt.Errorf("not an HTTP multiaddr: %s", addr)
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return &url.URL{Scheme: scheme, Host: host}, nil
+}
@@ -0,0 +1,300 @@
+package retriever_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	gstestutil "github.com/ipfs/go-graphsync/testutil"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-varint"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHttpRetriever(t *testing.T) {
+	ctx := context.Background()
+
+	remoteLsys := makeLsys(nil)
+	tbc1 := gstestutil.SetupBlockChain(ctx, t, *remoteLsys, 1000, 100)
+	tbc2 := gstestutil.SetupBlockChain(ctx, t, *remoteLsys, 1000, 100)
+	cid1 := tbc1.TipLink.(cidlink.Link).Cid
+	cid2 := tbc2.TipLink.(cidlink.Link).Cid
+	carOf := func(root cid.Cid) []byte {
+		var buf bytes.Buffer
+		_, err := car.TraverseV1(ctx, remoteLsys, root, selectorparse.CommonSelector_ExploreAllRecursively, &buf)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	car1 := carOf(cid1)
+	var car1Size uint64
+	for _, blk := range tbc1.AllBlocks() {
+		car1Size += uint64(len(blk.RawData()))
+	}
+	// flipping the final byte corrupts the data of the final block
+	corruptCar1 := append([]byte{}, car1...)
+	corruptCar1[len(corruptCar1)-1] ^= 0xff
+
+	testCases := []struct {
+		name          string
+		responses     [][]byte
+		statuses      []int
+		expectedCodes [][]types.EventCode
+		expectedFrom  int
+		expectErr     bool
+	}{
+		{
+			name:      "successful retrieval",
+			responses: [][]byte{car1},
+			expectedCodes: [][]types.EventCode{
+				{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode},
+			},
+		},
+		{
+			name:      "unexpected blocks, falls back to second candidate",
+			responses: [][]byte{carOf(cid2), car1},
+			expectedCodes: [][]types.EventCode{
+				{types.StartedCode, types.ConnectedCode, types.MisbehavedCode, types.FailedCode},
+				{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode},
+			},
+			expectedFrom: 1,
+		},
+		{
+			name:      "corrupt block",
+			responses: [][]byte{corruptCar1},
+			expectedCodes: [][]types.EventCode{
+				{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.MisbehavedCode, types.FailedCode},
+			},
+			expectErr: true,
+		},
+		{
+			name:      "http error, falls back to second candidate",
+			responses: [][]byte{nil, car1},
+			statuses:  []int{http.StatusNotFound, http.StatusOK},
+			expectedCodes: [][]types.EventCode{
+				{types.StartedCode, types.FailedCode},
+				{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode},
+			},
+			expectedFrom: 1,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			req := require.New(t)
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+
+			var candidates []types.RetrievalCandidate
+			for i, response := range testCase.responses {
+				i, response := i, response
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					req.Equal("/ipfs/"+cid1.String(), r.URL.Path)
+					req.Equal("all", r.URL.Query().Get("dag-scope"))
+					req.Equal("application/vnd.ipld.car", r.Header.Get("Accept"))
+					if testCase.statuses != nil && testCase.statuses[i] != http.StatusOK {
+						w.WriteHeader(testCase.statuses[i])
+						return
+					}
+					w.Header().Set("Content-Type", "application/vnd.ipld.car")
+					_, _ = w.Write(response)
+				}))
+				defer server.Close()
+				candidates = append(candidates, httpCandidate(t, cid1, server.URL))
+			}
+
+			rid, err := types.NewRetrievalID()
+			req.NoError(err)
+			request := types.RetrievalRequest{
+				RetrievalID: rid,
+				Cid:         cid1,
+				LinkSystem:  *makeLsys(nil),
+			}
+			receivedEvents := make(map[peer.ID][]types.EventCode)
+			collector := func(evt types.RetrievalEvent) {
+				if spEvent, ok := evt.(interface{ StorageProviderId() peer.ID }); ok {
+					receivedEvents[spEvent.StorageProviderId()] = append(receivedEvents[spEvent.StorageProviderId()], evt.Code())
+				}
+			}
+			hr := &retriever.HttpRetriever{}
+			stats, err := hr.Retrieve(ctx, request, collector).RetrieveFromAsyncCandidates(makeAsyncCandidates(candidates))
+			if testCase.expectErr {
+				req.ErrorIs(err, retriever.ErrAllRetrievalsFailed)
+				req.Nil(stats)
+			} else {
+				req.NoError(err)
+				req.Equal(candidates[testCase.expectedFrom].MinerPeer.ID, stats.StorageProviderId)
+				req.Equal(uint64(100), stats.Blocks)
+				req.Equal(car1Size, stats.Size)
+				// everything was written to the request's storage
+				for _, blk := range tbc1.AllBlocks() {
+					_, err := request.LinkSystem.StorageReadOpener(linking.LinkContext{}, cidlink.Link{Cid: blk.Cid()})
+					req.NoError(err)
+				}
+			}
+			for i, expectedCodes := range testCase.expectedCodes {
+				req.Equal(expectedCodes, receivedEvents[candidates[i].MinerPeer.ID])
+			}
+		})
+	}
+}
+
+func TestHttpRetrieverPathAndScope(t *testing.T) {
+	req := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := cid.MustParse("bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e")
+
+	var requested *url.URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	request, err := types.NewRequestForPath(nil, c, "/a/b", false)
+	req.NoError(err)
+	request.LinkSystem = *makeLsys(nil)
+	hr := &retriever.HttpRetriever{}
+	_, err = hr.Retrieve(ctx, request, nil).RetrieveFromAsyncCandidates(makeAsyncCandidates([]types.RetrievalCandidate{httpCandidate(t, c, server.URL)}))
+	req.ErrorIs(err, retriever.ErrAllRetrievalsFailed)
+	req.Equal("/ipfs/"+c.String()+"/a/b", requested.Path)
+	req.Equal("entity", requested.Query().Get("dag-scope"))
+
+	// a selector without a path can't be retrieved
+	request.Scope = ""
+	requested = nil
+	_, err = hr.Retrieve(ctx, request, nil).RetrieveFromAsyncCandidates(makeAsyncCandidates([]types.RetrievalCandidate{httpCandidate(t, c, server.URL)}))
+	req.ErrorContains(err, retriever.ErrSelectorNotSupported.Error())
+	req.Nil(requested)
+}
+
+func TestHttpRetrieverPieces(t *testing.T) {
+	ctx := context.Background()
+
+	remoteLsys := makeLsys(nil)
+	tbc1 := gstestutil.SetupBlockChain(ctx, t, *remoteLsys, 1000, 100)
+	tbc2 := gstestutil.SetupBlockChain(ctx, t, *remoteLsys, 1000, 100)
+	cid1 := tbc1.TipLink.(cidlink.Link).Cid
+	cid2 := tbc2.TipLink.(cidlink.Link).Cid
+	pieceCid := cid.MustParse("baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq")
+	carOf := func(root cid.Cid) []byte {
+		var buf bytes.Buffer
+		_, err := car.TraverseV1(ctx, remoteLsys, root, selectorparse.CommonSelector_ExploreAllRecursively, &buf)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+	sectionsOf := func(carBytes []byte) []byte {
+		headerLength, n, err := varint.FromUvarint(carBytes)
+		require.NoError(t, err)
+		return carBytes[n+int(headerLength):]
+	}
+	var car1Size uint64
+	for _, blk := range tbc1.AllBlocks() {
+		car1Size += uint64(len(blk.RawData()))
+	}
+	// a piece holding both DAGs, followed by padding
+	pieceV1 := append(append(carOf(cid2), sectionsOf(carOf(cid1))...), make([]byte, 127)...)
+	var pieceV2 bytes.Buffer
+	carWriter, err := car.NewSelectiveWriter(ctx, remoteLsys, cid1, selectorparse.CommonSelector_ExploreAllRecursively)
+	require.NoError(t, err)
+	_, err = carWriter.WriteTo(&pieceV2)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		piece         []byte
+		expectedCodes []types.EventCode
+		expectErr     bool
+	}{
+		{
+			name:          "CARv1 piece",
+			piece:         pieceV1,
+			expectedCodes: []types.EventCode{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode},
+		},
+		{
+			name:          "CARv2 piece",
+			piece:         pieceV2.Bytes(),
+			expectedCodes: []types.EventCode{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode},
+		},
+		{
+			name:          "DAG not in piece",
+			piece:         carOf(cid2),
+			expectedCodes: []types.EventCode{types.StartedCode, types.ConnectedCode, types.FailedCode},
+			expectErr:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			req := require.New(t)
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req.Equal("/piece/"+pieceCid.String(), r.URL.Path)
+				_, _ = w.Write(testCase.piece)
+			}))
+			defer server.Close()
+			candidate := httpCandidate(t, cid1, server.URL)
+			candidate.Metadata = types.MetadataContext.New(&metadata.GraphsyncFilecoinV1{PieceCID: pieceCid})
+
+			rid, err := types.NewRetrievalID()
+			req.NoError(err)
+			request := types.RetrievalRequest{
+				RetrievalID: rid,
+				Cid:         cid1,
+				LinkSystem:  *makeLsys(nil),
+			}
+			var receivedCodes []types.EventCode
+			collector := func(evt types.RetrievalEvent) {
+				receivedCodes = append(receivedCodes, evt.Code())
+			}
+			hr := &retriever.HttpRetriever{}
+			stats, err := hr.Retrieve(ctx, request, collector).RetrieveFromAsyncCandidates(makeAsyncCandidates([]types.RetrievalCandidate{candidate}))
+			if testCase.expectErr {
+				req.ErrorIs(err, retriever.ErrAllRetrievalsFailed)
+			} else {
+				req.NoError(err)
+				req.Equal(uint64(100), stats.Blocks)
+				req.Equal(car1Size, stats.Size)
+				// only the requested DAG was kept
+				for _, blk := range tbc1.AllBlocks() {
+					_, err := request.LinkSystem.StorageReadOpener(linking.LinkContext{}, cidlink.Link{Cid: blk.Cid()})
+					req.NoError(err)
+				}
+				_, err = request.LinkSystem.StorageReadOpener(linking.LinkContext{}, tbc2.TipLink)
+				req.Error(err)
+			}
+			req.Equal(testCase.expectedCodes, receivedCodes)
+		})
+	}
+}
+
+func httpCandidate(t *testing.T, root cid.Cid, serverUrl string) types.RetrievalCandidate {
+	u, err := url.Parse(serverUrl)
+	require.NoError(t, err)
+	addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%s/http", u.Hostname(), u.Port()))
+	require.NoError(t, err)
+	candidate := types.NewRetrievalCandidate(testutil.GeneratePeers(1)[0], root, &types.IpfsGatewayHttp{})
+	candidate.MinerPeer.Addrs = []multiaddr.Multiaddr{addr}
+	return candidate
+}
@@ -0,0 +1,110 @@
+package retriever
+
+import (
+	"context"
+
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+)
+
+var _ CandidateFinder = (*LocalCandidateFinder)(nil)
+
+// LocalCandidateFinder finds a local candidate when the root of a retrieval is
+// held in LocalStores, ahead of the candidates found by a CandidateFinder for
+// the network. Once there is a local candidate, failure to find candidates on
+// the network no longer fails the search.
+type LocalCandidateFinder struct {
+	stores *LocalStores
+	next   CandidateFinder
+}
+
+// NewLocalCandidateFinder returns a new LocalCandidateFinder for the stores,
+// followed by the network's candidates from next where it isn't nil
+func NewLocalCandidateFinder(stores *LocalStores, next CandidateFinder) *LocalCandidateFinder {
+	return &LocalCandidateFinder{stores: stores, next: next}
+}
+
+func (lcf *LocalCandidateFinder) localCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	has, err := lcf.stores.Has(ctx, c)
+	if err != nil || !has {
+		return nil, err
+	}
+	candidate := types.NewRetrievalCandidate(LocalStorageProviderId, c, &types.Local{})
+	return []types.RetrievalCandidate{candidate}, nil
+}
+
+func (lcf *LocalCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	candidates, err := lcf.localCandidates(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if lcf.next == nil {
+		return candidates, nil
+	}
+	networkCandidates, err := lcf.next.FindCandidates(ctx, c)
+	if err != nil {
+		if len(candidates) > 0 {
+			log.Debugw("failed to find network candidates, using local candidate alone", "cid", c, "err", err)
+			return candidates, nil
+		}
+		return nil, err
+	}
+	return append(candidates, networkCandidates...), nil
+}
+
+func (lcf *LocalCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	candidates, err := lcf.localCandidates(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	var networkResults <-chan types.FindCandidatesResult
+	if lcf.next != nil {
+		networkResults, err = lcf.next.FindCandidatesAsync(ctx, c)
+		if err != nil {
+			if len(candidates) == 0 {
+				return nil, err
+			}
+			log.Debugw("failed to find network candidates, using local candidate alone", "cid", c, "err", err)
+			networkResults = nil
+		}
+	}
+
+	results := make(chan types.FindCandidatesResult)
+	go func() {
+		defer close(results)
+		send := func(result types.FindCandidatesResult) bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case results <- result:
+				return true
+			}
+		}
+		for _, candidate := range candidates {
+			if !send(types.FindCandidatesResult{Candidate: candidate}) {
+				return
+			}
+		}
+		if networkResults == nil {
+			return
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case result, ok := <-networkResults:
+				if !ok {
+					return
+				}
+				if result.Err != nil && len(candidates) > 0 {
+					log.Debugw("failed to find network candidates, using local candidate alone", "cid", c, "err", result.Err)
+					return
+				}
+				if !send(result) {
+					return
+				}
+			}
+		}
+	}()
+	return results, nil
+}
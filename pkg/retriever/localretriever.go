@@ -0,0 +1,229 @@
+package retriever
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	carblockstore "github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/multierr"
+)
+
+// LocalStorageProviderId identifies the local stores as the storage provider
+// of local candidates and retrievals
+const LocalStorageProviderId = peer.ID("local")
+
+// ErrNotInLocalStores indicates that a block is in none of the local stores
+var ErrNotInLocalStores = errors.New("not in local stores")
+
+// LocalStores is a set of CAR files and blockstores on the local machine that
+// retrievals can be served from before, or alongside, the network. The stores
+// are read only, and are searched in the order they were opened.
+type LocalStores struct {
+	stores  []blockstore.Blockstore
+	closers []io.Closer
+}
+
+// OpenLocalStores opens CAR files and blockstore directories for reading.
+// CARv2 files are read through their index, while other CARs are indexed as
+// they are opened. Blockstore directories are leveldb datastores holding
+// blocks as an IPFS blockstore does.
+func OpenLocalStores(carPaths []string, blockstoreDirs []string) (*LocalStores, error) {
+	ls := &LocalStores{}
+	for _, carPath := range carPaths {
+		bs, err := carblockstore.OpenReadOnly(carPath)
+		if err != nil {
+			_ = ls.Close()
+			return nil, fmt.Errorf("failed to open CAR %s: %w", carPath, err)
+		}
+		ls.stores = append(ls.stores, bs)
+		ls.closers = append(ls.closers, bs)
+	}
+	for _, dir := range blockstoreDirs {
+		ds, err := leveldb.NewDatastore(dir, &leveldb.Options{ReadOnly: true})
+		if err != nil {
+			_ = ls.Close()
+			return nil, fmt.Errorf("failed to open blockstore %s: %w", dir, err)
+		}
+		ls.stores = append(ls.stores, blockstore.NewBlockstore(ds))
+		ls.closers = append(ls.closers, ds)
+	}
+	return ls, nil
+}
+
+// NewLocalStores makes LocalStores from blockstores that are already open,
+// which are left open by Close
+func NewLocalStores(stores ...blockstore.Blockstore) *LocalStores {
+	return &LocalStores{stores: stores}
+}
+
+// Has determines whether any of the stores holds a block
+func (ls *LocalStores) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	for _, store := range ls.stores {
+		has, err := store.Has(ctx, c)
+		if err != nil {
+			return false, err
+		}
+		if has {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Get reads a block from the first of the stores that holds it
+func (ls *LocalStores) Get(ctx context.Context, c cid.Cid) ([]byte, error) {
+	for _, store := range ls.stores {
+		has, err := store.Has(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			continue
+		}
+		blk, err := store.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return blk.RawData(), nil
+	}
+	return nil, fmt.Errorf("%s %w", c, ErrNotInLocalStores)
+}
+
+// Close closes the CAR files and blockstores that were opened
+func (ls *LocalStores) Close() error {
+	var err error
+	for _, closer := range ls.closers {
+		err = multierr.Append(err, closer.Close())
+	}
+	return err
+}
+
+// LocalRetriever retrieves from LocalStores, completing the request's
+// traversal with the blocks held locally. Retrievals emit the same events and
+// stats as retrievals from the network, with LocalStorageProviderId as the
+// storage provider.
+type LocalRetriever struct {
+	Stores *LocalStores
+	// Clock is used to time retrievals, a real clock is used if nil
+	Clock clock.Clock
+}
+
+var _ types.CandidateRetriever = (*LocalRetriever)(nil)
+
+type localRetrieval struct {
+	*LocalRetriever
+	ctx     context.Context
+	request types.RetrievalRequest
+	events  func(types.RetrievalEvent)
+}
+
+// Retrieve sets up a retrieval of the request from the local stores
+func (cfg *LocalRetriever) Retrieve(ctx context.Context, request types.RetrievalRequest, events func(types.RetrievalEvent)) types.CandidateRetrieval {
+	if events == nil {
+		events = func(types.RetrievalEvent) {}
+	}
+	return &localRetrieval{cfg, ctx, request, events}
+}
+
+func (r *localRetrieval) RetrieveFromAsyncCandidates(asyncCandidates types.InboundAsyncCandidates) (*types.RetrievalStats, error) {
+	sel, err := selector.ParseSelector(r.request.GetSelector())
+	if err != nil {
+		return nil, err
+	}
+	var retrievalErrors error
+	for {
+		hasCandidates, candidates, err := asyncCandidates.Next(r.ctx)
+		if !hasCandidates || err != nil {
+			break
+		}
+		for _, candidate := range candidates {
+			stats, err := r.retrieveFromCandidate(candidate, sel)
+			if err == nil {
+				return stats, nil
+			}
+			retrievalErrors = multierr.Append(retrievalErrors, fmt.Errorf("%w: %s", ErrRetrievalFailed, err))
+			if r.ctx.Err() != nil {
+				return nil, r.ctx.Err()
+			}
+		}
+	}
+	if retrievalErrors == nil {
+		// nothing was found locally, so we give up on local retrieval
+		return nil, nil
+	}
+	return nil, multierr.Append(retrievalErrors, ErrAllRetrievalsFailed)
+}
+
+func (r *localRetrieval) retrieveFromCandidate(candidate types.RetrievalCandidate, sel selector.Selector) (*types.RetrievalStats, error) {
+	clk := r.Clock
+	if clk == nil {
+		clk = clock.New()
+	}
+	phaseStartTime := clk.Now()
+	r.events(events.Started(r.request.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate))
+	r.events(events.Connected(r.request.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate))
+
+	var totalWritten, blockCount uint64
+	seen := make(map[cid.Cid]struct{})
+	wrappedLsys := r.request.LinkSystem
+	wrappedLsys.StorageReadOpener = func(lctx linking.LinkContext, lnk datamodel.Link) (io.Reader, error) {
+		cidLink, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("invalid link type for loading: %v", lnk)
+		}
+		if _, ok := seen[cidLink.Cid]; ok {
+			return r.request.LinkSystem.StorageReadOpener(lctx, lnk)
+		}
+		data, err := r.Stores.Get(r.ctx, cidLink.Cid)
+		if err != nil {
+			return nil, err
+		}
+		if err := storeBlock(&r.request.LinkSystem, lctx, lnk, data); err != nil {
+			return nil, err
+		}
+		seen[cidLink.Cid] = struct{}{}
+		if blockCount == 0 {
+			r.events(events.FirstByte(r.request.RetrievalID, phaseStartTime, candidate))
+		}
+		totalWritten += uint64(len(data))
+		blockCount++
+		return bytes.NewReader(data), nil
+	}
+	if err := easyTraverse(r.ctx, cidlink.Link{Cid: r.request.Cid}, sel, &wrappedLsys); err != nil {
+		r.events(events.Failed(r.request.RetrievalID, phaseStartTime, types.RetrievalPhase, candidate, err.Error()))
+		return nil, err
+	}
+
+	duration := clk.Since(phaseStartTime)
+	var speed uint64
+	if duration > 0 {
+		speed = uint64(float64(totalWritten) / duration.Seconds())
+	}
+	r.events(events.Success(r.request.RetrievalID, phaseStartTime, candidate, totalWritten, blockCount, duration, big.Zero()))
+	return &types.RetrievalStats{
+		StorageProviderId: candidate.MinerPeer.ID,
+		RootCid:           r.request.Cid,
+		Size:              totalWritten,
+		Blocks:            blockCount,
+		Duration:          duration,
+		AverageSpeed:      speed,
+		TotalPayment:      big.Zero(),
+		NumPayments:       0,
+		AskPrice:          big.Zero(),
+	}, nil
+}
@@ -0,0 +1,157 @@
+package retriever_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	gstestutil "github.com/ipfs/go-graphsync/testutil"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipld/go-car/v2"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalRetriever(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	remoteLsys := makeLsys(nil)
+	tbc1 := gstestutil.SetupBlockChain(ctx, t, *remoteLsys, 1000, 100)
+	tbc2 := gstestutil.SetupBlockChain(ctx, t, *remoteLsys, 1000, 100)
+	tbc3 := gstestutil.SetupBlockChain(ctx, t, *remoteLsys, 1000, 100)
+	cid1 := tbc1.TipLink.(cidlink.Link).Cid
+	cid2 := tbc2.TipLink.(cidlink.Link).Cid
+	cid3 := tbc3.TipLink.(cidlink.Link).Cid
+
+	// the first DAG is in a CAR, the second in a blockstore and only the first
+	// ten blocks of the third are in another CAR
+	dir := t.TempDir()
+	carPath := filepath.Join(dir, "1.car")
+	require.NoError(t, car.TraverseToFile(ctx, remoteLsys, cid1, selectorparse.CommonSelector_ExploreAllRecursively, carPath))
+	partialCarPath := filepath.Join(dir, "3.car")
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+	depth10Selector := ssb.ExploreRecursive(selector.RecursionLimitDepth(10), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node()
+	require.NoError(t, car.TraverseToFile(ctx, remoteLsys, cid3, depth10Selector, partialCarPath))
+	blockstoreDir := filepath.Join(dir, "blockstore")
+	ds, err := leveldb.NewDatastore(blockstoreDir, nil)
+	require.NoError(t, err)
+	for _, blk := range tbc2.AllBlocks() {
+		require.NoError(t, blockstore.NewBlockstore(ds).Put(ctx, blk))
+	}
+	require.NoError(t, ds.Close())
+
+	stores, err := retriever.OpenLocalStores([]string{carPath, partialCarPath}, []string{blockstoreDir})
+	require.NoError(t, err)
+	defer stores.Close()
+
+	networkCandidate := types.NewRetrievalCandidate(testutil.GeneratePeers(1)[0], cid1, &types.IpfsGatewayHttp{})
+	networkFinder := &testutil.MockCandidateFinder{Candidates: map[cid.Cid][]types.RetrievalCandidate{cid1: {networkCandidate}}}
+
+	t.Run("finds local candidates", func(t *testing.T) {
+		req := require.New(t)
+		localCandidate := types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1, &types.Local{})
+
+		candidates, err := retriever.NewLocalCandidateFinder(stores, networkFinder).FindCandidates(ctx, cid1)
+		req.NoError(err)
+		req.Equal([]types.RetrievalCandidate{localCandidate, networkCandidate}, candidates)
+
+		results, err := retriever.NewLocalCandidateFinder(stores, networkFinder).FindCandidatesAsync(ctx, cid1)
+		req.NoError(err)
+		candidates = nil
+		for result := range results {
+			req.NoError(result.Err)
+			candidates = append(candidates, result.Candidate)
+		}
+		req.Equal([]types.RetrievalCandidate{localCandidate, networkCandidate}, candidates)
+
+		// the local candidate is enough when the network can't be searched
+		failingFinder := &testutil.MockCandidateFinder{Error: errors.New("indexer down")}
+		candidates, err = retriever.NewLocalCandidateFinder(stores, failingFinder).FindCandidates(ctx, cid1)
+		req.NoError(err)
+		req.Equal([]types.RetrievalCandidate{localCandidate}, candidates)
+
+		// but without one the search still fails
+		_, err = retriever.NewLocalCandidateFinder(stores, failingFinder).FindCandidates(ctx, testutil.GenerateCids(1)[0])
+		req.Error(err)
+
+		candidates, err = retriever.NewLocalCandidateFinder(stores, nil).FindCandidates(ctx, cid2)
+		req.NoError(err)
+		req.Len(candidates, 1)
+	})
+
+	testCases := []struct {
+		name          string
+		root          cid.Cid
+		dag           *gstestutil.TestBlockChain
+		expectedCodes []types.EventCode
+		expectErr     bool
+	}{
+		{
+			name:          "from a CAR",
+			root:          cid1,
+			dag:           tbc1,
+			expectedCodes: []types.EventCode{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode},
+		},
+		{
+			name:          "from a blockstore",
+			root:          cid2,
+			dag:           tbc2,
+			expectedCodes: []types.EventCode{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.SuccessCode},
+		},
+		{
+			name:          "incomplete DAG",
+			root:          cid3,
+			dag:           tbc3,
+			expectedCodes: []types.EventCode{types.StartedCode, types.ConnectedCode, types.FirstByteCode, types.FailedCode},
+			expectErr:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			req := require.New(t)
+			rid, err := types.NewRetrievalID()
+			req.NoError(err)
+			request := types.RetrievalRequest{
+				RetrievalID: rid,
+				Cid:         testCase.root,
+				LinkSystem:  *makeLsys(nil),
+			}
+			var receivedCodes []types.EventCode
+			collector := func(evt types.RetrievalEvent) {
+				receivedCodes = append(receivedCodes, evt.Code())
+			}
+			candidates, err := retriever.NewLocalCandidateFinder(stores, nil).FindCandidates(ctx, testCase.root)
+			req.NoError(err)
+			lr := &retriever.LocalRetriever{Stores: stores}
+			stats, err := lr.Retrieve(ctx, request, collector).RetrieveFromAsyncCandidates(makeAsyncCandidates(candidates))
+			req.Equal(testCase.expectedCodes, receivedCodes)
+			if testCase.expectErr {
+				req.ErrorIs(err, retriever.ErrAllRetrievalsFailed)
+				req.ErrorContains(err, retriever.ErrNotInLocalStores.Error())
+				return
+			}
+			req.NoError(err)
+			req.Equal(retriever.LocalStorageProviderId, stats.StorageProviderId)
+			req.Equal(uint64(100), stats.Blocks)
+			for _, blk := range testCase.dag.AllBlocks() {
+				_, err := request.LinkSystem.StorageReadOpener(linking.LinkContext{}, cidlink.Link{Cid: blk.Cid()})
+				req.NoError(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,669 @@
+package retriever
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	datatransfer "github.com/filecoin-project/go-data-transfer/v2"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/multiformats/go-multihash"
+)
+
+// maxSplitDepth is how far below the root a split retrieval follows blocks
+// with a single link, looking for one with more links to split at
+const maxSplitDepth = 8
+
+// parallelPart is the part a storage provider takes in a parallel retrieval
+type parallelPart int
+
+const (
+	// partAlone retrieves the whole DAG from the storage provider alone
+	partAlone parallelPart = iota
+	// partSplit joins the retrieval split across storage providers
+	partSplit
+	// partNone doesn't retrieve from the storage provider at all
+	partNone
+)
+
+// parallelRetrieval coordinates a full DAG retrieval that is split across
+// multiple storage providers. The first storage provider to be retrieved from
+// fetches the root block, along with any blocks below it that have only a
+// single link, and the blocks linked from the first block with more than one
+// link become subtree tasks. Each storage provider that joins the retrieval
+// takes tasks from a shared queue until none remain. A task that fails, or
+// stalls for longer than the storage provider timeout, is returned to the
+// queue for another storage provider to take, and the storage provider that
+// failed it leaves the retrieval.
+//
+// Retrieved blocks are held in a temporary file and written to the request's
+// LinkSystem by a traversal of the DAG, so they arrive in the same depth-first
+// order as they would from a single storage provider, which streamed CAR
+// output relies on.
+//
+// A storage provider that charges to unseal would charge again for every deal
+// it is part of, so only those that don't take part in a split. If the first
+// storage provider to be retrieved from charges to unseal, it retrieves the
+// whole DAG alone, as does every storage provider after it.
+type parallelRetrieval struct {
+	maxProviders int
+	tempDir      string
+
+	lk        sync.Mutex
+	started   bool
+	alone     bool
+	startTime time.Time
+	tasks     []cid.Cid
+	inFlight  int
+	providers int
+	changed   chan struct{}
+	stats     types.RetrievalStats
+	blocks    *parallelBlocks
+	// written is closed once every block has been written to the request's
+	// LinkSystem, or writing has failed with err
+	written chan struct{}
+	err     error
+}
+
+func newParallelRetrieval(maxProviders int, tempDir string) *parallelRetrieval {
+	return &parallelRetrieval{
+		maxProviders: maxProviders,
+		tempDir:      tempDir,
+		changed:      make(chan struct{}),
+	}
+}
+
+// claim decides the part a storage provider takes in the retrieval from its
+// query response. It is called once the candidate is let through the wait
+// queue.
+func (pr *parallelRetrieval) claim(queryResponse *retrievalmarket.QueryResponse) parallelPart {
+	pr.lk.Lock()
+	defer pr.lk.Unlock()
+	if pr.alone {
+		return partAlone
+	}
+	if queryResponse.UnsealPrice.Nil() || queryResponse.UnsealPrice.IsZero() {
+		return partSplit
+	}
+	if pr.started {
+		return partNone
+	}
+	pr.alone = true
+	return partAlone
+}
+
+// retrieve performs a single storage provider's part in the retrieval; it is
+// called once the candidate is let through the wait queue and calls release
+// to let the next candidate through once it has joined. onStart is called
+// before the storage provider is first retrieved from. Stats for the work done
+// by this storage provider are returned, these will be nil if the retrieval
+// was completed by others before this storage provider could join.
+func (pr *parallelRetrieval) retrieve(
+	ctx context.Context,
+	cfg *GraphSyncRetriever,
+	req types.RetrievalRequest,
+	client RetrievalClient,
+	timeout time.Duration,
+	candidate types.RetrievalCandidate,
+	queryResponse *retrievalmarket.QueryResponse,
+	eventsCallback datatransfer.Subscriber,
+	onStart func(),
+	release func(),
+) (*types.RetrievalStats, error) {
+
+	pr.lk.Lock()
+	started := pr.started
+	pr.lk.Unlock()
+
+	startTime := time.Now()
+	providerStats := types.RetrievalStats{
+		StorageProviderId: candidate.MinerPeer.ID,
+		RootCid:           candidate.RootCid,
+		TotalPayment:      big.Zero(),
+		AskPrice:          queryResponse.MinPricePerByte,
+	}
+
+	if !started {
+		// only one candidate is let through the wait queue at a time, so we are
+		// the only one attempting to fetch the root
+		if pr.blocks == nil {
+			blocks, err := newParallelBlocks(pr.tempDir, pr.blockAdded)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrRetrievalFailed, err)
+			}
+			pr.lk.Lock()
+			pr.blocks = blocks
+			pr.lk.Unlock()
+		}
+		onStart()
+		subtrees, stats, err := pr.retrieveRoots(ctx, cfg, req, client, timeout, candidate, queryResponse, eventsCallback)
+		if err != nil {
+			return nil, err
+		}
+		addStats(&providerStats, stats)
+
+		pr.lk.Lock()
+		pr.started = true
+		pr.startTime = startTime
+		pr.tasks = subtrees
+		pr.providers++
+		pr.stats = *stats
+		pr.written = make(chan struct{})
+		pr.broadcast()
+		pr.lk.Unlock()
+
+		go pr.write(ctx, req.LinkSystem, candidate.RootCid)
+	} else {
+		if !pr.join(ctx) {
+			return nil, nil
+		}
+		onStart()
+	}
+	release()
+
+	for {
+		subtree, more, err := pr.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+		subtreeCandidate := candidate
+		subtreeCandidate.RootCid = subtree
+		stats, err := retrievalPhase(
+			ctx,
+			cfg,
+			pr.linkSystem(req.LinkSystem),
+			client,
+			timeout,
+			subtreeCandidate,
+			queryResponse,
+			selectorparse.CommonSelector_ExploreAllRecursively,
+			eventsCallback,
+		)
+		if err != nil {
+			pr.fail(subtree)
+			return nil, err
+		}
+		pr.done(stats)
+		addStats(&providerStats, stats)
+	}
+
+	providerStats.Duration = time.Since(startTime)
+	providerStats.AverageSpeed = uint64(float64(providerStats.Size) / providerStats.Duration.Seconds())
+	return &providerStats, nil
+}
+
+// retrieveRoots fetches the root block on its own, followed by each block
+// below it with a single link, until it reaches a block with more links to
+// split at or maxSplitDepth is reached. The blocks to split at are returned,
+// along with the stats of all the blocks fetched.
+func (pr *parallelRetrieval) retrieveRoots(
+	ctx context.Context,
+	cfg *GraphSyncRetriever,
+	req types.RetrievalRequest,
+	client RetrievalClient,
+	timeout time.Duration,
+	candidate types.RetrievalCandidate,
+	queryResponse *retrievalmarket.QueryResponse,
+	eventsCallback datatransfer.Subscriber,
+) ([]cid.Cid, *types.RetrievalStats, error) {
+
+	lsys := pr.linkSystem(req.LinkSystem)
+	var total *types.RetrievalStats
+	rootCandidate := candidate
+	for depth := 0; ; depth++ {
+		stats, err := retrievalPhase(
+			ctx,
+			cfg,
+			lsys,
+			client,
+			timeout,
+			rootCandidate,
+			queryResponse,
+			selectorparse.CommonSelector_MatchPoint,
+			eventsCallback,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		if total == nil {
+			first := *stats
+			total = &first
+		} else {
+			addStats(total, stats)
+		}
+		subtrees, err := subtreeRoots(ctx, lsys, rootCandidate.RootCid)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrRetrievalFailed, err)
+		}
+		if len(subtrees) != 1 || depth == maxSplitDepth {
+			return subtrees, total, nil
+		}
+		rootCandidate.RootCid = subtrees[0]
+	}
+}
+
+// linkSystem returns a copy of the request's LinkSystem that reads and writes
+// the blocks held for the retrieval
+func (pr *parallelRetrieval) linkSystem(lsys ipld.LinkSystem) ipld.LinkSystem {
+	lsys.SetReadStorage(pr.blocks)
+	lsys.SetWriteStorage(pr.blocks)
+	return lsys
+}
+
+// write traverses the DAG in the order a single storage provider would send
+// it, waiting for each block to be retrieved and writing it to the request's
+// LinkSystem. It runs until the traversal is done or the retrieval is
+// cancelled.
+func (pr *parallelRetrieval) write(ctx context.Context, lsys ipld.LinkSystem, root cid.Cid) {
+	err := pr.traverse(ctx, lsys, root)
+
+	pr.lk.Lock()
+	defer pr.lk.Unlock()
+	if err != nil {
+		pr.err = fmt.Errorf("%w: %v", ErrRetrievalFailed, err)
+	}
+	close(pr.written)
+	pr.broadcast()
+}
+
+func (pr *parallelRetrieval) traverse(ctx context.Context, lsys ipld.LinkSystem, root cid.Cid) error {
+	walkLsys := lsys
+	// we want the links in the blocks themselves, not those of any ADL they
+	// may represent
+	walkLsys.NodeReifier = nil
+	walkLsys.StorageReadOpener = func(lctx linking.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, fmt.Errorf("unsupported link type %T", lnk)
+		}
+		if cl.Cid.Prefix().MhType == multihash.IDENTITY {
+			dmh, err := multihash.Decode(cl.Cid.Hash())
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(dmh.Digest), nil
+		}
+		data, err := pr.waitBlock(lctx.Ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+		w, commit, err := lsys.StorageWriteOpener(lctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := commit(lnk); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+
+	protoChooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLink := cidlink.Link{Cid: root}
+	prototype, err := protoChooser(rootLink, linking.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+	node, err := walkLsys.Load(linking.LinkContext{Ctx: ctx}, rootLink, prototype)
+	if err != nil {
+		return err
+	}
+	sel, err := selector.CompileSelector(selectorparse.CommonSelector_ExploreAllRecursively)
+	if err != nil {
+		return err
+	}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     walkLsys,
+			LinkTargetNodePrototypeChooser: protoChooser,
+			LinkVisitOnlyOnce:              true,
+		},
+	}
+	return progress.WalkAdv(node, sel, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+}
+
+// waitBlock waits for a block to be retrieved, returning an error if every
+// subtree has been retrieved without it
+func (pr *parallelRetrieval) waitBlock(ctx context.Context, c cid.Cid) ([]byte, error) {
+	for {
+		// check for completion before the block, a block is always stored
+		// before the subtree it belongs to is done
+		pr.lk.Lock()
+		complete := pr.complete()
+		changed := pr.changed
+		pr.lk.Unlock()
+
+		data, err := pr.blocks.Get(ctx, c.KeyString())
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, format.ErrNotFound{}) {
+			return nil, err
+		}
+		if complete {
+			return nil, fmt.Errorf("block %s was not retrieved", c)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// blockAdded wakes the writer when a block is stored
+func (pr *parallelRetrieval) blockAdded() {
+	pr.lk.Lock()
+	defer pr.lk.Unlock()
+	pr.broadcast()
+}
+
+// close waits for the writer to stop and removes the blocks held for the
+// retrieval, it is called once the retrieval is over
+func (pr *parallelRetrieval) close() {
+	pr.lk.Lock()
+	written := pr.written
+	blocks := pr.blocks
+	pr.lk.Unlock()
+
+	if written != nil {
+		<-written
+	}
+	if blocks != nil {
+		if err := blocks.close(); err != nil {
+			log.Warnf("failed to remove parallel retrieval blocks: %v", err)
+		}
+	}
+}
+
+// join waits for a free place in the retrieval, returning false if the
+// retrieval was completed, or cancelled, before one became available
+func (pr *parallelRetrieval) join(ctx context.Context) bool {
+	for {
+		pr.lk.Lock()
+		if pr.complete() || pr.err != nil {
+			pr.lk.Unlock()
+			return false
+		}
+		if pr.providers < pr.maxProviders {
+			pr.providers++
+			pr.lk.Unlock()
+			return true
+		}
+		changed := pr.changed
+		pr.lk.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// next waits for a subtree to retrieve, returning false once there are no
+// more to retrieve. If the retrieval is cancelled while waiting, or writing
+// the retrieved blocks fails, an error is returned and the caller is no longer
+// counted as part of the retrieval.
+func (pr *parallelRetrieval) next(ctx context.Context) (cid.Cid, bool, error) {
+	for {
+		pr.lk.Lock()
+		if pr.err != nil {
+			err := pr.err
+			pr.providers--
+			pr.broadcast()
+			pr.lk.Unlock()
+			return cid.Undef, false, err
+		}
+		if len(pr.tasks) > 0 {
+			subtree := pr.tasks[0]
+			pr.tasks = pr.tasks[1:]
+			pr.inFlight++
+			pr.lk.Unlock()
+			return subtree, true, nil
+		}
+		if pr.inFlight == 0 {
+			pr.lk.Unlock()
+			return cid.Undef, false, nil
+		}
+		changed := pr.changed
+		pr.lk.Unlock()
+
+		select {
+		case <-ctx.Done():
+			pr.lk.Lock()
+			pr.providers--
+			pr.broadcast()
+			pr.lk.Unlock()
+			return cid.Undef, false, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// done records the successful retrieval of a subtree
+func (pr *parallelRetrieval) done(stats *types.RetrievalStats) {
+	pr.lk.Lock()
+	defer pr.lk.Unlock()
+	pr.inFlight--
+	addStats(&pr.stats, stats)
+	pr.broadcast()
+}
+
+// fail returns a subtree to the queue for another storage provider to take
+// and removes the storage provider that failed it from the retrieval
+func (pr *parallelRetrieval) fail(subtree cid.Cid) {
+	pr.lk.Lock()
+	defer pr.lk.Unlock()
+	pr.inFlight--
+	pr.providers--
+	pr.tasks = append(pr.tasks, subtree)
+	pr.broadcast()
+}
+
+// leave is called by a storage provider that has finished its part in a
+// completed retrieval. The last to leave waits for every block to be written
+// and receives the stats for the whole retrieval, all others receive nil.
+func (pr *parallelRetrieval) leave(ctx context.Context) (*types.RetrievalStats, error) {
+	pr.lk.Lock()
+	pr.providers--
+	pr.broadcast()
+	last := pr.providers == 0
+	written := pr.written
+	pr.lk.Unlock()
+	if !last {
+		return nil, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-written:
+	}
+
+	pr.lk.Lock()
+	defer pr.lk.Unlock()
+	if pr.err != nil {
+		return nil, pr.err
+	}
+	stats := pr.stats
+	stats.Duration = time.Since(pr.startTime)
+	stats.AverageSpeed = uint64(float64(stats.Size) / stats.Duration.Seconds())
+	return &stats, nil
+}
+
+// complete must be called with lk held
+func (pr *parallelRetrieval) complete() bool {
+	return pr.started && len(pr.tasks) == 0 && pr.inFlight == 0
+}
+
+// broadcast wakes all goroutines waiting for a change, it must be called with
+// lk held
+func (pr *parallelRetrieval) broadcast() {
+	close(pr.changed)
+	pr.changed = make(chan struct{})
+}
+
+func addStats(total *types.RetrievalStats, stats *types.RetrievalStats) {
+	total.Size += stats.Size
+	total.Blocks += stats.Blocks
+	total.NumPayments += stats.NumPayments
+	if total.TotalPayment.Nil() {
+		total.TotalPayment = big.Zero()
+	}
+	if !stats.TotalPayment.Nil() {
+		total.TotalPayment = big.Add(total.TotalPayment, stats.TotalPayment)
+	}
+}
+
+// subtreeRoots loads the root block of a DAG from the LinkSystem and returns
+// the unique CIDs it links to, excluding identity CIDs which carry their own
+// data
+func subtreeRoots(ctx context.Context, lsys ipld.LinkSystem, root cid.Cid) ([]cid.Cid, error) {
+	// we want the links in the block itself, not those of any ADL it may
+	// represent
+	lsys.NodeReifier = nil
+	protoChooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLink := cidlink.Link{Cid: root}
+	prototype, err := protoChooser(rootLink, linking.LinkContext{Ctx: ctx})
+	if err != nil {
+		return nil, err
+	}
+	node, err := lsys.Load(linking.LinkContext{Ctx: ctx}, rootLink, prototype)
+	if err != nil {
+		return nil, err
+	}
+	links, err := traversal.SelectLinks(node)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[cid.Cid]struct{}, len(links))
+	subtrees := make([]cid.Cid, 0, len(links))
+	for _, link := range links {
+		cl, ok := link.(cidlink.Link)
+		if !ok {
+			continue
+		}
+		if cl.Cid.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		if _, has := seen[cl.Cid]; has {
+			continue
+		}
+		seen[cl.Cid] = struct{}{}
+		subtrees = append(subtrees, cl.Cid)
+	}
+	return subtrees, nil
+}
+
+// parallelBlocks holds the blocks of a split retrieval until they can be
+// written in order. Blocks are appended to a temporary file and indexed in
+// memory.
+type parallelBlocks struct {
+	file  *os.File
+	added func()
+
+	lk    sync.Mutex
+	size  int64
+	index map[string]blockSpan
+}
+
+type blockSpan struct {
+	offset int64
+	length int
+}
+
+var _ storage.ReadableStorage = (*parallelBlocks)(nil)
+var _ storage.WritableStorage = (*parallelBlocks)(nil)
+
+func newParallelBlocks(tempDir string, added func()) (*parallelBlocks, error) {
+	file, err := os.CreateTemp(tempDir, "lassie_parallel")
+	if err != nil {
+		return nil, err
+	}
+	return &parallelBlocks{
+		file:  file,
+		added: added,
+		index: make(map[string]blockSpan),
+	}, nil
+}
+
+func (pb *parallelBlocks) Has(ctx context.Context, key string) (bool, error) {
+	pb.lk.Lock()
+	defer pb.lk.Unlock()
+	_, has := pb.index[key]
+	return has, nil
+}
+
+func (pb *parallelBlocks) Get(ctx context.Context, key string) ([]byte, error) {
+	pb.lk.Lock()
+	span, has := pb.index[key]
+	pb.lk.Unlock()
+	if !has {
+		c, err := cid.Cast([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		return nil, format.ErrNotFound{Cid: c}
+	}
+	data := make([]byte, span.length)
+	if _, err := pb.file.ReadAt(data, span.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (pb *parallelBlocks) Put(ctx context.Context, key string, content []byte) error {
+	pb.lk.Lock()
+	if _, has := pb.index[key]; has {
+		pb.lk.Unlock()
+		return nil
+	}
+	offset := pb.size
+	pb.size += int64(len(content))
+	pb.lk.Unlock()
+
+	// the space for the block is reserved, so it can be written without
+	// holding the lock
+	if _, err := pb.file.WriteAt(content, offset); err != nil {
+		return err
+	}
+
+	pb.lk.Lock()
+	pb.index[key] = blockSpan{offset: offset, length: len(content)}
+	pb.lk.Unlock()
+	pb.added()
+	return nil
+}
+
+func (pb *parallelBlocks) close() error {
+	if err := pb.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(pb.file.Name())
+}
@@ -0,0 +1,448 @@
+package retriever
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	datatransfer "github.com/filecoin-project/go-data-transfer/v2"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever/selectorutils"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelRetrieval(t *testing.T) {
+	fullSelector, err := selectorutils.UnixfsPathToSelector("", true)
+	require.NoError(t, err)
+
+	queryResponse := &retrievalmarket.QueryResponse{
+		Status:          retrievalmarket.QueryResponseAvailable,
+		MinPricePerByte: big.Zero(),
+		UnsealPrice:     big.Zero(),
+	}
+	unsealQueryResponse := &retrievalmarket.QueryResponse{
+		Status:          retrievalmarket.QueryResponseAvailable,
+		MinPricePerByte: big.Zero(),
+		UnsealPrice:     big.NewInt(100),
+	}
+	successfulRetrieval := func(p string) testutil.DelayedRetrievalReturn {
+		return testutil.DelayedRetrievalReturn{
+			ResultStats: &types.RetrievalStats{StorageProviderId: peer.ID(p), Size: 10, Blocks: 1, TotalPayment: big.Zero()},
+			Delay:       20 * time.Millisecond,
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		maxProviders int
+		selector     ipld.Node
+		// deep puts a block with a single link between the root and the
+		// subtrees
+		deep             bool
+		queryReturns     map[string]testutil.DelayedQueryReturn
+		retrievalReturns map[string]testutil.DelayedRetrievalReturn
+		// expectedSplit is true when the root and each subtree are retrieved
+		// separately, otherwise a single retrieval of the whole DAG is expected
+		expectedSplit bool
+		// expectedSkipped are the storage providers expected not to be
+		// retrieved from at all
+		expectedSkipped []string
+		// expectedProviders is the minimum number of storage providers
+		// expected to retrieve subtrees
+		expectedProviders int
+		expectedFailures  []string
+	}{
+		{
+			name:         "splits subtrees across providers",
+			maxProviders: 3,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: queryResponse},
+				"bar": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+				"baz": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				// slower, so subtrees complete out of order
+				"bar": {ResultStats: successfulRetrieval("bar").ResultStats, Delay: 50 * time.Millisecond},
+				"baz": successfulRetrieval("baz"),
+			},
+			expectedSplit:     true,
+			expectedProviders: 2,
+		},
+		{
+			name:         "splits full unixfs path selector",
+			maxProviders: 2,
+			selector:     fullSelector,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: queryResponse},
+				"bar": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				"bar": successfulRetrieval("bar"),
+			},
+			expectedSplit:     true,
+			expectedProviders: 2,
+		},
+		{
+			name:         "reassigns subtrees of failed provider",
+			maxProviders: 2,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: queryResponse},
+				"bar": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				"bar": {ResultErr: errors.New("stalled"), Delay: 5 * time.Millisecond},
+			},
+			expectedSplit:     true,
+			expectedProviders: 1,
+			expectedFailures:  []string{"bar"},
+		},
+		{
+			name:         "splits below a block with a single link",
+			maxProviders: 2,
+			deep:         true,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: queryResponse},
+				"bar": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				"bar": successfulRetrieval("bar"),
+			},
+			expectedSplit:     true,
+			expectedProviders: 2,
+		},
+		{
+			name:         "leaves out providers that charge to unseal",
+			maxProviders: 2,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: queryResponse},
+				"bar": {QueryResponse: unsealQueryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				"bar": successfulRetrieval("bar"),
+			},
+			expectedSplit:     true,
+			expectedProviders: 1,
+			expectedSkipped:   []string{"bar"},
+		},
+		{
+			name:         "does not split when first provider charges to unseal",
+			maxProviders: 2,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: unsealQueryResponse},
+				"bar": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				"bar": successfulRetrieval("bar"),
+			},
+		},
+		{
+			name:         "does not split partial DAG selector",
+			maxProviders: 2,
+			selector:     selectorparse.CommonSelector_MatchPoint,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: queryResponse},
+				"bar": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				"bar": successfulRetrieval("bar"),
+			},
+		},
+		{
+			name:         "does not split when disabled",
+			maxProviders: 1,
+			queryReturns: map[string]testutil.DelayedQueryReturn{
+				"foo": {QueryResponse: queryResponse},
+				"bar": {QueryResponse: queryResponse, Delay: 5 * time.Millisecond},
+			},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				"foo": successfulRetrieval("foo"),
+				"bar": successfulRetrieval("bar"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			// the storage providers all serve the DAG in the source store and the
+			// order blocks are written to the request's store is recorded
+			sourceStore := &memstore.Store{}
+			source := cidlink.DefaultLinkSystem()
+			source.SetReadStorage(sourceStore)
+			source.SetWriteStorage(sourceStore)
+			rootCid, splitCids, subtrees := storeDAG(t, source, tc.deep)
+			expectedOrder := &orderedStore{}
+			sel := tc.selector
+			if sel == nil {
+				sel = selectorparse.CommonSelector_ExploreAllRecursively
+			}
+			require.NoError(t, copyBlocks(context.Background(), source, orderedLinkSystem(expectedOrder), rootCid, sel))
+
+			store := &orderedStore{}
+			lsys := orderedLinkSystem(store)
+
+			retrievalID := types.RetrievalID(uuid.New())
+			mockClient := &blockWritingClient{testutil.NewMockClient(tc.queryReturns, tc.retrievalReturns), source}
+			candidates := []types.RetrievalCandidate{}
+			for p := range tc.queryReturns {
+				candidates = append(candidates, types.RetrievalCandidate{MinerPeer: peer.AddrInfo{ID: peer.ID(p)}, RootCid: rootCid})
+			}
+			cfg := &GraphSyncRetriever{
+				GetStorageProviderTimeout: func(peer peer.ID) time.Duration { return time.Second },
+				IsAcceptableQueryResponse: func(peer peer.ID, req types.RetrievalRequest, qr *retrievalmarket.QueryResponse) error { return nil },
+				MaxParallelProviders:      tc.maxProviders,
+				Client:                    mockClient,
+			}
+
+			var lk sync.Mutex
+			successes := make(map[peer.ID]uint64)
+			failures := make([]string, 0)
+			stats, err := cfg.Retrieve(context.Background(), types.RetrievalRequest{
+				Cid:         rootCid,
+				RetrievalID: retrievalID,
+				LinkSystem:  lsys,
+				Selector:    tc.selector,
+			}, func(event types.RetrievalEvent) {
+				lk.Lock()
+				defer lk.Unlock()
+				switch ret := event.(type) {
+				case events.RetrievalEventSuccess:
+					successes[ret.StorageProviderId()] = ret.ReceivedSize()
+				case events.RetrievalEventFailed:
+					if ret.Phase() == types.RetrievalPhase {
+						failures = append(failures, string(ret.StorageProviderId()))
+					}
+				}
+			}).RetrieveFromAsyncCandidates(MakeAsyncCandidates(t, candidates))
+			require.NoError(t, err)
+			require.NotNil(t, stats)
+
+			retrievals := mockClient.GetReceivedRetrievals()
+			lk.Lock()
+			defer lk.Unlock()
+			require.ElementsMatch(t, tc.expectedFailures, failures)
+			require.Equal(t, expectedOrder.order, store.order)
+			for _, rr := range retrievals {
+				require.NotContains(t, tc.expectedSkipped, string(rr.Peer))
+			}
+
+			if !tc.expectedSplit {
+				require.Len(t, retrievals, 1)
+				require.Equal(t, rootCid, retrievals[0].Proposal.PayloadCID)
+				require.Equal(t, tc.retrievalReturns[string(retrievals[0].Peer)].ResultStats, stats)
+				return
+			}
+
+			// the root block, and any block with a single link below it, is
+			// retrieved first, on its own, followed by each of the subtrees once
+			// from a successful provider
+			for i, splitCid := range splitCids {
+				require.Equal(t, splitCid, retrievals[i].Proposal.PayloadCID)
+				require.Same(t, selectorparse.CommonSelector_MatchPoint, retrievals[i].Selector)
+			}
+			retrievedSubtrees := make([]cid.Cid, 0)
+			subtreeProviders := make(map[peer.ID]struct{})
+			for _, rr := range retrievals[len(splitCids):] {
+				require.Same(t, selectorparse.CommonSelector_ExploreAllRecursively, rr.Selector)
+				if tc.retrievalReturns[string(rr.Peer)].ResultErr == nil {
+					retrievedSubtrees = append(retrievedSubtrees, rr.Proposal.PayloadCID)
+					subtreeProviders[rr.Peer] = struct{}{}
+				}
+			}
+			require.ElementsMatch(t, subtrees, retrievedSubtrees)
+			require.GreaterOrEqual(t, len(subtreeProviders), tc.expectedProviders)
+
+			// stats cover the whole DAG, while each provider reports its own part
+			require.Equal(t, peer.ID(retrievals[0].Peer), stats.StorageProviderId)
+			require.Equal(t, uint64(10*(len(subtrees)+len(splitCids))), stats.Size)
+			require.Equal(t, uint64(len(subtrees)+len(splitCids)), stats.Blocks)
+			var total uint64
+			for _, size := range successes {
+				total += size
+			}
+			require.Equal(t, stats.Size, total)
+		})
+	}
+}
+
+// storeDAG writes a root block linking to subtrees, with a duplicate link
+// and an identity CID, neither of which are expected to be retrieved. Each
+// subtree has a block of its own below it. When deep, a block with a single
+// link is placed between the root and the block linking to the subtrees. The
+// CIDs of the blocks retrieved before the split are returned along with the
+// subtrees.
+func storeDAG(t *testing.T, lsys ipld.LinkSystem, deep bool) (cid.Cid, []cid.Cid, []cid.Cid) {
+	prefix := cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}}
+	storeList := func(links ...cid.Cid) cid.Cid {
+		node, err := qp.BuildList(basicnode.Prototype.Any, -1, func(la datamodel.ListAssembler) {
+			for _, c := range links {
+				qp.ListEntry(la, qp.Link(cidlink.Link{Cid: c}))
+			}
+		})
+		require.NoError(t, err)
+		link, err := lsys.Store(ipld.LinkContext{}, prefix, node)
+		require.NoError(t, err)
+		return link.(cidlink.Link).Cid
+	}
+
+	subtrees := make([]cid.Cid, 0)
+	for _, data := range []string{"apples", "oranges", "pears", "bananas"} {
+		w, commit, err := lsys.StorageWriteOpener(ipld.LinkContext{})
+		require.NoError(t, err)
+		_, err = w.Write([]byte(data))
+		require.NoError(t, err)
+		mh, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		leaf := cid.NewCidV1(cid.Raw, mh)
+		require.NoError(t, commit(cidlink.Link{Cid: leaf}))
+		subtrees = append(subtrees, storeList(leaf))
+	}
+	identity, err := multihash.Sum([]byte("inline"), multihash.IDENTITY, -1)
+	require.NoError(t, err)
+
+	root := storeList(append(subtrees, subtrees[0], cid.NewCidV1(cid.Raw, identity))...)
+	if !deep {
+		return root, []cid.Cid{root}, subtrees
+	}
+	top := storeList(root)
+	return top, []cid.Cid{top, root}, subtrees
+}
+
+// blockWritingClient writes the blocks of each successful retrieval from the
+// source LinkSystem to the LinkSystem it was given, as a storage provider
+// would send them
+type blockWritingClient struct {
+	*testutil.MockClient
+	source ipld.LinkSystem
+}
+
+func (c *blockWritingClient) RetrieveFromPeer(
+	ctx context.Context,
+	linkSystem ipld.LinkSystem,
+	peerID peer.ID,
+	minerWallet address.Address,
+	proposal *retrievalmarket.DealProposal,
+	selector ipld.Node,
+	eventsCallback datatransfer.Subscriber,
+	gracefulShutdownRequested <-chan struct{},
+) (*types.RetrievalStats, error) {
+	stats, err := c.MockClient.RetrieveFromPeer(ctx, linkSystem, peerID, minerWallet, proposal, selector, eventsCallback, gracefulShutdownRequested)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyBlocks(ctx, c.source, linkSystem, proposal.PayloadCID, selector); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// copyBlocks traverses a DAG in from, writing each block it loads to to
+func copyBlocks(ctx context.Context, from ipld.LinkSystem, to ipld.LinkSystem, root cid.Cid, sel ipld.Node) error {
+	read := from.StorageReadOpener
+	from.StorageReadOpener = func(lctx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		c := lnk.(cidlink.Link).Cid
+		if c.Prefix().MhType == multihash.IDENTITY {
+			dmh, err := multihash.Decode(c.Hash())
+			if err != nil {
+				return nil, err
+			}
+			return bytes.NewReader(dmh.Digest), nil
+		}
+		r, err := read(lctx, lnk)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		w, commit, err := to.StorageWriteOpener(lctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := commit(lnk); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	node, err := from.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, basicnode.Prototype.Any)
+	if err != nil {
+		return err
+	}
+	compiled, err := selector.CompileSelector(sel)
+	if err != nil {
+		return err
+	}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:        ctx,
+			LinkSystem: from,
+			LinkTargetNodePrototypeChooser: func(ipld.Link, ipld.LinkContext) (ipld.NodePrototype, error) {
+				return basicnode.Prototype.Any, nil
+			},
+		},
+	}
+	return progress.WalkAdv(node, compiled, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+}
+
+// orderedStore records the order blocks are first written in
+type orderedStore struct {
+	memstore.Store
+	lk    sync.Mutex
+	order []string
+}
+
+func (os *orderedStore) Put(ctx context.Context, key string, content []byte) error {
+	os.lk.Lock()
+	defer os.lk.Unlock()
+	if has, _ := os.Store.Has(ctx, key); !has {
+		os.order = append(os.order, key)
+	}
+	return os.Store.Put(ctx, key, content)
+}
+
+func orderedLinkSystem(store *orderedStore) ipld.LinkSystem {
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.SetReadStorage(store)
+	lsys.SetWriteStorage(store)
+	return lsys
+}
@@ -0,0 +1,170 @@
+package retriever
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// PaymentPolicy limits what is paid for retrievals when paid retrievals are
+// allowed. All amounts are in attoFIL, and a nil amount (the zero value)
+// places no limit.
+type PaymentPolicy struct {
+	// MaxPricePerByte is the highest price per byte a storage provider may ask
+	MaxPricePerByte abi.TokenAmount
+	// MaxUnsealPrice is the highest unseal price a storage provider may ask
+	MaxUnsealPrice abi.TokenAmount
+	// MaxCost is the most that may be paid for a single retrieval, the price
+	// per byte for the full size of the content plus the unseal price, summed
+	// across every storage provider that may be paid for it
+	MaxCost abi.TokenAmount
+	// Budget is the most that may be spent across all retrievals within a
+	// BudgetPeriod. What has been spent isn't persisted, so a new retriever,
+	// such as after a restart, starts with the whole Budget.
+	Budget abi.TokenAmount
+	// BudgetPeriod is the period over which the Budget applies, for example
+	// 24 hours for a daily budget; 0 applies the Budget for the lifetime of
+	// the retriever
+	BudgetPeriod time.Duration
+}
+
+// queryResponseCost is the total that a storage provider asks to be paid for
+// the retrieval described by a query response
+func queryResponseCost(queryResponse *retrievalmarket.QueryResponse) abi.TokenAmount {
+	return big.Add(big.Mul(queryResponse.MinPricePerByte, big.NewIntUnsigned(queryResponse.Size)), queryResponse.UnsealPrice)
+}
+
+// check returns an error describing the first limit that the query response
+// exceeds, given the amount already spent or reserved in the current budget
+// period and the amount reserved for other storage providers of the same
+// retrieval, or nil if it is within all limits
+func (pp PaymentPolicy) check(queryResponse *retrievalmarket.QueryResponse, spent abi.TokenAmount, retrievalReserved abi.TokenAmount) error {
+	if !pp.MaxPricePerByte.Nil() && queryResponse.MinPricePerByte.GreaterThan(pp.MaxPricePerByte) {
+		return fmt.Errorf("price per byte %s exceeds maximum of %s", types.FIL(queryResponse.MinPricePerByte).String(), types.FIL(pp.MaxPricePerByte).String())
+	}
+	if !pp.MaxUnsealPrice.Nil() && queryResponse.UnsealPrice.GreaterThan(pp.MaxUnsealPrice) {
+		return fmt.Errorf("unseal price %s exceeds maximum of %s", types.FIL(queryResponse.UnsealPrice).String(), types.FIL(pp.MaxUnsealPrice).String())
+	}
+	cost := queryResponseCost(queryResponse)
+	if retrievalCost := big.Add(retrievalReserved, cost); !pp.MaxCost.Nil() && retrievalCost.GreaterThan(pp.MaxCost) {
+		return fmt.Errorf("retrieval cost %s exceeds maximum of %s", types.FIL(retrievalCost).String(), types.FIL(pp.MaxCost).String())
+	}
+	if !pp.Budget.Nil() && big.Add(spent, cost).GreaterThan(pp.Budget) {
+		return fmt.Errorf("retrieval cost %s exceeds remaining budget of %s", types.FIL(cost).String(), types.FIL(big.Max(big.Sub(pp.Budget, spent), big.Zero())).String())
+	}
+	return nil
+}
+
+// spendTracker keeps a running total of the amount paid for retrievals within
+// the current budget period, along with the amount reserved for each storage
+// provider that may be paid by retrievals that are underway, so that
+// concurrent retrievals, and the storage providers of a single retrieval,
+// can't overspend between them. The total is kept in memory only, so a
+// restart begins a new budget period with nothing spent.
+type spendTracker struct {
+	lk          sync.Mutex
+	clock       clock.Clock
+	periodStart time.Time
+	spent       abi.TokenAmount
+	reserved    map[types.RetrievalID]map[peer.ID]abi.TokenAmount
+}
+
+func newSpendTracker(clock clock.Clock) *spendTracker {
+	return &spendTracker{
+		clock:       clock,
+		periodStart: clock.Now(),
+		spent:       big.Zero(),
+		reserved:    make(map[types.RetrievalID]map[peer.ID]abi.TokenAmount),
+	}
+}
+
+// rollover starts a new budget period if the current one has elapsed, it must
+// be called with the lock held
+func (st *spendTracker) rollover(period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	now := st.clock.Now()
+	if now.Sub(st.periodStart) >= period {
+		st.periodStart = now
+		st.spent = big.Zero()
+	}
+}
+
+// Spent returns the amount paid within the current budget period
+func (st *spendTracker) Spent(period time.Duration) abi.TokenAmount {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	st.rollover(period)
+	return st.spent
+}
+
+// Reserve sets aside the cost of paying a storage provider for a retrieval if
+// check accepts it. check is given the amount spent within the current budget
+// period plus everything else reserved, and the part of that reserved for the
+// other storage providers of the same retrieval. A later reservation for the
+// same storage provider and retrieval replaces the earlier one.
+func (st *spendTracker) Reserve(period time.Duration, retrievalId types.RetrievalID, storageProviderId peer.ID, cost abi.TokenAmount, check func(committed abi.TokenAmount, retrievalReserved abi.TokenAmount) error) error {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	st.rollover(period)
+	committed := st.spent
+	retrievalReserved := big.Zero()
+	for id, reservations := range st.reserved {
+		for sp, amount := range reservations {
+			if id == retrievalId && sp == storageProviderId {
+				continue
+			}
+			committed = big.Add(committed, amount)
+			if id == retrievalId {
+				retrievalReserved = big.Add(retrievalReserved, amount)
+			}
+		}
+	}
+	if err := check(committed, retrievalReserved); err != nil {
+		return err
+	}
+	reservations, ok := st.reserved[retrievalId]
+	if !ok {
+		reservations = make(map[peer.ID]abi.TokenAmount)
+		st.reserved[retrievalId] = reservations
+	}
+	reservations[storageProviderId] = cost
+	return nil
+}
+
+// Release frees what was reserved for a storage provider that won't be paid
+// for a retrieval, such as one dropped before a deal was proposed to it
+func (st *spendTracker) Release(retrievalId types.RetrievalID, storageProviderId peer.ID) {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	reservations, ok := st.reserved[retrievalId]
+	if !ok {
+		return
+	}
+	delete(reservations, storageProviderId)
+	if len(reservations) == 0 {
+		delete(st.reserved, retrievalId)
+	}
+}
+
+// Settle releases what was reserved for a retrieval once it has finished,
+// adding what was actually paid for it to the amount paid within the current
+// budget period
+func (st *spendTracker) Settle(period time.Duration, retrievalId types.RetrievalID, paid abi.TokenAmount) {
+	st.lk.Lock()
+	defer st.lk.Unlock()
+	delete(st.reserved, retrievalId)
+	if paid.Nil() || paid.Sign() == 0 {
+		return
+	}
+	st.rollover(period)
+	st.spent = big.Add(st.spent, paid)
+}
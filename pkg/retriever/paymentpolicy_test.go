@@ -0,0 +1,242 @@
+package retriever
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentPolicy(t *testing.T) {
+	queryResponse := func(pricePerByte int64, size uint64, unsealPrice int64) *retrievalmarket.QueryResponse {
+		return &retrievalmarket.QueryResponse{
+			Status:          retrievalmarket.QueryResponseAvailable,
+			MinPricePerByte: big.NewInt(pricePerByte),
+			Size:            size,
+			UnsealPrice:     big.NewInt(unsealPrice),
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		paidRetrievals bool
+		paymentPolicy  PaymentPolicy
+		paidPolicy     types.PaidRetrievalPolicy
+		spent          abi.TokenAmount
+		reserved       abi.TokenAmount
+		// retrievalReserved is reserved for another storage provider of the
+		// same retrieval
+		retrievalReserved abi.TokenAmount
+		queryResponse     *retrievalmarket.QueryResponse
+		expectedReason    string
+	}{
+		{
+			name:          "free retrievals are always acceptable",
+			paymentPolicy: PaymentPolicy{Budget: big.Zero()},
+			queryResponse: queryResponse(0, 100, 0),
+		},
+		{
+			name:           "paid retrievals not allowed",
+			queryResponse:  queryResponse(1, 100, 0),
+			expectedReason: "paid retrieval not allowed",
+		},
+		{
+			name:           "paid retrievals allowed without limits",
+			paidRetrievals: true,
+			queryResponse:  queryResponse(1_000_000, 100, 1_000_000),
+		},
+		{
+			name:           "paid retrievals denied by request",
+			paidRetrievals: true,
+			paidPolicy:     types.DenyPaidRetrievals,
+			queryResponse:  queryResponse(1, 100, 0),
+			expectedReason: "paid retrieval not allowed",
+		},
+		{
+			name:           "price per byte above maximum",
+			paidRetrievals: true,
+			paymentPolicy:  PaymentPolicy{MaxPricePerByte: big.NewInt(10)},
+			queryResponse:  queryResponse(11, 100, 0),
+			expectedReason: "price per byte 0.000000000000000011 FIL exceeds maximum of 0.00000000000000001 FIL",
+		},
+		{
+			name:           "unseal price above maximum",
+			paidRetrievals: true,
+			paymentPolicy:  PaymentPolicy{MaxPricePerByte: big.NewInt(10), MaxUnsealPrice: big.NewInt(1000)},
+			queryResponse:  queryResponse(10, 100, 1001),
+			expectedReason: "unseal price 0.000000000000001001 FIL exceeds maximum of 0.000000000000001 FIL",
+		},
+		{
+			name:           "total cost above maximum",
+			paidRetrievals: true,
+			paymentPolicy:  PaymentPolicy{MaxCost: big.NewInt(1000)},
+			queryResponse:  queryResponse(5, 100, 501),
+			expectedReason: "retrieval cost 0.000000000000001001 FIL exceeds maximum of 0.000000000000001 FIL",
+		},
+		{
+			name:              "total cost of the retrieval across storage providers above maximum",
+			paidRetrievals:    true,
+			paymentPolicy:     PaymentPolicy{MaxCost: big.NewInt(1000)},
+			retrievalReserved: big.NewInt(600),
+			queryResponse:     queryResponse(4, 100, 1),
+			expectedReason:    "retrieval cost 0.000000000000001001 FIL exceeds maximum of 0.000000000000001 FIL",
+		},
+		{
+			name:              "cost above budget remaining after reservations for the same retrieval",
+			paidRetrievals:    true,
+			paymentPolicy:     PaymentPolicy{Budget: big.NewInt(1000)},
+			retrievalReserved: big.NewInt(600),
+			queryResponse:     queryResponse(4, 100, 1),
+			expectedReason:    "retrieval cost 0.000000000000000401 FIL exceeds remaining budget of 0.0000000000000004 FIL",
+		},
+		{
+			name:           "within limits",
+			paidRetrievals: true,
+			paymentPolicy:  PaymentPolicy{MaxPricePerByte: big.NewInt(10), MaxUnsealPrice: big.NewInt(1000), MaxCost: big.NewInt(2000), Budget: big.NewInt(2000)},
+			queryResponse:  queryResponse(10, 100, 1000),
+		},
+		{
+			name:           "cost above remaining budget",
+			paidRetrievals: true,
+			paymentPolicy:  PaymentPolicy{Budget: big.NewInt(2000)},
+			spent:          big.NewInt(1500),
+			queryResponse:  queryResponse(5, 100, 1),
+			expectedReason: "retrieval cost 0.000000000000000501 FIL exceeds remaining budget of 0.0000000000000005 FIL",
+		},
+		{
+			name:           "cost above budget remaining after reservations",
+			paidRetrievals: true,
+			paymentPolicy:  PaymentPolicy{Budget: big.NewInt(2000)},
+			spent:          big.NewInt(1000),
+			reserved:       big.NewInt(500),
+			queryResponse:  queryResponse(5, 100, 1),
+			expectedReason: "retrieval cost 0.000000000000000501 FIL exceeds remaining budget of 0.0000000000000005 FIL",
+		},
+		{
+			name:           "paid retrievals allowed by request are subject to limits",
+			paidPolicy:     types.AllowPaidRetrievals,
+			paymentPolicy:  PaymentPolicy{MaxCost: big.NewInt(100)},
+			queryResponse:  queryResponse(5, 100, 0),
+			expectedReason: "retrieval cost 0.0000000000000005 FIL exceeds maximum of 0.0000000000000001 FIL",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ret, err := NewRetriever(context.Background(), RetrieverConfig{
+				PaidRetrievals: tc.paidRetrievals,
+				PaymentPolicy:  tc.paymentPolicy,
+			}, &testutil.MockClient{}, &testutil.MockCandidateFinder{}, nil)
+			require.NoError(t, err)
+			if !tc.spent.Nil() {
+				ret.spending.Settle(0, types.RetrievalID(uuid.New()), tc.spent)
+			}
+			retrievalID := types.RetrievalID(uuid.New())
+			accept := func(abi.TokenAmount, abi.TokenAmount) error { return nil }
+			if !tc.reserved.Nil() {
+				require.NoError(t, ret.spending.Reserve(0, types.RetrievalID(uuid.New()), peer.ID("B"), tc.reserved, accept))
+			}
+			if !tc.retrievalReserved.Nil() {
+				require.NoError(t, ret.spending.Reserve(0, retrievalID, peer.ID("B"), tc.retrievalReserved, accept))
+			}
+
+			err = ret.isAcceptableQueryResponse(peer.ID("A"), types.RetrievalRequest{
+				RetrievalID:    retrievalID,
+				PaidRetrievals: tc.paidPolicy,
+			}, tc.queryResponse)
+			if tc.expectedReason == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedReason)
+			}
+		})
+	}
+}
+
+func TestSpendTracker(t *testing.T) {
+	clock := clock.NewMock()
+	st := newSpendTracker(clock)
+	day := 24 * time.Hour
+	settled := func(paid abi.TokenAmount) {
+		st.Settle(day, types.RetrievalID(uuid.New()), paid)
+	}
+
+	require.Equal(t, big.Zero(), st.Spent(day))
+	settled(big.NewInt(100))
+	settled(big.Zero())
+	settled(big.Int{})
+	require.Equal(t, big.NewInt(100), st.Spent(day))
+
+	clock.Add(day - time.Second)
+	settled(big.NewInt(50))
+	require.Equal(t, big.NewInt(150), st.Spent(day))
+	// a global budget never resets
+	require.Equal(t, big.NewInt(150), st.Spent(0))
+
+	// a new period starts once the last has elapsed
+	clock.Add(time.Second)
+	require.Equal(t, big.Zero(), st.Spent(day))
+	settled(big.NewInt(25))
+	require.Equal(t, big.NewInt(25), st.Spent(day))
+}
+
+func TestSpendTrackerReservations(t *testing.T) {
+	st := newSpendTracker(clock.NewMock())
+	first := types.RetrievalID(uuid.New())
+	second := types.RetrievalID(uuid.New())
+	spA, spB := peer.ID("A"), peer.ID("B")
+	var committed, retrievalReserved abi.TokenAmount
+	check := func(amount abi.TokenAmount, forRetrieval abi.TokenAmount) error {
+		committed = amount
+		retrievalReserved = forRetrieval
+		return nil
+	}
+
+	st.Settle(0, types.RetrievalID(uuid.New()), big.NewInt(100))
+	require.NoError(t, st.Reserve(0, first, spA, big.NewInt(50), check))
+	require.Equal(t, big.NewInt(100), committed)
+	require.Equal(t, big.Zero(), retrievalReserved)
+	// a storage provider's later reservation replaces its earlier one
+	require.NoError(t, st.Reserve(0, first, spA, big.NewInt(70), check))
+	require.Equal(t, big.NewInt(100), committed)
+	// but each storage provider of a retrieval may be paid so they add up
+	require.NoError(t, st.Reserve(0, first, spB, big.NewInt(20), check))
+	require.Equal(t, big.NewInt(170), committed)
+	require.Equal(t, big.NewInt(70), retrievalReserved)
+	require.NoError(t, st.Reserve(0, second, spA, big.NewInt(10), check))
+	require.Equal(t, big.NewInt(190), committed)
+	require.Equal(t, big.Zero(), retrievalReserved)
+
+	// a reservation isn't made when the check fails
+	require.EqualError(t, st.Reserve(0, second, spB, big.NewInt(1000), func(abi.TokenAmount, abi.TokenAmount) error { return errors.New("over budget") }), "over budget")
+
+	// releasing a storage provider frees only its reservation
+	st.Release(first, spB)
+	require.NoError(t, st.Reserve(0, first, spB, big.NewInt(5), check))
+	require.Equal(t, big.NewInt(180), committed)
+	require.Equal(t, big.NewInt(70), retrievalReserved)
+
+	// settling swaps the reservations for what was paid
+	st.Settle(0, first, big.NewInt(60))
+	require.Equal(t, big.NewInt(160), st.Spent(0))
+	require.NoError(t, st.Reserve(0, types.RetrievalID(uuid.New()), spA, big.NewInt(1), check))
+	require.Equal(t, big.NewInt(170), committed)
+
+	// and a retrieval that paid nothing releases its reservations
+	st.Settle(0, second, big.Zero())
+	require.NoError(t, st.Reserve(0, first, spA, big.NewInt(1), check))
+	require.Equal(t, big.NewInt(161), committed)
+}
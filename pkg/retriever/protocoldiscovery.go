@@ -0,0 +1,303 @@
+package retriever
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	datatransfer "github.com/filecoin-project/go-data-transfer/v2"
+	"github.com/filecoin-project/lassie/pkg/internal/lp2ptransports"
+	"github.com/filecoin-project/lassie/pkg/internal/lrucache"
+	"github.com/filecoin-project/lassie/pkg/types"
+	lru "github.com/hashicorp/golang-lru"
+	gsnet "github.com/ipfs/go-graphsync/network"
+	bsnet "github.com/ipfs/go-libipfs/bitswap/network"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// DefaultProtocolDiscoveryTTL is how long the protocols discovered for a
+	// peer are used before they are refreshed, when ProtocolDiscoveryConfig
+	// doesn't set a TTL
+	DefaultProtocolDiscoveryTTL = 10 * time.Minute
+	// DefaultUnreachableBackoff is how long a peer that can't be reached is
+	// skipped for after its first failure, when ProtocolDiscoveryConfig doesn't
+	// set a Backoff
+	DefaultUnreachableBackoff = 10 * time.Second
+	// DefaultMaxUnreachableBackoff is the longest a peer that can't be reached
+	// is skipped for, when ProtocolDiscoveryConfig doesn't set a MaxBackoff
+	DefaultMaxUnreachableBackoff = 5 * time.Minute
+	// DefaultProtocolDiscoverySize is the number of peers whose protocols are
+	// cached when ProtocolDiscoveryConfig doesn't set a Size
+	DefaultProtocolDiscoverySize = 1024
+
+	// discoveryTimeout bounds a discovery, which is made apart from the
+	// contexts of those waiting on it
+	discoveryTimeout = time.Minute
+)
+
+// ProtocolDiscoveryConfig configures a ProtocolDiscovery
+type ProtocolDiscoveryConfig struct {
+	// TTL is how long the protocols discovered for a peer are used before they
+	// are discovered again; once it has passed they are still used while they
+	// are refreshed in the background
+	TTL time.Duration
+	// Backoff is how long a peer that can't be reached is skipped for after it
+	// first fails, doubling with each failure after that up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Size is the most peers whose protocols are cached at once, the least
+	// recently used are evicted first
+	Size int
+}
+
+// DiscoveredCandidate is an address of a peer along with the retrieval
+// protocols it supports there
+type DiscoveredCandidate struct {
+	AddrInfo  peer.AddrInfo
+	Protocols []metadata.Protocol
+}
+
+// peerProtocols is what has been discovered about a peer
+type peerProtocols struct {
+	discovered   bool
+	candidates   []DiscoveredCandidate
+	discoveredAt time.Time
+	refreshing   bool
+	failures     int
+	backoffUntil time.Time
+}
+
+// firstDiscovery is the discovery of a peer that nothing is known about yet,
+// which may still be in flight
+type firstDiscovery struct {
+	candidates []DiscoveredCandidate
+	err        error
+	done       chan struct{}
+}
+
+// ProtocolDiscovery discovers the retrieval protocols supported by peers,
+// through the Boost libp2p transports protocol where they support it, or else
+// by probing for the libp2p protocols of each retrieval protocol.
+//
+// What is discovered for a peer is cached for the TTL, after which it is
+// refreshed in the background while still being used; a refresh that fails
+// leaves what was discovered before in use. A peer that can't be reached is
+// skipped, or not refreshed, for a backoff that grows with each failure,
+// rather than being dialed again for every retrieval.
+//
+// Concurrent discoveries of a peer share a single discovery, which runs apart
+// from the contexts of those waiting on it. Discoveries, including those in
+// the background, end when the context the ProtocolDiscovery is created with
+// is done.
+type ProtocolDiscovery struct {
+	ctx      context.Context
+	h        host.Host
+	cfg      ProtocolDiscoveryConfig
+	clock    clock.Clock
+	lk       sync.Mutex
+	peers    *lru.Cache
+	inflight map[peer.ID]*firstDiscovery
+}
+
+func NewProtocolDiscovery(ctx context.Context, h host.Host, cfg ProtocolDiscoveryConfig) *ProtocolDiscovery {
+	return NewProtocolDiscoveryWithClock(ctx, h, cfg, clock.New())
+}
+
+func NewProtocolDiscoveryWithClock(ctx context.Context, h host.Host, cfg ProtocolDiscoveryConfig, clock clock.Clock) *ProtocolDiscovery {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultProtocolDiscoveryTTL
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultUnreachableBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = DefaultMaxUnreachableBackoff
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultProtocolDiscoverySize
+	}
+	return &ProtocolDiscovery{
+		ctx:      ctx,
+		h:        h,
+		cfg:      cfg,
+		clock:    clock,
+		peers:    lrucache.New(cfg.Size),
+		inflight: make(map[peer.ID]*firstDiscovery),
+	}
+}
+
+// Discover returns the addresses of a peer and the retrieval protocols it
+// supports at each, which may have been cached. Nothing is returned, without
+// an error, for a peer that is backing off after failing to be reached; the
+// error is only returned to those waiting on the discovery that failed.
+func (pd *ProtocolDiscovery) Discover(ctx context.Context, provider peer.AddrInfo) ([]DiscoveredCandidate, error) {
+	pd.lk.Lock()
+	if cached, ok := pd.peers.Get(provider.ID); ok {
+		pp := cached.(*peerProtocols)
+		now := pd.clock.Now()
+		if pp.discovered {
+			stale := !now.Before(pp.discoveredAt.Add(pd.cfg.TTL))
+			if stale && !pp.refreshing && !now.Before(pp.backoffUntil) {
+				pp.refreshing = true
+				go pd.refresh(provider)
+			}
+			candidates := pp.candidates
+			pd.lk.Unlock()
+			return candidates, nil
+		}
+		if now.Before(pp.backoffUntil) {
+			pd.lk.Unlock()
+			log.Debugw("skipping unreachable peer while it backs off", "peer", provider.ID, "until", pp.backoffUntil)
+			return nil, nil
+		}
+	}
+	fd, ok := pd.inflight[provider.ID]
+	if !ok {
+		fd = &firstDiscovery{done: make(chan struct{})}
+		pd.inflight[provider.ID] = fd
+		go pd.discoverFirst(provider, fd)
+	}
+	pd.lk.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-fd.done:
+		return fd.candidates, fd.err
+	}
+}
+
+func (pd *ProtocolDiscovery) discoverFirst(provider peer.AddrInfo, fd *firstDiscovery) {
+	ctx, cancel := context.WithTimeout(pd.ctx, discoveryTimeout)
+	defer cancel()
+	fd.candidates, fd.err = pd.discover(ctx, provider)
+	if pd.ctx.Err() != nil {
+		// shutting down isn't a failure of the peer
+		fd.err = pd.ctx.Err()
+	} else {
+		pd.record(provider.ID, fd.candidates, fd.err)
+	}
+	pd.lk.Lock()
+	delete(pd.inflight, provider.ID)
+	pd.lk.Unlock()
+	close(fd.done)
+}
+
+func (pd *ProtocolDiscovery) refresh(provider peer.AddrInfo) {
+	ctx, cancel := context.WithTimeout(pd.ctx, discoveryTimeout)
+	defer cancel()
+	candidates, err := pd.discover(ctx, provider)
+	if pd.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.Debugw("failed to refresh peer protocols", "peer", provider.ID, "err", err)
+	}
+	pd.record(provider.ID, candidates, err)
+}
+
+// record caches a discovery, or backs off from the peer if it failed. A peer
+// that fails to be refreshed keeps what was discovered before.
+func (pd *ProtocolDiscovery) record(id peer.ID, candidates []DiscoveredCandidate, err error) {
+	pd.lk.Lock()
+	defer pd.lk.Unlock()
+	now := pd.clock.Now()
+	if err == nil {
+		pd.peers.Add(id, &peerProtocols{discovered: true, candidates: candidates, discoveredAt: now})
+		return
+	}
+	pp := &peerProtocols{}
+	if cached, ok := pd.peers.Get(id); ok {
+		pp = cached.(*peerProtocols)
+	}
+	pp.refreshing = false
+	pp.failures++
+	backoff := pd.cfg.Backoff
+	for i := 1; i < pp.failures && backoff < pd.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > pd.cfg.MaxBackoff {
+		backoff = pd.cfg.MaxBackoff
+	}
+	pp.backoffUntil = now.Add(backoff)
+	pd.peers.Add(id, pp)
+}
+
+func (pd *ProtocolDiscovery) discover(ctx context.Context, provider peer.AddrInfo) ([]DiscoveredCandidate, error) {
+	if err := pd.h.Connect(ctx, provider); err != nil {
+		return nil, err
+	}
+	// check for support for Boost libp2p transports protocol
+	transportsClient := lp2ptransports.NewTransportsClient(pd.h)
+	qr, err := transportsClient.SendQuery(ctx, provider.ID)
+	if err == nil {
+		log.Debugw("retrieving metadata from transports protocol", "peer", provider.ID)
+		// if present, construct metadata from Boost libp2p transports response
+		return candidatesFromTransportsProtocol(qr, provider), nil
+	}
+	log.Debugw("retrieving metadata from libp2p protocol list", "peer", provider.ID)
+	// if not present, just make guesses based on list of supported libp2p
+	// protocols catalogued via identify protocol
+	return []DiscoveredCandidate{pd.candidateFromProtocolProbing(ctx, provider)}, nil
+}
+
+func (pd *ProtocolDiscovery) candidateFromProtocolProbing(ctx context.Context, provider peer.AddrInfo) DiscoveredCandidate {
+	var protocols []metadata.Protocol
+	s, err := pd.h.NewStream(ctx, provider.ID,
+		bsnet.ProtocolBitswap,
+		bsnet.ProtocolBitswapOneOne,
+		bsnet.ProtocolBitswapOneZero,
+		bsnet.ProtocolBitswapNoVers,
+	)
+	if err == nil {
+		s.Close()
+		protocols = append(protocols, &metadata.Bitswap{})
+	}
+	// must support both graphsync & data transfer to do graphsync filecoin v1 retrieval
+	s, err = pd.h.NewStream(ctx, provider.ID,
+		gsnet.ProtocolGraphsync_2_0_0)
+	if err == nil {
+		s.Close()
+		s, err = pd.h.NewStream(ctx, provider.ID, datatransfer.ProtocolDataTransfer1_2)
+		if err == nil {
+			s.Close()
+			protocols = append(protocols, &metadata.GraphsyncFilecoinV1{})
+
+		}
+	}
+	return DiscoveredCandidate{AddrInfo: provider, Protocols: protocols}
+}
+
+func candidatesFromTransportsProtocol(qr *lp2ptransports.QueryResponse, provider peer.AddrInfo) []DiscoveredCandidate {
+	var candidates []DiscoveredCandidate
+	for _, protocol := range qr.Protocols {
+		// try to parse addr infos directly
+		addrs, err := peer.AddrInfosFromP2pAddrs(protocol.Addresses...)
+		// if no peer id is present, use provider's id
+		if err != nil {
+			addrs = []peer.AddrInfo{{
+				ID:    provider.ID,
+				Addrs: protocol.Addresses,
+			}}
+		}
+		var retrievalProtocol metadata.Protocol
+		switch protocol.Name {
+		case "libp2p":
+			retrievalProtocol = &metadata.GraphsyncFilecoinV1{}
+		case "bitswap":
+			retrievalProtocol = &metadata.Bitswap{}
+		case "http":
+			retrievalProtocol = &types.IpfsGatewayHttp{}
+		default:
+			continue
+		}
+		for _, addr := range addrs {
+			candidates = append(candidates, DiscoveredCandidate{AddrInfo: addr, Protocols: []metadata.Protocol{retrievalProtocol}})
+		}
+	}
+	return candidates
+}
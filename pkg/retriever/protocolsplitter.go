@@ -17,8 +17,22 @@ func NewProtocolSplitter(protocols []multicodec.Code) types.CandidateSplitter[mu
 	return &ProtocolSplitter{protocols: protocols}
 }
 
+// SplitRetrievalRequest creates a splitter for the request, restricted to the
+// request's Protocols where it has any
 func (ps *ProtocolSplitter) SplitRetrievalRequest(ctx context.Context, request types.RetrievalRequest, events func(types.RetrievalEvent)) types.RetrievalSplitter[multicodec.Code] {
-	return &retrievalProtocolSplitter{ps}
+	if len(request.Protocols) == 0 {
+		return &retrievalProtocolSplitter{ps}
+	}
+	protocols := make([]multicodec.Code, 0, len(ps.protocols))
+	for _, protocol := range ps.protocols {
+		for _, requested := range request.Protocols {
+			if protocol == requested {
+				protocols = append(protocols, protocol)
+				break
+			}
+		}
+	}
+	return &retrievalProtocolSplitter{&ProtocolSplitter{protocols: protocols}}
 }
 
 type retrievalProtocolSplitter struct {
@@ -33,6 +47,11 @@ func (rps *retrievalProtocolSplitter) SplitCandidates(candidates []types.Retriev
 		for _, candidateProtocol := range candidateProtocolsArr {
 			candidateProtocolsSet[candidateProtocol] = struct{}{}
 		}
+		// the pieces of graphsync candidates with HTTP endpoints can be
+		// retrieved by the HTTP retriever too
+		if isHttpPieceCandidate(candidate) {
+			candidateProtocolsSet[types.TransportIpfsGatewayHttp] = struct{}{}
+		}
 		for _, protocol := range rps.protocols {
 			if _, ok := candidateProtocolsSet[protocol]; ok {
 				protocolCandidates[protocol] = append(protocolCandidates[protocol], candidate)
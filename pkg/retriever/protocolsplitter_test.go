@@ -0,0 +1,61 @@
+package retriever_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolSplitter(t *testing.T) {
+	cid1 := cid.MustParse("bafkqaalb")
+	graphsync := types.NewRetrievalCandidate(peer.ID("graphsync"), cid1, &metadata.GraphsyncFilecoinV1{})
+	bitswap := types.NewRetrievalCandidate(peer.ID("bitswap"), cid1, metadata.Bitswap{})
+	both := types.NewRetrievalCandidate(peer.ID("both"), cid1, &metadata.GraphsyncFilecoinV1{}, metadata.Bitswap{})
+	httpPiece := types.NewRetrievalCandidate(peer.ID("httpPiece"), cid1, &metadata.GraphsyncFilecoinV1{PieceCID: cid1})
+	httpPiece.MinerPeer.Addrs = []multiaddr.Multiaddr{multiaddr.StringCast("/dns/example.com/tcp/443/https")}
+	protocols := []multicodec.Code{multicodec.TransportGraphsyncFilecoinv1, multicodec.TransportBitswap, types.TransportIpfsGatewayHttp}
+
+	testCases := []struct {
+		name     string
+		request  types.RetrievalRequest
+		expected map[multicodec.Code][]types.RetrievalCandidate
+	}{
+		{
+			name: "all protocols",
+			expected: map[multicodec.Code][]types.RetrievalCandidate{
+				multicodec.TransportGraphsyncFilecoinv1: {graphsync, both, httpPiece},
+				multicodec.TransportBitswap:             {bitswap, both},
+				types.TransportIpfsGatewayHttp:          {httpPiece},
+			},
+		},
+		{
+			name:    "requested protocols",
+			request: types.RetrievalRequest{Protocols: []multicodec.Code{multicodec.TransportBitswap}},
+			expected: map[multicodec.Code][]types.RetrievalCandidate{
+				multicodec.TransportBitswap: {bitswap, both},
+			},
+		},
+		{
+			name:     "requested protocol not configured",
+			request:  types.RetrievalRequest{Protocols: []multicodec.Code{multicodec.Http}},
+			expected: map[multicodec.Code][]types.RetrievalCandidate{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			splitter := retriever.NewProtocolSplitter(protocols).SplitRetrievalRequest(context.Background(), testCase.request, func(types.RetrievalEvent) {})
+			split, err := splitter.SplitCandidates([]types.RetrievalCandidate{graphsync, bitswap, both, httpPiece})
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, split)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package retriever
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ProviderConfig is the subset of RetrieverConfig that relates to individual
+// storage providers. It can be swapped on a running Retriever with
+// UpdateProviderConfig.
+type ProviderConfig struct {
+	MinerBlacklist map[peer.ID]bool
+	MinerWhitelist map[peer.ID]bool
+	MinerConfigs   map[peer.ID]MinerConfig
+}
+
+// ProviderConfig returns the provider specific portion of the RetrieverConfig
+func (cfg *RetrieverConfig) ProviderConfig() ProviderConfig {
+	return ProviderConfig{
+		MinerBlacklist: cfg.MinerBlacklist,
+		MinerWhitelist: cfg.MinerWhitelist,
+		MinerConfigs:   cfg.MinerConfigs,
+	}
+}
+
+func (cfg *RetrieverConfig) setProviderConfig(providerConfig ProviderConfig) {
+	cfg.MinerBlacklist = providerConfig.MinerBlacklist
+	cfg.MinerWhitelist = providerConfig.MinerWhitelist
+	cfg.MinerConfigs = providerConfig.MinerConfigs
+}
+
+// ProviderConfigDiff describes the changes between two ProviderConfigs
+type ProviderConfigDiff struct {
+	BlacklistAdded      []peer.ID
+	BlacklistRemoved    []peer.ID
+	WhitelistAdded      []peer.ID
+	WhitelistRemoved    []peer.ID
+	MinerConfigsChanged []peer.ID
+}
+
+// IsEmpty returns true if there are no differences
+func (diff ProviderConfigDiff) IsEmpty() bool {
+	return len(diff.BlacklistAdded) == 0 &&
+		len(diff.BlacklistRemoved) == 0 &&
+		len(diff.WhitelistAdded) == 0 &&
+		len(diff.WhitelistRemoved) == 0 &&
+		len(diff.MinerConfigsChanged) == 0
+}
+
+// Diff compares this ProviderConfig with a newer version
+func (cfg ProviderConfig) Diff(newer ProviderConfig) ProviderConfigDiff {
+	var diff ProviderConfigDiff
+	diff.BlacklistAdded, diff.BlacklistRemoved = diffPeerSet(cfg.MinerBlacklist, newer.MinerBlacklist)
+	diff.WhitelistAdded, diff.WhitelistRemoved = diffPeerSet(cfg.MinerWhitelist, newer.MinerWhitelist)
+	for id, minerConfig := range newer.MinerConfigs {
+		if old, has := cfg.MinerConfigs[id]; !has || old != minerConfig {
+			diff.MinerConfigsChanged = append(diff.MinerConfigsChanged, id)
+		}
+	}
+	for id := range cfg.MinerConfigs {
+		if _, has := newer.MinerConfigs[id]; !has {
+			diff.MinerConfigsChanged = append(diff.MinerConfigsChanged, id)
+		}
+	}
+	sortPeers(diff.MinerConfigsChanged)
+	return diff
+}
+
+func diffPeerSet(older, newer map[peer.ID]bool) (added []peer.ID, removed []peer.ID) {
+	for id, set := range newer {
+		if set && !older[id] {
+			added = append(added, id)
+		}
+	}
+	for id, set := range older {
+		if set && !newer[id] {
+			removed = append(removed, id)
+		}
+	}
+	sortPeers(added)
+	sortPeers(removed)
+	return added, removed
+}
+
+func sortPeers(ids []peer.ID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+type providerConfigJson struct {
+	Denylist  []string                           `json:"denylist"`
+	Allowlist []string                           `json:"allowlist"`
+	Providers map[string]providerMinerConfigJson `json:"providers"`
+}
+
+type providerMinerConfigJson struct {
+	RetrievalTimeout        string `json:"retrievalTimeout"`
+	MaxConcurrentRetrievals uint   `json:"maxConcurrentRetrievals"`
+}
+
+// ParseProviderConfig reads a ProviderConfig from its JSON form:
+//
+//	{
+//	  "denylist": ["12D3KooW..."],
+//	  "allowlist": ["12D3KooW..."],
+//	  "providers": {
+//	    "12D3KooW...": { "retrievalTimeout": "30s", "maxConcurrentRetrievals": 2 }
+//	  }
+//	}
+//
+// All fields are optional.
+func ParseProviderConfig(r io.Reader) (ProviderConfig, error) {
+	var cfgJson providerConfigJson
+	if err := json.NewDecoder(r).Decode(&cfgJson); err != nil {
+		return ProviderConfig{}, fmt.Errorf("invalid provider config: %w", err)
+	}
+
+	var cfg ProviderConfig
+	var err error
+	if cfg.MinerBlacklist, err = parsePeerSet(cfgJson.Denylist); err != nil {
+		return ProviderConfig{}, fmt.Errorf("invalid provider config denylist: %w", err)
+	}
+	if cfg.MinerWhitelist, err = parsePeerSet(cfgJson.Allowlist); err != nil {
+		return ProviderConfig{}, fmt.Errorf("invalid provider config allowlist: %w", err)
+	}
+	if len(cfgJson.Providers) > 0 {
+		cfg.MinerConfigs = make(map[peer.ID]MinerConfig, len(cfgJson.Providers))
+		for idStr, minerConfigJson := range cfgJson.Providers {
+			id, err := peer.Decode(idStr)
+			if err != nil {
+				return ProviderConfig{}, fmt.Errorf("invalid provider config peer ID %s: %w", idStr, err)
+			}
+			var minerConfig MinerConfig
+			if minerConfigJson.RetrievalTimeout != "" {
+				if minerConfig.RetrievalTimeout, err = time.ParseDuration(minerConfigJson.RetrievalTimeout); err != nil {
+					return ProviderConfig{}, fmt.Errorf("invalid provider config timeout for %s: %w", idStr, err)
+				}
+			}
+			minerConfig.MaxConcurrentRetrievals = minerConfigJson.MaxConcurrentRetrievals
+			cfg.MinerConfigs[id] = minerConfig
+		}
+	}
+	return cfg, nil
+}
+
+func parsePeerSet(idStrs []string) (map[peer.ID]bool, error) {
+	if len(idStrs) == 0 {
+		return nil, nil
+	}
+	set := make(map[peer.ID]bool, len(idStrs))
+	for _, idStr := range idStrs {
+		id, err := peer.Decode(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", idStr, err)
+		}
+		set[id] = true
+	}
+	return set, nil
+}
@@ -0,0 +1,82 @@
+package retriever
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProviderConfig(t *testing.T) {
+	peerA, err := peer.Decode("12D3KooWBSTEYMLSu5FnQjshEVah9LFGEZoQt26eacCEVYfedWA4")
+	require.NoError(t, err)
+	peerB, err := peer.Decode("QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC")
+	require.NoError(t, err)
+
+	cfg, err := ParseProviderConfig(strings.NewReader(`{
+		"denylist": ["12D3KooWBSTEYMLSu5FnQjshEVah9LFGEZoQt26eacCEVYfedWA4"],
+		"providers": {
+			"QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC": { "retrievalTimeout": "30s", "maxConcurrentRetrievals": 2 }
+		}
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, map[peer.ID]bool{peerA: true}, cfg.MinerBlacklist)
+	require.Nil(t, cfg.MinerWhitelist)
+	require.Equal(t, map[peer.ID]MinerConfig{peerB: {RetrievalTimeout: 30 * time.Second, MaxConcurrentRetrievals: 2}}, cfg.MinerConfigs)
+
+	_, err = ParseProviderConfig(strings.NewReader(`{"allowlist": ["nope"]}`))
+	require.ErrorContains(t, err, "allowlist")
+	_, err = ParseProviderConfig(strings.NewReader(`{"providers": {"QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC": { "retrievalTimeout": "soon" }}}`))
+	require.ErrorContains(t, err, "timeout")
+}
+
+func TestProviderConfigDiff(t *testing.T) {
+	peers := testutil.GeneratePeers(4)
+	older := ProviderConfig{
+		MinerBlacklist: map[peer.ID]bool{peers[0]: true, peers[1]: true},
+		MinerConfigs:   map[peer.ID]MinerConfig{peers[2]: {RetrievalTimeout: time.Second}},
+	}
+	newer := ProviderConfig{
+		MinerBlacklist: map[peer.ID]bool{peers[1]: true},
+		MinerWhitelist: map[peer.ID]bool{peers[3]: true},
+		MinerConfigs:   map[peer.ID]MinerConfig{peers[2]: {RetrievalTimeout: 2 * time.Second}},
+	}
+	diff := older.Diff(newer)
+	require.Equal(t, ProviderConfigDiff{
+		BlacklistRemoved:    []peer.ID{peers[0]},
+		WhitelistAdded:      []peer.ID{peers[3]},
+		MinerConfigsChanged: []peer.ID{peers[2]},
+	}, diff)
+	require.False(t, diff.IsEmpty())
+	require.True(t, newer.Diff(newer).IsEmpty())
+}
+
+func TestUpdateProviderConfig(t *testing.T) {
+	peers := testutil.GeneratePeers(2)
+	ret, err := NewRetriever(context.Background(), RetrieverConfig{
+		DefaultMinerConfig: MinerConfig{RetrievalTimeout: time.Second},
+		MinerBlacklist:     map[peer.ID]bool{peers[0]: true},
+		PaidRetrievals:     true,
+	}, &testutil.MockClient{}, &testutil.MockCandidateFinder{}, nil)
+	require.NoError(t, err)
+
+	require.False(t, ret.isAcceptableStorageProvider(peers[0]))
+	require.True(t, ret.isAcceptableStorageProvider(peers[1]))
+	require.Equal(t, time.Second, ret.getStorageProviderTimeout(peers[1]))
+
+	ret.UpdateProviderConfig(ProviderConfig{
+		MinerBlacklist: map[peer.ID]bool{peers[1]: true},
+		MinerConfigs:   map[peer.ID]MinerConfig{peers[0]: {RetrievalTimeout: time.Minute}},
+	})
+
+	require.True(t, ret.isAcceptableStorageProvider(peers[0]))
+	require.False(t, ret.isAcceptableStorageProvider(peers[1]))
+	require.Equal(t, time.Minute, ret.getStorageProviderTimeout(peers[0]))
+	require.Equal(t, time.Second, ret.getStorageProviderTimeout(peers[1]))
+	// non-provider config is retained
+	require.True(t, ret.config.Load().PaidRetrievals)
+}
@@ -0,0 +1,529 @@
+package retriever
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/metrics"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+)
+
+const (
+	defaultReputationHalfLife = time.Hour * 24
+	// defaultMaxReputations bounds the number of storage providers whose
+	// history is kept
+	defaultMaxReputations = 16384
+	// reputationExpiryHalfLives is the number of half-lives after which an
+	// unsuspended storage provider's history has decayed to almost nothing and
+	// is forgotten
+	reputationExpiryHalfLives = 10
+	// reputationFlushInterval is how often updated reputations are written to
+	// the datastore
+	reputationFlushInterval = time.Second * 10
+
+	// unreliableSuccessRate is the success rate below which a storage provider
+	// is considered unreliable once it has at least
+	// minReputationObservations (decayed) observations
+	unreliableSuccessRate     = 0.5
+	minReputationObservations = 5
+
+	// reputationTTFBScale is the TTFB at which a storage provider's score is
+	// halved relative to one that responds instantly
+	reputationTTFBScale = time.Second * 10
+
+	otherFailureClass = "other"
+)
+
+var reputationKeyPrefix = datastore.NewKey("/reputation")
+
+// ReputationConfig configures how the history of storage provider retrievals
+// is weighted. Zero values are replaced with defaults.
+type ReputationConfig struct {
+	// HalfLife is the age at which an observation counts for half as much as a
+	// new one, defaults to 24 hours
+	HalfLife time.Duration
+	// MaxStorageProviders is the maximum number of storage providers whose
+	// history is kept, the least recently updated are forgotten first,
+	// defaults to 16384
+	MaxStorageProviders int
+}
+
+// ProtocolReputation is the retrieval history of a storage provider over a
+// single protocol. Counts and averages are decayed according to the
+// ReputationConfig HalfLife so are not whole numbers.
+type ProtocolReputation struct {
+	Successes      float64
+	Failures       float64
+	FailureClasses map[string]float64
+	// TTFB is the decayed average time to first byte
+	TTFB       time.Duration
+	ttfbWeight float64
+	// Throughput is the decayed average of successful retrievals, in bytes per
+	// second
+	Throughput  float64
+	LastUpdated time.Time
+}
+
+// SuccessRate returns the proportion of successful retrievals, or zero if
+// there are none recorded
+func (pr ProtocolReputation) SuccessRate() float64 {
+	if pr.Successes+pr.Failures == 0 {
+		return 0
+	}
+	return pr.Successes / (pr.Successes + pr.Failures)
+}
+
+// Score returns a value between 0 and 1 that ranks this reputation against
+// others, higher is better. A storage provider with no history scores 0.5.
+func (pr ProtocolReputation) Score() float64 {
+	// Laplace smoothing so a single observation doesn't dominate
+	reliability := (pr.Successes + 1) / (pr.Successes + pr.Failures + 2)
+	return reliability / (1 + pr.TTFB.Seconds()/reputationTTFBScale.Seconds())
+}
+
+// decayed returns a copy of the reputation with all weights decayed to now
+func (pr ProtocolReputation) decayed(now time.Time, halfLife time.Duration) ProtocolReputation {
+	if pr.LastUpdated.IsZero() || !now.After(pr.LastUpdated) {
+		return pr
+	}
+	factor := math.Pow(0.5, float64(now.Sub(pr.LastUpdated))/float64(halfLife))
+	pr.Successes *= factor
+	pr.Failures *= factor
+	pr.ttfbWeight *= factor
+	classes := make(map[string]float64, len(pr.FailureClasses))
+	for class, count := range pr.FailureClasses {
+		classes[class] = count * factor
+	}
+	pr.FailureClasses = classes
+	pr.LastUpdated = now
+	return pr
+}
+
+// StorageProviderReputation is the retrieval history of a storage provider
+// across all of the protocols it has been retrieved with.
+type StorageProviderReputation struct {
+	StorageProviderId peer.ID
+	Protocols         map[multicodec.Code]ProtocolReputation
+	// SuspendedUntil is set while the storage provider is suspended so that
+	// the suspension can survive a restart
+	SuspendedUntil time.Time
+}
+
+// lastUpdated returns the time of the most recent observation over any protocol
+func (spr StorageProviderReputation) lastUpdated() time.Time {
+	var last time.Time
+	for _, pr := range spr.Protocols {
+		if pr.LastUpdated.After(last) {
+			last = pr.LastUpdated
+		}
+	}
+	return last
+}
+
+func (spr StorageProviderReputation) totals() (successes float64, failures float64) {
+	for _, pr := range spr.Protocols {
+		successes += pr.Successes
+		failures += pr.Failures
+	}
+	return successes, failures
+}
+
+// ReputationStore keeps a persistent, time-decayed, history of retrievals from
+// storage providers. Updates are made in memory and written to the datastore
+// in the background, the full history is loaded from the datastore when the
+// store is created. History that has decayed away, or that exceeds
+// MaxStorageProviders, is forgotten.
+type ReputationStore struct {
+	lk          sync.Mutex
+	cfg         ReputationConfig
+	ds          datastore.Datastore
+	reputations map[peer.ID]StorageProviderReputation
+	// dirty holds the storage providers updated or forgotten since the last
+	// flush
+	dirty map[peer.ID]struct{}
+	// flushLk keeps flushes in order so an older write can't replace a newer
+	flushLk sync.Mutex
+	clock   func() time.Time
+}
+
+// NewReputationStore creates a ReputationStore backed by the given datastore,
+// loading any existing history from it. Updates are flushed to the datastore
+// periodically and once more when the context is cancelled. If the datastore
+// is nil, history is only kept in memory and will not survive a restart.
+func NewReputationStore(ctx context.Context, ds datastore.Datastore, cfg ReputationConfig) (*ReputationStore, error) {
+	if cfg.HalfLife == 0 {
+		cfg.HalfLife = defaultReputationHalfLife
+	}
+	if cfg.MaxStorageProviders == 0 {
+		cfg.MaxStorageProviders = defaultMaxReputations
+	}
+	rs := &ReputationStore{
+		cfg:         cfg,
+		ds:          ds,
+		reputations: make(map[peer.ID]StorageProviderReputation),
+		dirty:       make(map[peer.ID]struct{}),
+		clock:       time.Now,
+	}
+	if ds == nil {
+		go rs.run(ctx)
+		return rs, nil
+	}
+
+	results, err := ds.Query(ctx, query.Query{Prefix: reputationKeyPrefix.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load storage provider reputations: %w", err)
+	}
+	defer results.Close()
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, fmt.Errorf("failed to load storage provider reputations: %w", result.Error)
+		}
+		var spr StorageProviderReputation
+		if err := json.Unmarshal(result.Value, (*storageProviderReputationJson)(&spr)); err != nil {
+			// a single bad record shouldn't prevent startup, we'll overwrite it
+			log.Warnf("skipping invalid storage provider reputation %s: %s", result.Key, err.Error())
+			continue
+		}
+		rs.reputations[spr.StorageProviderId] = spr
+	}
+	log.Debugf("loaded %d storage provider reputations", len(rs.reputations))
+	go rs.run(ctx)
+	return rs, nil
+}
+
+// run flushes updates until the context is cancelled, then flushes a last time
+func (rs *ReputationStore) run(ctx context.Context) {
+	ticker := time.NewTicker(reputationFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := rs.Flush(context.Background()); err != nil {
+				log.Errorf("failed to persist storage provider reputations: %s", err.Error())
+			}
+			return
+		case <-ticker.C:
+			if err := rs.Flush(ctx); err != nil {
+				log.Errorf("failed to persist storage provider reputations: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Flush forgets expired history, beyond MaxStorageProviders, and writes any
+// updates since the last flush to the datastore
+func (rs *ReputationStore) Flush(ctx context.Context) error {
+	rs.flushLk.Lock()
+	defer rs.flushLk.Unlock()
+
+	rs.lk.Lock()
+	rs.prune(rs.clock())
+	if rs.ds == nil {
+		rs.dirty = make(map[peer.ID]struct{})
+		rs.lk.Unlock()
+		return nil
+	}
+	puts := make(map[peer.ID][]byte, len(rs.dirty))
+	for storageProviderId := range rs.dirty {
+		spr, has := rs.reputations[storageProviderId]
+		if !has {
+			puts[storageProviderId] = nil
+			continue
+		}
+		byts, err := json.Marshal((*storageProviderReputationJson)(&spr))
+		if err != nil {
+			log.Errorf("failed to encode reputation for storage provider %s: %s", storageProviderId, err.Error())
+			continue
+		}
+		puts[storageProviderId] = byts
+	}
+	rs.dirty = make(map[peer.ID]struct{})
+	rs.lk.Unlock()
+
+	if len(puts) == 0 {
+		return nil
+	}
+	var ds datastore.Write = rs.ds
+	var batch datastore.Batch
+	if batching, ok := rs.ds.(datastore.Batching); ok {
+		var err error
+		if batch, err = batching.Batch(ctx); err != nil {
+			return err
+		}
+		ds = batch
+	}
+	for storageProviderId, byts := range puts {
+		var err error
+		if byts == nil {
+			err = ds.Delete(ctx, reputationKey(storageProviderId))
+		} else {
+			err = ds.Put(ctx, reputationKey(storageProviderId), byts)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to persist reputation for storage provider %s: %w", storageProviderId, err)
+		}
+	}
+	if batch != nil {
+		return batch.Commit(ctx)
+	}
+	return nil
+}
+
+// prune forgets the history of storage providers that are not suspended and
+// have not been updated for reputationExpiryHalfLives, then the least recently
+// updated beyond MaxStorageProviders. Must be called with the lock held.
+func (rs *ReputationStore) prune(now time.Time) {
+	expiry := now.Add(-reputationExpiryHalfLives * rs.cfg.HalfLife)
+	remaining := make([]StorageProviderReputation, 0, len(rs.reputations))
+	for storageProviderId, spr := range rs.reputations {
+		if spr.SuspendedUntil.Before(now) && spr.lastUpdated().Before(expiry) {
+			rs.forget(storageProviderId)
+			continue
+		}
+		remaining = append(remaining, spr)
+	}
+	if len(remaining) <= rs.cfg.MaxStorageProviders {
+		return
+	}
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].lastUpdated().Before(remaining[j].lastUpdated())
+	})
+	for _, spr := range remaining[:len(remaining)-rs.cfg.MaxStorageProviders] {
+		rs.forget(spr.StorageProviderId)
+	}
+}
+
+func (rs *ReputationStore) forget(storageProviderId peer.ID) {
+	delete(rs.reputations, storageProviderId)
+	rs.dirty[storageProviderId] = struct{}{}
+}
+
+// Reputation returns the reputation of a storage provider with all weights
+// decayed to the current time, and false if the storage provider has no
+// recorded history.
+func (rs *ReputationStore) Reputation(storageProviderId peer.ID) (StorageProviderReputation, bool) {
+	rs.lk.Lock()
+	defer rs.lk.Unlock()
+	spr, has := rs.reputations[storageProviderId]
+	if !has {
+		return StorageProviderReputation{}, false
+	}
+	now := rs.clock()
+	protocols := make(map[multicodec.Code]ProtocolReputation, len(spr.Protocols))
+	for protocol, pr := range spr.Protocols {
+		protocols[protocol] = pr.decayed(now, rs.cfg.HalfLife)
+	}
+	spr.Protocols = protocols
+	return spr, true
+}
+
+// Reputations returns the reputations of all storage providers with recorded
+// history
+func (rs *ReputationStore) Reputations() []StorageProviderReputation {
+	rs.lk.Lock()
+	ids := make([]peer.ID, 0, len(rs.reputations))
+	for id := range rs.reputations {
+		ids = append(ids, id)
+	}
+	rs.lk.Unlock()
+	sortPeers(ids)
+	reputations := make([]StorageProviderReputation, 0, len(ids))
+	for _, id := range ids {
+		if spr, has := rs.Reputation(id); has {
+			reputations = append(reputations, spr)
+		}
+	}
+	return reputations
+}
+
+// Score ranks a storage provider for a protocol, see ProtocolReputation#Score
+func (rs *ReputationStore) Score(storageProviderId peer.ID, protocol multicodec.Code) float64 {
+	spr, _ := rs.Reputation(storageProviderId)
+	return spr.Protocols[protocol].Score()
+}
+
+// IsUnreliable returns true if there is enough recent history for the storage
+// provider to be confident that the majority of its retrievals fail
+func (rs *ReputationStore) IsUnreliable(storageProviderId peer.ID) bool {
+	spr, has := rs.Reputation(storageProviderId)
+	if !has {
+		return false
+	}
+	successes, failures := spr.totals()
+	if successes+failures < minReputationObservations {
+		return false
+	}
+	return successes/(successes+failures) < unreliableSuccessRate
+}
+
+// RecordFirstByte records the time to first byte of a retrieval
+func (rs *ReputationStore) RecordFirstByte(storageProviderId peer.ID, protocol multicodec.Code, ttfb time.Duration) {
+	rs.update(storageProviderId, func(spr *StorageProviderReputation, now time.Time) {
+		pr := spr.Protocols[protocol].decayed(now, rs.cfg.HalfLife)
+		pr.TTFB = time.Duration((float64(pr.TTFB)*pr.ttfbWeight + float64(ttfb)) / (pr.ttfbWeight + 1))
+		pr.ttfbWeight++
+		pr.LastUpdated = now
+		spr.Protocols[protocol] = pr
+	})
+}
+
+// RecordSuccess records a successful retrieval of size bytes over duration
+func (rs *ReputationStore) RecordSuccess(storageProviderId peer.ID, protocol multicodec.Code, size uint64, duration time.Duration) {
+	rs.update(storageProviderId, func(spr *StorageProviderReputation, now time.Time) {
+		pr := spr.Protocols[protocol].decayed(now, rs.cfg.HalfLife)
+		if duration > 0 {
+			throughput := float64(size) / duration.Seconds()
+			pr.Throughput = (pr.Throughput*pr.Successes + throughput) / (pr.Successes + 1)
+		}
+		pr.Successes++
+		pr.LastUpdated = now
+		spr.Protocols[protocol] = pr
+	})
+}
+
+// RecordFailure records a failed query or retrieval, the error message is
+// classified using the same error matching as the failure metrics
+func (rs *ReputationStore) RecordFailure(storageProviderId peer.ID, protocol multicodec.Code, errorMessage string) {
+	class := failureClass(errorMessage)
+	rs.update(storageProviderId, func(spr *StorageProviderReputation, now time.Time) {
+		pr := spr.Protocols[protocol].decayed(now, rs.cfg.HalfLife)
+		pr.Failures++
+		// copy so that reputations already handed out are left unchanged
+		classes := make(map[string]float64, len(pr.FailureClasses)+1)
+		for c, count := range pr.FailureClasses {
+			classes[c] = count
+		}
+		classes[class]++
+		pr.FailureClasses = classes
+		pr.LastUpdated = now
+		spr.Protocols[protocol] = pr
+	})
+}
+
+// RecordSuspension records the time a storage provider is suspended until, a
+// zero time clears the suspension
+func (rs *ReputationStore) RecordSuspension(storageProviderId peer.ID, until time.Time) {
+	rs.update(storageProviderId, func(spr *StorageProviderReputation, now time.Time) {
+		spr.SuspendedUntil = until
+	})
+}
+
+func (rs *ReputationStore) update(storageProviderId peer.ID, fn func(*StorageProviderReputation, time.Time)) {
+	if storageProviderId == "" {
+		return
+	}
+	rs.lk.Lock()
+	defer rs.lk.Unlock()
+
+	spr, has := rs.reputations[storageProviderId]
+	if !has {
+		spr = StorageProviderReputation{StorageProviderId: storageProviderId}
+	}
+	protocols := make(map[multicodec.Code]ProtocolReputation, len(spr.Protocols)+1)
+	for protocol, pr := range spr.Protocols {
+		protocols[protocol] = pr
+	}
+	spr.Protocols = protocols
+	fn(&spr, rs.clock())
+	rs.reputations[storageProviderId] = spr
+	rs.dirty[storageProviderId] = struct{}{}
+}
+
+func reputationKey(storageProviderId peer.ID) datastore.Key {
+	return reputationKeyPrefix.ChildString(storageProviderId.String())
+}
+
+// failureClass reduces an error message to the matching failure metric
+// substring so that failures can be grouped
+func failureClass(errorMessage string) string {
+	for substr := range metrics.ErrorMetricMatches {
+		if strings.Contains(errorMessage, substr) {
+			return strings.TrimSpace(substr)
+		}
+	}
+	for substr := range metrics.QueryErrorMetricMatches {
+		if strings.Contains(errorMessage, substr) {
+			return strings.TrimSpace(substr)
+		}
+	}
+	return otherFailureClass
+}
+
+// storageProviderReputationJson is the persisted form of
+// StorageProviderReputation, protocols are keyed by name
+type storageProviderReputationJson StorageProviderReputation
+
+type protocolReputationJson struct {
+	Successes      float64            `json:"successes"`
+	Failures       float64            `json:"failures"`
+	FailureClasses map[string]float64 `json:"failureClasses,omitempty"`
+	TTFB           time.Duration      `json:"ttfb"`
+	TTFBWeight     float64            `json:"ttfbWeight"`
+	Throughput     float64            `json:"throughput"`
+	LastUpdated    time.Time          `json:"lastUpdated"`
+}
+
+type reputationJson struct {
+	StorageProviderId string                            `json:"storageProviderId"`
+	Protocols         map[string]protocolReputationJson `json:"protocols"`
+	SuspendedUntil    time.Time                         `json:"suspendedUntil,omitempty"`
+}
+
+func (spr *storageProviderReputationJson) MarshalJSON() ([]byte, error) {
+	rj := reputationJson{
+		StorageProviderId: spr.StorageProviderId.String(),
+		Protocols:         make(map[string]protocolReputationJson, len(spr.Protocols)),
+		SuspendedUntil:    spr.SuspendedUntil,
+	}
+	for protocol, pr := range spr.Protocols {
+		rj.Protocols[protocol.String()] = protocolReputationJson{
+			Successes:      pr.Successes,
+			Failures:       pr.Failures,
+			FailureClasses: pr.FailureClasses,
+			TTFB:           pr.TTFB,
+			TTFBWeight:     pr.ttfbWeight,
+			Throughput:     pr.Throughput,
+			LastUpdated:    pr.LastUpdated,
+		}
+	}
+	return json.Marshal(rj)
+}
+
+func (spr *storageProviderReputationJson) UnmarshalJSON(byts []byte) error {
+	var rj reputationJson
+	if err := json.Unmarshal(byts, &rj); err != nil {
+		return err
+	}
+	id, err := peer.Decode(rj.StorageProviderId)
+	if err != nil {
+		return err
+	}
+	spr.StorageProviderId = id
+	spr.SuspendedUntil = rj.SuspendedUntil
+	spr.Protocols = make(map[multicodec.Code]ProtocolReputation, len(rj.Protocols))
+	for name, prj := range rj.Protocols {
+		var protocol multicodec.Code
+		if err := protocol.Set(name); err != nil {
+			return err
+		}
+		spr.Protocols[protocol] = ProtocolReputation{
+			Successes:      prj.Successes,
+			Failures:       prj.Failures,
+			FailureClasses: prj.FailureClasses,
+			TTFB:           prj.TTFB,
+			ttfbWeight:     prj.TTFBWeight,
+			Throughput:     prj.Throughput,
+			LastUpdated:    prj.LastUpdated,
+		}
+	}
+	return nil
+}
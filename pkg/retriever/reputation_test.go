@@ -0,0 +1,247 @@
+package retriever
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReputationDecay(t *testing.T) {
+	ctx := context.Background()
+	sp := testutil.GeneratePeers(1)[0]
+	now := time.Now()
+
+	rs, err := NewReputationStore(ctx, nil, ReputationConfig{HalfLife: time.Hour})
+	require.NoError(t, err)
+	rs.clock = func() time.Time { return now }
+
+	_, has := rs.Reputation(sp)
+	require.False(t, has)
+	require.Equal(t, 0.5, rs.Score(sp, multicodec.TransportGraphsyncFilecoinv1))
+
+	rs.RecordFirstByte(sp, multicodec.TransportGraphsyncFilecoinv1, time.Second)
+	rs.RecordFirstByte(sp, multicodec.TransportGraphsyncFilecoinv1, 3*time.Second)
+	rs.RecordSuccess(sp, multicodec.TransportGraphsyncFilecoinv1, 2000, time.Second)
+	rs.RecordSuccess(sp, multicodec.TransportGraphsyncFilecoinv1, 4000, time.Second)
+	rs.RecordFailure(sp, multicodec.TransportGraphsyncFilecoinv1, "timeout after 20s")
+	rs.RecordFailure(sp, multicodec.TransportGraphsyncFilecoinv1, "something unexpected")
+
+	spr, has := rs.Reputation(sp)
+	require.True(t, has)
+	pr := spr.Protocols[multicodec.TransportGraphsyncFilecoinv1]
+	require.Equal(t, 2.0, pr.Successes)
+	require.Equal(t, 2.0, pr.Failures)
+	require.Equal(t, map[string]float64{"timeout after": 1, otherFailureClass: 1}, pr.FailureClasses)
+	require.Equal(t, 2*time.Second, pr.TTFB)
+	require.Equal(t, 3000.0, pr.Throughput)
+	require.Equal(t, 0.5, pr.SuccessRate())
+
+	// a half-life later, the weight of the history is halved but averages
+	// are retained
+	now = now.Add(time.Hour)
+	spr, _ = rs.Reputation(sp)
+	pr = spr.Protocols[multicodec.TransportGraphsyncFilecoinv1]
+	require.InDelta(t, 1.0, pr.Successes, 0.0001)
+	require.InDelta(t, 1.0, pr.Failures, 0.0001)
+	require.InDelta(t, 0.5, pr.FailureClasses[otherFailureClass], 0.0001)
+	require.Equal(t, 2*time.Second, pr.TTFB)
+
+	// new observations now carry as much weight as the decayed history
+	rs.RecordFirstByte(sp, multicodec.TransportGraphsyncFilecoinv1, 5*time.Second)
+	spr, _ = rs.Reputation(sp)
+	require.InDelta(t, float64(3500*time.Millisecond), float64(spr.Protocols[multicodec.TransportGraphsyncFilecoinv1].TTFB), float64(time.Millisecond))
+
+	// unknown protocol is a neutral score
+	require.Equal(t, 0.5, rs.Score(sp, multicodec.TransportBitswap))
+}
+
+func TestReputationPersistence(t *testing.T) {
+	ctx := context.Background()
+	// persisted reputations are keyed by real peer IDs
+	peers := make([]peer.ID, 0, 2)
+	for _, id := range []string{"12D3KooWBSTEYMLSu5FnQjshEVah9LFGEZoQt26eacCEVYfedWA4", "QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC"} {
+		sp, err := peer.Decode(id)
+		require.NoError(t, err)
+		peers = append(peers, sp)
+	}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	suspendedUntil := time.Now().Add(time.Hour).Round(0)
+
+	rs, err := NewReputationStore(ctx, ds, ReputationConfig{})
+	require.NoError(t, err)
+	rs.RecordFirstByte(peers[0], multicodec.TransportGraphsyncFilecoinv1, time.Second)
+	rs.RecordSuccess(peers[0], multicodec.TransportGraphsyncFilecoinv1, 1000, time.Second)
+	rs.RecordFailure(peers[0], multicodec.TransportBitswap, "response rejected")
+	rs.RecordFailure(peers[1], multicodec.TransportGraphsyncFilecoinv1, "failed to dial")
+	rs.RecordSuspension(peers[1], suspendedUntil)
+	// no storage provider, not recorded
+	rs.RecordFailure(peer.ID(""), multicodec.TransportBitswap, "nope")
+	require.NoError(t, rs.Flush(ctx))
+
+	reloaded, err := NewReputationStore(ctx, ds, ReputationConfig{})
+	require.NoError(t, err)
+	// compare without further decay
+	now := time.Now()
+	rs.clock = func() time.Time { return now }
+	reloaded.clock = func() time.Time { return now }
+	require.Len(t, reloaded.Reputations(), 2)
+	for _, sp := range peers {
+		expected, _ := rs.Reputation(sp)
+		actual, has := reloaded.Reputation(sp)
+		require.True(t, has)
+		require.Equal(t, expected.StorageProviderId, actual.StorageProviderId)
+		require.True(t, expected.SuspendedUntil.Equal(actual.SuspendedUntil))
+		require.Len(t, actual.Protocols, len(expected.Protocols))
+		for protocol, pr := range expected.Protocols {
+			require.Contains(t, actual.Protocols, protocol)
+			require.InDelta(t, pr.Successes, actual.Protocols[protocol].Successes, 0.0001)
+			require.InDelta(t, pr.Failures, actual.Protocols[protocol].Failures, 0.0001)
+			require.Equal(t, pr.TTFB, actual.Protocols[protocol].TTFB)
+			require.Equal(t, pr.Throughput, actual.Protocols[protocol].Throughput)
+			require.InDelta(t, pr.ttfbWeight, actual.Protocols[protocol].ttfbWeight, 0.0001)
+		}
+	}
+	spr, _ := reloaded.Reputation(peers[1])
+	require.True(t, suspendedUntil.Equal(spr.SuspendedUntil))
+}
+
+func TestReputationPruning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	peers := make([]peer.ID, 0, 4)
+	for _, id := range []string{
+		"12D3KooWBSTEYMLSu5FnQjshEVah9LFGEZoQt26eacCEVYfedWA4",
+		"QmcgpsyWgH8Y8ajJz1Cu72KnS5uo2Aa2LpzU7kinSupNKC",
+		"12D3KooWEC2pbrHfqV4Mq2LKB9AD6LVGHRVDRiMbfc5uRCRcNBj2",
+		"12D3KooWHHzSeKaY8xuZVzkLbKFfvNgPPeKhFBGrMbNzbm5akpqu",
+	} {
+		sp, err := peer.Decode(id)
+		require.NoError(t, err)
+		peers = append(peers, sp)
+	}
+	ds := dssync.MutexWrap(datastore.NewMapDatastore())
+	now := time.Now()
+
+	rs, err := NewReputationStore(ctx, ds, ReputationConfig{HalfLife: time.Hour, MaxStorageProviders: 2})
+	require.NoError(t, err)
+	rs.clock = func() time.Time { return now }
+	rs.RecordFailure(peers[0], multicodec.TransportGraphsyncFilecoinv1, "response rejected")
+	rs.RecordFailure(peers[1], multicodec.TransportGraphsyncFilecoinv1, "response rejected")
+	rs.RecordSuspension(peers[1], now.Add(reputationExpiryHalfLives*time.Hour+time.Minute))
+	require.NoError(t, rs.Flush(ctx))
+	for _, sp := range peers[:2] {
+		has, err := ds.Has(ctx, reputationKey(sp))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// decayed history is forgotten, unless the storage provider is suspended
+	now = now.Add(reputationExpiryHalfLives*time.Hour + time.Second)
+	require.NoError(t, rs.Flush(ctx))
+	_, has := rs.Reputation(peers[0])
+	require.False(t, has)
+	_, has = rs.Reputation(peers[1])
+	require.True(t, has)
+	has, err = ds.Has(ctx, reputationKey(peers[0]))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// beyond the maximum, the least recently updated are forgotten
+	rs.RecordSuccess(peers[2], multicodec.TransportGraphsyncFilecoinv1, 1000, time.Second)
+	now = now.Add(time.Second)
+	rs.RecordSuccess(peers[3], multicodec.TransportGraphsyncFilecoinv1, 1000, time.Second)
+	require.NoError(t, rs.Flush(ctx))
+	require.Len(t, rs.Reputations(), 2)
+	_, has = rs.Reputation(peers[1])
+	require.False(t, has)
+
+	// updates since the last flush are written when the store is done with
+	rs.RecordSuccess(peers[2], multicodec.TransportBitswap, 1000, time.Second)
+	cancel()
+	require.Eventually(t, func() bool {
+		reloaded, err := NewReputationStore(context.Background(), ds, ReputationConfig{})
+		require.NoError(t, err)
+		spr, _ := reloaded.Reputation(peers[2])
+		return len(reloaded.Reputations()) == 2 && len(spr.Protocols) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReputationRanking(t *testing.T) {
+	ctx := context.Background()
+	peers := testutil.GeneratePeers(3)
+	rs, err := NewReputationStore(ctx, nil, ReputationConfig{})
+	require.NoError(t, err)
+
+	// peers[0] is fast and reliable, peers[1] unknown, peers[2] unreliable
+	for i := 0; i < 5; i++ {
+		rs.RecordFirstByte(peers[0], multicodec.TransportGraphsyncFilecoinv1, 100*time.Millisecond)
+		rs.RecordSuccess(peers[0], multicodec.TransportGraphsyncFilecoinv1, 1000, time.Second)
+		rs.RecordFailure(peers[2], multicodec.TransportGraphsyncFilecoinv1, "response rejected")
+	}
+	rs.RecordSuccess(peers[2], multicodec.TransportGraphsyncFilecoinv1, 1000, time.Second)
+
+	score := func(sp peer.ID) float64 { return rs.Score(sp, multicodec.TransportGraphsyncFilecoinv1) }
+	require.Greater(t, score(peers[0]), score(peers[1]))
+	require.Greater(t, score(peers[1]), score(peers[2]))
+	require.False(t, rs.IsUnreliable(peers[0]))
+	require.False(t, rs.IsUnreliable(peers[1]))
+	require.True(t, rs.IsUnreliable(peers[2]))
+
+	// with reputation weighting, reputation ranks above size and query
+	// latency, but below price
+	reputation := func(sp peer.ID) ProtocolReputation {
+		spr, _ := rs.Reputation(sp)
+		return spr.Protocols[multicodec.TransportGraphsyncFilecoinv1]
+	}
+	cheap := retrievalmarket.QueryResponse{Size: 10, MinPricePerByte: big.Zero(), UnsealPrice: big.Zero()}
+	pricey := retrievalmarket.QueryResponse{Size: 10, MinPricePerByte: big.NewInt(1), UnsealPrice: big.Zero()}
+	large := retrievalmarket.QueryResponse{Size: 100, MinPricePerByte: big.Zero(), UnsealPrice: big.Zero()}
+	prefer := ReputationCandidateScorer.Prefer
+	require.True(t, prefer(QueriedCandidate{QueryResponse: large, QueryDuration: time.Second, Reputation: reputation(peers[0])}, QueriedCandidate{QueryResponse: cheap, QueryDuration: time.Millisecond, Reputation: reputation(peers[1])}))
+	require.False(t, prefer(QueriedCandidate{QueryResponse: cheap, QueryDuration: time.Second, Reputation: reputation(peers[2])}, QueriedCandidate{QueryResponse: large, QueryDuration: time.Second, Reputation: reputation(peers[1])}))
+	require.True(t, prefer(QueriedCandidate{QueryResponse: cheap, QueryDuration: time.Second, Reputation: reputation(peers[2])}, QueriedCandidate{QueryResponse: pricey, QueryDuration: time.Millisecond, Reputation: reputation(peers[0])}))
+	// equal scores fall through to size
+	require.True(t, prefer(QueriedCandidate{QueryResponse: cheap, QueryDuration: time.Second, Reputation: reputation(peers[1])}, QueriedCandidate{QueryResponse: large, QueryDuration: time.Millisecond, Reputation: reputation(peers[1])}))
+}
+
+func TestSuspendUnreliableSooner(t *testing.T) {
+	ctx := context.Background()
+	ret := types.RetrievalID(uuid.New())
+	peers := testutil.GeneratePeers(2)
+	rs, err := NewReputationStore(ctx, nil, ReputationConfig{})
+	require.NoError(t, err)
+	for i := 0; i < minReputationObservations+1; i++ {
+		rs.RecordFailure(peers[0], multicodec.TransportGraphsyncFilecoinv1, "response rejected")
+	}
+
+	tracker := newSpTracker(&SpTrackerConfig{MaxFailuresBeforeSuspend: 4})
+	tracker.reputation = rs
+	require.True(t, tracker.RegisterRetrieval(ret, cid.MustParse("bafkqaalb")))
+	for i := 0; i < 3; i++ {
+		for _, sp := range peers {
+			require.NoError(t, tracker.AddToRetrieval(ret, []peer.ID{sp}))
+			require.NoError(t, tracker.RecordFailure(sp, ret))
+		}
+	}
+	require.True(t, tracker.IsSuspended(peers[0]))
+	require.False(t, tracker.IsSuspended(peers[1]))
+
+	// suspensions recorded in the reputation store can be restored
+	tracker = newSpTracker(nil)
+	tracker.restoreSuspension(peers[0], time.Now().Add(time.Hour))
+	tracker.restoreSuspension(peers[1], time.Now().Add(-time.Hour))
+	require.True(t, tracker.IsSuspended(peers[0]))
+	require.False(t, tracker.IsSuspended(peers[1]))
+}
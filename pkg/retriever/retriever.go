@@ -5,16 +5,23 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/dustin/go-humanize"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/internal/limitstore"
 	"github.com/filecoin-project/lassie/pkg/metrics"
 	"github.com/filecoin-project/lassie/pkg/retriever/combinators"
+	"github.com/filecoin-project/lassie/pkg/retriever/coordinators"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/multiformats/go-multicodec"
 	"go.opencensus.io/stats"
@@ -34,6 +41,9 @@ var (
 	ErrAllQueriesFailed            = errors.New("all queries failed")
 	ErrRetrievalTimedOut           = errors.New("retrieval timed out")
 	ErrRetrievalAlreadyRunning     = errors.New("retrieval already running for CID")
+	ErrFixedPeersNotSupported      = errors.New("retrieval from fixed peers not supported")
+	ErrPaidRetrievalNotAllowed     = errors.New("paid retrieval not allowed")
+	ErrMaxDepthExceeded            = errors.New("exceeded maximum DAG depth")
 )
 
 type MinerConfig struct {
@@ -49,6 +59,41 @@ type RetrieverConfig struct {
 	MinerConfigs       map[peer.ID]MinerConfig
 	PaidRetrievals     bool
 	DisableGraphsync   bool
+	DisableHttp        bool
+	SpTrackerConfig    SpTrackerConfig
+	ReputationConfig   ReputationConfig
+	// LocalStores, when set, are retrieved from for the local candidates found
+	// by a LocalCandidateFinder, and come first in the preference between protocols
+	LocalStores *LocalStores
+	// CandidateScorer orders graphsync candidates for retrieval, if nil the
+	// DefaultCandidateScorer is used
+	CandidateScorer CandidateScorer
+	// CoordinationKind determines how retrievals over different protocols are
+	// coordinated, defaults to RaceCoordination
+	CoordinationKind types.CoordinationKind
+	// HedgeDelay is the time to wait for a first byte from the preferred
+	// protocol, once it has started retrieving, before starting the others
+	// with HedgedCoordination
+	HedgeDelay time.Duration
+	// ReputationDatastore persists the history of storage provider retrievals
+	// across restarts, if nil the history is kept in memory only
+	ReputationDatastore datastore.Datastore
+	// MaxParallelProviders, when greater than 1, splits graphsync retrievals of
+	// a full DAG across up to this many storage providers
+	MaxParallelProviders int
+	// TempDir is where the blocks of split graphsync retrievals are held until
+	// they can be written in order, the system temporary directory is used if
+	// empty
+	TempDir string
+	// RetryPolicy determines whether a retrieval is attempted again, with
+	// fresh candidates, after every candidate has failed
+	RetryPolicy RetryPolicy
+	// FixedPeerFinder finds candidates for requests with FixedPeers, if nil
+	// such requests fail
+	FixedPeerFinder FixedPeerFinder
+	// PaymentPolicy limits what is paid for retrievals when PaidRetrievals is
+	// enabled, the zero value places no limits
+	PaymentPolicy PaymentPolicy
 }
 
 func (cfg *RetrieverConfig) getMinerConfig(peer peer.ID) MinerConfig {
@@ -68,11 +113,15 @@ func (cfg *RetrieverConfig) getMinerConfig(peer peer.ID) MinerConfig {
 }
 
 type Retriever struct {
-	// Assumed immutable during operation
-	config       RetrieverConfig
+	// Assumed immutable during operation, with the exception of the
+	// ProviderConfig portion which is replaced wholesale by UpdateProviderConfig
+	config       atomic.Pointer[RetrieverConfig]
+	configLk     sync.Mutex
 	executor     types.Retriever
 	eventManager *events.EventManager
 	spTracker    *spTracker
+	reputation   *ReputationStore
+	spending     *spendTracker
 }
 
 type CandidateFinder interface {
@@ -93,18 +142,65 @@ func NewRetriever(
 	candidateFinder CandidateFinder,
 	bitswapRetriever types.CandidateRetriever,
 ) (*Retriever, error) {
+	coordinationKind := config.CoordinationKind
+	if coordinationKind == "" {
+		coordinationKind = types.RaceCoordination
+	}
+	if _, err := coordinators.Coordinator(coordinationKind, coordinators.HedgeConfig{}); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, coordinationKind)
+	}
+
+	reputation, err := NewReputationStore(ctx, config.ReputationDatastore, config.ReputationConfig)
+	if err != nil {
+		return nil, err
+	}
+	clock := clock.New()
 	retriever := &Retriever{
-		config:       config,
 		eventManager: events.NewEventManager(ctx),
-		spTracker:    newSpTracker(nil),
+		spTracker:    newSpTrackerWithClock(&config.SpTrackerConfig, clock),
+		reputation:   reputation,
+		spending:     newSpendTracker(clock),
+	}
+	retriever.config.Store(&config)
+	retriever.spTracker.reputation = reputation
+	for _, spr := range reputation.Reputations() {
+		if !spr.SuspendedUntil.IsZero() {
+			retriever.spTracker.restoreSuspension(spr.StorageProviderId, spr.SuspendedUntil)
+		}
+	}
+	retriever.spTracker.onSuspensionChange = func(event types.RetrievalEvent) {
+		logEvent(event)
+		switch tevent := event.(type) {
+		case events.RetrievalEventSuspended:
+			reputation.RecordSuspension(tevent.StorageProviderId(), tevent.Time().Add(tevent.Duration()))
+		case events.RetrievalEventUnsuspended:
+			reputation.RecordSuspension(tevent.StorageProviderId(), time.Time{})
+		}
+		if retriever.eventManager.IsStarted() {
+			retriever.eventManager.DispatchEvent(event)
+		}
 	}
 	candidateRetrievers := map[multicodec.Code]types.CandidateRetriever{}
 	protocols := []multicodec.Code{}
+	if config.LocalStores != nil {
+		candidateRetrievers[types.TransportLocal] = &LocalRetriever{Stores: config.LocalStores}
+		protocols = append(protocols, types.TransportLocal)
+	}
 	if !config.DisableGraphsync {
 		candidateRetrievers[multicodec.TransportGraphsyncFilecoinv1] = &GraphSyncRetriever{
 			GetStorageProviderTimeout: retriever.getStorageProviderTimeout,
 			IsAcceptableQueryResponse: retriever.isAcceptableQueryResponse,
-			Client:                    client,
+			ReleaseQueryResponse: func(peer peer.ID, req types.RetrievalRequest) {
+				retriever.spending.Release(req.RetrievalID, peer)
+			},
+			GetStorageProviderReputation: func(storageProviderId peer.ID) ProtocolReputation {
+				spr, _ := reputation.Reputation(storageProviderId)
+				return spr.Protocols[multicodec.TransportGraphsyncFilecoinv1]
+			},
+			CandidateScorer:      config.CandidateScorer,
+			MaxParallelProviders: config.MaxParallelProviders,
+			TempDir:              config.TempDir,
+			Client:               client,
 		}
 		protocols = append(protocols, multicodec.TransportGraphsyncFilecoinv1)
 	}
@@ -112,12 +208,22 @@ func NewRetriever(
 		candidateRetrievers[multicodec.TransportBitswap] = bitswapRetriever
 		protocols = append(protocols, multicodec.TransportBitswap)
 	}
+	if !config.DisableHttp {
+		// HTTP candidates are those with trustless gateway metadata, along with
+		// graphsync candidates whose pieces can be retrieved over HTTP
+		candidateRetrievers[types.TransportIpfsGatewayHttp] = &HttpRetriever{
+			GetStorageProviderTimeout: retriever.getStorageProviderTimeout,
+		}
+		protocols = append(protocols, types.TransportIpfsGatewayHttp)
+	}
 	retriever.executor = combinators.RetrieverWithCandidateFinder{
-		CandidateFinder: NewAssignableCandidateFinder(candidateFinder, retriever.isAcceptableStorageProvider),
+		CandidateFinder: NewAssignableCandidateFinder(candidateFinder, retriever.isAcceptableStorageProvider).WithFixedPeerFinder(config.FixedPeerFinder),
 		CandidateRetriever: combinators.SplitRetriever[multicodec.Code]{
 			AsyncCandidateSplitter: combinators.NewAsyncCandidateSplitter(protocols, NewProtocolSplitter),
 			CandidateRetrievers:    candidateRetrievers,
-			CoordinationKind:       types.RaceCoordination,
+			CoordinationKind:       coordinationKind,
+			HedgeDelay:             config.HedgeDelay,
+			Preference:             protocols,
 		},
 	}
 
@@ -142,22 +248,82 @@ func (retriever *Retriever) RegisterSubscriber(subscriber types.RetrievalEventSu
 	return retriever.eventManager.RegisterSubscriber(subscriber)
 }
 
+// UpdateProviderConfig atomically replaces the storage provider blacklist,
+// whitelist and individual miner configs. Retrievals already in progress are
+// not interrupted, the new values are consulted for candidates and
+// storage providers evaluated after this call.
+func (retriever *Retriever) UpdateProviderConfig(providerConfig ProviderConfig) {
+	retriever.configLk.Lock()
+	defer retriever.configLk.Unlock()
+
+	oldConfig := retriever.config.Load()
+	newConfig := *oldConfig
+	newConfig.setProviderConfig(providerConfig)
+	retriever.config.Store(&newConfig)
+
+	diff := oldConfig.ProviderConfig().Diff(providerConfig)
+	if diff.IsEmpty() {
+		log.Infow("Reloaded provider config, no changes")
+		return
+	}
+	log.Infow(
+		"Reloaded provider config",
+		"blacklistAdded", diff.BlacklistAdded,
+		"blacklistRemoved", diff.BlacklistRemoved,
+		"whitelistAdded", diff.WhitelistAdded,
+		"whitelistRemoved", diff.WhitelistRemoved,
+		"minerConfigsChanged", diff.MinerConfigsChanged,
+	)
+}
+
+// SuspendedStorageProviders lists the storage providers that are currently
+// suspended, along with their recent failure history.
+func (retriever *Retriever) SuspendedStorageProviders() []StorageProviderSuspension {
+	return retriever.spTracker.Suspensions()
+}
+
+// SuspendStorageProvider suspends a storage provider so that it is not used
+// for new retrievals for the given duration. A zero duration will use the
+// configured suspension duration.
+func (retriever *Retriever) SuspendStorageProvider(storageProviderId peer.ID, duration time.Duration) {
+	retriever.spTracker.Suspend(storageProviderId, duration)
+}
+
+// UnsuspendStorageProvider lifts the suspension of a storage provider and
+// clears its failure history. Returns false if the storage provider was not
+// suspended.
+func (retriever *Retriever) UnsuspendStorageProvider(storageProviderId peer.ID) bool {
+	return retriever.spTracker.Unsuspend(storageProviderId)
+}
+
+// StorageProviderReputations lists the recorded retrieval history of all
+// storage providers, decayed to the current time.
+func (retriever *Retriever) StorageProviderReputations() []StorageProviderReputation {
+	return retriever.reputation.Reputations()
+}
+
 func (retriever *Retriever) getStorageProviderTimeout(storageProviderId peer.ID) time.Duration {
-	return retriever.config.getMinerConfig(storageProviderId).RetrievalTimeout
+	return retriever.config.Load().getMinerConfig(storageProviderId).RetrievalTimeout
 }
 
 // isAcceptableStorageProvider checks whether the storage provider in question
 // is acceptable as a retrieval candidate. It checks the blacklists and
 // whitelists, the miner monitor for failures and whether we are already at
-// concurrency limit for this SP.
+// concurrency limit for this SP. The local stores are always acceptable.
 func (retriever *Retriever) isAcceptableStorageProvider(storageProviderId peer.ID) bool {
+	if storageProviderId == LocalStorageProviderId {
+		return true
+	}
+
+	config := retriever.config.Load()
+
 	// Skip blacklist
-	if retriever.config.MinerBlacklist[storageProviderId] {
+	if config.MinerBlacklist[storageProviderId] {
 		return false
 	}
 
 	// Skip non-whitelist IF the whitelist isn't empty
-	if len(retriever.config.MinerWhitelist) > 0 && !retriever.config.MinerWhitelist[storageProviderId] {
+	if len(config.MinerWhitelist) > 0 && !config.MinerWhitelist[storageProviderId] {
 		return false
 	}
 
@@ -169,7 +335,7 @@ func (retriever *Retriever) isAcceptableStorageProvider(storageProviderId peer.I
 	// Skip if we are currently at our maximum concurrent retrievals for this SP
 	// since we likely won't be able to retrieve from them at the moment even if
 	// query is successful
-	minerConfig := retriever.config.getMinerConfig(storageProviderId)
+	minerConfig := config.getMinerConfig(storageProviderId)
 	if minerConfig.MaxConcurrentRetrievals > 0 &&
 		retriever.spTracker.GetConcurrency(storageProviderId) >= minerConfig.MaxConcurrentRetrievals {
 		return false
@@ -179,17 +345,37 @@ func (retriever *Retriever) isAcceptableStorageProvider(storageProviderId peer.I
 }
 
 // isAcceptableQueryResponse determines whether a queryResponse is acceptable
-// according to the current configuration. For now this is just checking whether
-// PaidRetrievals is set and not accepting paid retrievals if so.
-func (retriever *Retriever) isAcceptableQueryResponse(peer peer.ID, req types.RetrievalRequest, queryResponse *retrievalmarket.QueryResponse) bool {
-	// filter out paid retrievals if necessary
-
-	acceptable := retriever.config.PaidRetrievals || big.Add(big.Mul(queryResponse.MinPricePerByte, big.NewIntUnsigned(queryResponse.Size)), queryResponse.UnsealPrice).Equals(big.Zero())
-	if !acceptable {
-		log.Debugf("skipping query response from %s for %s: paid retrieval not allowed", peer, req.Cid)
+// according to the current configuration, or the request's PaidRetrievals
+// policy where it has one. Free retrievals are always acceptable, paid
+// retrievals must be allowed and within the limits of the PaymentPolicy,
+// including what remains of its budget.
+func (retriever *Retriever) isAcceptableQueryResponse(peer peer.ID, req types.RetrievalRequest, queryResponse *retrievalmarket.QueryResponse) error {
+	config := retriever.config.Load()
+	paidRetrievals := config.PaidRetrievals
+	switch req.PaidRetrievals {
+	case types.AllowPaidRetrievals:
+		paidRetrievals = true
+	case types.DenyPaidRetrievals:
+		paidRetrievals = false
+	}
+
+	var err error
+	if cost := queryResponseCost(queryResponse); !cost.Equals(big.Zero()) {
+		if !paidRetrievals {
+			err = ErrPaidRetrievalNotAllowed
+		} else {
+			// the cost is reserved until the retrieval finishes, or the
+			// storage provider is dropped without being paid
+			err = retriever.spending.Reserve(config.PaymentPolicy.BudgetPeriod, req.RetrievalID, peer, cost, func(committed abi.TokenAmount, retrievalReserved abi.TokenAmount) error {
+				return config.PaymentPolicy.check(queryResponse, committed, retrievalReserved)
+			})
+		}
+	}
+	if err != nil {
+		log.Debugf("skipping query response from %s for %s: %s", peer, req.Cid, err.Error())
 		retriever.spTracker.RemoveStorageProviderFromRetrieval(peer, req.RetrievalID)
 	}
-	return acceptable
+	return err
 }
 
 // Retrieve attempts to retrieve the given CID using the configured
@@ -218,21 +404,23 @@ func (retriever *Retriever) Retrieve(
 	onRetrievalEvent := makeOnRetrievalEvent(ctx,
 		retriever.eventManager,
 		retriever.spTracker,
+		retriever.reputation,
 		request.Cid,
 		request.RetrievalID,
 		eventStats,
 		eventsCB,
 	)
 
-	// retrieve, note that we could get a successful retrieval
-	// (retrievalStats!=nil) _and_ also an error return because there may be
-	// multiple failures along the way, if we got a retrieval then we'll pretend
-	// to our caller that there was no error
-	retrievalStats, err := retriever.executor.Retrieve(
-		ctx,
-		request,
-		onRetrievalEvent,
-	)
+	if request.MaxBlocks > 0 {
+		request.LinkSystem = limitstore.LimitLinkSystem(request.LinkSystem, request.MaxBlocks)
+	}
+
+	retrievalStats, err := retriever.retrieveWithRetries(ctx, request, onRetrievalEvent)
+	paid := big.Zero()
+	if retrievalStats != nil {
+		paid = retrievalStats.TotalPayment
+	}
+	retriever.spending.Settle(retriever.config.Load().PaymentPolicy.BudgetPeriod, request.RetrievalID, paid)
 	if err != nil && retrievalStats == nil {
 		return nil, err
 	}
@@ -250,11 +438,17 @@ func (retriever *Retriever) Retrieve(
 		types.FIL(retrievalStats.TotalPayment),
 	)
 
-	stats.Record(ctx, metrics.RetrievalDealActiveCount.M(-1))
-	stats.Record(ctx, metrics.RetrievalDealSuccessCount.M(1))
-	stats.Record(ctx, metrics.RetrievalDealDuration.M(retrievalStats.Duration.Seconds()))
-	stats.Record(ctx, metrics.RetrievalDealSize.M(int64(retrievalStats.Size)))
-	stats.Record(ctx, metrics.RetrievalDealCost.M(retrievalStats.TotalPayment.Int64()))
+	// reading the local stores isn't a deal
+	if retrievalStats.StorageProviderId != LocalStorageProviderId {
+		stats.Record(ctx, metrics.RetrievalDealActiveCount.M(-1))
+		stats.Record(ctx, metrics.RetrievalDealSuccessCount.M(1))
+		stats.Record(ctx, metrics.RetrievalDealDuration.M(retrievalStats.Duration.Seconds()))
+		stats.Record(ctx, metrics.RetrievalDealSize.M(int64(retrievalStats.Size)))
+		stats.Record(ctx, metrics.RetrievalDealCost.M(retrievalStats.TotalPayment.Int64()))
+	}
+	if !retrievalStats.TotalPayment.Nil() && retrievalStats.TotalPayment.Sign() > 0 {
+		stats.Record(ctx, metrics.RetrievalSpend.M(retrievalStats.TotalPayment.Int64()))
+	}
 	stats.Record(ctx, metrics.FailedRetrievalsPerRequestCount.M(eventStats.failedCount))
 	stats.Record(ctx, metrics.SuccessfulQueriesPerRequestCount.M(eventStats.queryCount))
 	stats.Record(ctx, metrics.SuccessfulQueriesPerRequestFilteredCount.M(eventStats.filteredQueryCount))
@@ -262,11 +456,65 @@ func (retriever *Retriever) Retrieve(
 	return retrievalStats, nil
 }
 
+// retrieveWithRetries makes attempts at a retrieval according to the
+// configured RetryPolicy. Each attempt after the first finds candidates afresh
+// and skips storage providers that failed in earlier attempts.
+func (retriever *Retriever) retrieveWithRetries(
+	ctx context.Context,
+	request types.RetrievalRequest,
+	onRetrievalEvent func(types.RetrievalEvent),
+) (*types.RetrievalStats, error) {
+
+	retryPolicy := retriever.config.Load().RetryPolicy
+	failures := newRetryFailures()
+	onAttemptEvent := func(event types.RetrievalEvent) {
+		failures.record(event)
+		onRetrievalEvent(event)
+	}
+
+	startTime := time.Now()
+	attemptCtx := ctx
+	for attempt := 1; ; attempt++ {
+		// retrieve, note that we could get a successful retrieval
+		// (retrievalStats!=nil) _and_ also an error return because there may be
+		// multiple failures along the way, if we got a retrieval then we'll
+		// pretend to our caller that there was no error
+		retrievalStats, err := retriever.executor.Retrieve(
+			attemptCtx,
+			request,
+			onAttemptEvent,
+		)
+		if err == nil || retrievalStats != nil {
+			return retrievalStats, err
+		}
+
+		errorMessages, failed := failures.nextAttempt()
+		if attempt >= retryPolicy.MaxAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+		if !retryPolicy.isRetryable(append(errorMessages, err.Error())) {
+			return nil, err
+		}
+
+		delay := retryPolicy.backoff(attempt + 1)
+		onRetrievalEvent(events.Retrying(request.RetrievalID, startTime, request.Cid, attempt+1, delay, err.Error()))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		attemptCtx = withExcludedStorageProviders(ctx, failed)
+	}
+}
+
 // Implement RetrievalSubscriber
 func makeOnRetrievalEvent(
 	ctx context.Context,
 	eventManager *events.EventManager,
 	spTracker *spTracker,
+	reputation *ReputationStore,
 	retrievalCid cid.Cid,
 	retrievalId types.RetrievalID,
 	eventStats *eventStats,
@@ -286,11 +534,14 @@ func makeOnRetrievalEvent(
 			handleStartedEvent(ret)
 		case events.RetrievalEventFailed:
 			handleFailureEvent(ctx, spTracker, retrievalId, eventStats, ret)
+		case events.RetrievalEventMisbehaved:
+			handleMisbehavedEvent(spTracker, retrievalId, ret)
 		case events.RetrievalEventQueryAsked: // query-ask success
 			handleQueryAskEvent(ctx, eventStats, ret)
 		case events.RetrievalEventQueryAskedFiltered:
-			handleQueryAskFilteredEvent(eventStats)
+			handleQueryAskFilteredEvent(ctx, eventStats, ret)
 		}
+		recordReputation(reputation, event)
 
 		eventManager.DispatchEvent(event)
 		if eventsCb != nil {
@@ -299,7 +550,33 @@ func makeOnRetrievalEvent(
 	}
 }
 
-func handleQueryAskFilteredEvent(eventStats *eventStats) {
+// recordReputation updates the long term history of the storage provider
+// involved in the event, which the local stores don't have
+func recordReputation(reputation *ReputationStore, event types.RetrievalEvent) {
+	if event.Phase() == types.IndexerPhase || event.StorageProviderId() == peer.ID("") || event.StorageProviderId() == LocalStorageProviderId {
+		return
+	}
+	protocol, ok := types.EventProtocol(event)
+	if !ok {
+		return
+	}
+	switch tevent := event.(type) {
+	case events.RetrievalEventFirstByte:
+		reputation.RecordFirstByte(tevent.StorageProviderId(), protocol, tevent.Time().Sub(tevent.PhaseStartTime()))
+	case events.RetrievalEventSuccess:
+		reputation.RecordSuccess(tevent.StorageProviderId(), protocol, tevent.ReceivedSize(), tevent.Duration())
+	case events.RetrievalEventFailed:
+		reputation.RecordFailure(tevent.StorageProviderId(), protocol, tevent.ErrorMessage())
+	case events.RetrievalEventMisbehaved:
+		reputation.RecordFailure(tevent.StorageProviderId(), protocol, tevent.Reason())
+	}
+}
+
+func handleQueryAskFilteredEvent(ctx context.Context, eventStats *eventStats, event events.RetrievalEventQueryAskedFiltered) {
+	if event.Rejected() {
+		stats.Record(ctx, metrics.QueryRejectedCount.M(1))
+		return
+	}
 	eventStats.filteredQueryCount++
 	if eventStats.filteredQueryCount == 1 {
 		stats.Record(context.Background(), metrics.RequestWithSuccessfulQueriesFilteredCount.M(1))
@@ -317,6 +594,21 @@ func handleQueryAskEvent(
 	}
 }
 
+// handleMisbehavedEvent suspends a storage provider that sent data it
+// shouldn't have straight away, rather than waiting for repeated failures
+func handleMisbehavedEvent(spTracker *spTracker, retrievalId types.RetrievalID, event events.RetrievalEventMisbehaved) {
+	if event.StorageProviderId() == peer.ID("") || event.StorageProviderId() == LocalStorageProviderId {
+		return
+	}
+	log.Warnf(
+		"Storage provider %s misbehaved retrieving %s: %s",
+		event.StorageProviderId(),
+		event.PayloadCid(),
+		event.Reason(),
+	)
+	spTracker.RecordMisbehaviour(event.StorageProviderId(), retrievalId, event.Reason())
+}
+
 // handleFailureEvent is called when a query _or_ retrieval fails
 func handleFailureEvent(
 	ctx context.Context,
@@ -325,6 +617,11 @@ func handleFailureEvent(
 	eventStats *eventStats,
 	event events.RetrievalEventFailed,
 ) {
+	if event.StorageProviderId() == LocalStorageProviderId {
+		// the local stores missing blocks isn't a storage provider failing
+		log.Debugf("Failed to retrieve %s from the local stores: %s", event.PayloadCid(), event.ErrorMessage())
+		return
+	}
 	if event.Phase() != types.IndexerPhase { // indexer failures don't have a storageProviderId
 		spTracker.RecordFailure(event.StorageProviderId(), retrievalId)
 	}
@@ -370,7 +667,7 @@ func handleFailureEvent(
 }
 
 func handleStartedEvent(event events.RetrievalEventStarted) {
-	if event.Phase() == types.RetrievalPhase {
+	if event.Phase() == types.RetrievalPhase && event.StorageProviderId() != LocalStorageProviderId {
 		stats.Record(context.Background(), metrics.RetrievalRequestCount.M(1))
 		stats.Record(context.Background(), metrics.RetrievalDealActiveCount.M(1))
 	}
@@ -430,10 +727,16 @@ func logEvent(event types.RetrievalEvent) {
 			"queryResponse:MaxPaymentIntervalIncrease", tevent.QueryResponse().MaxPaymentIntervalIncrease,
 			"queryResponse:Message", tevent.QueryResponse().Message,
 			"queryResponse:UnsealPrice", tevent.QueryResponse().UnsealPrice)
+		if filtered, ok := tevent.(events.RetrievalEventQueryAskedFiltered); ok && filtered.Rejected() {
+			logadd("reason", filtered.Reason())
+		}
 	case events.EventWithCandidates:
 		var cands = strings.Builder{}
 		for i, c := range tevent.Candidates() {
 			cands.WriteString(c.MinerPeer.ID.String())
+			if c.Source != "" {
+				cands.WriteString(" (" + c.Source + ")")
+			}
 			if i < len(tevent.Candidates())-1 {
 				cands.WriteString(", ")
 			}
@@ -443,6 +746,14 @@ func logEvent(event types.RetrievalEvent) {
 		logadd("errorMessage", tevent.ErrorMessage())
 	case events.RetrievalEventSuccess:
 		logadd("receivedSize", tevent.ReceivedSize())
+	case events.RetrievalEventSuspended:
+		logadd("duration", tevent.Duration(), "reason", tevent.Reason())
+	case events.RetrievalEventUnsuspended:
+		logadd("reason", tevent.Reason())
+	case events.RetrievalEventMisbehaved:
+		logadd("reason", tevent.Reason())
+	case events.RetrievalEventRetrying:
+		logadd("attempt", tevent.Attempt(), "delay", tevent.Delay(), "reason", tevent.Reason())
 	}
 	log.Debugw("retrieval-event", kv...)
 }
@@ -310,6 +310,44 @@ func TestRetriever(t *testing.T) {
 				events.Success(rid, rst, types.NewRetrievalCandidate(peerB, cid1), 20, 30, 40*time.Second, big.Zero()),
 			},
 		},
+		{
+			name: "whitelist doesn't exclude the local stores",
+			setup: func(rc *retriever.RetrieverConfig) {
+				rc.MinerWhitelist = map[peer.ID]bool{peerA: true}
+			},
+			candidates: []types.RetrievalCandidate{
+				{MinerPeer: peer.AddrInfo{ID: peerB}, RootCid: cid1, Metadata: metadata.Default.New(&metadata.GraphsyncFilecoinV1{})},
+				{MinerPeer: peer.AddrInfo{ID: retriever.LocalStorageProviderId}, RootCid: cid1, Metadata: metadata.Default.New(&metadata.GraphsyncFilecoinV1{})},
+			},
+			returns_queries: map[string]testutil.DelayedQueryReturn{
+				string(retriever.LocalStorageProviderId): {QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}, Err: nil, Delay: time.Millisecond * 20},
+			},
+			returns_retrievals: map[string]testutil.DelayedRetrievalReturn{
+				string(retriever.LocalStorageProviderId): {ResultStats: &types.RetrievalStats{
+					StorageProviderId: retriever.LocalStorageProviderId,
+					Size:              1,
+					Blocks:            2,
+					Duration:          3 * time.Second,
+					TotalPayment:      big.Zero(),
+					RootCid:           cid1,
+					AskPrice:          abi.NewTokenAmount(0),
+				}, Delay: time.Millisecond * 5},
+			},
+			expectedEvents: []types.RetrievalEvent{
+				events.Started(rid, ist, types.IndexerPhase, types.RetrievalCandidate{RootCid: cid1}),
+				events.CandidatesFound(rid, ist, cid1, []types.RetrievalCandidate{types.NewRetrievalCandidate(peerB, cid1), types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)}),
+				events.CandidatesFiltered(rid, ist, cid1, []types.RetrievalCandidate{types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)}),
+				events.Started(rid, qst, types.QueryPhase, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)),
+				events.Connected(rid, qst, types.QueryPhase, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)),
+				events.QueryAsked(rid, qst, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1), retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}),
+				events.QueryAskedFiltered(rid, qst, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1), retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}),
+				events.Started(rid, rst, types.RetrievalPhase, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)),
+				events.Proposed(rid, rst, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)),
+				events.Accepted(rid, rst, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)),
+				events.FirstByte(rid, rst, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1)),
+				events.Success(rid, rst, types.NewRetrievalCandidate(retriever.LocalStorageProviderId, cid1), 1, 2, 3*time.Second, big.Zero()),
+			},
+		},
 		{
 			name: "no candidates",
 			setup: func(rc *retriever.RetrieverConfig) {
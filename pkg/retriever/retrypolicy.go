@@ -0,0 +1,136 @@
+package retriever
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	DefaultRetryBackoff    = time.Second
+	DefaultMaxRetryBackoff = 30 * time.Second
+)
+
+// DefaultRetryableFailures are the failures, matched against the error
+// messages of failed queries and retrievals, that are likely to be transient
+// and so worth attempting a retrieval again for
+var DefaultRetryableFailures = []string{
+	"Too many retrieval deals received",
+	"Under maintenance, retry later",
+	"timeout after ",
+}
+
+// RetryPolicy determines whether a retrieval is attempted again once every
+// candidate has failed. Each retry finds candidates afresh, skipping storage
+// providers that have already failed for the retrieval. Zero values for
+// Backoff, MaxBackoff and RetryableFailures are replaced with defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts at a retrieval, including
+	// the first; 0 or 1 disables retries
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubling for each retry
+	// that follows
+	Backoff time.Duration
+	// MaxBackoff is the longest delay between attempts
+	MaxBackoff time.Duration
+	// RetryableFailures lists error message substrings, as used to classify
+	// failures for metrics, of which at least one must be matched by a failure
+	// in an attempt for the retrieval to be retried
+	RetryableFailures []string
+}
+
+// backoff returns the delay before the given attempt, where the first retry
+// is attempt 2
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := rp.Backoff
+	if backoff == 0 {
+		backoff = DefaultRetryBackoff
+	}
+	maxBackoff := rp.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = DefaultMaxRetryBackoff
+	}
+	for i := 2; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// isRetryable determines whether any of the error messages match a
+// retryable failure
+func (rp RetryPolicy) isRetryable(errorMessages []string) bool {
+	retryableFailures := rp.RetryableFailures
+	if len(retryableFailures) == 0 {
+		retryableFailures = DefaultRetryableFailures
+	}
+	for _, msg := range errorMessages {
+		for _, substr := range retryableFailures {
+			if strings.Contains(msg, substr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryFailures collects the failures that occur across the attempts at a
+// retrieval
+type retryFailures struct {
+	lk            sync.Mutex
+	failed        map[peer.ID]struct{}
+	errorMessages []string
+}
+
+func newRetryFailures() *retryFailures {
+	return &retryFailures{failed: make(map[peer.ID]struct{})}
+}
+
+func (rf *retryFailures) record(event types.RetrievalEvent) {
+	failed, ok := event.(events.RetrievalEventFailed)
+	if !ok || failed.Phase() == types.IndexerPhase {
+		return
+	}
+	rf.lk.Lock()
+	defer rf.lk.Unlock()
+	if failed.StorageProviderId() != peer.ID("") {
+		rf.failed[failed.StorageProviderId()] = struct{}{}
+	}
+	rf.errorMessages = append(rf.errorMessages, failed.ErrorMessage())
+}
+
+// nextAttempt returns the error messages of the failures in the attempt just
+// made and the storage providers that have failed in any attempt so far
+func (rf *retryFailures) nextAttempt() ([]string, map[peer.ID]struct{}) {
+	rf.lk.Lock()
+	defer rf.lk.Unlock()
+	errorMessages := rf.errorMessages
+	rf.errorMessages = nil
+	failed := make(map[peer.ID]struct{}, len(rf.failed))
+	for storageProviderId := range rf.failed {
+		failed[storageProviderId] = struct{}{}
+	}
+	return errorMessages, failed
+}
+
+type excludedStorageProvidersKey struct{}
+
+// withExcludedStorageProviders attaches a set of storage providers to a
+// context, candidates for these storage providers are not retrieved from by a
+// retrieval made with the context
+func withExcludedStorageProviders(ctx context.Context, excluded map[peer.ID]struct{}) context.Context {
+	return context.WithValue(ctx, excludedStorageProvidersKey{}, excluded)
+}
+
+func isExcludedStorageProvider(ctx context.Context, storageProviderId peer.ID) bool {
+	excluded, _ := ctx.Value(excludedStorageProvidersKey{}).(map[peer.ID]struct{})
+	_, has := excluded[storageProviderId]
+	return has
+}
@@ -0,0 +1,213 @@
+package retriever_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/lassie/pkg/events"
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	cid1 := cid.MustParse("bafkqaalb")
+	peerA := peer.ID("A")
+	peerB := peer.ID("B")
+	candidateA := types.RetrievalCandidate{MinerPeer: peer.AddrInfo{ID: peerA}, RootCid: cid1, Metadata: metadata.Default.New(&metadata.GraphsyncFilecoinV1{})}
+	candidateB := types.RetrievalCandidate{MinerPeer: peer.AddrInfo{ID: peerB}, RootCid: cid1, Metadata: metadata.Default.New(&metadata.GraphsyncFilecoinV1{})}
+	queryReturn := testutil.DelayedQueryReturn{QueryResponse: &retrievalmarket.QueryResponse{Status: retrievalmarket.QueryResponseAvailable, MinPricePerByte: big.Zero(), Size: 2, UnsealPrice: big.Zero()}, Delay: time.Millisecond * 5}
+	statsB := &types.RetrievalStats{StorageProviderId: peerB, Size: 10, Blocks: 11, RootCid: cid1, TotalPayment: big.Zero()}
+	tooMany := testutil.DelayedRetrievalReturn{ResultErr: errors.New("Too many retrieval deals received"), Delay: time.Millisecond * 5}
+
+	testCases := []struct {
+		name             string
+		retryPolicy      retriever.RetryPolicy
+		candidates       [][]types.RetrievalCandidate
+		retrievalReturns map[string]testutil.DelayedRetrievalReturn
+		expectedStats    *types.RetrievalStats
+		// expectedAttempts is the number of times candidates are found
+		expectedAttempts int
+		// expectedRetrievals are the storage providers retrieved from, in order
+		expectedRetrievals []peer.ID
+	}{
+		{
+			name:        "retries with fresh candidates, skipping failed storage providers",
+			retryPolicy: retriever.RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond},
+			candidates:  [][]types.RetrievalCandidate{{candidateA}, {candidateA, candidateB}},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				string(peerA): tooMany,
+				string(peerB): {ResultStats: statsB, Delay: time.Millisecond * 5},
+			},
+			expectedStats:      statsB,
+			expectedAttempts:   2,
+			expectedRetrievals: []peer.ID{peerA, peerB},
+		},
+		{
+			name:       "does not retry without a retry policy",
+			candidates: [][]types.RetrievalCandidate{{candidateA}, {candidateB}},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				string(peerA): tooMany,
+				string(peerB): {ResultStats: statsB, Delay: time.Millisecond * 5},
+			},
+			expectedAttempts:   1,
+			expectedRetrievals: []peer.ID{peerA},
+		},
+		{
+			name:        "does not retry failures that are not retryable",
+			retryPolicy: retriever.RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond},
+			candidates:  [][]types.RetrievalCandidate{{candidateA}, {candidateB}},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				string(peerA): {ResultErr: errors.New("bork!"), Delay: time.Millisecond * 5},
+				string(peerB): {ResultStats: statsB, Delay: time.Millisecond * 5},
+			},
+			expectedAttempts:   1,
+			expectedRetrievals: []peer.ID{peerA},
+		},
+		{
+			name: "retries custom retryable failures",
+			retryPolicy: retriever.RetryPolicy{
+				MaxAttempts:       3,
+				Backoff:           10 * time.Millisecond,
+				RetryableFailures: []string{"bork!"},
+			},
+			candidates: [][]types.RetrievalCandidate{{candidateA}, {candidateB}},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				string(peerA): {ResultErr: errors.New("bork!"), Delay: time.Millisecond * 5},
+				string(peerB): {ResultStats: statsB, Delay: time.Millisecond * 5},
+			},
+			expectedStats:      statsB,
+			expectedAttempts:   2,
+			expectedRetrievals: []peer.ID{peerA, peerB},
+		},
+		{
+			name:        "gives up after max attempts",
+			retryPolicy: retriever.RetryPolicy{MaxAttempts: 2, Backoff: 10 * time.Millisecond},
+			candidates:  [][]types.RetrievalCandidate{{candidateA}, {candidateB}, {candidateB}},
+			retrievalReturns: map[string]testutil.DelayedRetrievalReturn{
+				string(peerA): tooMany,
+				string(peerB): tooMany,
+			},
+			expectedAttempts:   2,
+			expectedRetrievals: []peer.ID{peerA, peerB},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rid := types.RetrievalID(uuid.New())
+			candidateFinder := &sequenceCandidateFinder{candidates: tc.candidates}
+			client := testutil.NewMockClient(map[string]testutil.DelayedQueryReturn{
+				string(peerA): queryReturn,
+				string(peerB): queryReturn,
+			}, tc.retrievalReturns)
+			ret, err := retriever.NewRetriever(context.Background(), retriever.RetrieverConfig{RetryPolicy: tc.retryPolicy}, client, candidateFinder, nil)
+			require.NoError(t, err)
+			ret.Start()
+			defer ret.Stop()
+
+			var lk sync.Mutex
+			retrying := make([]events.RetrievalEventRetrying, 0)
+			filtered := make([][]types.RetrievalCandidate, 0)
+			stats, err := ret.Retrieve(context.Background(), types.RetrievalRequest{
+				LinkSystem:  cidlink.DefaultLinkSystem(),
+				RetrievalID: rid,
+				Cid:         cid1,
+			}, func(event types.RetrievalEvent) {
+				lk.Lock()
+				defer lk.Unlock()
+				require.Equal(t, rid, event.RetrievalId())
+				switch tevent := event.(type) {
+				case events.RetrievalEventRetrying:
+					retrying = append(retrying, tevent)
+				case events.RetrievalEventCandidatesFiltered:
+					filtered = append(filtered, tevent.Candidates())
+				}
+			})
+			if tc.expectedStats != nil {
+				require.NoError(t, err)
+				require.Equal(t, tc.expectedStats, stats)
+			} else {
+				require.ErrorIs(t, err, retriever.ErrAllRetrievalsFailed)
+				require.Nil(t, stats)
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+			require.Equal(t, tc.expectedAttempts, candidateFinder.calls())
+			require.Len(t, retrying, tc.expectedAttempts-1)
+			for ii, event := range retrying {
+				require.Equal(t, ii+2, event.Attempt())
+				require.Equal(t, tc.retryPolicy.Backoff<<ii, event.Delay())
+			}
+			// storage providers that failed in an earlier attempt are filtered out
+			failed := make(map[peer.ID]struct{})
+			for ii, candidates := range filtered {
+				for _, candidate := range candidates {
+					require.NotContains(t, failed, candidate.MinerPeer.ID)
+				}
+				for _, candidate := range tc.candidates[ii] {
+					failed[candidate.MinerPeer.ID] = struct{}{}
+				}
+			}
+			retrievals := client.GetReceivedRetrievals()
+			retrievedFrom := make([]peer.ID, 0, len(retrievals))
+			for _, rr := range retrievals {
+				retrievedFrom = append(retrievedFrom, rr.Peer)
+			}
+			require.Equal(t, tc.expectedRetrievals, retrievedFrom)
+		})
+	}
+}
+
+// sequenceCandidateFinder finds a different set of candidates each time it is
+// called, repeating the last set once all have been found
+type sequenceCandidateFinder struct {
+	lk         sync.Mutex
+	candidates [][]types.RetrievalCandidate
+	call       int
+}
+
+func (scf *sequenceCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	scf.lk.Lock()
+	defer scf.lk.Unlock()
+	candidates := scf.candidates[len(scf.candidates)-1]
+	if scf.call < len(scf.candidates) {
+		candidates = scf.candidates[scf.call]
+	}
+	scf.call++
+	return candidates, nil
+}
+
+func (scf *sequenceCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	candidates, err := scf.FindCandidates(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	rch := make(chan types.FindCandidatesResult, len(candidates))
+	for _, candidate := range candidates {
+		rch <- types.FindCandidatesResult{Candidate: candidate}
+	}
+	close(rch)
+	return rch, nil
+}
+
+func (scf *sequenceCandidateFinder) calls() int {
+	scf.lk.Lock()
+	defer scf.lk.Unlock()
+	return scf.call
+}
@@ -2,9 +2,12 @@ package retriever
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/lassie/pkg/events"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -18,43 +21,129 @@ type activeRetrieval struct {
 type trackedSp struct {
 	suspensionStart    time.Time
 	suspensionDuration time.Duration
-	failures           []time.Time // should be ordered, oldest to newest
-	concurrency        uint
+	// fires when the suspension expires
+	suspensionTimer *clock.Timer
+	failures        []time.Time // should be ordered, oldest to newest
+	concurrency     uint
 }
 
-func (status *trackedSp) isSuspended() bool {
-	return !status.suspensionStart.IsZero() && time.Since(status.suspensionStart) < status.suspensionDuration
+func (status *trackedSp) isSuspended(now time.Time) bool {
+	return !status.suspensionStart.IsZero() && now.Sub(status.suspensionStart) < status.suspensionDuration
 }
 
-type spTrackerConfig struct {
-	maxFailuresBeforeSuspend uint
-	failureHistoryDuration   time.Duration
-	suspensionDuration       time.Duration
+// clearSuspension lifts a suspension, stopping its expiry
+func (status *trackedSp) clearSuspension() {
+	if status.suspensionTimer != nil {
+		status.suspensionTimer.Stop()
+	}
+	status.suspensionStart = time.Time{}
+	status.suspensionDuration = 0
+	status.suspensionTimer = nil
+}
+
+// SpTrackerConfig is the policy for suspending storage providers that fail
+// too often. A storage provider is suspended for SuspensionDuration once it has
+// more than MaxFailuresBeforeSuspend failures within FailureHistoryDuration.
+// Zero values are replaced with defaults of 5 failures within 30 seconds
+// leading to a 10 minute suspension.
+type SpTrackerConfig struct {
+	MaxFailuresBeforeSuspend uint
+	FailureHistoryDuration   time.Duration
+	SuspensionDuration       time.Duration
+}
+
+const (
+	defaultMaxFailuresBeforeSuspend = 5
+	defaultFailureHistoryDuration   = time.Second * 30
+	defaultSuspensionDuration       = time.Minute * 10
+)
+
+// StorageProviderSuspension describes an active suspension of a storage
+// provider along with its recent failure history
+type StorageProviderSuspension struct {
+	StorageProviderId peer.ID
+	SuspensionStart   time.Time
+	Duration          time.Duration
+	Failures          []time.Time
 }
 
 type spTracker struct {
-	lk  sync.RWMutex
-	cfg spTrackerConfig
+	lk    sync.RWMutex
+	cfg   SpTrackerConfig
+	clock clock.Clock
 	// active retrievals
 	arm map[types.RetrievalID]activeRetrieval
 	// failures and concurrency of storage providers
 	spm map[peer.ID]trackedSp
+	// called, outside of the lock, when a storage provider's suspension state
+	// changes
+	onSuspensionChange func(types.RetrievalEvent)
+	// optional long term history, storage providers with a poor reputation are
+	// suspended after fewer failures
+	reputation *ReputationStore
 }
 
 // newSpTracker creates a new spTracker with the given config. If the config is
-// nil, a default config will be used.
-func newSpTracker(cfg *spTrackerConfig) *spTracker {
+// nil, a default config will be used. Any zero values in the config will be
+// replaced with defaults.
+func newSpTracker(cfg *SpTrackerConfig) *spTracker {
+	return newSpTrackerWithClock(cfg, clock.New())
+}
+
+func newSpTrackerWithClock(cfg *SpTrackerConfig, clock clock.Clock) *spTracker {
 	if cfg == nil {
-		cfg = &spTrackerConfig{
-			maxFailuresBeforeSuspend: 5,
-			suspensionDuration:       time.Minute * 10,
-			failureHistoryDuration:   time.Second * 30,
-		}
+		cfg = &SpTrackerConfig{}
+	}
+	c := *cfg
+	if c.MaxFailuresBeforeSuspend == 0 {
+		c.MaxFailuresBeforeSuspend = defaultMaxFailuresBeforeSuspend
+	}
+	if c.FailureHistoryDuration == 0 {
+		c.FailureHistoryDuration = defaultFailureHistoryDuration
+	}
+	if c.SuspensionDuration == 0 {
+		c.SuspensionDuration = defaultSuspensionDuration
 	}
 	return &spTracker{
-		cfg: *cfg,
-		arm: make(map[types.RetrievalID]activeRetrieval),
-		spm: make(map[peer.ID]trackedSp),
+		cfg:   c,
+		clock: clock,
+		arm:   make(map[types.RetrievalID]activeRetrieval),
+		spm:   make(map[peer.ID]trackedSp),
+	}
+}
+
+func (spt *spTracker) notifySuspensionChange(event types.RetrievalEvent) {
+	if spt.onSuspensionChange != nil {
+		spt.onSuspensionChange(event)
+	}
+}
+
+// suspend starts a suspension of a storage provider, replacing any it already
+// has, and schedules its expiry. It must be called with the lock held.
+func (spt *spTracker) suspend(storageProviderId peer.ID, status *trackedSp, duration time.Duration) {
+	status.clearSuspension()
+	start := spt.clock.Now()
+	status.suspensionStart = start
+	status.suspensionDuration = duration
+	status.suspensionTimer = spt.clock.AfterFunc(duration, func() {
+		spt.expireSuspension(storageProviderId, start)
+	})
+}
+
+// expireSuspension clears a suspension that has run its course and notifies of
+// the change, unless it was replaced or lifted in the meantime
+func (spt *spTracker) expireSuspension(storageProviderId peer.ID, start time.Time) {
+	spt.lk.Lock()
+	status, has := spt.spm[storageProviderId]
+	expired := has && status.suspensionStart.Equal(start)
+	if expired {
+		status.clearSuspension()
+		spt.spm[storageProviderId] = status
+	}
+	spt.lk.Unlock()
+	if expired {
+		log.Infof("Suspension expired for storage provider %s", storageProviderId)
+		spt.notifySuspensionChange(events.Unsuspended(types.RetrievalID{}, cid.Undef, storageProviderId, "suspension expired"))
 	}
 }
 
@@ -132,10 +221,112 @@ func (spt *spTracker) GetConcurrency(storageProviderId peer.ID) uint {
 func (spt *spTracker) IsSuspended(storageProviderId peer.ID) bool {
 	spt.lk.RLock()
 	defer spt.lk.RUnlock()
-	if status, has := spt.spm[storageProviderId]; has {
-		return status.isSuspended()
+	status, has := spt.spm[storageProviderId]
+	return has && status.isSuspended(spt.clock.Now())
+}
+
+// Suspensions returns the active suspensions, ordered by storage provider
+func (spt *spTracker) Suspensions() []StorageProviderSuspension {
+	spt.lk.RLock()
+	defer spt.lk.RUnlock()
+	suspensions := make([]StorageProviderSuspension, 0)
+	now := spt.clock.Now()
+	for id, status := range spt.spm {
+		if status.isSuspended(now) {
+			suspensions = append(suspensions, StorageProviderSuspension{
+				StorageProviderId: id,
+				SuspensionStart:   status.suspensionStart,
+				Duration:          status.suspensionDuration,
+				Failures:          append([]time.Time{}, status.failures...),
+			})
+		}
+	}
+	sort.Slice(suspensions, func(i, j int) bool {
+		return suspensions[i].StorageProviderId < suspensions[j].StorageProviderId
+	})
+	return suspensions
+}
+
+// Suspend manually suspends a storage provider for the given duration, or the
+// configured suspension duration if zero
+func (spt *spTracker) Suspend(storageProviderId peer.ID, duration time.Duration) {
+	if duration == 0 {
+		duration = spt.cfg.SuspensionDuration
+	}
+	spt.lk.Lock()
+	status := spt.spm[storageProviderId]
+	spt.suspend(storageProviderId, &status, duration)
+	spt.spm[storageProviderId] = status
+	spt.lk.Unlock()
+
+	log.Warnf("Manually suspending storage provider for %s: %s", duration, storageProviderId)
+	spt.notifySuspensionChange(events.Suspended(types.RetrievalID{}, cid.Undef, storageProviderId, duration, "manual suspension"))
+}
+
+// RecordMisbehaviour suspends a storage provider immediately, for the
+// configured suspension duration, after it sent data it should not have. A
+// storage provider that is already suspended stays suspended until its
+// suspension expires.
+func (spt *spTracker) RecordMisbehaviour(storageProviderId peer.ID, retrievalId types.RetrievalID, reason string) {
+	spt.lk.Lock()
+	status := spt.spm[storageProviderId]
+	if status.isSuspended(spt.clock.Now()) {
+		spt.lk.Unlock()
+		return
+	}
+	spt.suspend(storageProviderId, &status, spt.cfg.SuspensionDuration)
+	spt.spm[storageProviderId] = status
+	var payloadCid cid.Cid
+	if ar, has := spt.arm[retrievalId]; has {
+		payloadCid = ar.cid
+	}
+	spt.lk.Unlock()
+
+	log.Warnf("Suspending misbehaving storage provider for %s: %s", spt.cfg.SuspensionDuration, storageProviderId)
+	spt.notifySuspensionChange(events.Suspended(retrievalId, payloadCid, storageProviderId, spt.cfg.SuspensionDuration, "misbehaved: "+reason))
+}
+
+// Unsuspend lifts the suspension of a storage provider and clears its failure
+// history, returning false if the storage provider was not suspended
+func (spt *spTracker) Unsuspend(storageProviderId peer.ID) bool {
+	spt.lk.Lock()
+	status, has := spt.spm[storageProviderId]
+	wasSuspended := has && status.isSuspended(spt.clock.Now())
+	if has {
+		status.clearSuspension()
+		status.failures = nil
+		spt.spm[storageProviderId] = status
 	}
-	return false
+	spt.lk.Unlock()
+
+	if wasSuspended {
+		log.Infof("Manually unsuspending storage provider %s", storageProviderId)
+		spt.notifySuspensionChange(events.Unsuspended(types.RetrievalID{}, cid.Undef, storageProviderId, "manual unsuspension"))
+	}
+	return wasSuspended
+}
+
+// restoreSuspension reinstates a suspension that was in place before a
+// restart, it does not notify of a suspension change
+func (spt *spTracker) restoreSuspension(storageProviderId peer.ID, until time.Time) {
+	duration := until.Sub(spt.clock.Now())
+	if duration <= 0 {
+		return
+	}
+	spt.lk.Lock()
+	defer spt.lk.Unlock()
+	status := spt.spm[storageProviderId]
+	spt.suspend(storageProviderId, &status, duration)
+	spt.spm[storageProviderId] = status
+}
+
+// maxFailuresBeforeSuspend halves the configured number of failures before a
+// storage provider is suspended if its reputation shows it to be unreliable
+func (spt *spTracker) maxFailuresBeforeSuspend(storageProviderId peer.ID) uint {
+	if spt.reputation != nil && spt.reputation.IsUnreliable(storageProviderId) {
+		return spt.cfg.MaxFailuresBeforeSuspend / 2
+	}
+	return spt.cfg.MaxFailuresBeforeSuspend
 }
 
 // RemoveStorageProviderFromRetrieval removes a storage provider from a an
@@ -180,16 +371,20 @@ func (spt *spTracker) RecordFailure(storageProviderId peer.ID, retrievalId types
 	if err := spt.RemoveStorageProviderFromRetrieval(storageProviderId, retrievalId); err != nil {
 		return err
 	}
+	maxFailures := spt.maxFailuresBeforeSuspend(storageProviderId)
 
 	spt.lk.Lock()
-	defer spt.lk.Unlock()
-
 	status := spt.spm[storageProviderId]
+	now := spt.clock.Now()
+	var payloadCid cid.Cid
+	if ar, has := spt.arm[retrievalId]; has {
+		payloadCid = ar.cid
+	}
 
 	// Filter out expired history
 	n := 0
 	for _, failure := range status.failures {
-		if time.Since(failure) <= spt.cfg.failureHistoryDuration {
+		if now.Sub(failure) <= spt.cfg.FailureHistoryDuration {
 			status.failures[n] = failure
 			n++
 		}
@@ -197,25 +392,28 @@ func (spt *spTracker) RecordFailure(storageProviderId peer.ID, retrievalId types
 	status.failures = status.failures[:n]
 
 	// Add new failure to history
-	status.failures = append(status.failures, time.Now())
+	status.failures = append(status.failures, now)
 
-	// Decide whether to suspend miner
-	if len(status.failures) > int(spt.cfg.maxFailuresBeforeSuspend) {
-		status.suspensionStart = time.Now()
-		status.suspensionDuration = spt.cfg.suspensionDuration
+	// Decide whether to suspend miner, a suspended one stays suspended until
+	// its suspension expires
+	suspending := !status.isSuspended(now) && len(status.failures) > int(maxFailures)
+	if suspending {
+		spt.suspend(storageProviderId, &status, spt.cfg.SuspensionDuration)
 	}
 
-	if status.isSuspended() {
+	// Write updated status back to map
+	spt.spm[storageProviderId] = status
+	spt.lk.Unlock()
+
+	if suspending {
+		reason := fmt.Sprintf("%d failures within %s", len(status.failures), now.Sub(status.failures[0]))
 		log.Warnf(
-			"Suspending storage provider for %s after %d failures within %s: %s",
+			"Suspending storage provider for %s after %s: %s",
 			status.suspensionDuration,
-			len(status.failures),
-			time.Since(status.failures[0]),
+			reason,
 			storageProviderId,
 		)
+		spt.notifySuspensionChange(events.Suspended(retrievalId, payloadCid, storageProviderId, status.suspensionDuration, reason))
 	}
-
-	// Write updated status back to map
-	spt.spm[storageProviderId] = status
 	return nil
 }
@@ -1,9 +1,12 @@
 package retriever
 
 import (
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/filecoin-project/lassie/pkg/events"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
@@ -19,39 +22,161 @@ func TestSuspend(t *testing.T) {
 	testSPB := peer.ID("B")
 	testSPC := peer.ID("C")
 
-	cfg := &spTrackerConfig{
-		maxFailuresBeforeSuspend: 3,
-		failureHistoryDuration:   time.Millisecond * 50,
-		suspensionDuration:       time.Millisecond * 50,
+	cfg := &SpTrackerConfig{
+		MaxFailuresBeforeSuspend: 3,
+		FailureHistoryDuration:   time.Millisecond * 50,
+		SuspensionDuration:       time.Millisecond * 50,
 	}
 
-	tracker := newSpTracker(cfg)
+	clock := clock.NewMock()
+	tracker := newSpTrackerWithClock(cfg, clock)
+	var lk sync.Mutex
+	var receivedEvents []types.RetrievalEvent
+	tracker.onSuspensionChange = func(event types.RetrievalEvent) {
+		lk.Lock()
+		defer lk.Unlock()
+		receivedEvents = append(receivedEvents, event)
+	}
+	eventCount := func() int {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(receivedEvents)
+	}
 
 	assert.True(t, tracker.RegisterRetrieval(ret, cid))
 
 	// Must have max failures + 1 logged and be marked as suspended... and then
 	// no longer be marked as suspended after the suspension duration is up
-	for i := uint(0); i < cfg.maxFailuresBeforeSuspend+1; i++ {
+	for i := uint(0); i < cfg.MaxFailuresBeforeSuspend+1; i++ {
 		require.NoError(t, tracker.AddToRetrieval(ret, []peer.ID{testSPA}))
 		require.NoError(t, tracker.RecordFailure(testSPA, ret))
 	}
-	require.Len(t, tracker.spm[testSPA].failures, int(cfg.maxFailuresBeforeSuspend+1))
+	require.Len(t, tracker.spm[testSPA].failures, int(cfg.MaxFailuresBeforeSuspend+1))
 	require.True(t, tracker.IsSuspended(testSPA))
-	require.Eventually(
-		t,
-		func() bool { return !tracker.IsSuspended(testSPA) },
-		cfg.suspensionDuration*time.Duration(3),
-		time.Millisecond,
-	)
+	require.Equal(t, 1, eventCount())
+
+	// failing while suspended neither extends the suspension nor signals again
+	clock.Add(cfg.SuspensionDuration / 2)
+	require.NoError(t, tracker.AddToRetrieval(ret, []peer.ID{testSPA}))
+	require.NoError(t, tracker.RecordFailure(testSPA, ret))
+	require.True(t, tracker.IsSuspended(testSPA))
+	require.Equal(t, 1, eventCount())
+
+	// the expiry is signalled as it happens
+	clock.Add(cfg.SuspensionDuration / 2)
+	require.Equal(t, 2, eventCount())
+	unsuspended, ok := receivedEvents[1].(events.RetrievalEventUnsuspended)
+	require.True(t, ok)
+	require.Equal(t, testSPA, unsuspended.StorageProviderId())
+	require.False(t, tracker.IsSuspended(testSPA))
 
 	// Must have max failures and not be marked as suspended
-	for i := uint(0); i < cfg.maxFailuresBeforeSuspend; i++ {
+	for i := uint(0); i < cfg.MaxFailuresBeforeSuspend; i++ {
 		require.NoError(t, tracker.AddToRetrieval(ret, []peer.ID{testSPB}))
 		require.NoError(t, tracker.RecordFailure(testSPB, ret))
 	}
-	require.Len(t, tracker.spm[testSPB].failures, int(cfg.maxFailuresBeforeSuspend))
+	require.Len(t, tracker.spm[testSPB].failures, int(cfg.MaxFailuresBeforeSuspend))
 	require.False(t, tracker.IsSuspended(testSPB))
 	require.False(t, tracker.IsSuspended(testSPC)) // one we've never registered
+
+	// failures outside of the history don't count towards a suspension
+	clock.Add(cfg.FailureHistoryDuration + time.Millisecond)
+	require.NoError(t, tracker.AddToRetrieval(ret, []peer.ID{testSPB}))
+	require.NoError(t, tracker.RecordFailure(testSPB, ret))
+	require.Len(t, tracker.spm[testSPB].failures, 1)
+	require.False(t, tracker.IsSuspended(testSPB))
+	require.Equal(t, 2, eventCount())
+}
+
+func TestManualSuspend(t *testing.T) {
+	ret := types.RetrievalID(uuid.New())
+	cid := cid.MustParse("bafkqaalb")
+	testSPA := peer.ID("A")
+	testSPB := peer.ID("B")
+
+	tracker := newSpTracker(&SpTrackerConfig{MaxFailuresBeforeSuspend: 1})
+	var receivedEvents []types.RetrievalEvent
+	tracker.onSuspensionChange = func(event types.RetrievalEvent) {
+		receivedEvents = append(receivedEvents, event)
+	}
+	require.True(t, tracker.RegisterRetrieval(ret, cid))
+
+	// suspension through failures
+	for i := 0; i < 3; i++ {
+		require.NoError(t, tracker.AddToRetrieval(ret, []peer.ID{testSPA}))
+		require.NoError(t, tracker.RecordFailure(testSPA, ret))
+	}
+	require.True(t, tracker.IsSuspended(testSPA))
+	// only a single event for the change of state
+	require.Len(t, receivedEvents, 1)
+	suspended, ok := receivedEvents[0].(events.RetrievalEventSuspended)
+	require.True(t, ok)
+	require.Equal(t, testSPA, suspended.StorageProviderId())
+	require.Equal(t, ret, suspended.RetrievalId())
+	require.Equal(t, cid, suspended.PayloadCid())
+	require.Equal(t, defaultSuspensionDuration, suspended.Duration())
+
+	// manual suspension
+	tracker.Suspend(testSPB, time.Hour)
+	require.True(t, tracker.IsSuspended(testSPB))
+	require.Len(t, receivedEvents, 2)
+	suspended, ok = receivedEvents[1].(events.RetrievalEventSuspended)
+	require.True(t, ok)
+	require.Equal(t, testSPB, suspended.StorageProviderId())
+	require.Equal(t, time.Hour, suspended.Duration())
+
+	suspensions := tracker.Suspensions()
+	require.Len(t, suspensions, 2)
+	require.Equal(t, testSPA, suspensions[0].StorageProviderId)
+	require.Len(t, suspensions[0].Failures, 3)
+	require.Equal(t, testSPB, suspensions[1].StorageProviderId)
+	require.Equal(t, time.Hour, suspensions[1].Duration)
+	require.Len(t, suspensions[1].Failures, 0)
+
+	// manual unsuspension
+	require.True(t, tracker.Unsuspend(testSPA))
+	require.False(t, tracker.IsSuspended(testSPA))
+	require.False(t, tracker.Unsuspend(testSPA))
+	require.Len(t, receivedEvents, 3)
+	unsuspended, ok := receivedEvents[2].(events.RetrievalEventUnsuspended)
+	require.True(t, ok)
+	require.Equal(t, testSPA, unsuspended.StorageProviderId())
+	require.Len(t, tracker.Suspensions(), 1)
+
+	// failure history is cleared, so a single failure doesn't re-suspend
+	require.NoError(t, tracker.AddToRetrieval(ret, []peer.ID{testSPA}))
+	require.NoError(t, tracker.RecordFailure(testSPA, ret))
+	require.False(t, tracker.IsSuspended(testSPA))
+}
+
+func TestMisbehaviourSuspend(t *testing.T) {
+	ret := types.RetrievalID(uuid.New())
+	cid := cid.MustParse("bafkqaalb")
+	testSPA := peer.ID("A")
+
+	tracker := newSpTracker(&SpTrackerConfig{MaxFailuresBeforeSuspend: 3})
+	var receivedEvents []types.RetrievalEvent
+	tracker.onSuspensionChange = func(event types.RetrievalEvent) {
+		receivedEvents = append(receivedEvents, event)
+	}
+	require.True(t, tracker.RegisterRetrieval(ret, cid))
+
+	// a single misbehaviour suspends, regardless of failures
+	tracker.RecordMisbehaviour(testSPA, ret, "sent unrequested block")
+	require.True(t, tracker.IsSuspended(testSPA))
+	require.Len(t, receivedEvents, 1)
+	suspended, ok := receivedEvents[0].(events.RetrievalEventSuspended)
+	require.True(t, ok)
+	require.Equal(t, testSPA, suspended.StorageProviderId())
+	require.Equal(t, ret, suspended.RetrievalId())
+	require.Equal(t, cid, suspended.PayloadCid())
+	require.Equal(t, defaultSuspensionDuration, suspended.Duration())
+	require.Equal(t, "misbehaved: sent unrequested block", suspended.Reason())
+
+	// further misbehaviour while suspended doesn't signal again
+	tracker.RecordMisbehaviour(testSPA, ret, "sent unrequested block")
+	require.True(t, tracker.IsSuspended(testSPA))
+	require.Len(t, receivedEvents, 1)
 }
 
 func TestSPConcurrency(t *testing.T) {
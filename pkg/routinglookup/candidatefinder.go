@@ -0,0 +1,295 @@
+package routinglookup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/filecoin-project/lassie/pkg/retriever"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-log/v2"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+)
+
+var (
+	_ retriever.CandidateFinder = (*RoutingCandidateFinder)(nil)
+
+	logger = log.Logger("routinglookup")
+)
+
+const (
+	mimeTypeJson   = "application/json"
+	mimeTypeNdJson = "application/x-ndjson"
+
+	schemaPeer                = "peer"
+	schemaBitswap             = "bitswap"
+	schemaGraphsyncFilecoinV1 = "graphsync-filecoinv1"
+
+	protocolIpfsGatewayHttp = "transport-ipfs-gateway-http"
+)
+
+// providerRecord is a provider record of the Routing V1 HTTP API. Records of
+// the peer schema list the transfer protocols a peer serves in Protocols,
+// while the older bitswap and graphsync-filecoinv1 schemas each name a single
+// protocol, with the graphsync schema also describing the deal holding the
+// content.
+type providerRecord struct {
+	Schema        string   `json:"Schema"`
+	ID            string   `json:"ID"`
+	Addrs         []string `json:"Addrs,omitempty"`
+	Protocols     []string `json:"Protocols,omitempty"`
+	Protocol      string   `json:"Protocol,omitempty"`
+	PieceCID      string   `json:"PieceCID,omitempty"`
+	VerifiedDeal  bool     `json:"VerifiedDeal,omitempty"`
+	FastRetrieval bool     `json:"FastRetrieval,omitempty"`
+}
+
+type providersResponse struct {
+	Providers []providerRecord `json:"Providers"`
+}
+
+// RoutingCandidateFinder finds candidates through a routing service speaking
+// the Routing V1 HTTP API, as specified at
+// https://specs.ipfs.tech/routing/http-routing-v1/, turning the transfer
+// protocols of each provider record into candidate metadata. Records naming
+// none of the protocols we retrieve over are skipped.
+type RoutingCandidateFinder struct {
+	*options
+}
+
+func NewCandidateFinder(o ...Option) (*RoutingCandidateFinder, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	return &RoutingCandidateFinder{
+		options: opts,
+	}, nil
+}
+
+func (rf *RoutingCandidateFinder) FindCandidates(ctx context.Context, c cid.Cid) ([]types.RetrievalCandidate, error) {
+	req, err := rf.newProvidersHttpRequest(ctx, c, mimeTypeJson)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rf.httpClient.Do(req)
+	if err != nil {
+		logger.Debugw("Failed to perform json lookup", "err", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("providers query failed: %s", http.StatusText(resp.StatusCode))
+	}
+	var parsedResp providersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsedResp); err != nil {
+		logger.Debugw("Failed to decode providers response", "err", err)
+		return nil, err
+	}
+	var matches []types.RetrievalCandidate
+	for _, record := range parsedResp.Providers {
+		if candidate, ok := recordCandidate(c, record); ok {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches, nil
+}
+
+func (rf *RoutingCandidateFinder) FindCandidatesAsync(ctx context.Context, c cid.Cid) (<-chan types.FindCandidatesResult, error) {
+	req, err := rf.newProvidersHttpRequest(ctx, c, mimeTypeNdJson)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rf.httpClient.Do(req)
+	if err != nil {
+		logger.Debugw("Failed to perform streaming lookup", "err", err)
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		rch := make(chan types.FindCandidatesResult)
+		close(rch)
+		return rch, nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("providers query failed: %s", http.StatusText(resp.StatusCode))
+	}
+	// services are free to answer with plain JSON even when we ask for NDJSON
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == mimeTypeJson {
+		return rf.decodeProvidersResponse(ctx, c, resp.Body), nil
+	}
+	return rf.decodeProviderRecordStream(ctx, c, resp.Body), nil
+}
+
+func (rf *RoutingCandidateFinder) newProvidersHttpRequest(ctx context.Context, c cid.Cid, accept string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rf.providersEndpoint(c), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	if rf.httpUserAgent != "" {
+		req.Header.Set("User-Agent", rf.httpUserAgent)
+	}
+	logger.Debugw("sending outgoing request", "url", req.URL, "accept", accept)
+	return req, nil
+}
+
+func (rf *RoutingCandidateFinder) decodeProvidersResponse(ctx context.Context, c cid.Cid, from io.ReadCloser) <-chan types.FindCandidatesResult {
+	rch := make(chan types.FindCandidatesResult, rf.asyncResultsChanBuffer)
+	go func() {
+		defer close(rch)
+		defer from.Close()
+		var parsedResp providersResponse
+		if err := json.NewDecoder(from).Decode(&parsedResp); err != nil {
+			rf.sendResult(ctx, rch, types.FindCandidatesResult{Err: err})
+			return
+		}
+		for _, record := range parsedResp.Providers {
+			if candidate, ok := recordCandidate(c, record); ok {
+				if !rf.sendResult(ctx, rch, types.FindCandidatesResult{Candidate: candidate}) {
+					return
+				}
+			}
+		}
+	}()
+	return rch
+}
+
+func (rf *RoutingCandidateFinder) decodeProviderRecordStream(ctx context.Context, c cid.Cid, from io.ReadCloser) <-chan types.FindCandidatesResult {
+	rch := make(chan types.FindCandidatesResult, rf.asyncResultsChanBuffer)
+	go func() {
+		defer close(rch)
+		defer from.Close()
+		scanner := bufio.NewScanner(from)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			var record providerRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				rf.sendResult(ctx, rch, types.FindCandidatesResult{Err: err})
+				return
+			}
+			if candidate, ok := recordCandidate(c, record); ok {
+				if !rf.sendResult(ctx, rch, types.FindCandidatesResult{Candidate: candidate}) {
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			rf.sendResult(ctx, rch, types.FindCandidatesResult{Err: err})
+		}
+	}()
+	return rch
+}
+
+// sendResult sends a result unless the context is done first, in which case
+// it reports false
+func (rf *RoutingCandidateFinder) sendResult(ctx context.Context, rch chan<- types.FindCandidatesResult, r types.FindCandidatesResult) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case rch <- r:
+		return true
+	}
+}
+
+func (rf *RoutingCandidateFinder) providersEndpoint(c cid.Cid) string {
+	return rf.httpEndpoint.String() + path.Join("/routing/v1/providers", c.String())
+}
+
+// recordCandidate turns a provider record into a candidate, it reports false
+// for records of unknown schemas, with an undecodable peer ID, or naming none
+// of the protocols we retrieve over
+func recordCandidate(c cid.Cid, record providerRecord) (types.RetrievalCandidate, bool) {
+	var protocolNames []string
+	switch record.Schema {
+	case schemaPeer:
+		protocolNames = record.Protocols
+	case schemaBitswap, schemaGraphsyncFilecoinV1:
+		protocolNames = []string{record.Protocol}
+		if record.Protocol == "" {
+			protocolNames = []string{"transport-" + record.Schema}
+		}
+	default:
+		logger.Debugw("Skipping provider record of unknown schema", "schema", record.Schema)
+		return types.RetrievalCandidate{}, false
+	}
+	id, err := peer.Decode(record.ID)
+	if err != nil {
+		logger.Debugw("Skipping provider record with invalid peer ID", "id", record.ID, "err", err)
+		return types.RetrievalCandidate{}, false
+	}
+
+	var protocols []metadata.Protocol
+	seen := make(map[multicodec.Code]struct{})
+	for _, name := range protocolNames {
+		protocol := recordProtocol(name, record)
+		if protocol == nil {
+			continue
+		}
+		if _, ok := seen[protocol.ID()]; ok {
+			continue
+		}
+		seen[protocol.ID()] = struct{}{}
+		protocols = append(protocols, protocol)
+	}
+	if len(protocols) == 0 {
+		return types.RetrievalCandidate{}, false
+	}
+
+	addrs := make([]multiaddr.Multiaddr, 0, len(record.Addrs))
+	for _, addr := range record.Addrs {
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			logger.Debugw("Skipping invalid provider address", "provider", id, "addr", addr, "err", err)
+			continue
+		}
+		addrs = append(addrs, ma)
+	}
+	return types.RetrievalCandidate{
+		MinerPeer: peer.AddrInfo{ID: id, Addrs: addrs},
+		RootCid:   c,
+		Metadata:  types.MetadataContext.New(protocols...),
+	}, true
+}
+
+// recordProtocol is the metadata for a transfer protocol named in a provider
+// record, or nil if we don't retrieve over it
+func recordProtocol(name string, record providerRecord) metadata.Protocol {
+	switch name {
+	case multicodec.TransportBitswap.String():
+		return &metadata.Bitswap{}
+	case multicodec.TransportGraphsyncFilecoinv1.String():
+		gs := &metadata.GraphsyncFilecoinV1{
+			VerifiedDeal:  record.VerifiedDeal,
+			FastRetrieval: record.FastRetrieval,
+		}
+		if record.PieceCID != "" {
+			if pieceCid, err := cid.Parse(record.PieceCID); err == nil {
+				gs.PieceCID = pieceCid
+			}
+		}
+		return gs
+	case protocolIpfsGatewayHttp:
+		return &types.IpfsGatewayHttp{}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+package routinglookup_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/lassie/pkg/internal/testutil"
+	"github.com/filecoin-project/lassie/pkg/routinglookup"
+	"github.com/filecoin-project/lassie/pkg/types"
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/index-provider/metadata"
+	"github.com/libp2p/go-libp2p/core/peer"
+	lp2ptest "github.com/libp2p/go-libp2p/core/test"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingCandidateFinder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	root := testutil.GenerateCids(1)[0]
+	pieceCid := testutil.GenerateCids(1)[0]
+	peers := make([]peer.ID, 4)
+	for i := range peers {
+		peers[i] = lp2ptest.RandPeerIDFatal(t)
+	}
+	addr := multiaddr.StringCast("/ip4/127.0.0.1/tcp/1234")
+
+	records := []string{
+		// peer schema with several protocols, some we don't retrieve over
+		fmt.Sprintf(`{"Schema":"peer","ID":"%s","Addrs":["%s","not-an-addr"],"Protocols":["transport-bitswap","transport-ipfs-gateway-http","transport-unknown"]}`, peers[0], addr),
+		// legacy graphsync schema describing the deal
+		fmt.Sprintf(`{"Schema":"graphsync-filecoinv1","Protocol":"transport-graphsync-filecoinv1","ID":"%s","Addrs":["%s"],"PieceCID":"%s","VerifiedDeal":true,"FastRetrieval":true}`, peers[1], addr, pieceCid),
+		// legacy bitswap schema
+		fmt.Sprintf(`{"Schema":"bitswap","Protocol":"transport-bitswap","ID":"%s"}`, peers[2]),
+		// skipped: unknown schema, no known protocols, bad peer ID
+		fmt.Sprintf(`{"Schema":"unknown","ID":"%s","Protocols":["transport-bitswap"]}`, peers[3]),
+		fmt.Sprintf(`{"Schema":"peer","ID":"%s","Protocols":["transport-unknown"]}`, peers[3]),
+		`{"Schema":"peer","ID":"not-a-peer","Protocols":["transport-bitswap"]}`,
+	}
+	expectedCandidates := []types.RetrievalCandidate{
+		{
+			MinerPeer: peer.AddrInfo{ID: peers[0], Addrs: []multiaddr.Multiaddr{addr}},
+			RootCid:   root,
+			Metadata:  types.MetadataContext.New(&metadata.Bitswap{}, &types.IpfsGatewayHttp{}),
+		},
+		{
+			MinerPeer: peer.AddrInfo{ID: peers[1], Addrs: []multiaddr.Multiaddr{addr}},
+			RootCid:   root,
+			Metadata:  types.MetadataContext.New(&metadata.GraphsyncFilecoinV1{PieceCID: pieceCid, VerifiedDeal: true, FastRetrieval: true}),
+		},
+		{
+			MinerPeer: peer.AddrInfo{ID: peers[2], Addrs: []multiaddr.Multiaddr{}},
+			RootCid:   root,
+			Metadata:  types.MetadataContext.New(&metadata.Bitswap{}),
+		},
+	}
+
+	jsonOnly := false
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.URL.Path != "/routing/v1/providers/"+root.String() {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Accept") == "application/x-ndjson" && !jsonOnly {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			fmt.Fprint(w, strings.Join(records, "\n")+"\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"Providers":[%s]}`, strings.Join(records, ","))
+	}))
+	defer server.Close()
+	endpoint, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	finder, err := routinglookup.NewCandidateFinder(routinglookup.WithHttpEndpoint(endpoint))
+	require.NoError(t, err)
+
+	collect := func(t *testing.T, c cid.Cid) []types.RetrievalCandidate {
+		results, err := finder.FindCandidatesAsync(ctx, c)
+		require.NoError(t, err)
+		var candidates []types.RetrievalCandidate
+		for result := range results {
+			require.NoError(t, result.Err)
+			candidates = append(candidates, result.Candidate)
+		}
+		return candidates
+	}
+	requireCandidates := func(t *testing.T, expected, actual []types.RetrievalCandidate) {
+		require.Len(t, actual, len(expected))
+		for i := range expected {
+			require.Equal(t, expected[i].MinerPeer, actual[i].MinerPeer)
+			require.Equal(t, expected[i].RootCid, actual[i].RootCid)
+			for _, code := range []multicodec.Code{multicodec.TransportBitswap, multicodec.TransportGraphsyncFilecoinv1, types.TransportIpfsGatewayHttp} {
+				require.Equal(t, expected[i].Metadata.Get(code), actual[i].Metadata.Get(code))
+			}
+		}
+	}
+
+	t.Run("json", func(t *testing.T) {
+		candidates, err := finder.FindCandidates(ctx, root)
+		require.NoError(t, err)
+		requireCandidates(t, expectedCandidates, candidates)
+		require.Equal(t, "application/json", requests[len(requests)-1].Header.Get("Accept"))
+		require.Equal(t, "lassie", requests[len(requests)-1].Header.Get("User-Agent"))
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		requireCandidates(t, expectedCandidates, collect(t, root))
+		require.Equal(t, "application/x-ndjson", requests[len(requests)-1].Header.Get("Accept"))
+	})
+
+	t.Run("json in reply to ndjson", func(t *testing.T) {
+		jsonOnly = true
+		defer func() { jsonOnly = false }()
+		requireCandidates(t, expectedCandidates, collect(t, root))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		missing := testutil.GenerateCids(1)[0]
+		candidates, err := finder.FindCandidates(ctx, missing)
+		require.NoError(t, err)
+		require.Empty(t, candidates)
+		require.Empty(t, collect(t, missing))
+	})
+}
@@ -0,0 +1,91 @@
+package routinglookup
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		asyncResultsChanBuffer int
+		httpEndpoint           *url.URL
+		httpClient             *http.Client
+		httpClientTimeout      time.Duration
+		httpUserAgent          string
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	const defaultEndpoint = "https://delegated-ipfs.dev"
+	opts := options{
+		asyncResultsChanBuffer: 1,
+		httpClientTimeout:      time.Minute,
+		httpUserAgent:          "lassie",
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if opts.httpEndpoint == nil {
+		opts.httpEndpoint, err = url.Parse(defaultEndpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.httpClient == nil {
+		opts.httpClient = &http.Client{Timeout: opts.httpClientTimeout}
+	}
+	return &opts, nil
+}
+
+// WithHttpClient sets the http.Client used to contact the routing service,
+// whose own timeout applies in place of WithHttpClientTimeout.
+// Defaults to a new http.Client if unspecified.
+func WithHttpClient(c *http.Client) Option {
+	return func(o *options) error {
+		o.httpClient = c
+		return nil
+	}
+}
+
+// WithHttpClientTimeout sets the timeout for the HTTP requests sent to the routing service.
+// Defaults to one minute if unspecified.
+func WithHttpClientTimeout(t time.Duration) Option {
+	return func(o *options) error {
+		o.httpClientTimeout = t
+		return nil
+	}
+}
+
+// WithHttpEndpoint sets the base URL of the routing service, under which the
+// Routing V1 HTTP API is served at /routing/v1.
+// Defaults to https://delegated-ipfs.dev if unspecified.
+func WithHttpEndpoint(e *url.URL) Option {
+	return func(o *options) error {
+		o.httpEndpoint = e
+		return nil
+	}
+}
+
+// WithHttpUserAgent sets the User-Agent header value when contacting the routing service.
+// Setting this option to empty string will disable inclusion of User-Agent header.
+// Defaults to "lassie" if unspecified.
+func WithHttpUserAgent(a string) Option {
+	return func(o *options) error {
+		o.httpUserAgent = a
+		return nil
+	}
+}
+
+// WithAsyncResultsChanBuffer sets the channel buffer returned by RoutingCandidateFinder.FindCandidatesAsync.
+// Defaults to 1 if unspecified.
+func WithAsyncResultsChanBuffer(i int) Option {
+	return func(o *options) error {
+		o.asyncResultsChanBuffer = i
+		return nil
+	}
+}
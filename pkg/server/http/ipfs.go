@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +17,8 @@ import (
 	"github.com/filecoin-project/lassie/pkg/retriever"
 	"github.com/filecoin-project/lassie/pkg/types"
 	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
 )
 
 func ipfsHandler(lassie *lassie.Lassie, cfg HttpServerConfig) func(http.ResponseWriter, *http.Request) {
@@ -199,6 +203,11 @@ func ipfsHandler(lassie *lassie.Lassie, cfg HttpServerConfig) func(http.Response
 			return
 		}
 		request.RetrievalID = retrievalId
+		if err := parseRequestOverrides(req.URL.Query(), cfg, &request); err != nil {
+			logger.logStatus(http.StatusBadRequest, err.Error())
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		log.Debugw("fetching CID", "retrievalId", retrievalId, "CID", rootCid.String(), "path", unixfsPath, "fullFetch", fullFetch)
 		stats, err := lassie.Fetch(req.Context(), request)
@@ -229,6 +238,110 @@ func ipfsHandler(lassie *lassie.Lassie, cfg HttpServerConfig) func(http.Response
 	}
 }
 
+// parseRequestOverrides sets the optional fields of a request that override
+// the instance configuration from the query parameters:
+//
+//   - providerTimeout: a duration, e.g. 10s, which is reduced to the daemon's
+//     own MaxProviderTimeout
+//   - protocols: a comma separated list of protocols, e.g. bitswap,graphsync,http
+//   - maxBlocks: the maximum number of blocks, which can't raise the daemon's
+//     own limit
+//   - paidRetrievals: only "deny" is accepted, whether to pay for retrievals is
+//     left to the daemon's operator
+//   - providers: a comma separated list of multiaddrs, including peer IDs, of
+//     storage providers to retrieve from in place of those found by the indexer,
+//     only accepted when the daemon sets AllowProvidersParameter
+//   - allowProviders, denyProviders: comma separated lists of peer IDs
+func parseRequestOverrides(query url.Values, cfg HttpServerConfig, request *types.RetrievalRequest) error {
+	if query.Has("providerTimeout") {
+		timeout, err := time.ParseDuration(query.Get("providerTimeout"))
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("Invalid providerTimeout parameter")
+		}
+		if cfg.MaxProviderTimeout > 0 && timeout > cfg.MaxProviderTimeout {
+			timeout = cfg.MaxProviderTimeout
+		}
+		request.ProviderTimeout = timeout
+	}
+	if query.Has("protocols") {
+		for _, name := range strings.Split(query.Get("protocols"), ",") {
+			protocol, err := parseProtocol(name)
+			if err != nil {
+				return fmt.Errorf("Invalid protocols parameter: %w", err)
+			}
+			request.Protocols = append(request.Protocols, protocol)
+		}
+	}
+	if query.Has("maxBlocks") {
+		maxBlocks, err := strconv.ParseUint(query.Get("maxBlocks"), 10, 64)
+		if err != nil || maxBlocks == 0 {
+			return fmt.Errorf("Invalid maxBlocks parameter")
+		}
+		request.MaxBlocks = maxBlocks
+	}
+	if query.Has("paidRetrievals") {
+		if query.Get("paidRetrievals") != string(types.DenyPaidRetrievals) {
+			return fmt.Errorf("Invalid paidRetrievals parameter, only %q is supported", types.DenyPaidRetrievals)
+		}
+		request.PaidRetrievals = types.DenyPaidRetrievals
+	}
+	if query.Has("providers") {
+		if !cfg.AllowProvidersParameter {
+			return fmt.Errorf("The providers parameter is not enabled on this server")
+		}
+		for _, addr := range strings.Split(query.Get("providers"), ",") {
+			addrInfo, err := peer.AddrInfoFromString(addr)
+			if err != nil {
+				return fmt.Errorf("Invalid providers parameter: %w", err)
+			}
+			request.FixedPeers = append(request.FixedPeers, *addrInfo)
+		}
+	}
+	var err error
+	if request.ProviderAllowlist, err = parsePeerIds(query, "allowProviders"); err != nil {
+		return err
+	}
+	if request.ProviderDenylist, err = parsePeerIds(query, "denyProviders"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseProtocol accepts the short names bitswap, graphsync, http and local as
+// well as multicodec names
+func parseProtocol(name string) (multicodec.Code, error) {
+	switch name {
+	case "bitswap":
+		return multicodec.TransportBitswap, nil
+	case "graphsync":
+		return multicodec.TransportGraphsyncFilecoinv1, nil
+	case "http":
+		return types.TransportIpfsGatewayHttp, nil
+	case "local":
+		return types.TransportLocal, nil
+	}
+	var protocol multicodec.Code
+	if err := protocol.Set(name); err != nil {
+		return 0, err
+	}
+	return protocol, nil
+}
+
+func parsePeerIds(query url.Values, param string) ([]peer.ID, error) {
+	if !query.Has(param) {
+		return nil, nil
+	}
+	var peerIds []peer.ID
+	for _, str := range strings.Split(query.Get(param), ",") {
+		peerId, err := peer.Decode(str)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s parameter: %w", param, err)
+		}
+		peerIds = append(peerIds, peerId)
+	}
+	return peerIds, nil
+}
+
 // A logger for the requests and responses, separate from the application logging
 type requestLogger struct {
 	method string
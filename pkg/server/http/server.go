@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/filecoin-project/lassie/pkg/lassie"
 	"github.com/filecoin-project/lassie/pkg/metrics"
@@ -27,6 +28,12 @@ type HttpServerConfig struct {
 	TempDir             string
 	MaxBlocksPerRequest uint64
 	Metrics             bool
+	// MaxProviderTimeout is the longest providerTimeout a request may ask for,
+	// longer ones are reduced to it; zero leaves them as requested
+	MaxProviderTimeout time.Duration
+	// AllowProvidersParameter lets requests name the providers to retrieve
+	// from with the providers query parameter, which is otherwise rejected
+	AllowProvidersParameter bool
 }
 
 // NewHttpServer creates a new HttpServer
@@ -0,0 +1,94 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ipni/index-provider/metadata"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-varint"
+)
+
+// TransportIpfsGatewayHttp is the multicodec code for retrieval of CARs from a
+// trustless IPFS HTTP gateway. It is newer than the go-multicodec release in
+// use, so is declared here until it can be taken from there.
+const TransportIpfsGatewayHttp multicodec.Code = 0x0920
+
+// TransportLocal is the code for retrieval from stores on the local machine.
+// It is never advertised or sent anywhere, so is taken from the multicodec
+// private use range.
+const TransportLocal multicodec.Code = 0x300000
+
+var (
+	ipfsGatewayHttpBytes                   = varint.ToUvarint(uint64(TransportIpfsGatewayHttp))
+	localBytes                             = varint.ToUvarint(uint64(TransportLocal))
+	_                    metadata.Protocol = (*IpfsGatewayHttp)(nil)
+	_                    metadata.Protocol = (*Local)(nil)
+)
+
+// MetadataContext decodes and creates metadata for all of the protocols that
+// can be retrieved with, including those the metadata package doesn't know
+var MetadataContext = metadata.Default.
+	WithProtocol(TransportIpfsGatewayHttp, func() metadata.Protocol { return &IpfsGatewayHttp{} }).
+	WithProtocol(TransportLocal, func() metadata.Protocol { return &Local{} })
+
+// IpfsGatewayHttp represents the indexing metadata of content available from a
+// trustless IPFS HTTP gateway, which carries nothing beyond its protocol ID.
+type IpfsGatewayHttp struct{}
+
+func (IpfsGatewayHttp) ID() multicodec.Code {
+	return TransportIpfsGatewayHttp
+}
+
+func (IpfsGatewayHttp) MarshalBinary() ([]byte, error) {
+	return ipfsGatewayHttpBytes, nil
+}
+
+func (IpfsGatewayHttp) UnmarshalBinary(data []byte) error {
+	return unmarshalTransportID(data, TransportIpfsGatewayHttp, ipfsGatewayHttpBytes)
+}
+
+func (IpfsGatewayHttp) ReadFrom(r io.Reader) (int64, error) {
+	return readTransportID(r, TransportIpfsGatewayHttp, ipfsGatewayHttpBytes)
+}
+
+// Local represents content held in the stores on the local machine, which
+// carries nothing beyond its protocol ID.
+type Local struct{}
+
+func (Local) ID() multicodec.Code {
+	return TransportLocal
+}
+
+func (Local) MarshalBinary() ([]byte, error) {
+	return localBytes, nil
+}
+
+func (Local) UnmarshalBinary(data []byte) error {
+	return unmarshalTransportID(data, TransportLocal, localBytes)
+}
+
+func (Local) ReadFrom(r io.Reader) (int64, error) {
+	return readTransportID(r, TransportLocal, localBytes)
+}
+
+// unmarshalTransportID checks the metadata of a protocol that carries nothing
+// beyond its protocol ID
+func unmarshalTransportID(data []byte, code multicodec.Code, expected []byte) error {
+	if !bytes.Equal(data, expected) {
+		return fmt.Errorf("transport ID does not match %s", code)
+	}
+	return nil
+}
+
+// readTransportID reads the metadata of a protocol that carries nothing beyond
+// its protocol ID
+func readTransportID(r io.Reader, code multicodec.Code, expected []byte) (int64, error) {
+	buf := make([]byte, len(expected))
+	read, err := io.ReadFull(r, buf)
+	if err != nil {
+		return int64(read), err
+	}
+	return int64(read), unmarshalTransportID(buf, code, expected)
+}
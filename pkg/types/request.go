@@ -1,6 +1,8 @@
 package types
 
 import (
+	"time"
+
 	"github.com/filecoin-project/lassie/pkg/retriever/selectorutils"
 	"github.com/google/uuid"
 	"github.com/ipfs/go-cid"
@@ -9,6 +11,8 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/storage"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
 )
 
 type ReadableWritableStorage interface {
@@ -45,8 +49,59 @@ type RetrievalRequest struct {
 	Cid         cid.Cid
 	LinkSystem  ipld.LinkSystem
 	Selector    ipld.Node
+	// Path and Scope describe the Selector in the terms of the trustless
+	// gateway HTTP API, for retrievals over HTTP. They are set when the
+	// Selector is made from a UnixFS path, requests with other selectors can
+	// not be retrieved over HTTP.
+	Path  string
+	Scope DagScope
+
+	// The remaining fields are optional and override the retriever's
+	// configuration for this request alone; zero values leave the
+	// configuration as it is.
+
+	// ProviderTimeout is the time to wait for data from a storage provider
+	// before retrieval from it fails
+	ProviderTimeout time.Duration
+	// Protocols restricts the retrieval to these protocols
+	Protocols []multicodec.Code
+	// MaxBlocks limits the number of blocks written to the LinkSystem, beyond
+	// which the retrieval fails
+	MaxBlocks uint64
+	// PaidRetrievals determines whether storage providers asking for payment
+	// are retrieved from
+	PaidRetrievals PaidRetrievalPolicy
+	// FixedPeers are retrieved from in place of the candidates that would
+	// otherwise be found for the CID
+	FixedPeers []peer.AddrInfo
+	// ProviderAllowlist, when not empty, restricts the retrieval to these
+	// storage providers
+	ProviderAllowlist []peer.ID
+	// ProviderDenylist excludes these storage providers from the retrieval
+	ProviderDenylist []peer.ID
 }
 
+// DagScope is the extent of the DAG at the end of a path that is retrieved
+// over HTTP, as the dag-scope parameter of the trustless gateway HTTP API
+type DagScope string
+
+const (
+	// DagScopeAll retrieves the complete DAG at the end of the path
+	DagScopeAll DagScope = "all"
+	// DagScopeEntity retrieves only the entity at the end of the path, such as
+	// a whole file or a directory without its contents
+	DagScopeEntity DagScope = "entity"
+)
+
+type PaidRetrievalPolicy string
+
+const (
+	// DefaultPaidRetrievals uses the retriever's configuration
+	DefaultPaidRetrievals PaidRetrievalPolicy = ""
+	AllowPaidRetrievals   PaidRetrievalPolicy = "allow"
+	DenyPaidRetrievals    PaidRetrievalPolicy = "deny"
+)
+
 // NewRequestForPath creates a new RetrievalRequest from the provided parameters
 // and assigns a new RetrievalID to it.
 //
@@ -66,6 +121,11 @@ func NewRequestForPath(store ReadableWritableStorage, cid cid.Cid, path string,
 		return RetrievalRequest{}, err
 	}
 
+	scope := DagScopeEntity
+	if full {
+		scope = DagScopeAll
+	}
+
 	linkSystem := cidlink.DefaultLinkSystem()
 	linkSystem.SetReadStorage(store)
 	linkSystem.SetWriteStorage(store)
@@ -76,6 +136,8 @@ func NewRequestForPath(store ReadableWritableStorage, cid cid.Cid, path string,
 		RetrievalID: retrievalId,
 		Cid:         cid,
 		Selector:    selector,
+		Path:        path,
+		Scope:       scope,
 		LinkSystem:  linkSystem,
 	}, nil
 }
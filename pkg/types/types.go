@@ -16,10 +16,13 @@ type RetrievalCandidate struct {
 	MinerPeer peer.AddrInfo
 	RootCid   cid.Cid
 	Metadata  metadata.Metadata
+	// Source names where the candidate was found, such as the indexer or the
+	// DHT. It is set by finders that search more than one source.
+	Source string
 }
 
 func NewRetrievalCandidate(pid peer.ID, rootCid cid.Cid, protocols ...metadata.Protocol) RetrievalCandidate {
-	md := metadata.Default.New(protocols...)
+	md := MetadataContext.New(protocols...)
 	return RetrievalCandidate{
 		MinerPeer: peer.AddrInfo{ID: pid},
 		RootCid:   rootCid,
@@ -109,6 +112,16 @@ type RetrievalStats struct {
 	AskPrice          abi.TokenAmount
 	TimeToFirstByte   time.Duration
 	Selector          string
+	// Providers breaks down the data received by the storage providers it was
+	// received from, where a retrieval may receive from more than one
+	Providers map[peer.ID]ProviderStats
+}
+
+// ProviderStats is the portion of a retrieval received from a single storage
+// provider
+type ProviderStats struct {
+	Size   uint64
+	Blocks uint64
 }
 
 type RetrievalResult struct {
@@ -156,6 +169,7 @@ type CoordinationKind string
 const (
 	RaceCoordination       = "race"
 	SequentialCoordination = "sequential"
+	HedgedCoordination     = "hedged"
 )
 
 type Phase string
@@ -183,6 +197,10 @@ const (
 	FirstByteCode          EventCode = "first-byte-received"
 	FailedCode             EventCode = "failure"
 	SuccessCode            EventCode = "success"
+	SuspendedCode          EventCode = "suspended"
+	UnsuspendedCode        EventCode = "unsuspended"
+	RetryingCode           EventCode = "retrying"
+	MisbehavedCode         EventCode = "misbehaved"
 )
 
 type RetrievalEvent interface {
@@ -218,6 +236,22 @@ func Identifier(event RetrievalEvent) string {
 	return ""
 }
 
+// EventProtocol determines the protocol an event relates to; events carry the
+// protocols of the candidate so graphsync is assumed where a candidate supports
+// more than one, as bitswap events are always for a bitswap-only candidate.
+func EventProtocol(event RetrievalEvent) (multicodec.Code, bool) {
+	protocols := event.Protocols()
+	if len(protocols) == 1 {
+		return protocols[0], true
+	}
+	for _, protocol := range protocols {
+		if protocol == multicodec.TransportGraphsyncFilecoinv1 {
+			return protocol, true
+		}
+	}
+	return 0, false
+}
+
 // RetrievalEventSubscriber is a function that receives a stream of retrieval
 // events from all retrievals that are in progress. Various different types
 // implement the RetrievalEvent interface and may contain additional information